@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// newStepContext is done once the step receives SIGINT or SIGTERM, e.g. when the build
+// is aborted, or timeout passed. No timeout when it's 0. The returned func releases it.
+func newStepContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Warnf("Received %s, stopping", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// abortError explains err when it was caused by stopping ctx.
+func abortError(ctx context.Context, timeout time.Duration, err error) error {
+	switch ctx.Err() {
+	case nil:
+		return err
+	case context.DeadlineExceeded:
+		return fmt.Errorf("Step timed out after %s: %s", timeout, err)
+	default:
+		return fmt.Errorf("Step was aborted: %s", err)
+	}
+}
+
+// matrixTracker passes gcloud output through to out and records the IDs of the test
+// matrices gcloud created, so they can be cancelled when the step stops early.
+// Writes are expected to be whole lines, as written by shards, or to continue the
+// previous write.
+type matrixTracker struct {
+	out       io.Writer
+	lock      sync.Mutex
+	line      []byte
+	matrixIDs []string
+}
+
+func (tracker *matrixTracker) Write(p []byte) (int, error) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	for _, b := range p {
+		if b != '\n' {
+			tracker.line = append(tracker.line, b)
+			continue
+		}
+		tracker.record(string(tracker.line))
+		tracker.line = tracker.line[:0]
+	}
+
+	return tracker.out.Write(p)
+}
+
+func (tracker *matrixTracker) record(line string) {
+	match := matrixIDPattern.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+	for _, matrixID := range tracker.matrixIDs {
+		if matrixID == match[1] {
+			return
+		}
+	}
+	tracker.matrixIDs = append(tracker.matrixIDs, match[1])
+}
+
+// MatrixIDs returns every matrix created so far, in order.
+func (tracker *matrixTracker) MatrixIDs() []string {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	tracker.record(string(tracker.line))
+	return append([]string{}, tracker.matrixIDs...)
+}
+
+// cancelMatrices cancels matrixIDs, logging the state each one ended up in. Matrices
+// that already finished are left alone by Test Lab.
+func cancelMatrices(matrices matrixService, matrixIDs []string) {
+	for _, matrixID := range matrixIDs {
+		state, err := matrices.CancelMatrix(matrixID)
+		if err != nil {
+			log.Warnf("Failed to cancel %s: %s", matrixID, err)
+			continue
+		}
+		log.Warnf("Cancelled %s, state: %s", matrixID, state)
+	}
+}
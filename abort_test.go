@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewStepContext(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, stop := newStepContext(10 * time.Millisecond)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		assert.Fail("step timeout didn't stop the step")
+	}
+	assert.Equal(context.DeadlineExceeded, ctx.Err())
+	stop()
+
+	ctx, stop = newStepContext(0)
+	defer stop()
+	assert.NoError(syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		assert.Fail("SIGTERM didn't stop the step")
+	}
+	assert.Equal(context.Canceled, ctx.Err())
+}
+
+func TestAbortError(t *testing.T) {
+	assert := assert.New(t)
+
+	err := errors.New("shard 1: context canceled")
+	assert.Equal(err, abortError(context.Background(), 0, err))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.EqualError(abortError(ctx, 0, err), "Step was aborted: shard 1: context canceled")
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	assert.EqualError(abortError(ctx, time.Hour, context.DeadlineExceeded), "Step timed out after 1h0m0s: context deadline exceeded")
+}
+
+func TestMatrixTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	output := &bytes.Buffer{}
+	tracker := &matrixTracker{out: output}
+	writes := []string{
+		"Uploading [/tmp/app.apk] to Firebase Test Lab...\nTest [matrix-",
+		"1] has been created in the Google Cloud.\n",
+		"[shard 2/2] Test [matrix-2] has been created in the Google Cloud.\n",
+		"Test [matrix-1] has been created in the Google Cloud.\n",
+		"Test [matrix-3] has been created",
+	}
+
+	_, _ = fmt.Fprint(tracker, writes[0])
+	assert.Equal([]string{}, tracker.MatrixIDs())
+	for _, write := range writes[1:] {
+		_, _ = fmt.Fprint(tracker, write)
+	}
+
+	assert.Equal([]string{"matrix-1", "matrix-2", "matrix-3"}, tracker.MatrixIDs())
+	assert.Equal(strings.Join(writes, ""), output.String())
+}
+
+func TestExecRunnerContext(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := execRunner{Context: ctx}.Run([]string{"sleep", "10"}, nil)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < 5*time.Second)
+}
+
+func TestRunCancelsMatricesOnAbort(t *testing.T) {
+	assert := assert.New(t)
+
+	// gcloud creates the matrix and waits for it until it's killed
+	FakeBinary("gcloud", `case "$1 $2" in
+  "firebase test") echo "Test [matrix-1] has been created in the Google Cloud." >&2; exec sleep 30 ;;
+esac`)
+	defer FakeGcloud()
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	config := newFakeGcloudConfig(assert)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	config.Runner = execRunner{Context: ctx}
+	matrices := &fakeMatrixService{}
+	config.Matrices = matrices
+
+	start := time.Now()
+	_, err = run(config, localStorage{Root: root}, ioutil.Discard)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < 10*time.Second)
+	assert.Equal([]string{"matrix-1"}, matrices.Cancelled)
+}
+
+func TestRunStopsRetryBackoffOnAbort(t *testing.T) {
+	assert := assert.New(t)
+
+	// every attempt fails with a retryable infrastructure failure
+	FakeBinary("gcloud", `case "$1 $2" in
+  "firebase test") echo "Test [matrix-1] has been created in the Google Cloud." >&2; exit 20 ;;
+esac`)
+	defer FakeGcloud()
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	config := newFakeGcloudConfig(assert)
+	config.Retry.sleep = nil
+	config.Retry.MaxAttempts = 3
+	config.Retry.InitialBackoff = 5 * time.Minute
+	config.Retry.MaxBackoff = 5 * time.Minute
+	matrices := &fakeMatrixService{}
+	config.Matrices = matrices
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = setupBackend(config, ctx)
+	assert.NoError(err)
+
+	start := time.Now()
+	_, err = run(config, localStorage{Root: root}, ioutil.Discard)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < 10*time.Second)
+	assert.Equal([]string{"matrix-1"}, matrices.Cancelled)
+}
+
+func TestRunCancelsRerunMatricesOnAbort(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	// the run fails a test, its re-run waits for the matrix until gcloud is killed
+	fixture := filepath.Join(root, "test_result_1.xml")
+	PanicOnErr(ioutil.WriteFile(fixture, []byte(JUnitResult([]string{"testAdd", "testFlaky"}, "testFlaky")), 0644))
+	FakeBinary("gcloud", fmt.Sprintf(`case "$1 $2" in
+  "firebase test") ;;
+  *) exit 0 ;;
+esac
+for arg in "$@"; do
+  case "$arg" in
+    --results-dir=*) dir="${arg#--results-dir=}" ;;
+  esac
+done
+case "$dir" in
+  */rerun_1) echo "Test [matrix-2] has been created in the Google Cloud." >&2; exec sleep 30 ;;
+esac
+out=%q/golang-bucket/$dir/NexusLowRes-25-en-portrait
+mkdir -p "$out"
+cp %q "$out/test_result_1.xml"
+echo "Test [matrix-1] has been created in the Google Cloud." >&2
+exit 10`, root, fixture))
+	defer FakeGcloud()
+
+	config := newFakeGcloudConfig(assert)
+	config.Rerun = rerunConfig{Attempts: 1}
+	matrices := &fakeMatrixService{}
+	config.Matrices = matrices
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = setupBackend(config, ctx)
+	assert.NoError(err)
+
+	start := time.Now()
+	_, err = run(config, localStorage{Root: root}, ioutil.Discard)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < 10*time.Second)
+	assert.Equal([]string{"matrix-1", "matrix-2"}, matrices.Cancelled)
+}
+
+func TestCollectStopsOnAbort(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	config := newFakeGcloudConfig(assert)
+	config.Async = asyncConfig{Mode: modeCollect, MatrixID: "matrix-1", Poll: newPollPolicy()}
+	cancels := &fakeMatrixService{}
+	config.Matrices = cancels
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = setupBackend(config, ctx)
+	assert.NoError(err)
+
+	// the matrix keeps running, the next check would be 15s later
+	matrices, ok := config.Matrices.(contextMatrices)
+	assert.True(ok)
+	assert.Equal(cancels, matrices.matrixService)
+	lookups := &fakeMatrixService{Matrices: []testMatrix{{State: "RUNNING"}}}
+	matrices.lookups = lookups
+	config.Matrices = matrices
+
+	start := time.Now()
+	_, err = collect(config, localStorage{Root: root}, ioutil.Discard)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < 10*time.Second)
+	assert.Equal([]string{"matrix-1"}, lookups.Calls)
+
+	// matrices can still be cancelled
+	state, err := config.Matrices.CancelMatrix("matrix-1")
+	assert.NoError(err)
+	assert.Equal("CANCELLED", state)
+	assert.Equal([]string{"matrix-1"}, cancels.Cancelled)
+}
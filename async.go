@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Values of MODE.
+const (
+	// modeRun submits the test matrix and waits for its results.
+	modeRun = "run"
+	// modeSubmit submits the test matrix with --async and exports its ID.
+	modeSubmit = "submit"
+	// modeCollect waits for the matrix submitted by an earlier step and collects its results.
+	modeCollect = "collect"
+)
+
+// Polling of MODE collect.
+const (
+	defaultPollInterval    = 15 * time.Second
+	defaultMaxPollInterval = 2 * time.Minute
+	defaultWaitTimeout     = 2 * time.Hour
+)
+
+// testingAPIURL is the Cloud Testing API gcloud creates the test matrices with.
+const testingAPIURL = "https://testing.googleapis.com"
+
+var matrixIDValuePattern = regexp.MustCompile(`^matrix-[0-9A-Za-z_-]+$`)
+
+// asyncConfig splits submitting a test matrix and collecting its results across steps,
+// so other work can run while Test Lab is busy.
+type asyncConfig struct {
+	Mode string
+	// MatrixID is the matrix MODE collect waits for.
+	MatrixID string
+	// Poll spaces the status checks of MODE collect, its Deadline is WAIT_TIMEOUT.
+	Poll retryPolicy
+}
+
+// newPollPolicy spaces the status checks of a running matrix, without a deadline.
+func newPollPolicy() retryPolicy {
+	return retryPolicy{
+		InitialBackoff: defaultPollInterval,
+		MaxBackoff:     defaultMaxPollInterval,
+		Jitter:         retryJitter,
+	}
+}
+
+func newAsyncConfig() (asyncConfig, error) {
+	config := asyncConfig{Mode: modeRun, Poll: newPollPolicy()}
+	config.Poll.Deadline = defaultWaitTimeout
+
+	switch modeValue := getOptionalEnv(envKeyMode); modeValue {
+	case "", modeRun:
+		return config, nil
+	case modeSubmit:
+		config.Mode = modeSubmit
+		return config, nil
+	case modeCollect:
+		config.Mode = modeCollect
+	default:
+		return config, errors.New(envKeyMode + " must be '" + modeRun + "', '" + modeSubmit + "' or '" + modeCollect + "'")
+	}
+
+	matrixIDValue, err := getRequiredEnv(envKeyMatrixID)
+	if err != nil {
+		return config, err
+	}
+	config.MatrixID = strings.TrimSpace(matrixIDValue)
+	if !matrixIDValuePattern.MatchString(config.MatrixID) {
+		return config, errors.New(envKeyMatrixID + " must be a test matrix ID like matrix-1a2b3c4d5e6f7: '" + matrixIDValue + "'")
+	}
+
+	if timeoutValue := getOptionalEnv(envKeyWaitTimeout); !isEmpty(timeoutValue) {
+		config.Poll.Deadline, err = parseTimeout(envKeyWaitTimeout, timeoutValue)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	return config, nil
+}
+
+// testMatrix is the part of the Cloud Testing API TestMatrix the step uses.
+// https://firebase.google.com/docs/test-lab/reference/testing/rest/v1/projects.testMatrices
+type testMatrix struct {
+	TestMatrixID         string `json:"testMatrixId"`
+	State                string `json:"state"`
+	OutcomeSummary       string `json:"outcomeSummary"`
+	InvalidMatrixDetails string `json:"invalidMatrixDetails"`
+	ResultStorage        struct {
+		GoogleCloudStorage struct {
+			GcsPath string `json:"gcsPath"`
+		} `json:"googleCloudStorage"`
+		ResultsURL string `json:"resultsUrl"`
+	} `json:"resultStorage"`
+	TestExecutions []testExecution `json:"testExecutions"`
+}
+
+// testExecution is the run of a matrix on a single device.
+type testExecution struct {
+	State       string `json:"state"`
+	Environment struct {
+		AndroidDevice androidDevice `json:"androidDevice"`
+	} `json:"environment"`
+	ToolResultsStep struct {
+		ProjectID   string `json:"projectId"`
+		HistoryID   string `json:"historyId"`
+		ExecutionID string `json:"executionId"`
+		StepID      string `json:"stepId"`
+	} `json:"toolResultsStep"`
+}
+
+// finished reports whether the matrix reached a final state.
+func (matrix testMatrix) finished() bool {
+	switch matrix.State {
+	case "", "TEST_STATE_UNSPECIFIED", "VALIDATING", "PENDING", "RUNNING":
+		return false
+	default:
+		return true
+	}
+}
+
+// exitCode is the exit code gcloud would have exited with for the finished matrix.
+func (matrix testMatrix) exitCode() int {
+	switch matrix.State {
+	case "FINISHED":
+		switch matrix.OutcomeSummary {
+		case "SUCCESS":
+			return exitCodeSuccess
+		case "FAILURE":
+			return exitCodeTestFailure
+		case "SKIPPED":
+			return exitCodeIncompatible
+		default:
+			return exitCodeInconclusive
+		}
+	case "UNSUPPORTED_ENVIRONMENT", "INCOMPATIBLE_ENVIRONMENT", "INCOMPATIBLE_ARCHITECTURE":
+		return exitCodeIncompatible
+	case "INVALID":
+		if strings.HasPrefix(matrix.InvalidMatrixDetails, "INCOMPATIBLE") {
+			return exitCodeIncompatible
+		}
+		return exitCodeGeneralFailure
+	case "CANCELLED":
+		return exitCodeCancelled
+	default:
+		return exitCodeInfrastructure
+	}
+}
+
+// resultsLocation splits the gs://bucket/dir/ the matrix wrote its results to.
+func (matrix testMatrix) resultsLocation() (string, string, error) {
+	gcsPath := matrix.ResultStorage.GoogleCloudStorage.GcsPath
+	parts := strings.SplitN(strings.TrimPrefix(gcsPath, "gs://"), "/", 2)
+	if !strings.HasPrefix(gcsPath, "gs://") || len(parts) != 2 || isEmpty(parts[0]) {
+		return "", "", fmt.Errorf("%s has no results dir: '%s'", matrix.TestMatrixID, gcsPath)
+	}
+	return parts[0], strings.TrimSuffix(parts[1], "/"), nil
+}
+
+// matrixService looks up and cancels test matrices, testingAPI asks Test Lab, tests use a fake.
+type matrixService interface {
+	GetMatrix(matrixID string) (testMatrix, error)
+	// CancelMatrix returns the state of the matrix after cancelling it.
+	CancelMatrix(matrixID string) (string, error)
+}
+
+// testingAPI calls the Cloud Testing API. Its tokens must work after the step was
+// aborted to cancel matrices.
+type testingAPI struct {
+	API     googleAPI
+	Project string
+	BaseURL string
+}
+
+func (api testingAPI) matrixURL(matrixID string) string {
+	return api.BaseURL + "/v1/projects/" + url.PathEscape(api.Project) + "/testMatrices/" + url.PathEscape(matrixID)
+}
+
+func (api testingAPI) GetMatrix(matrixID string) (testMatrix, error) {
+	matrix := testMatrix{}
+	err := api.API.callJSON("GET", api.matrixURL(matrixID), nil, &matrix, "get", matrixID)
+	return matrix, err
+}
+
+func (api testingAPI) CancelMatrix(matrixID string) (string, error) {
+	response := struct {
+		TestState string `json:"testState"`
+	}{}
+	err := api.API.callJSON("POST", api.matrixURL(matrixID)+":cancel", nil, &response, "cancel", matrixID)
+	return response.TestState, err
+}
+
+// CreateMatrix submits request and returns the created matrix.
+func (api testingAPI) CreateMatrix(request matrixRequest) (testMatrix, error) {
+	matrix := testMatrix{}
+	createURL := api.BaseURL + "/v1/projects/" + url.PathEscape(api.Project) + "/testMatrices"
+	err := api.API.callJSON("POST", createURL, request, &matrix, "create", "test matrix")
+	return matrix, err
+}
+
+// waitForMatrix polls matrixID with the backoff of policy until it finished. Fails once
+// the next check would happen after the deadline of policy.
+func waitForMatrix(matrices matrixService, matrixID string, policy retryPolicy, output io.Writer) (testMatrix, error) {
+	now, sleep := policy.clock()
+	start := now()
+
+	for check := 1; ; check++ {
+		matrix, err := matrices.GetMatrix(matrixID)
+		if err != nil {
+			return matrix, err
+		}
+		if matrix.finished() {
+			_, _ = fmt.Fprintf(output, "%s finished: %s %s\n", matrixID, matrix.State, matrix.OutcomeSummary)
+			return matrix, nil
+		}
+
+		delay := policy.backoff(check)
+		if policy.Deadline > 0 && now().Add(delay).Sub(start) >= policy.Deadline {
+			return matrix, fmt.Errorf("%s is still %s after %s", matrixID, matrix.State, policy.Deadline)
+		}
+
+		_, _ = fmt.Fprintf(output, "%s is %s, checking again in %s\n", matrixID, matrix.State, delay)
+		sleep(delay)
+	}
+}
+
+// collect waits for the matrix submitted by MODE submit, then collects and reports its
+// results like run does.
+func collect(config *firebaseConfig, storage resultsStorage, output io.Writer) (testOutcome, error) {
+	err := authenticate(config, output)
+	if err != nil {
+		return testOutcome{}, err
+	}
+
+	matrix, err := waitForMatrix(config.Matrices, config.Async.MatrixID, config.Async.Poll, output)
+	if err != nil {
+		return testOutcome{}, err
+	}
+
+	bucket, resultsDir, err := matrix.resultsLocation()
+	if err != nil {
+		return testOutcome{}, err
+	}
+
+	err = exportOutputs(config.Runner, locationOutputs(bucket, resultsDir))
+	if err != nil {
+		return testOutcome{}, err
+	}
+
+	outcome := newTestOutcome(matrix.exitCode(), config.FailOnInconclusive)
+	outcome.ResultsDir = resultsDir
+	outcome.Attempts = []retryAttempt{{
+		Number:     1,
+		ResultsDir: resultsDir,
+		ExitCode:   outcome.ExitCode,
+		Run:        runResult{MatrixID: config.Async.MatrixID, ConsoleURL: matrix.ResultStorage.ResultsURL},
+	}}
+
+	outcome, report, reportPath, err := collectResults(config, storage, bucket, nil, outcome, output)
+	if err != nil {
+		return outcome, err
+	}
+	if config.TestType == testTypeGameLoop {
+		err = collectGameLoopResults(config, storage, bucket, resultsDir)
+		if err != nil {
+			return outcome, err
+		}
+	}
+	if config.Coverage {
+		err = collectCoverage(config, storage, bucket, outcome)
+		if err != nil {
+			return outcome, err
+		}
+	}
+
+	return outcome, reportResults(config, bucket, outcome, report, reportPath)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeMatrixService answers with the next of Matrices, repeating the last one, and
+// records the matrices it's asked to cancel.
+type fakeMatrixService struct {
+	Matrices  []testMatrix
+	Calls     []string
+	Cancelled []string
+}
+
+func (source *fakeMatrixService) GetMatrix(matrixID string) (testMatrix, error) {
+	source.Calls = append(source.Calls, matrixID)
+	if len(source.Matrices) == 0 {
+		return testMatrix{}, errors.New("no such matrix")
+	}
+
+	matrix := source.Matrices[0]
+	if len(source.Matrices) > 1 {
+		source.Matrices = source.Matrices[1:]
+	}
+	return matrix, nil
+}
+
+func (source *fakeMatrixService) CancelMatrix(matrixID string) (string, error) {
+	source.Cancelled = append(source.Cancelled, matrixID)
+	return "CANCELLED", nil
+}
+
+// FinishedMatrix is a matrix that wrote its results to gs://golang-bucket/results_dir/.
+func FinishedMatrix(outcomeSummary string) testMatrix {
+	matrix := testMatrix{TestMatrixID: "matrix-1", State: "FINISHED", OutcomeSummary: outcomeSummary}
+	matrix.ResultStorage.GoogleCloudStorage.GcsPath = "gs://golang-bucket/results_dir/"
+	matrix.ResultStorage.ResultsURL = "https://console.firebase.google.com/project/fake-project/testlab/histories/bh.1/matrices/1"
+	return matrix
+}
+
+func TestNewAsyncConfig(t *testing.T) {
+	assert := assert.New(t)
+	resetEnv()
+
+	config, err := newAsyncConfig()
+	assert.NoError(err)
+	assert.Equal(modeRun, config.Mode)
+	assert.Equal(2*time.Hour, config.Poll.Deadline)
+
+	Setenv(envKeyMode, "collect")
+	Setenv(envKeyMatrixID, " matrix-1a2b3c4d5e6f7\n")
+	Setenv(envKeyWaitTimeout, "45m")
+	config, err = newAsyncConfig()
+	assert.NoError(err)
+	assert.Equal(modeCollect, config.Mode)
+	assert.Equal("matrix-1a2b3c4d5e6f7", config.MatrixID)
+	assert.Equal(45*time.Minute, config.Poll.Deadline)
+
+	cases := []struct {
+		mode     string
+		matrixID string
+		err      string
+	}{
+		{"wait", "", envKeyMode + " must be 'run', 'submit' or 'collect'"},
+		{"collect", "", envKeyMatrixID + " is not defined!"},
+		{"collect", "https://console.firebase.google.com", envKeyMatrixID + " must be a test matrix ID like matrix-1a2b3c4d5e6f7: 'https://console.firebase.google.com'"},
+	}
+
+	for _, c := range cases {
+		resetEnv()
+		Setenv(envKeyMode, c.mode)
+		Setenv(envKeyMatrixID, c.matrixID)
+
+		_, err = newAsyncConfig()
+		assert.EqualError(err, c.err)
+	}
+}
+
+func TestNewFirebaseConfigModes(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	//- collect needs neither the app nor the tests
+	setupOptionsEnv()
+	Setenv(envKeyAppApk, "")
+	Setenv(envKeyNumShards, "2")
+	Setenv(envKeyMode, "collect")
+	Setenv(envKeyMatrixID, "matrix-1")
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal("matrix-1", config.Async.MatrixID)
+	assert.Equal(1, config.Shards.Count)
+	assert.Empty(config.TestType)
+
+	//- game loop results are collected, the apps aren't needed
+	Setenv(envKeyTestType, testTypeGameLoop)
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal(testTypeGameLoop, config.TestType)
+
+	Setenv(envKeyTestType, "monkey")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyTestType+" must be 'instrumentation', 'robo' or 'game-loop'")
+
+	//- submit adds --async once
+	setupOptionsEnv()
+	Setenv(envKeyMode, "submit")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	gcsCommand, err := buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	assert.Equal([]string{"--results-dir=results_dir", "--async"}, gcsCommand[len(gcsCommand)-2:])
+
+	config.Options = "--async"
+	gcsCommand, err = buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	assert.Equal([]string{"--results-dir=results_dir", "--async"}, gcsCommand[len(gcsCommand)-2:])
+
+	Setenv(envKeyRerunFailedTests, "1")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyMode+" submit can't be combined with "+envKeyNumShards+" or "+envKeyRerunFailedTests)
+}
+
+func TestTestMatrixExitCode(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		state          string
+		outcomeSummary string
+		details        string
+		exitCode       int
+	}{
+		{"FINISHED", "SUCCESS", "", exitCodeSuccess},
+		{"FINISHED", "FAILURE", "", exitCodeTestFailure},
+		{"FINISHED", "INCONCLUSIVE", "", exitCodeInconclusive},
+		{"FINISHED", "SKIPPED", "", exitCodeIncompatible},
+		{"INCOMPATIBLE_ARCHITECTURE", "", "", exitCodeIncompatible},
+		{"INVALID", "", "INCOMPATIBLE_ENVIRONMENT", exitCodeIncompatible},
+		{"INVALID", "", "NO_SIGNATURE", exitCodeGeneralFailure},
+		{"CANCELLED", "", "", exitCodeCancelled},
+		{"ERROR", "", "", exitCodeInfrastructure},
+	}
+
+	for _, c := range cases {
+		matrix := testMatrix{State: c.state, OutcomeSummary: c.outcomeSummary, InvalidMatrixDetails: c.details}
+		assert.True(matrix.finished())
+		assert.Equal(c.exitCode, matrix.exitCode(), c.state+" "+c.outcomeSummary)
+	}
+
+	for _, state := range []string{"VALIDATING", "PENDING", "RUNNING"} {
+		assert.False(testMatrix{State: state}.finished())
+	}
+}
+
+func TestResultsLocation(t *testing.T) {
+	assert := assert.New(t)
+
+	bucket, resultsDir, err := FinishedMatrix("SUCCESS").resultsLocation()
+	assert.NoError(err)
+	assert.Equal("golang-bucket", bucket)
+	assert.Equal("results_dir", resultsDir)
+
+	_, _, err = testMatrix{TestMatrixID: "matrix-1", State: "INVALID"}.resultsLocation()
+	assert.EqualError(err, "matrix-1 has no results dir: ''")
+}
+
+func TestWaitForMatrix(t *testing.T) {
+	assert := assert.New(t)
+
+	runner := &fakeRunner{}
+	policy := runner.Policy(retryPolicy{InitialBackoff: 15 * time.Second, MaxBackoff: time.Minute, Deadline: time.Hour})
+	source := &fakeMatrixService{Matrices: []testMatrix{
+		{State: "VALIDATING"}, {State: "PENDING"}, {State: "RUNNING"}, {State: "RUNNING"}, FinishedMatrix("SUCCESS"),
+	}}
+
+	output := &bytes.Buffer{}
+	matrix, err := waitForMatrix(source, "matrix-1", policy, output)
+	assert.NoError(err)
+	assert.Equal("SUCCESS", matrix.OutcomeSummary)
+	assert.Equal(5, len(source.Calls))
+	assert.Equal([]time.Duration{15 * time.Second, 30 * time.Second, time.Minute, time.Minute}, runner.Sleeps)
+	assert.Contains(output.String(), "matrix-1 is PENDING, checking again in 30s\n")
+	assert.Contains(output.String(), "matrix-1 finished: FINISHED SUCCESS\n")
+
+	//- checks after 0s, 15s, 45s and 105s, the next one would be after the deadline
+	runner = &fakeRunner{}
+	policy = runner.Policy(retryPolicy{InitialBackoff: 15 * time.Second, MaxBackoff: time.Minute, Deadline: 2 * time.Minute})
+	source = &fakeMatrixService{Matrices: []testMatrix{{State: "RUNNING"}}}
+	_, err = waitForMatrix(source, "matrix-1", policy, ioutil.Discard)
+	assert.EqualError(err, "matrix-1 is still RUNNING after 2m0s")
+	assert.Equal(4, len(source.Calls))
+
+	_, err = waitForMatrix(&fakeMatrixService{}, "matrix-1", policy, ioutil.Discard)
+	assert.EqualError(err, "no such matrix")
+}
+
+func TestTestingAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	var paths, authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		if r.Method == "POST" {
+			_, _ = w.Write([]byte(`{"testState": "CANCELLED"}`))
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/matrix-404") {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error": {"code": 404}}` + "\n"))
+			return
+		}
+		_, _ = w.Write([]byte(`{
+  "testMatrixId": "matrix-1",
+  "state": "FINISHED",
+  "outcomeSummary": "FAILURE",
+  "resultStorage": {
+    "googleCloudStorage": {"gcsPath": "gs://golang-bucket/results_dir/"},
+    "resultsUrl": "https://console.firebase.google.com/project/fake-project/testlab/histories/bh.1/matrices/1"
+  }
+}`))
+	}))
+	defer server.Close()
+
+	runner := &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		return commandResult{Stdout: "ya29.token\n"}, nil
+	}}
+	api := testingAPI{API: googleAPI{Tokens: gcloudTokens{Runner: runner}, Client: http.DefaultClient}, Project: "fake-project", BaseURL: server.URL}
+
+	matrix, err := api.GetMatrix("matrix-1")
+	assert.NoError(err)
+	assert.Equal(FinishedMatrix("FAILURE"), matrix)
+	assert.Equal([]string{"/v1/projects/fake-project/testMatrices/matrix-1"}, paths)
+	assert.Equal([]string{"Bearer ya29.token"}, authorizations)
+	assert.Equal([]string{"gcloud auth print-access-token"}, runner.Commands())
+
+	_, err = api.GetMatrix("matrix-404")
+	assert.EqualError(err, `Failed to get matrix-404, status: 404 Not Found | response: {"error": {"code": 404}}`)
+
+	state, err := api.CancelMatrix("matrix-1")
+	assert.NoError(err)
+	assert.Equal("CANCELLED", state)
+	assert.Equal("/v1/projects/fake-project/testMatrices/matrix-1:cancel", paths[2])
+
+	runner.Handle = func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		return commandResult{ExitCode: 1}, nil
+	}
+	_, err = api.GetMatrix("matrix-1")
+	assert.EqualError(err, "gcloud auth print-access-token failed with exit code 1")
+	assert.Equal(3, len(paths))
+}
+
+func TestRunSubmit(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	deployDir, err := ioutil.TempDir("", "deploy")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(deployDir)
+	}()
+
+	config := newFakeGcloudConfig(assert)
+	Setenv(envKeyDeployDir, deployDir)
+	config.Async.Mode = modeSubmit
+
+	envman, exports := FakeEnvman()
+	runner := &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		if cmdSlice[0] == "bitrise" {
+			return envman.Run(cmdSlice, output)
+		}
+		return commandResult{Stderr: GcloudMatrixOutput(1)}, nil
+	}}
+	config.Runner = runner
+
+	// nothing to collect yet
+	outcome, err := run(config, localStorage{Root: root}, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal("submitted", outcome.Name)
+	assert.True(outcome.Passed)
+	assert.True(strings.HasSuffix(runner.Commands()[5], "--results-dir="+outcome.ResultsDir+" --async"))
+
+	assert.Equal(map[string]string{
+		outputGcsResultsDir: "gs://golang-bucket/" + outcome.ResultsDir,
+		outputResultsBucket: "golang-bucket",
+		outputResultsDir:    outcome.ResultsDir,
+		outputConsoleURL:    "https://console.firebase.google.com/project/fake-project/testlab/histories/bh.1/matrices/1",
+		outputMatrixID:      "matrix-1",
+		outputOutcome:       "submitted",
+		outputSummaryPath:   filepath.Join(deployDir, summaryFileName),
+	}, exports)
+}
+
+func TestCollect(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	deployDir, err := ioutil.TempDir("", "deploy")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(deployDir)
+	}()
+
+	resultPath := filepath.Join(root, "golang-bucket", "results_dir", "NexusLowRes-25-en-portrait", "test_result_1.xml")
+	PanicOnErr(os.MkdirAll(filepath.Dir(resultPath), 0755))
+	PanicOnErr(ioutil.WriteFile(resultPath, []byte(JUnitResult([]string{"testAdd", "testBroken"}, "testBroken")), 0644))
+
+	config := newFakeGcloudConfig(assert)
+	Setenv(envKeyDeployDir, deployDir)
+	config.Async = asyncConfig{Mode: modeCollect, MatrixID: "matrix-1"}
+	config.Async.Poll.sleep = func(time.Duration) {}
+
+	envman, exports := FakeEnvman()
+	runner := &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		if cmdSlice[0] == "bitrise" {
+			return envman.Run(cmdSlice, output)
+		}
+		return commandResult{}, nil
+	}}
+	config.Runner = runner
+
+	source := &fakeMatrixService{Matrices: []testMatrix{{State: "RUNNING"}, FinishedMatrix("FAILURE")}}
+	config.Matrices = source
+	outcome, err := collect(config, localStorage{Root: root}, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal("failed", outcome.Name)
+	assert.Equal(exitCodeTestFailure, outcome.ExitCode)
+	assert.Equal([]string{"matrix-1", "matrix-1"}, source.Calls)
+
+	// no test matrix is run
+	for _, command := range runner.Commands() {
+		assert.False(strings.Contains(command, "firebase test"), command)
+	}
+
+	assert.Equal(map[string]string{
+		outputGcsResultsDir:   "gs://golang-bucket/results_dir",
+		outputResultsBucket:   "golang-bucket",
+		outputResultsDir:      "results_dir",
+		outputConsoleURL:      "https://console.firebase.google.com/project/fake-project/testlab/histories/bh.1/matrices/1",
+		outputMatrixID:        "matrix-1",
+		outputOutcome:         "failed",
+		outputTestsPassed:     "1",
+		outputTestsFailed:     "1",
+		outputTestsFlaky:      "0",
+		outputTestsSkipped:    "0",
+		outputJUnitReportPath: filepath.Join(deployDir, junitReportFileName),
+		outputSummaryPath:     filepath.Join(deployDir, summaryFileName),
+	}, exports)
+}
+
+func TestCollectGameLoop(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	deployDir, err := ioutil.TempDir("", "deploy")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(deployDir)
+	}()
+
+	WriteObject(root, "golang-bucket", "results_dir/NexusLowRes-25-en-portrait/test_result_1.xml", JUnitResult([]string{"scenario_1"}))
+	WriteObject(root, "golang-bucket", "results_dir/NexusLowRes-25-en-portrait/game_loop_results/results_scenario_1.json", `{"score": 42}`)
+
+	config := newFakeGcloudConfig(assert)
+	Setenv(envKeyDeployDir, deployDir)
+	config.TestType = testTypeGameLoop
+	config.Async = asyncConfig{Mode: modeCollect, MatrixID: "matrix-1"}
+	config.Async.Poll.sleep = func(time.Duration) {}
+	envman, exports := FakeEnvman()
+	config.Runner = &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		if cmdSlice[0] == "bitrise" {
+			return envman.Run(cmdSlice, output)
+		}
+		return commandResult{}, nil
+	}}
+	config.Matrices = &fakeMatrixService{Matrices: []testMatrix{FinishedMatrix("SUCCESS")}}
+
+	outcome, err := collect(config, localStorage{Root: root}, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal("passed", outcome.Name)
+
+	outputDir := filepath.Join(deployDir, gameLoopResultsDirName)
+	assert.Equal(outputDir, exports[outputGameLoopResultsDir])
+	data, err := ioutil.ReadFile(filepath.Join(outputDir, "NexusLowRes-25-en-portrait", "game_loop_results", "results_scenario_1.json"))
+	assert.NoError(err)
+	assert.Equal(`{"score": 42}`, string(data))
+}
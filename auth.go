@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Values of AUTH_MODE.
+const (
+	// authModeKey reads the credentials of GCLOUD_KEY: base64 or raw JSON, a file path or a download URL.
+	authModeKey = "key"
+	// authModeADC reads the credentials file of GOOGLE_APPLICATION_CREDENTIALS.
+	authModeADC = "adc"
+	// authModeGcloud uses the account gcloud is already authenticated with.
+	authModeGcloud = "gcloud"
+)
+
+// Types of the credentials files gcloud can authenticate with.
+const (
+	credentialsServiceAccount = "service_account"
+	// credentialsExternalAccount is a workload identity federation config.
+	credentialsExternalAccount = "external_account"
+)
+
+const envKeyApplicationCredentials = "GOOGLE_APPLICATION_CREDENTIALS"
+
+// Matches the service account of service_account_impersonation_url:
+// https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/name@project.iam.gserviceaccount.com:generateAccessToken
+var impersonatedAccountPattern = regexp.MustCompile(`/serviceAccounts/([^/:]+):generateAccessToken$`)
+
+// authProvider holds the credentials of the run and where they came from.
+type authProvider struct {
+	Mode string
+	// Source describes where the credentials were read from, e.g. "base64 GCLOUD_KEY".
+	Source string
+	// Key is the credentials JSON, empty in gcloud mode.
+	Key []byte
+	// Type is service_account or external_account, empty in gcloud mode.
+	Type string
+	// Email of the service account, the impersonated one of an external account when known.
+	Email   string
+	Project string
+}
+
+func (auth authProvider) String() string {
+	switch auth.Type {
+	case credentialsServiceAccount:
+		return "service account " + auth.Email + " from " + auth.Source
+	case credentialsExternalAccount:
+		if !isEmpty(auth.Email) {
+			return "external account impersonating " + auth.Email + " from " + auth.Source
+		}
+		return "external account from " + auth.Source
+	default:
+		return auth.Source
+	}
+}
+
+// keyDownloadTimeout bounds downloading GCLOUD_KEY, which happens before the step can be stopped.
+const keyDownloadTimeout = time.Minute
+
+// newAuthProvider loads and validates the credentials of AUTH_MODE. URLs are downloaded with client.
+func newAuthProvider(client *http.Client) (authProvider, error) {
+	mode := getOptionalEnv(envKeyAuthMode)
+	if isEmpty(mode) {
+		mode = authModeKey
+	}
+	auth := authProvider{Mode: mode}
+
+	var err error
+	switch mode {
+	case authModeKey:
+		var value string
+		value, err = getRequiredEnv(envKeyGcloud)
+		if err != nil {
+			return auth, err
+		}
+		auth.Key, auth.Source, err = loadKey(value, client)
+		if err != nil {
+			return auth, err
+		}
+	case authModeADC:
+		var keyPath string
+		keyPath, err = getRequiredEnv(envKeyApplicationCredentials)
+		if err != nil {
+			return auth, err
+		}
+		auth.Source = envKeyApplicationCredentials + " " + keyPath
+		auth.Key, err = ioutil.ReadFile(keyPath)
+		if err != nil {
+			return auth, err
+		}
+	case authModeGcloud:
+		auth.Source = "the active gcloud account"
+		return auth, nil
+	default:
+		return auth, errors.New(envKeyAuthMode + " must be '" + authModeKey + "', '" + authModeADC + "' or '" + authModeGcloud + "'")
+	}
+
+	err = auth.parse()
+	return auth, err
+}
+
+// loadKey reads GCLOUD_KEY as raw JSON, an https URL to download, e.g. of the Bitrise file
+// storage, the path of a key file, or base64 JSON.
+func loadKey(value string, client *http.Client) ([]byte, string, error) {
+	switch {
+	case strings.HasPrefix(strings.TrimSpace(value), "{"):
+		return []byte(value), "JSON " + envKeyGcloud, nil
+	case strings.HasPrefix(value, "https://"):
+		key, err := downloadKey(value, client)
+		return key, "download " + withoutQuery(value), err
+	case strings.HasPrefix(value, "http://"):
+		// the private key would be readable on the way
+		return nil, "download " + withoutQuery(value), errors.New(envKeyGcloud + " must be downloaded over https: '" + withoutQuery(value) + "'")
+	}
+
+	if info, err := os.Stat(value); err == nil && !info.IsDir() {
+		key, err := ioutil.ReadFile(value)
+		return key, "key file " + value, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil && (strings.Contains(value, string(filepath.Separator)) || strings.HasSuffix(value, ".json")) {
+		// most likely a path, base64 errors would be misleading
+		return nil, "key file " + value, fileExists(value)
+	}
+	return key, "base64 " + envKeyGcloud, err
+}
+
+// downloadKey gets a key file, errors leave out the query of keyURL, which may be a signature.
+func downloadKey(keyURL string, client *http.Client) ([]byte, error) {
+	resp, err := client.Get(keyURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s from %s", envKeyGcloud, withoutQuery(keyURL))
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s from %s: %s", envKeyGcloud, withoutQuery(keyURL), resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func withoutQuery(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "the " + envKeyGcloud + " URL"
+	}
+	parsed.RawQuery = ""
+	parsed.Fragment = ""
+	parsed.User = nil
+	return parsed.String()
+}
+
+// parse validates the fields gcloud needs to authenticate with the credentials file, and reads
+// the email and the project.
+func (auth *authProvider) parse() error {
+	name := envKeyGcloud
+	if auth.Mode == authModeADC {
+		name = envKeyApplicationCredentials
+	}
+
+	keyFile := GcloudKeyFile{}
+	err := json.Unmarshal(auth.Key, &keyFile)
+	if err != nil {
+		return errors.New(name + " isn't a JSON credentials file: " + err.Error())
+	}
+	auth.Type = keyFile.Type
+	auth.Project = keyFile.ProjectID
+
+	switch keyFile.Type {
+	case credentialsServiceAccount:
+		auth.Email = keyFile.ClientEmail
+		if isEmpty(keyFile.ClientEmail) {
+			return errors.New(name + " has no client_email")
+		}
+		if block, _ := pem.Decode([]byte(keyFile.PrivateKey)); block == nil {
+			return errors.New(name + " has no PEM encoded private_key")
+		}
+	case credentialsExternalAccount:
+		if isEmpty(keyFile.Audience) {
+			return errors.New(name + " has no audience")
+		}
+		if len(keyFile.CredentialSource) == 0 || string(keyFile.CredentialSource) == "null" {
+			return errors.New(name + " has no credential_source")
+		}
+		if match := impersonatedAccountPattern.FindStringSubmatch(keyFile.ImpersonationURL); match != nil {
+			auth.Email = match[1]
+		}
+	default:
+		return errors.New(name + " must be a " + credentialsServiceAccount + " or " + credentialsExternalAccount + " credentials file, type: '" + keyFile.Type + "'")
+	}
+
+	return nil
+}
+
+// loginCommand authenticates gcloud with the credentials file at keyPath, nil in gcloud mode.
+func (auth authProvider) loginCommand(keyPath string, user string) []string {
+	switch auth.Type {
+	case credentialsServiceAccount:
+		return []string{"gcloud", "auth", "activate-service-account", "--key-file", keyPath, user}
+	case credentialsExternalAccount:
+		return []string{"gcloud", "auth", "login", "--cred-file", keyPath, "--quiet"}
+	default:
+		return nil
+	}
+}
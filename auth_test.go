@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ServiceAccountKey is testdata/service_account_key.json of email, base64 encoded like GCLOUD_KEY.
+func ServiceAccountKey(email string) string {
+	key := map[string]interface{}{}
+	PanicOnErr(json.Unmarshal([]byte(ReadFixture("service_account_key.json")), &key))
+	key["client_email"] = email
+	data, err := json.Marshal(key)
+	PanicOnErr(err)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// ExternalAccountKey is a workload identity federation config impersonating email, raw JSON.
+func ExternalAccountKey(email string) string {
+	key := map[string]interface{}{
+		"type":               "external_account",
+		"audience":           "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/ci/providers/bitrise",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":          "https://sts.googleapis.com/v1/token",
+		"credential_source":  map[string]string{"file": "/tmp/oidc_token"},
+	}
+	if !isEmpty(email) {
+		key["service_account_impersonation_url"] = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/" + email + ":generateAccessToken"
+	}
+	data, err := json.Marshal(key)
+	PanicOnErr(err)
+	return string(data)
+}
+
+func TestLoadKey(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "auth")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	keyJSON := ReadFixture("service_account_key.json")
+	keyPath := filepath.Join(tmpDir, "key.json")
+	PanicOnErr(ioutil.WriteFile(keyPath, []byte(keyJSON), 0600))
+
+	hang := make(chan bool)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("signature") {
+		case "s3cr3t":
+			_, _ = w.Write([]byte(keyJSON))
+		case "slow":
+			<-hang
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	defer close(hang)
+	client := server.Client()
+
+	cases := []struct {
+		value  string
+		source string
+	}{
+		{base64.StdEncoding.EncodeToString([]byte(keyJSON)), "base64 " + envKeyGcloud},
+		{keyJSON, "JSON " + envKeyGcloud},
+		{"\n  " + keyJSON, "JSON " + envKeyGcloud},
+		{keyPath, "key file " + keyPath},
+		{server.URL + "/key.json?signature=s3cr3t", "download " + server.URL + "/key.json"},
+	}
+	for _, c := range cases {
+		key, source, err := loadKey(c.value, client)
+		assert.NoError(err, c.source)
+		assert.Equal(c.source, source)
+		assert.Equal(strings.TrimSpace(keyJSON), strings.TrimSpace(string(key)), c.source)
+	}
+
+	//- the signature of the URL isn't reported
+	_, _, err = loadKey(server.URL+"/key.json?signature=expired", client)
+	assert.EqualError(err, "failed to download "+envKeyGcloud+" from "+server.URL+"/key.json: 403 Forbidden")
+
+	//- the key isn't downloaded in plain text
+	plainURL := strings.Replace(server.URL, "https://", "http://", 1) + "/key.json?signature=s3cr3t"
+	_, _, err = loadKey(plainURL, client)
+	assert.EqualError(err, envKeyGcloud+" must be downloaded over https: '"+strings.Replace(server.URL, "https://", "http://", 1)+"/key.json'")
+
+	//- a hanging download times out
+	client.Timeout = 100 * time.Millisecond
+	start := time.Now()
+	_, _, err = loadKey(server.URL+"/key.json?signature=slow", client)
+	assert.EqualError(err, "failed to download "+envKeyGcloud+" from "+server.URL+"/key.json")
+	assert.True(time.Since(start) < 10*time.Second)
+
+	_, _, err = loadKey(filepath.Join(tmpDir, "missing.json"), http.DefaultClient)
+	assert.EqualError(err, "file doesn't exist: '"+filepath.Join(tmpDir, "missing.json")+"'")
+
+	_, _, err = loadKey("not base64", http.DefaultClient)
+	assert.EqualError(err, "illegal base64 data at input byte 3")
+}
+
+func TestNewAuthProvider(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	tmpDir, err := ioutil.TempDir("", "auth")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	resetEnv()
+	Setenv(envKeyGcloud, ServiceAccountKey("fake@example.com"))
+	auth, err := newAuthProvider(http.DefaultClient)
+	assert.NoError(err)
+	assert.Equal(authModeKey, auth.Mode)
+	assert.Equal(credentialsServiceAccount, auth.Type)
+	assert.Equal("fake@example.com", auth.Email)
+	assert.Equal("fake-project", auth.Project)
+	assert.Equal("service account fake@example.com from base64 "+envKeyGcloud, auth.String())
+
+	Setenv(envKeyGcloud, ExternalAccountKey("ci@fake-project.iam.gserviceaccount.com"))
+	auth, err = newAuthProvider(http.DefaultClient)
+	assert.NoError(err)
+	assert.Equal(credentialsExternalAccount, auth.Type)
+	assert.Equal("", auth.Project)
+	assert.Equal("external account impersonating ci@fake-project.iam.gserviceaccount.com from JSON "+envKeyGcloud, auth.String())
+
+	adcPath := filepath.Join(tmpDir, "application_default_credentials.json")
+	PanicOnErr(ioutil.WriteFile(adcPath, []byte(ExternalAccountKey("")), 0600))
+	Setenv(envKeyAuthMode, authModeADC)
+	Setenv(envKeyApplicationCredentials, adcPath)
+	auth, err = newAuthProvider(http.DefaultClient)
+	assert.NoError(err)
+	assert.Equal("external account from "+envKeyApplicationCredentials+" "+adcPath, auth.String())
+
+	Setenv(envKeyAuthMode, authModeGcloud)
+	auth, err = newAuthProvider(http.DefaultClient)
+	assert.NoError(err)
+	assert.Equal(authProvider{Mode: authModeGcloud, Source: "the active gcloud account"}, auth)
+	assert.Equal("the active gcloud account", auth.String())
+
+	Setenv(envKeyAuthMode, "oauth")
+	_, err = newAuthProvider(http.DefaultClient)
+	assert.EqualError(err, envKeyAuthMode+" must be 'key', 'adc' or 'gcloud'")
+
+	Setenv(envKeyAuthMode, authModeADC)
+	PanicOnErr(ioutil.WriteFile(adcPath, []byte(`{"type": "authorized_user", "client_id": "x"}`), 0600))
+	_, err = newAuthProvider(http.DefaultClient)
+	assert.EqualError(err, envKeyApplicationCredentials+" must be a service_account or external_account credentials file, type: 'authorized_user'")
+
+	Setenv(envKeyAuthMode, authModeKey)
+	cases := []struct {
+		key string
+		err string
+	}{
+		{`{"type": "service_account", "private_key": "x"`, envKeyGcloud + " isn't a JSON credentials file: unexpected end of JSON input"},
+		{`{"type": "service_account", "private_key": "x"}`, envKeyGcloud + " has no client_email"},
+		{`{"type": "service_account", "client_email": "a@b"}`, envKeyGcloud + " has no PEM encoded private_key"},
+		{`{"type": "external_account", "credential_source": {"file": "/tmp/token"}}`, envKeyGcloud + " has no audience"},
+		{`{"type": "external_account", "audience": "//iam.googleapis.com/x"}`, envKeyGcloud + " has no credential_source"},
+	}
+	for _, c := range cases {
+		Setenv(envKeyGcloud, c.key)
+		_, err = newAuthProvider(http.DefaultClient)
+		assert.EqualError(err, c.err, c.key)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	config := newFakeGcloudConfig(assert)
+	config.KeyPath = "/tmp/key.json"
+	runner := &recordingRunner{}
+	config.Runner = runner
+	assert.NoError(authenticate(config, ioutil.Discard))
+	assert.Equal([]string{
+		"gcloud config set project fake-project",
+		"gcloud auth activate-service-account --key-file /tmp/key.json fake@example.com",
+	}, runner.Commands())
+
+	//- service account keys sign the tokens of the api backend
+	runner.Calls = nil
+	config.Backend = backendAPI
+	assert.NoError(authenticate(config, ioutil.Discard))
+	assert.Equal(0, len(runner.Calls))
+
+	Setenv(envKeyGcloud, ExternalAccountKey(""))
+	Setenv(envKeyGcloudProject, "fake-project")
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	config.KeyPath = "/tmp/key.json"
+	config.Backend = backendAPI
+	config.Runner = runner
+	assert.NoError(authenticate(config, ioutil.Discard))
+	assert.Equal([]string{
+		"gcloud config set project fake-project",
+		"gcloud auth login --cred-file /tmp/key.json --quiet",
+	}, runner.Commands())
+
+	runner.Calls = nil
+	Setenv(envKeyAuthMode, authModeGcloud)
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	config.Runner = runner
+	assert.NoError(authenticate(config, ioutil.Discard))
+	assert.Equal(0, len(runner.Calls))
+
+	//- the project is required without a key
+	Setenv(envKeyGcloudProject, "")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyGcloudProject+" not defined in env or gcloud key")
+}
+
+func TestNewCredentialsGcloudMode(t *testing.T) {
+	assert := assert.New(t)
+	projectValue, hadProject := os.LookupEnv(envKeyCloudSDKProject)
+	defer func() {
+		if hadProject {
+			Setenv(envKeyCloudSDKProject, projectValue)
+		} else {
+			PanicOnErr(os.Unsetenv(envKeyCloudSDKProject))
+		}
+	}()
+	PanicOnErr(os.Unsetenv(envKeyCloudSDKProject))
+	configValue := os.Getenv(envKeyCloudSDKConfig)
+
+	config := &firebaseConfig{Project: "fake-project", Auth: authProvider{Mode: authModeGcloud}}
+	creds, err := newCredentials(config)
+	assert.NoError(err)
+	assert.Equal("", creds.Dir)
+	assert.Equal("", config.KeyPath)
+	assert.Equal("fake-project", os.Getenv(envKeyCloudSDKProject))
+	assert.Equal(configValue, os.Getenv(envKeyCloudSDKConfig))
+
+	creds.Remove()
+	_, set := os.LookupEnv(envKeyCloudSDKProject)
+	assert.False(set)
+}
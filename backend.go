@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values of BACKEND.
+const (
+	// backendGcloud runs the test matrices with the gcloud CLI.
+	backendGcloud = "gcloud"
+	// backendAPI calls the Cloud Testing API directly, without the Cloud SDK.
+	backendAPI = "api"
+)
+
+func newBackend(platform string) (string, error) {
+	switch backend := getOptionalEnv(envKeyBackend); backend {
+	case "", backendGcloud:
+		return backendGcloud, nil
+	case backendAPI:
+		if platform != platformAndroid {
+			return backend, errors.New(envKeyBackend + " " + backendAPI + " supports Android only")
+		}
+		return backend, nil
+	default:
+		return backend, errors.New(envKeyBackend + " must be '" + backendGcloud + "' or '" + backendAPI + "'")
+	}
+}
+
+// setupBackend points config at the backend running its test matrices, stopped once
+// ctx is done, and returns the storage holding the results.
+func setupBackend(config *firebaseConfig, ctx context.Context) (resultsStorage, error) {
+	runner := execRunner{Context: ctx}
+	// MODE collect polls until the matrix finished, the lookups and the sleeps in between
+	// are stopped with ctx, like the backoff before the next attempt of a run.
+	config.Async.Poll = config.Async.Poll.withContext(ctx)
+	config.Retry = config.Retry.withContext(ctx)
+
+	client := &http.Client{Timeout: apiRequestTimeout}
+
+	if config.Backend != backendAPI {
+		config.Runner = runner
+		config.Matrices = contextMatrices{
+			matrixService: config.Matrices,
+			ctx:           ctx,
+			lookups:       testingAPI{API: googleAPI{Tokens: gcloudTokens{Runner: runner}, Client: client, Context: ctx}, Project: config.Project, BaseURL: testingAPIURL},
+		}
+		config.Catalog = &cachedCatalog{Source: gcloudCatalog{Runner: runner}}
+		return gsutilStorage{Runner: runner}, nil
+	}
+
+	var tokens tokenSource = gcloudTokens{Runner: runner}
+	if config.Auth.Type == credentialsServiceAccount {
+		keyTokens, err := newServiceAccountTokens(config.Auth.Key, client)
+		if err != nil {
+			return nil, err
+		}
+		tokens = keyTokens
+	}
+
+	api := googleAPI{Tokens: tokens, Client: client, Context: ctx}
+	testing := testingAPI{API: api, Project: config.Project, BaseURL: testingAPIURL}
+	storage := storageAPI{API: api, BaseURL: storageAPIURL}
+	// the matrices are cancelled after ctx is done, with requests ctx doesn't stop
+	cancels := testing
+	cancels.API.Context = nil
+	cancels.API.Client = &http.Client{Timeout: apiCancelTimeout}
+	config.Matrices = contextMatrices{matrixService: cancels, ctx: ctx, lookups: testing}
+	config.Catalog = &cachedCatalog{Source: testing}
+	config.Runner = apiRunner{
+		Testing:     testing,
+		ToolResults: toolResultsAPI{API: api, BaseURL: toolResultsAPIURL},
+		Storage:     storage,
+		Fallback:    runner,
+		Context:     ctx,
+		Poll:        newPollPolicy(),
+	}
+	return storage, nil
+}
+
+// apiRunner runs `gcloud firebase test android run` commands with the Cloud Testing
+// and Tool Results APIs, writing the lines of gcloud output the step parses. Other
+// commands, e.g. envman, are run by Fallback.
+type apiRunner struct {
+	Testing     testingAPI
+	ToolResults toolResultsAPI
+	Storage     storageAPI
+	Fallback    commandRunner
+	// Context stops waiting for the matrix, never done when nil.
+	Context context.Context
+	Poll    retryPolicy
+}
+
+func (runner apiRunner) Run(cmdSlice []string, output io.Writer) (commandResult, error) {
+	if len(cmdSlice) < 5 || cmdSlice[0] != "gcloud" || cmdSlice[1] != "firebase" || cmdSlice[2] != "test" || cmdSlice[4] != "run" {
+		return runner.Fallback.Run(cmdSlice, output)
+	}
+	if output == nil {
+		output = ioutil.Discard
+	}
+
+	captured := &bytes.Buffer{}
+	start := time.Now()
+	exitCode, err := runner.runMatrix(cmdSlice, io.MultiWriter(output, captured))
+	return commandResult{ExitCode: exitCode, Stderr: captured.String(), Duration: time.Since(start)}, err
+}
+
+// runMatrix returns the exit code gcloud would have exited with. Like with gcloud,
+// invalid commands and API failures exit with 1, only stopping the step is an error.
+func (runner apiRunner) runMatrix(cmdSlice []string, output io.Writer) (int, error) {
+	ctx := runner.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	run, err := parseTestRunCommand(cmdSlice)
+	if err != nil {
+		_, _ = fmt.Fprintf(output, "ERROR: %s\n", err)
+		return exitCodeGeneralFailure, nil
+	}
+
+	appPath, err := runner.upload(run.App, run.ResultsBucket, run.ResultsDir, output)
+	if err != nil {
+		_, _ = fmt.Fprintf(output, "ERROR: %s\n", err)
+		return exitCodeGeneralFailure, nil
+	}
+	testPath := ""
+	if run.Type == "instrumentation" {
+		testPath, err = runner.upload(run.Test, run.ResultsBucket, run.ResultsDir, output)
+		if err != nil {
+			_, _ = fmt.Fprintf(output, "ERROR: %s\n", err)
+			return exitCodeGeneralFailure, nil
+		}
+	}
+	if !isEmpty(run.RoboScript) {
+		run.RoboScript, err = runner.upload(run.RoboScript, run.ResultsBucket, run.ResultsDir, output)
+		if err != nil {
+			_, _ = fmt.Fprintf(output, "ERROR: %s\n", err)
+			return exitCodeGeneralFailure, nil
+		}
+	}
+
+	matrix, err := runner.Testing.CreateMatrix(run.request(runner.Testing.Project, appPath, testPath))
+	if err != nil {
+		_, _ = fmt.Fprintf(output, "ERROR: %s\n", err)
+		return exitCodeGeneralFailure, nil
+	}
+	_, _ = fmt.Fprintf(output, "Test [%s] has been created in the Google Cloud.\n", matrix.TestMatrixID)
+	if run.Async {
+		return exitCodeSuccess, nil
+	}
+
+	matrix, err = waitForMatrix(contextMatrices{matrixService: runner.Testing, ctx: ctx}, matrix.TestMatrixID, runner.Poll.withContext(ctx), output)
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(output, "ERROR: %s\n", err)
+		return exitCodeGeneralFailure, nil
+	}
+
+	if !isEmpty(matrix.ResultStorage.ResultsURL) {
+		_, _ = fmt.Fprintf(output, "Test results will be streamed to [%s].\n", matrix.ResultStorage.ResultsURL)
+	}
+	runner.printOutcomes(matrix, output)
+	return matrix.exitCode(), nil
+}
+
+// upload copies a local app into the results dir like gcloud does, gs:// paths are
+// used as they are.
+func (runner apiRunner) upload(path string, bucket string, resultsDir string, output io.Writer) (string, error) {
+	if strings.HasPrefix(path, "gs://") {
+		return path, nil
+	}
+
+	_, _ = fmt.Fprintf(output, "Uploading [%s] to Firebase Test Lab...\n", path)
+	object := resultsDir + "/" + filepath.Base(path)
+	err := runner.Storage.Upload(bucket, object, path)
+	return "gs://" + bucket + "/" + object, err
+}
+
+// printOutcomes prints the outcome table of gcloud, one row per device.
+func (runner apiRunner) printOutcomes(matrix testMatrix, output io.Writer) {
+	rows := [][]string{{"OUTCOME", "TEST_AXIS_VALUE", "TEST_DETAILS"}}
+	for _, execution := range matrix.TestExecutions {
+		step, err := runner.ToolResults.GetStep(execution)
+		if err != nil {
+			_, _ = fmt.Fprintf(output, "WARNING: %s\n", err)
+		}
+		rows = append(rows, []string{step.outcome(), execution.axisValue(), step.details()})
+	}
+
+	widths := make([]int, 3)
+	for _, row := range rows {
+		for i, cell := range row {
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+	for _, row := range rows {
+		_, _ = fmt.Fprintf(output, "│ %-*s │ %-*s │ %-*s │\n", widths[0], row[0], widths[1], row[1], widths[2], row[2])
+	}
+}
+
+// contextMatrices stops looking up matrices once ctx is done. Cancelling isn't stopped,
+// matrices are cancelled after the step was stopped.
+type contextMatrices struct {
+	matrixService
+	ctx context.Context
+	// lookups gets the matrices when set, e.g. with gcloud stopped with ctx.
+	lookups matrixService
+}
+
+func (matrices contextMatrices) GetMatrix(matrixID string) (testMatrix, error) {
+	if err := matrices.ctx.Err(); err != nil {
+		return testMatrix{}, err
+	}
+	if matrices.lookups != nil {
+		return matrices.lookups.GetMatrix(matrixID)
+	}
+	return matrices.matrixService.GetMatrix(matrixID)
+}
+
+// Flags of `gcloud firebase test android run` the api backend supports, besides
+// --use-orchestrator, --no-use-orchestrator and --async.
+var apiValueFlags = map[string]bool{
+	"--type":                    true,
+	"--app":                     true,
+	"--test":                    true,
+	"--results-bucket":          true,
+	"--results-dir":             true,
+	"--device":                  true,
+	"--timeout":                 true,
+	"--directories-to-pull":     true,
+	"--environment-variables":   true,
+	"--test-targets":            true,
+	"--num-flaky-test-attempts": true,
+	"--robo-script":             true,
+	"--robo-directives":         true,
+	"--app-initial-activity":    true,
+	"--max-depth":               true,
+	"--max-steps":               true,
+}
+
+// apiTestRun is a `gcloud firebase test android run` command read by the api backend.
+type apiTestRun struct {
+	Type                 string
+	App                  string
+	Test                 string
+	ResultsBucket        string
+	ResultsDir           string
+	Devices              []device
+	Timeout              time.Duration
+	DirectoriesToPull    []string
+	EnvironmentVariables []environmentVariable
+	TestTargets          []string
+	UseOrchestrator      bool
+	FlakyTestAttempts    int
+	Async                bool
+	RoboScript           string
+	RoboDirectives       []roboDirective
+	InitialActivity      string
+	MaxDepth             int
+	MaxSteps             int
+}
+
+// checkAPITestRun fails when the api backend can't run cmdSlice, because of its platform,
+// a flag or the test type. Values are checked by parseTestRunCommand.
+func checkAPITestRun(cmdSlice []string) error {
+	if len(cmdSlice) < 5 || cmdSlice[3] != platformAndroid {
+		return errors.New(envKeyBackend + " " + backendAPI + " supports Android only")
+	}
+
+	testType := ""
+	args := cmdSlice[5:]
+	for i := 0; i < len(args); i++ {
+		flag, value, hasValue := args[i], "", false
+		if eq := strings.Index(flag, "="); eq >= 0 {
+			flag, value, hasValue = flag[:eq], flag[eq+1:], true
+		}
+
+		switch flag {
+		case "--use-orchestrator", "--no-use-orchestrator", "--async":
+			continue
+		}
+
+		if !apiValueFlags[flag] {
+			return fmt.Errorf("%s isn't supported by %s %s", flag, envKeyBackend, backendAPI)
+		}
+		if !hasValue && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		if flag == "--type" {
+			testType = value
+		}
+	}
+
+	if testType != "instrumentation" && testType != "robo" {
+		return errors.New(envKeyBackend + " " + backendAPI + " runs instrumentation and robo tests, --type: '" + testType + "'")
+	}
+	return nil
+}
+
+func parseTestRunCommand(cmdSlice []string) (apiTestRun, error) {
+	run := apiTestRun{}
+	err := checkAPITestRun(cmdSlice)
+	if err != nil {
+		return run, err
+	}
+
+	args := cmdSlice[5:]
+	for i := 0; i < len(args); i++ {
+		flag, value, hasValue := args[i], "", false
+		if eq := strings.Index(flag, "="); eq >= 0 {
+			flag, value, hasValue = flag[:eq], flag[eq+1:], true
+		}
+
+		switch flag {
+		case "--use-orchestrator":
+			run.UseOrchestrator = true
+			continue
+		case "--no-use-orchestrator":
+			run.UseOrchestrator = false
+			continue
+		case "--async":
+			run.Async = true
+			continue
+		}
+
+		if !hasValue {
+			if i+1 >= len(args) {
+				return run, errors.New(flag + " needs a value")
+			}
+			i++
+			value = args[i]
+		}
+
+		switch flag {
+		case "--type":
+			run.Type = value
+		case "--app":
+			run.App = value
+		case "--test":
+			run.Test = value
+		case "--results-bucket":
+			run.ResultsBucket = value
+		case "--results-dir":
+			run.ResultsDir = value
+		case "--device":
+			var devices []device
+			devices, err = parseDevices([]string{strings.Join(splitGcloudList(value), ",")})
+			run.Devices = append(run.Devices, devices...)
+		case "--timeout":
+			run.Timeout, err = parseTimeout(flag, value)
+		case "--directories-to-pull":
+			run.DirectoriesToPull = splitGcloudList(value)
+		case "--environment-variables":
+			run.EnvironmentVariables = nil
+			for _, pair := range splitGcloudList(value) {
+				keyValue := strings.SplitN(pair, "=", 2)
+				if len(keyValue) != 2 {
+					return run, errors.New(flag + " must be KEY=VALUE pairs: '" + value + "'")
+				}
+				run.EnvironmentVariables = append(run.EnvironmentVariables, environmentVariable{Key: keyValue[0], Value: keyValue[1]})
+			}
+		case "--test-targets":
+			run.TestTargets = splitGcloudList(value)
+		case "--num-flaky-test-attempts":
+			run.FlakyTestAttempts, err = strconv.Atoi(value)
+		case "--robo-script":
+			run.RoboScript = value
+		case "--robo-directives":
+			run.RoboDirectives, err = parseRoboDirectives(flag, splitGcloudList(value))
+		case "--app-initial-activity":
+			run.InitialActivity = value
+		case "--max-depth":
+			run.MaxDepth, err = strconv.Atoi(value)
+		case "--max-steps":
+			run.MaxSteps, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return run, err
+		}
+	}
+
+	switch {
+	case isEmpty(run.App):
+		return run, errors.New("--app is required")
+	case run.Type == "instrumentation" && isEmpty(run.Test):
+		return run, errors.New("--test is required for instrumentation tests")
+	case run.Type != "robo" && (!isEmpty(run.RoboScript) || len(run.RoboDirectives) > 0 || !isEmpty(run.InitialActivity) || run.MaxDepth > 0 || run.MaxSteps > 0):
+		return run, errors.New("--robo-script, --robo-directives, --app-initial-activity, --max-depth and --max-steps need --type robo")
+	case isEmpty(run.ResultsBucket) || isEmpty(run.ResultsDir):
+		return run, errors.New("--results-bucket and --results-dir are required")
+	case len(run.Devices) == 0:
+		return run, errors.New(envKeyBackend + " " + backendAPI + " needs at least one --device")
+	}
+	for _, d := range run.Devices {
+		if isEmpty(d.Model) || isEmpty(d.Version) {
+			return run, errors.New(envKeyBackend + " " + backendAPI + " needs the model and version of every device: '" + d.String() + "'")
+		}
+	}
+
+	return run, nil
+}
+
+// splitGcloudList splits a gcloud list, honouring the ^<delimiter>^ prefix of gcloudList.
+func splitGcloudList(value string) []string {
+	delimiter := ","
+	if strings.HasPrefix(value, "^") {
+		if end := strings.Index(value[1:], "^"); end > 0 {
+			delimiter = value[1 : end+1]
+			value = value[end+2:]
+		}
+	}
+	return strings.Split(value, delimiter)
+}
+
+// request is the TestMatrix to create for run, with its apps uploaded to appPath and testPath.
+func (run apiTestRun) request(project string, appPath string, testPath string) matrixRequest {
+	request := matrixRequest{
+		ProjectID:         project,
+		FlakyTestAttempts: run.FlakyTestAttempts,
+	}
+	request.ResultStorage.GoogleCloudStorage.GcsPath = "gs://" + run.ResultsBucket + "/" + run.ResultsDir + "/"
+
+	spec := &request.TestSpecification
+	if run.Timeout > 0 {
+		spec.TestTimeout = fmt.Sprintf("%ds", int(run.Timeout.Seconds()))
+	}
+	if len(run.DirectoriesToPull) > 0 || len(run.EnvironmentVariables) > 0 {
+		spec.TestSetup = &testSetup{DirectoriesToPull: run.DirectoriesToPull}
+		for _, variable := range run.EnvironmentVariables {
+			spec.TestSetup.EnvironmentVariables = append(spec.TestSetup.EnvironmentVariables, apiEnvironmentVariable{Key: variable.Key, Value: variable.Value})
+		}
+	}
+
+	if run.Type == "robo" {
+		spec.AndroidRoboTest = &androidRoboTest{
+			AppApk:             fileReference{GcsPath: appPath},
+			AppInitialActivity: run.InitialActivity,
+			MaxDepth:           run.MaxDepth,
+			MaxSteps:           run.MaxSteps,
+		}
+		if !isEmpty(run.RoboScript) {
+			spec.AndroidRoboTest.RoboScript = &fileReference{GcsPath: run.RoboScript}
+		}
+		for _, directive := range run.RoboDirectives {
+			spec.AndroidRoboTest.RoboDirectives = append(spec.AndroidRoboTest.RoboDirectives, apiRoboDirective{
+				ResourceName: directive.Resource,
+				InputText:    directive.Value,
+				ActionType:   roboActionTypes[directive.Type],
+			})
+		}
+	} else {
+		spec.AndroidInstrumentationTest = &androidInstrumentationTest{
+			AppApk:      fileReference{GcsPath: appPath},
+			TestApk:     fileReference{GcsPath: testPath},
+			TestTargets: run.TestTargets,
+		}
+		if run.UseOrchestrator {
+			spec.AndroidInstrumentationTest.OrchestratorOption = "USE_ORCHESTRATOR"
+		}
+	}
+
+	for _, d := range run.Devices {
+		apiDevice := androidDevice{AndroidModelID: d.Model, AndroidVersionID: d.Version, Locale: d.Locale, Orientation: d.Orientation}
+		// the defaults of gcloud
+		if isEmpty(apiDevice.Locale) {
+			apiDevice.Locale = "en"
+		}
+		if isEmpty(apiDevice.Orientation) {
+			apiDevice.Orientation = "portrait"
+		}
+		request.EnvironmentMatrix.AndroidDeviceList.AndroidDevices = append(request.EnvironmentMatrix.AndroidDeviceList.AndroidDevices, apiDevice)
+	}
+
+	return request
+}
+
+// matrixRequest is the TestMatrix sent to testMatrices.create.
+// https://firebase.google.com/docs/test-lab/reference/testing/rest/v1/projects.testMatrices#TestMatrix
+type matrixRequest struct {
+	ProjectID         string            `json:"projectId"`
+	TestSpecification testSpecification `json:"testSpecification"`
+	EnvironmentMatrix struct {
+		AndroidDeviceList struct {
+			AndroidDevices []androidDevice `json:"androidDevices"`
+		} `json:"androidDeviceList"`
+	} `json:"environmentMatrix"`
+	ResultStorage struct {
+		GoogleCloudStorage fileReference `json:"googleCloudStorage"`
+	} `json:"resultStorage"`
+	FlakyTestAttempts int `json:"flakyTestAttempts,omitempty"`
+}
+
+type testSpecification struct {
+	TestTimeout                string                      `json:"testTimeout,omitempty"`
+	TestSetup                  *testSetup                  `json:"testSetup,omitempty"`
+	AndroidInstrumentationTest *androidInstrumentationTest `json:"androidInstrumentationTest,omitempty"`
+	AndroidRoboTest            *androidRoboTest            `json:"androidRoboTest,omitempty"`
+}
+
+type testSetup struct {
+	DirectoriesToPull    []string                 `json:"directoriesToPull,omitempty"`
+	EnvironmentVariables []apiEnvironmentVariable `json:"environmentVariables,omitempty"`
+}
+
+type apiEnvironmentVariable struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type fileReference struct {
+	GcsPath string `json:"gcsPath"`
+}
+
+type androidInstrumentationTest struct {
+	AppApk             fileReference `json:"appApk"`
+	TestApk            fileReference `json:"testApk"`
+	TestTargets        []string      `json:"testTargets,omitempty"`
+	OrchestratorOption string        `json:"orchestratorOption,omitempty"`
+}
+
+type androidRoboTest struct {
+	AppApk             fileReference      `json:"appApk"`
+	AppInitialActivity string             `json:"appInitialActivity,omitempty"`
+	MaxDepth           int                `json:"maxDepth,omitempty"`
+	MaxSteps           int                `json:"maxSteps,omitempty"`
+	RoboDirectives     []apiRoboDirective `json:"roboDirectives,omitempty"`
+	RoboScript         *fileReference     `json:"roboScript,omitempty"`
+}
+
+type apiRoboDirective struct {
+	ResourceName string `json:"resourceName"`
+	InputText    string `json:"inputText,omitempty"`
+	ActionType   string `json:"actionType"`
+}
+
+// roboActionTypes map the directive types of gcloud to the RoboActionType of the API.
+var roboActionTypes = map[string]string{
+	roboDirectiveText:   "ENTER_TEXT",
+	roboDirectiveClick:  "SINGLE_CLICK",
+	roboDirectiveIgnore: "IGNORE",
+}
+
+type androidDevice struct {
+	AndroidModelID   string `json:"androidModelId"`
+	AndroidVersionID string `json:"androidVersionId"`
+	Locale           string `json:"locale"`
+	Orientation      string `json:"orientation"`
+}
+
+// axisValue names the device like gcloud's TEST_AXIS_VALUE, e.g. NexusLowRes-25-en-portrait.
+func (execution testExecution) axisValue() string {
+	d := execution.Environment.AndroidDevice
+	return strings.Join([]string{d.AndroidModelID, d.AndroidVersionID, d.Locale, d.Orientation}, "-")
+}
+
+// toolResultsAPI reads the outcome of test executions from the Tool Results API.
+type toolResultsAPI struct {
+	API     googleAPI
+	BaseURL string
+}
+
+// toolResultsStep is the part of a Tool Results Step the step uses.
+// https://firebase.google.com/docs/test-lab/reference/toolresults/rest/v1beta3/projects.histories.executions.steps
+type toolResultsStep struct {
+	Outcome struct {
+		Summary string `json:"summary"`
+	} `json:"outcome"`
+	TestExecutionStep struct {
+		TestSuiteOverviews []testSuiteOverview `json:"testSuiteOverviews"`
+	} `json:"testExecutionStep"`
+}
+
+type testSuiteOverview struct {
+	TotalCount   int `json:"totalCount"`
+	FailureCount int `json:"failureCount"`
+	ErrorCount   int `json:"errorCount"`
+	SkippedCount int `json:"skippedCount"`
+}
+
+func (api toolResultsAPI) GetStep(execution testExecution) (toolResultsStep, error) {
+	step := toolResultsStep{}
+	ids := execution.ToolResultsStep
+	if isEmpty(ids.StepID) {
+		return step, errors.New("no Tool Results step for " + execution.axisValue())
+	}
+
+	stepURL := api.BaseURL + "/toolresults/v1beta3/projects/" + url.PathEscape(ids.ProjectID) +
+		"/histories/" + url.PathEscape(ids.HistoryID) +
+		"/executions/" + url.PathEscape(ids.ExecutionID) +
+		"/steps/" + url.PathEscape(ids.StepID)
+	err := api.API.callJSON("GET", stepURL, nil, &step, "get the results of", execution.axisValue())
+	return step, err
+}
+
+// outcome names the outcome summary like gcloud's OUTCOME column.
+func (step toolResultsStep) outcome() string {
+	switch step.Outcome.Summary {
+	case "success":
+		return "Passed"
+	case "failure":
+		return "Failed"
+	case "skipped":
+		return "Skipped"
+	default:
+		return "Inconclusive"
+	}
+}
+
+// details sums up the test cases like gcloud's TEST_DETAILS column.
+func (step toolResultsStep) details() string {
+	total, failed, skipped := 0, 0, 0
+	for _, overview := range step.TestExecutionStep.TestSuiteOverviews {
+		total += overview.TotalCount
+		failed += overview.FailureCount + overview.ErrorCount
+		skipped += overview.SkippedCount
+	}
+
+	passed := total - failed - skipped
+	switch {
+	case total == 0:
+		return "--"
+	case failed > 0:
+		return fmt.Sprintf("%d test cases failed, %d passed", failed, passed)
+	default:
+		return fmt.Sprintf("%d test cases passed", passed)
+	}
+}
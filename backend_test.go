@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTestLab mimics the Cloud Testing, Tool Results and Cloud Storage APIs for a single
+// matrix, matrix-1. It's pending on the first get and finishes with Outcome on the next one.
+type fakeTestLab struct {
+	Outcome string
+	Results string
+	Created matrixRequest
+	Uploads []string
+	Gets    int
+	lock    sync.Mutex
+}
+
+func (lab *fakeTestLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lab.lock.Lock()
+	defer lab.lock.Unlock()
+
+	write := func(body string) {
+		_, _ = w.Write([]byte(body))
+	}
+
+	switch path := r.URL.EscapedPath(); {
+	case r.Header.Get("Authorization") != "Bearer ya29.token":
+		w.WriteHeader(http.StatusUnauthorized)
+	case r.Method == "POST" && path == "/upload/storage/v1/b/golang-bucket/o":
+		lab.Uploads = append(lab.Uploads, r.URL.Query().Get("name"))
+		write(`{}`)
+	case r.Method == "GET" && strings.HasPrefix(path, "/storage/v1/b/golang-bucket/o/uploads%2F"):
+		for _, upload := range lab.Uploads {
+			if path == "/storage/v1/b/golang-bucket/o/"+url.PathEscape(upload) {
+				write(`{"name": "` + upload + `"}`)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == "POST" && path == "/v1/projects/fake-project/testMatrices":
+		if err := json.NewDecoder(r.Body).Decode(&lab.Created); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		write(`{"testMatrixId": "matrix-1", "state": "VALIDATING"}`)
+	case r.Method == "GET" && path == "/v1/projects/fake-project/testMatrices/matrix-1":
+		lab.Gets++
+		if lab.Gets == 1 {
+			write(`{"testMatrixId": "matrix-1", "state": "PENDING"}`)
+			return
+		}
+		write(`{
+  "testMatrixId": "matrix-1",
+  "state": "FINISHED",
+  "outcomeSummary": "` + lab.Outcome + `",
+  "resultStorage": {
+    "googleCloudStorage": {"gcsPath": "` + lab.Created.ResultStorage.GoogleCloudStorage.GcsPath + `"},
+    "resultsUrl": "https://console.firebase.google.com/project/fake-project/testlab/histories/bh.1/matrices/1"
+  },
+  "testExecutions": [{
+    "state": "FINISHED",
+    "environment": {"androidDevice": {"androidModelId": "NexusLowRes", "androidVersionId": "25", "locale": "en", "orientation": "portrait"}},
+    "toolResultsStep": {"projectId": "fake-project", "historyId": "bh.1", "executionId": "e1", "stepId": "s1"}
+  }]
+}`)
+	case path == "/toolresults/v1beta3/projects/fake-project/histories/bh.1/executions/e1/steps/s1":
+		write(`{"outcome": {"summary": "failure"}, "testExecutionStep": {"testSuiteOverviews": [{"totalCount": 2, "failureCount": 1}]}}`)
+	case path == "/storage/v1/b/golang-bucket/o":
+		write(`{"items": [{"name": "` + r.URL.Query().Get("prefix") + `NexusLowRes-25-en-portrait/test_result_1.xml"}]}`)
+	case strings.HasSuffix(path, "%2Ftest_result_1.xml"):
+		write(lab.Results)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// APIBackend points config at server and returns the storage of the results.
+func APIBackend(config *firebaseConfig, server *httptest.Server) storageAPI {
+	api := googleAPI{Tokens: staticTokens("ya29.token"), Client: http.DefaultClient}
+	testing := testingAPI{API: api, Project: config.Project, BaseURL: server.URL}
+	storage := storageAPI{API: api, BaseURL: server.URL}
+
+	poll := newPollPolicy()
+	poll.sleep = func(time.Duration) {}
+
+	config.Backend = backendAPI
+	config.Matrices = testing
+	config.Runner = apiRunner{
+		Testing:     testing,
+		ToolResults: toolResultsAPI{API: api, BaseURL: server.URL},
+		Storage:     storage,
+		Fallback:    config.Runner,
+		Poll:        poll,
+	}
+	return storage
+}
+
+func TestNewBackend(t *testing.T) {
+	assert := assert.New(t)
+	resetEnv()
+
+	backend, err := newBackend(platformAndroid)
+	assert.NoError(err)
+	assert.Equal(backendGcloud, backend)
+
+	Setenv(envKeyBackend, "api")
+	backend, err = newBackend(platformAndroid)
+	assert.NoError(err)
+	assert.Equal(backendAPI, backend)
+
+	_, err = newBackend(platformIOS)
+	assert.EqualError(err, envKeyBackend+" api supports Android only")
+
+	Setenv(envKeyBackend, "rest")
+	_, err = newBackend(platformAndroid)
+	assert.EqualError(err, envKeyBackend+" must be 'gcloud' or 'api'")
+}
+
+func TestNewFirebaseConfigAPIBackend(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	setupOptionsEnv()
+	Setenv(envKeyBackend, "api")
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal(backendAPI, config.Backend)
+
+	//- unsupported flags fail before anything runs
+	Setenv(envKeyGcloudOptions, "--device-ids NexusLowRes")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, "--device-ids isn't supported by BACKEND api")
+
+	//- so do unsupported test types
+	Setenv(envKeyGcloudOptions, "")
+	Setenv(envKeyTestApk, "")
+	Setenv(envKeyTestType, testTypeGameLoop)
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, "BACKEND api runs instrumentation and robo tests, --type: 'game-loop'")
+
+	//- collecting runs no test
+	Setenv(envKeyMode, "collect")
+	Setenv(envKeyMatrixID, "matrix-1")
+	Setenv(envKeyGcloudOptions, "--device-ids NexusLowRes")
+	_, err = newFirebaseConfig()
+	assert.NoError(err)
+}
+
+func TestParseTestRunCommand(t *testing.T) {
+	assert := assert.New(t)
+	setupOptionsEnv()
+
+	Setenv(envKeyDevices, "model=NexusLowRes,version=25\nmodel=Nexus9,version=24,locale=de,orientation=landscape")
+	Setenv(envKeyTimeout, "25m")
+	Setenv(envKeyDirectoriesToPull, "/sdcard")
+	Setenv(envKeyEnvironmentVariables, "coverage=true\ncoverageFile=/sdcard/coverage.ec")
+	Setenv(envKeyTestTargets, "class com.example.A,com.example.B\npackage com.example.smoke")
+	Setenv(envKeyUseOrchestrator, "true")
+	Setenv(envKeyNumFlakyTestAttempts, "1")
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+
+	gcsCommand, err := buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	run, err := parseTestRunCommand(gcsCommand)
+	assert.NoError(err)
+
+	data, err := json.Marshal(run.request("fake-project", "gs://golang-bucket/results_dir/app.apk", "gs://golang-bucket/results_dir/test.apk"))
+	assert.NoError(err)
+	assert.JSONEq(`{
+  "projectId": "fake-project",
+  "testSpecification": {
+    "testTimeout": "1500s",
+    "testSetup": {
+      "directoriesToPull": ["/sdcard"],
+      "environmentVariables": [{"key": "coverage", "value": "true"}, {"key": "coverageFile", "value": "/sdcard/coverage.ec"}]
+    },
+    "androidInstrumentationTest": {
+      "appApk": {"gcsPath": "gs://golang-bucket/results_dir/app.apk"},
+      "testApk": {"gcsPath": "gs://golang-bucket/results_dir/test.apk"},
+      "testTargets": ["class com.example.A,com.example.B", "package com.example.smoke"],
+      "orchestratorOption": "USE_ORCHESTRATOR"
+    }
+  },
+  "environmentMatrix": {"androidDeviceList": {"androidDevices": [
+    {"androidModelId": "NexusLowRes", "androidVersionId": "25", "locale": "en", "orientation": "portrait"},
+    {"androidModelId": "Nexus9", "androidVersionId": "24", "locale": "de", "orientation": "landscape"}
+  ]}},
+  "resultStorage": {"googleCloudStorage": {"gcsPath": "gs://golang-bucket/results_dir/"}},
+  "flakyTestAttempts": 1
+}`, string(data))
+
+	cases := []struct {
+		options string
+		err     string
+	}{
+		{"--device-ids NexusLowRes", "--device-ids isn't supported by BACKEND api"},
+		{"--type game-loop", "BACKEND api runs instrumentation and robo tests, --type: 'game-loop'"},
+		{"--device model=Pixel2", "BACKEND api needs the model and version of every device: 'model=Pixel2'"},
+		{"--timeout", "--timeout needs a value"},
+	}
+	for _, c := range cases {
+		config.Options = c.options
+		gcsCommand, err = buildGcloudCommand(config, "results_dir")
+		assert.NoError(err)
+		_, err = parseTestRunCommand(gcsCommand)
+		assert.EqualError(err, c.err)
+	}
+}
+
+func TestSplitGcloudList(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, list := range [][]string{{"a"}, {"a", "b"}, {"a,b", "c"}, {"a,b", "c:d"}} {
+		assert.Equal(list, splitGcloudList(gcloudList(list)))
+	}
+}
+
+func TestRunAPIBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	deployDir, err := ioutil.TempDir("", "deploy")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(deployDir)
+	}()
+
+	lab := &fakeTestLab{Outcome: "FAILURE", Results: JUnitResult([]string{"testAdd", "testBroken"}, "testBroken")}
+	server := httptest.NewServer(lab)
+	defer server.Close()
+
+	config := newFakeGcloudConfig(assert)
+	Setenv(envKeyDeployDir, deployDir)
+	config.TestOptions.Devices = []device{{Model: "NexusLowRes", Version: "25"}}
+	envman, exports := FakeEnvman()
+	config.Runner = envman
+	storage := APIBackend(config, server)
+
+	output := &bytes.Buffer{}
+	outcome, err := run(config, storage, output)
+	assert.NoError(err)
+	assert.Equal("failed", outcome.Name)
+	assert.Equal(exitCodeTestFailure, outcome.ExitCode)
+
+	// no gcloud nor gsutil, only envman
+	for _, command := range envman.Commands() {
+		assert.True(strings.HasPrefix(command, "bitrise envman add "), command)
+	}
+
+	// the same content is uploaded once
+	hash, err := fileSHA256("/tmp/test.apk")
+	assert.NoError(err)
+	assert.Equal([]string{uploadsPrefix + hash + ".apk"}, lab.Uploads)
+	assert.Equal("gs://golang-bucket/"+uploadsPrefix+hash+".apk", lab.Created.TestSpecification.AndroidInstrumentationTest.TestApk.GcsPath)
+	assert.Equal(2, lab.Gets)
+	assert.Contains(output.String(), "matrix-1 is PENDING, checking again in ")
+
+	assert.Equal([]axisOutcome{
+		{Outcome: "Failed", TestAxisValue: "NexusLowRes-25-en-portrait", TestDetails: "1 test cases failed, 1 passed"},
+	}, outcome.Attempts[0].Run.Outcomes)
+	assert.Equal("matrix-1", exports[outputMatrixID])
+	assert.Equal("https://console.firebase.google.com/project/fake-project/testlab/histories/bh.1/matrices/1", exports[outputConsoleURL])
+	assert.Equal("1", exports[outputTestsFailed])
+}
+
+func TestAPIRunnerInvalidCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	output := &bytes.Buffer{}
+	result, err := apiRunner{}.Run([]string{"gcloud", "firebase", "test", "android", "run", "--type", "robo", "--device-ids", "x"}, output)
+	assert.NoError(err)
+	assert.Equal(exitCodeGeneralFailure, result.ExitCode)
+	assert.Equal("ERROR: --device-ids isn't supported by BACKEND api\n", output.String())
+	assert.Equal(output.String(), result.Stderr)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/bitrise-io/go-utils/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// cachePrefix is where passing outcomes are stored in the results bucket by their cache key.
+const cachePrefix = "cache/"
+
+// Values of the FIREBASE_TEST_LAB_CACHE output.
+const (
+	cacheHit  = "hit"
+	cacheMiss = "miss"
+)
+
+// resultCache stores passing outcomes in the results bucket, so the same apps tested on the
+// same devices with the same options reuse the earlier results instead of a new test matrix.
+type resultCache struct {
+	Storage resultsStorage
+	Bucket  string
+	Key     string
+}
+
+// newResultCache returns the cache entry of gcsCommand, nil when CACHE_RESULTS is off.
+func newResultCache(config *firebaseConfig, storage resultsStorage, bucket string, gcsCommand []string) (*resultCache, error) {
+	if !config.CacheResults {
+		return nil, nil
+	}
+
+	key, err := resultCacheKey(gcsCommand)
+	if err != nil {
+		return nil, err
+	}
+	return &resultCache{Storage: storage, Bucket: bucket, Key: key}, nil
+}
+
+// resultCacheKey hashes gcsCommand without its results dir, with the apps, the Robo script and
+// the OBB files replaced by the SHA-256 of their content and the devices sorted, e.g. the order
+// of DEVICES doesn't matter.
+func resultCacheKey(gcsCommand []string) (string, error) {
+	args := make([]string, 0, len(gcsCommand))
+	devices := make([]string, 0)
+
+	for i := 0; i < len(gcsCommand); i++ {
+		arg := gcsCommand[i]
+		parts := strings.SplitN(arg, "=", 2)
+		flag, value, inline := parts[0], "", len(parts) == 2
+		if inline {
+			value = parts[1]
+		}
+
+		switch flag {
+		case "--results-dir":
+			if !inline {
+				i++
+			}
+			continue
+		case "--app", "--test", "--xctestrun-file", "--robo-script", "--device":
+			if !inline {
+				if i+1 >= len(gcsCommand) {
+					break
+				}
+				i++
+				value = gcsCommand[i]
+			}
+
+			if flag == "--device" {
+				devices = append(devices, normalizeDevice(value))
+				continue
+			}
+			id, err := contentID(value)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, flag, id)
+			continue
+		case "--obb-files":
+			if !inline {
+				if i+1 >= len(gcsCommand) {
+					break
+				}
+				i++
+				value = gcsCommand[i]
+			}
+
+			ids := make([]string, 0)
+			for _, obbFile := range splitGcloudList(value) {
+				id, err := contentID(obbFile)
+				if err != nil {
+					return "", err
+				}
+				ids = append(ids, id)
+			}
+			args = append(args, flag, strings.Join(ids, ","))
+			continue
+		}
+		args = append(args, arg)
+	}
+	sort.Strings(devices)
+
+	data, err := json.Marshal(struct {
+		Args    []string `json:"args"`
+		Devices []string `json:"devices"`
+	}{args, devices})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// contentID is the SHA-256 of a local file, gs:// paths are taken as they are.
+func contentID(path string) (string, error) {
+	if strings.HasPrefix(path, "gs://") {
+		return path, nil
+	}
+	return fileSHA256(path)
+}
+
+// normalizeDevice sorts the dimensions of a --device value.
+func normalizeDevice(value string) string {
+	dimensions := strings.Split(value, ",")
+	sort.Strings(dimensions)
+	return strings.Join(dimensions, ",")
+}
+
+func (cache *resultCache) object() string {
+	return cachePrefix + cache.Key + ".json"
+}
+
+// Lookup returns the cached outcome, found is false on a cache miss.
+func (cache *resultCache) Lookup() (outcome testOutcome, found bool, err error) {
+	gcsPath := "gs://" + cache.Bucket + "/" + cache.object()
+	exists, err := cache.Storage.Exists(cache.Bucket, cache.object())
+	if err != nil {
+		return testOutcome{}, false, err
+	}
+	if !exists {
+		log.Printf("Result cache miss: %s", gcsPath)
+		return testOutcome{}, false, nil
+	}
+
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		return testOutcome{}, false, err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	entryPath := filepath.Join(dir, "entry.json")
+	err = cache.Storage.Download(cache.Bucket, cache.object(), entryPath)
+	if err != nil {
+		return testOutcome{}, false, err
+	}
+	data, err := ioutil.ReadFile(entryPath)
+	if err != nil {
+		return testOutcome{}, false, err
+	}
+	err = json.Unmarshal(data, &outcome)
+	if err != nil {
+		return testOutcome{}, false, err
+	}
+
+	log.Donef("Result cache hit: %s, reusing the results of %s", gcsPath, outcome.ResultsDir)
+	return outcome, true, nil
+}
+
+// Store caches outcome when it passed. A failing store doesn't fail the run, it's a warning.
+func (cache *resultCache) Store(outcome testOutcome) {
+	if outcome.ExitCode != exitCodeSuccess || !outcome.Passed {
+		return
+	}
+
+	err := cache.store(outcome)
+	if err != nil {
+		log.Warnf("Failed to cache the result: %s", err)
+		return
+	}
+	log.Printf("Cached the result as gs://%s/%s", cache.Bucket, cache.object())
+}
+
+func (cache *resultCache) store(outcome testOutcome) error {
+	data, err := json.Marshal(outcome)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	entryPath := filepath.Join(dir, "entry.json")
+	err = ioutil.WriteFile(entryPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return cache.Storage.Upload(cache.Bucket, cache.object(), entryPath)
+}
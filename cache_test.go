@@ -0,0 +1,180 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewFirebaseConfigCacheResults(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	setupOptionsEnv()
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	assert.False(config.CacheResults)
+
+	Setenv(envKeyCacheResults, "true")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	assert.True(config.CacheResults)
+
+	//- a submitted matrix has no outcome to cache yet
+	Setenv(envKeyMode, "submit")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	assert.False(config.CacheResults)
+
+	Setenv(envKeyMode, "")
+	Setenv(envKeyCacheResults, "yes")
+	_, err = newFirebaseConfig()
+	assert.Error(err)
+}
+
+func TestResultCacheKey(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "cache")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	app, copied, changed := filepath.Join(dir, "app.apk"), filepath.Join(dir, "copy.apk"), filepath.Join(dir, "changed.apk")
+	PanicOnErr(ioutil.WriteFile(app, []byte("app"), 0644))
+	PanicOnErr(ioutil.WriteFile(copied, []byte("app"), 0644))
+	PanicOnErr(ioutil.WriteFile(changed, []byte("app 2"), 0644))
+
+	command := func(app string, args ...string) []string {
+		return append([]string{"gcloud", "firebase", "test", "android", "run", "--type", "robo", "--app", app, "--results-bucket=golang-bucket"}, args...)
+	}
+	key, err := resultCacheKey(command(app, "--results-dir=a", "--device", "model=NexusLowRes,version=25", "--device", "model=Nexus9,version=24"))
+	assert.NoError(err)
+	assert.Equal(64, len(key))
+
+	same := [][]string{
+		command(copied, "--results-dir=b", "--device", "model=NexusLowRes,version=25", "--device", "model=Nexus9,version=24"),
+		command(app, "--results-dir", "c", "--device", "model=Nexus9,version=24", "--device=version=25,model=NexusLowRes"),
+	}
+	for _, c := range same {
+		other, err := resultCacheKey(c)
+		assert.NoError(err)
+		assert.Equal(key, other, strings.Join(c, " "))
+	}
+
+	different := [][]string{
+		command(changed, "--results-dir=a", "--device", "model=NexusLowRes,version=25", "--device", "model=Nexus9,version=24"),
+		command(app, "--results-dir=a", "--device", "model=NexusLowRes,version=25"),
+		command(app, "--results-dir=a", "--device", "model=NexusLowRes,version=25", "--device", "model=Nexus9,version=24", "--timeout", "5m"),
+		command("gs://golang-bucket/app.apk", "--results-dir=a", "--device", "model=NexusLowRes,version=25", "--device", "model=Nexus9,version=24"),
+	}
+	for _, c := range different {
+		other, err := resultCacheKey(c)
+		assert.NoError(err)
+		assert.NotEqual(key, other, strings.Join(c, " "))
+	}
+
+	//- OBB files by their content
+	obbKey, err := resultCacheKey(command(app, "--obb-files", app+","+copied))
+	assert.NoError(err)
+	other, err := resultCacheKey(command(app, "--obb-files="+copied+","+app))
+	assert.NoError(err)
+	assert.Equal(obbKey, other)
+	other, err = resultCacheKey(command(app, "--obb-files", app+","+changed))
+	assert.NoError(err)
+	assert.NotEqual(obbKey, other)
+
+	_, err = resultCacheKey(command(filepath.Join(dir, "missing.apk")))
+	assert.Error(err)
+}
+
+func TestResultCache(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	cache := &resultCache{Storage: localStorage{Root: root}, Bucket: "golang-bucket", Key: "key"}
+	_, found, err := cache.Lookup()
+	assert.NoError(err)
+	assert.False(found)
+
+	//- only passing outcomes are cached
+	failed := newTestOutcome(exitCodeTestFailure, true)
+	failed.ResultsDir = "results_dir"
+	cache.Store(failed)
+	_, found, err = cache.Lookup()
+	assert.NoError(err)
+	assert.False(found)
+
+	passed := newTestOutcome(exitCodeSuccess, true)
+	passed.ResultsDir = "results_dir"
+	passed.Attempts = []retryAttempt{{Number: 1, ResultsDir: "results_dir", Run: runResult{MatrixID: "matrix-1"}}}
+	cache.Store(passed)
+	assert.True(fileExists(filepath.Join(root, "golang-bucket", "cache", "key.json")) == nil)
+
+	outcome, found, err := cache.Lookup()
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(passed, outcome)
+}
+
+func TestRunCachedResult(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	config := newFakeGcloudConfig(assert)
+	config.CacheResults = true
+	matrices := 0
+	envman, exports := FakeEnvman()
+	config.Runner = &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		if cmdSlice[0] == "bitrise" {
+			return envman.Run(cmdSlice, output)
+		}
+		if cmdSlice[1] != "firebase" {
+			return commandResult{}, nil
+		}
+		matrices++
+
+		resultPath := filepath.Join(root, "golang-bucket", gcloudFlagValue(cmdSlice, "--results-dir"), "NexusLowRes-25-en-portrait", "test_result_1.xml")
+		PanicOnErr(os.MkdirAll(filepath.Dir(resultPath), 0755))
+		PanicOnErr(ioutil.WriteFile(resultPath, []byte(JUnitResult([]string{"testAdd"})), 0644))
+		return commandResult{Stderr: GcloudMatrixOutput(matrices)}, nil
+	}}
+
+	storage := localStorage{Root: root}
+	first, err := run(config, storage, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal("passed", first.Name)
+	assert.Equal(cacheMiss, exports[outputCache])
+
+	second, err := run(config, storage, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal(1, matrices)
+	assert.Equal(first.ResultsDir, second.ResultsDir)
+	assert.Equal(cacheHit, exports[outputCache])
+	assert.Equal(first.ResultsDir, exports[outputResultsDir])
+	assert.Equal("matrix-1", exports[outputMatrixID])
+	assert.Equal("1", exports[outputTestsPassed])
+
+	//- other devices miss the cache
+	config.TestOptions.Devices = []device{{Model: "Nexus9", Version: "24"}}
+	_, err = run(config, storage, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal(2, matrices)
+	assert.Equal(cacheMiss, exports[outputCache])
+}
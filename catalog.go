@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/kballard/go-shellquote"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// deviceCatalog lists the Android devices of Test Lab, the objects of `gcloud firebase test android
+// models list` and `versions list` in JSON.
+type deviceCatalog struct {
+	Models       []catalogModel   `json:"models"`
+	Versions     []catalogVersion `json:"versions"`
+	Locales      []catalogEntry   `json:"locales"`
+	Orientations []catalogEntry   `json:"orientations"`
+}
+
+type catalogModel struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Manufacturer string `json:"manufacturer"`
+	// PHYSICAL, VIRTUAL or EMULATOR
+	Form string `json:"form"`
+	// PHONE, TABLET or WEARABLE
+	FormFactor          string   `json:"formFactor"`
+	SupportedVersionIDs []string `json:"supportedVersionIds"`
+	Tags                []string `json:"tags"`
+}
+
+type catalogVersion struct {
+	ID       string   `json:"id"`
+	APILevel int      `json:"apiLevel"`
+	CodeName string   `json:"codeName"`
+	Tags     []string `json:"tags"`
+}
+
+type catalogEntry struct {
+	ID   string   `json:"id"`
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// catalogSource loads the device catalog, replaced in tests.
+type catalogSource interface {
+	Catalog() (deviceCatalog, error)
+}
+
+// gcloudCatalog lists the catalog with gcloud.
+type gcloudCatalog struct {
+	Runner commandRunner
+}
+
+func (source gcloudCatalog) Catalog() (deviceCatalog, error) {
+	catalog := deviceCatalog{Orientations: []catalogEntry{{ID: "portrait"}, {ID: "landscape"}}}
+	lists := []struct {
+		command string
+		result  interface{}
+	}{
+		{"models", &catalog.Models},
+		{"versions", &catalog.Versions},
+		{"locales", &catalog.Locales},
+	}
+
+	for _, list := range lists {
+		cmdSlice := []string{"gcloud", "firebase", "test", "android", list.command, "list", "--format=json"}
+		result, err := source.Runner.Run(cmdSlice, nil)
+		if err != nil {
+			return catalog, err
+		}
+		if result.ExitCode != 0 {
+			return catalog, fmt.Errorf("%s failed with exit code %d: %s", strings.Join(cmdSlice, " "), result.ExitCode, strings.TrimSpace(result.Stderr))
+		}
+		err = json.Unmarshal([]byte(result.Stdout), list.result)
+		if err != nil {
+			return catalog, fmt.Errorf("%s printed invalid JSON: %s", strings.Join(cmdSlice, " "), err)
+		}
+	}
+
+	return catalog, nil
+}
+
+// Catalog gets the Android catalog from the Cloud Testing API.
+func (api testingAPI) Catalog() (deviceCatalog, error) {
+	response := struct {
+		AndroidDeviceCatalog struct {
+			Models               []catalogModel   `json:"models"`
+			Versions             []catalogVersion `json:"versions"`
+			RuntimeConfiguration struct {
+				Locales      []catalogEntry `json:"locales"`
+				Orientations []catalogEntry `json:"orientations"`
+			} `json:"runtimeConfiguration"`
+		} `json:"androidDeviceCatalog"`
+	}{}
+	catalogURL := api.BaseURL + "/v1/testEnvironmentCatalog/ANDROID?projectId=" + url.QueryEscape(api.Project)
+	err := api.API.callJSON("GET", catalogURL, nil, &response, "get", "the device catalog")
+	if err != nil {
+		return deviceCatalog{}, err
+	}
+
+	android := response.AndroidDeviceCatalog
+	return deviceCatalog{
+		Models:       android.Models,
+		Versions:     android.Versions,
+		Locales:      android.RuntimeConfiguration.Locales,
+		Orientations: android.RuntimeConfiguration.Orientations,
+	}, nil
+}
+
+// cachedCatalog loads the catalog of Source once per run.
+type cachedCatalog struct {
+	Source catalogSource
+
+	lock    sync.Mutex
+	catalog *deviceCatalog
+}
+
+func (cache *cachedCatalog) Catalog() (deviceCatalog, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if cache.catalog == nil {
+		catalog, err := cache.Source.Catalog()
+		if err != nil {
+			return catalog, err
+		}
+		cache.catalog = &catalog
+	}
+	return *cache.catalog, nil
+}
+
+// requestedDevices are the devices of the gcloud device flags in GCLOUD_OPTIONS, or the typed
+// devices when there are none. The --device-ids, --os-version-ids, --locales and --orientations
+// lists make every combination. Unset dimensions are left to Test Lab's defaults.
+func requestedDevices(config *firebaseConfig) ([]device, error) {
+	userOptionsSlice, err := shellquote.Split(config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceLines := make([]string, 0)
+	dimensions := map[string][]string{}
+	for i := 0; i < len(userOptionsSlice); i++ {
+		parts := strings.SplitN(userOptionsSlice[i], "=", 2)
+		flag := parts[0]
+		switch flag {
+		case "--device", "--device-ids", "--os-version-ids", "--locales", "--orientations":
+		default:
+			continue
+		}
+
+		value := ""
+		if len(parts) == 2 {
+			value = parts[1]
+		} else if i+1 < len(userOptionsSlice) {
+			i++
+			value = userOptionsSlice[i]
+		}
+		if flag == "--device" {
+			deviceLines = append(deviceLines, value)
+		} else {
+			dimensions[flag] = append(dimensions[flag], splitGcloudList(value)...)
+		}
+	}
+
+	if len(deviceLines) > 0 {
+		return parseDevices(deviceLines)
+	}
+	if len(dimensions) == 0 {
+		return config.TestOptions.Devices, nil
+	}
+
+	devices := []device{{}}
+	expand := func(flag string, set func(*device, string)) {
+		values := dimensions[flag]
+		if len(values) == 0 {
+			return
+		}
+		expanded := make([]device, 0, len(devices)*len(values))
+		for _, d := range devices {
+			for _, value := range values {
+				set(&d, value)
+				expanded = append(expanded, d)
+			}
+		}
+		devices = expanded
+	}
+	expand("--device-ids", func(d *device, value string) { d.Model = value })
+	expand("--os-version-ids", func(d *device, value string) { d.Version = value })
+	expand("--locales", func(d *device, value string) { d.Locale = value })
+	expand("--orientations", func(d *device, value string) { d.Orientation = value })
+	return devices, nil
+}
+
+// validateDevices checks the requested Android devices against the minSdk of the app and the
+// catalog before anything is uploaded. Unknown IDs come with the closest IDs of the catalog.
+func validateDevices(config *firebaseConfig) error {
+	if config.Platform != platformAndroid {
+		return nil
+	}
+
+	devices, err := requestedDevices(config)
+	if err != nil || len(devices) == 0 {
+		return err
+	}
+
+	err = checkMinSdk(config.AppManifest, devices)
+	if err != nil || config.Catalog == nil {
+		return err
+	}
+
+	catalog, err := config.Catalog.Catalog()
+	if err != nil {
+		log.Warnf("Failed to load the device catalog, skipping the device checks: %s", err)
+		return nil
+	}
+
+	problems := catalog.check(devices)
+	if len(problems) > 0 {
+		return errors.New("Devices not available in Test Lab:\n- " + strings.Join(problems, "\n- "))
+	}
+	return nil
+}
+
+// check returns a problem per unknown ID and unsupported model and version combination.
+func (catalog deviceCatalog) check(devices []device) []string {
+	models := map[string]catalogModel{}
+	modelIDs := make([]string, 0, len(catalog.Models))
+	for _, model := range catalog.Models {
+		models[model.ID] = model
+		modelIDs = append(modelIDs, model.ID)
+	}
+	versionIDs := make([]string, 0, len(catalog.Versions))
+	for _, version := range catalog.Versions {
+		versionIDs = append(versionIDs, version.ID)
+	}
+	entryIDs := func(entries []catalogEntry) []string {
+		ids := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			ids = append(ids, entry.ID)
+		}
+		return ids
+	}
+
+	problems := make([]string, 0)
+	reported := map[string]bool{}
+	report := func(problem string) {
+		if !reported[problem] {
+			reported[problem] = true
+			problems = append(problems, problem)
+		}
+	}
+	checkID := func(kind string, id string, ids []string) bool {
+		if isEmpty(id) || containsID(ids, id) {
+			return true
+		}
+		problem := kind + " '" + id + "' isn't in the catalog"
+		if suggestions := closeMatches(id, ids); len(suggestions) > 0 {
+			problem += ", did you mean " + strings.Join(suggestions, ", ") + "?"
+		}
+		report(problem)
+		return false
+	}
+
+	for _, d := range devices {
+		knownModel := checkID("model", d.Model, modelIDs)
+		knownVersion := checkID("version", d.Version, versionIDs)
+		checkID("locale", d.Locale, entryIDs(catalog.Locales))
+		checkID("orientation", d.Orientation, entryIDs(catalog.Orientations))
+
+		if knownModel && knownVersion && !isEmpty(d.Model) && !isEmpty(d.Version) {
+			model := models[d.Model]
+			if !containsID(model.SupportedVersionIDs, d.Version) {
+				report("model " + model.ID + " doesn't support version " + d.Version + ", supported: " + strings.Join(model.SupportedVersionIDs, ", "))
+			}
+		}
+	}
+
+	return problems
+}
+
+func containsID(ids []string, id string) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+// closeMatches returns up to 3 IDs within an edit distance of a third of id, at least 1,
+// ignoring case, or containing it, closest first.
+func closeMatches(id string, ids []string) []string {
+	type match struct {
+		id       string
+		distance int
+	}
+
+	maxDistance := len(id) / 3
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+
+	lowerID := strings.ToLower(id)
+	matches := make([]match, 0)
+	for _, candidate := range ids {
+		lowerCandidate := strings.ToLower(candidate)
+		distance := editDistance(lowerID, lowerCandidate)
+		if distance <= maxDistance || strings.Contains(lowerCandidate, lowerID) {
+			matches = append(matches, match{candidate, distance})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].id < matches[j].id
+	})
+
+	suggestions := make([]string, 0, 3)
+	for i := 0; i < len(matches) && i < 3; i++ {
+		suggestions = append(suggestions, matches[i].id)
+	}
+	return suggestions
+}
+
+// editDistance is the Levenshtein distance of a and b.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fixtureCatalog loads testdata/android_catalog.json and counts the loads.
+type fixtureCatalog struct {
+	Loads int
+}
+
+func (source *fixtureCatalog) Catalog() (deviceCatalog, error) {
+	source.Loads++
+	catalog := deviceCatalog{}
+	err := json.Unmarshal([]byte(ReadFixture("android_catalog.json")), &catalog)
+	return catalog, err
+}
+
+// FixtureCatalog is the parsed testdata/android_catalog.json.
+func FixtureCatalog() deviceCatalog {
+	catalog, err := (&fixtureCatalog{}).Catalog()
+	PanicOnErr(err)
+	return catalog
+}
+
+func TestGcloudCatalog(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture := map[string]interface{}{}
+	PanicOnErr(json.Unmarshal([]byte(ReadFixture("android_catalog.json")), &fixture))
+	runner := &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		data, err := json.Marshal(fixture[cmdSlice[4]])
+		return commandResult{Stdout: string(data)}, err
+	}}
+
+	catalog, err := gcloudCatalog{Runner: runner}.Catalog()
+	assert.NoError(err)
+	assert.Equal(FixtureCatalog().Models, catalog.Models)
+	assert.Equal(FixtureCatalog().Versions, catalog.Versions)
+	assert.Equal(FixtureCatalog().Locales, catalog.Locales)
+	assert.Equal([]catalogEntry{{ID: "portrait"}, {ID: "landscape"}}, catalog.Orientations)
+	assert.Equal([]string{
+		"gcloud firebase test android models list --format=json",
+		"gcloud firebase test android versions list --format=json",
+		"gcloud firebase test android locales list --format=json",
+	}, runner.Commands())
+
+	runner.Handle = func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		return commandResult{ExitCode: 1, Stderr: "ERROR: (gcloud.firebase.test.android.models.list) PERMISSION_DENIED\n"}, nil
+	}
+	_, err = gcloudCatalog{Runner: runner}.Catalog()
+	assert.EqualError(err, "gcloud firebase test android models list --format=json failed with exit code 1: ERROR: (gcloud.firebase.test.android.models.list) PERMISSION_DENIED")
+
+	runner.Handle = func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		return commandResult{Stdout: "Listed 0 items."}, nil
+	}
+	_, err = gcloudCatalog{Runner: runner}.Catalog()
+	assert.Contains(err.Error(), "gcloud firebase test android models list --format=json printed invalid JSON: ")
+}
+
+func TestTestingAPICatalog(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/v1/testEnvironmentCatalog/ANDROID", r.URL.Path)
+		assert.Equal("fake-project", r.URL.Query().Get("projectId"))
+		_, _ = w.Write([]byte(`{"androidDeviceCatalog": {
+  "models": [{"id": "Pixel2", "form": "PHYSICAL", "formFactor": "PHONE", "supportedVersionIds": ["26", "27"]}],
+  "versions": [{"id": "26", "apiLevel": 26}],
+  "runtimeConfiguration": {"locales": [{"id": "en", "name": "English"}], "orientations": [{"id": "portrait"}]}
+}}`))
+	}))
+	defer server.Close()
+
+	api := testingAPI{API: googleAPI{Tokens: staticTokens("ya29.token"), Client: http.DefaultClient}, Project: "fake-project", BaseURL: server.URL}
+	catalog, err := api.Catalog()
+	assert.NoError(err)
+	assert.Equal(deviceCatalog{
+		Models:       []catalogModel{{ID: "Pixel2", Form: "PHYSICAL", FormFactor: "PHONE", SupportedVersionIDs: []string{"26", "27"}}},
+		Versions:     []catalogVersion{{ID: "26", APILevel: 26}},
+		Locales:      []catalogEntry{{ID: "en", Name: "English"}},
+		Orientations: []catalogEntry{{ID: "portrait"}},
+	}, catalog)
+}
+
+func TestCachedCatalog(t *testing.T) {
+	assert := assert.New(t)
+
+	source := &fixtureCatalog{}
+	cache := &cachedCatalog{Source: source}
+	for i := 0; i < 2; i++ {
+		catalog, err := cache.Catalog()
+		assert.NoError(err)
+		assert.Equal(7, len(catalog.Models))
+	}
+	assert.Equal(1, source.Loads)
+
+	failing := &cachedCatalog{Source: gcloudCatalog{Runner: &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		return commandResult{}, errors.New("gcloud not found")
+	}}}}
+	_, err := failing.Catalog()
+	assert.EqualError(err, "gcloud not found")
+	assert.Nil(failing.catalog)
+}
+
+func TestRequestedDevices(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &firebaseConfig{TestOptions: testOptions{Devices: []device{{Model: "Pixel2", Version: "28"}}}}
+	devices, err := requestedDevices(config)
+	assert.NoError(err)
+	assert.Equal([]device{{Model: "Pixel2", Version: "28"}}, devices)
+
+	config.Options = "--device model=Pixel3,version=29 --timeout 5m --device=model=Nexus9,locale=de"
+	devices, err = requestedDevices(config)
+	assert.NoError(err)
+	assert.Equal([]device{{Model: "Pixel3", Version: "29"}, {Model: "Nexus9", Locale: "de"}}, devices)
+
+	config.Options = "--device-ids Pixel2,Pixel3 --os-version-ids=28 --orientations portrait,landscape"
+	devices, err = requestedDevices(config)
+	assert.NoError(err)
+	assert.Equal([]device{
+		{Model: "Pixel2", Version: "28", Orientation: "portrait"},
+		{Model: "Pixel2", Version: "28", Orientation: "landscape"},
+		{Model: "Pixel3", Version: "28", Orientation: "portrait"},
+		{Model: "Pixel3", Version: "28", Orientation: "landscape"},
+	}, devices)
+
+	config.Options = "--device model"
+	_, err = requestedDevices(config)
+	assert.EqualError(err, "invalid device dimension 'model' in 'model'")
+}
+
+func TestCatalogCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	catalog := FixtureCatalog()
+	assert.Equal([]string{}, catalog.check([]device{
+		{Model: "Pixel2", Version: "28", Locale: "en_US", Orientation: "landscape"},
+		{Model: "Nexus9"},
+		{Version: "21"},
+	}))
+
+	assert.Equal([]string{
+		"model 'pixel2' isn't in the catalog, did you mean Pixel2, Pixel3?",
+		"version '99' isn't in the catalog, did you mean 29?",
+		"locale 'en-US' isn't in the catalog, did you mean en_US?",
+		"orientation 'Portrait' isn't in the catalog, did you mean portrait?",
+		"model Pixel2 doesn't support version 29, supported: 26, 27, 28, 30",
+		"model 'NexusLow' isn't in the catalog, did you mean NexusLowRes?",
+	}, catalog.check([]device{
+		{Model: "pixel2", Version: "99", Locale: "en-US", Orientation: "Portrait"},
+		{Model: "Pixel2", Version: "29"},
+		{Model: "Pixel2", Version: "29"},
+		{Model: "NexusLow", Version: "28"},
+	}))
+}
+
+func TestEditDistance(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, editDistance("pixel2", "pixel2"))
+	assert.Equal(1, editDistance("pixel2", "pixel3"))
+	assert.Equal(3, editDistance("kitten", "sitting"))
+	assert.Equal(6, editDistance("", "pixel2"))
+}
+
+func TestRunValidatesDevices(t *testing.T) {
+	assert := assert.New(t)
+
+	config := newFakeGcloudConfig(assert)
+	config.TestOptions.Devices = []device{{Model: "Pixle2", Version: "28"}}
+	runner := &recordingRunner{}
+	config.Runner = runner
+	source := &fixtureCatalog{}
+	config.Catalog = &cachedCatalog{Source: source}
+
+	_, err := run(config, localStorage{}, ioutil.Discard)
+	assert.EqualError(err, "Devices not available in Test Lab:\n- model 'Pixle2' isn't in the catalog, did you mean Pixel2?")
+	assert.Equal(1, source.Loads)
+	assert.Equal("/tmp/app.apk", config.AppApk)
+	for _, command := range runner.Commands() {
+		assert.False(strings.HasPrefix(command, "gcloud firebase test android run"), command)
+	}
+
+	//- unavailable catalogs skip the check
+	config.Catalog = gcloudCatalog{Runner: &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		return commandResult{ExitCode: 1}, nil
+	}}}
+	assert.NoError(validateDevices(config))
+
+	config.Platform = platformIOS
+	config.Catalog = source
+	assert.NoError(validateDevices(config))
+	assert.Equal(1, source.Loads)
+}
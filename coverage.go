@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Where the instrumentation writes coverage on the device, pulled by Test Lab into the
+// artifacts dir of every device. The orchestrator writes a file per test into a dir.
+const (
+	coverageDeviceDir  = "/sdcard"
+	coverageDeviceFile = "/sdcard/coverage.ec"
+	coverageDevicePath = "/sdcard/coverage/"
+)
+
+// coverageFileName is the name of the merged execution data written into the deploy dir.
+const coverageFileName = "firebase-test-lab-coverage.ec"
+
+// Blocks of the JaCoCo execution data format:
+// https://www.jacoco.org/jacoco/trunk/doc/api/org/jacoco/core/data/ExecutionDataWriter.html
+const (
+	jacocoBlockHeader        = 0x01
+	jacocoBlockSessionInfo   = 0x10
+	jacocoBlockExecutionData = 0x11
+
+	jacocoMagic         = 0xC0C0
+	jacocoFormatVersion = 0x1007
+)
+
+// maxProbes bounds the probes of a class, far above those of real classes, so that a corrupt
+// file can't make the step allocate gigabytes.
+const maxProbes = 1 << 24
+
+// newCoverage reads COVERAGE. Collecting a submitted matrix merges its coverage, every
+// other mode needs instrumentation tests writing it.
+func newCoverage(platform string, testType string, mode string) (bool, error) {
+	coverage, err := getOptionalBoolEnv(envKeyCoverage, false)
+	if err != nil || !coverage {
+		return false, err
+	}
+
+	switch {
+	case platform != platformAndroid:
+		return false, errors.New(envKeyCoverage + " is only supported on Android")
+	case mode != modeCollect && testType != testTypeInstrumentation:
+		return false, errors.New(envKeyCoverage + " needs instrumentation tests, not " + testType + " tests")
+	}
+	return true, nil
+}
+
+// withCoverage makes the instrumentation write its coverage to the sdcard and Test Lab pull
+// it. ENVIRONMENT_VARIABLES win over the injected variables.
+func (options testOptions) withCoverage() testOptions {
+	pulled := false
+	for _, dir := range options.DirectoriesToPull {
+		pulled = pulled || dir == coverageDeviceDir || dir == coverageDeviceDir+"/"
+	}
+	if !pulled {
+		options.DirectoriesToPull = append(options.DirectoriesToPull, coverageDeviceDir)
+	}
+
+	variables := []environmentVariable{{Key: "coverage", Value: "true"}}
+	if options.UseOrchestrator {
+		variables = append(variables, environmentVariable{Key: "coverageFilePath", Value: coverageDevicePath})
+	} else {
+		variables = append(variables, environmentVariable{Key: "coverageFile", Value: coverageDeviceFile})
+	}
+
+	// a copy, the variables of the options aren't modified
+	environmentVariables := append([]environmentVariable{}, options.EnvironmentVariables...)
+	for _, variable := range variables {
+		set := false
+		for _, existing := range environmentVariables {
+			set = set || existing.Key == variable.Key
+		}
+		if !set {
+			environmentVariables = append(environmentVariables, variable)
+		}
+	}
+	options.EnvironmentVariables = environmentVariables
+
+	return options
+}
+
+// collectCoverage merges the coverage files every device pulled into the deploy dir and
+// exports their path. Failing to merge them doesn't fail the step.
+func collectCoverage(config *firebaseConfig, storage resultsStorage, bucket string, outcome testOutcome) error {
+	deployDir := getOptionalEnv(envKeyDeployDir)
+	if isEmpty(deployDir) {
+		log.Warnf("%s is not defined, skipping the coverage", envKeyDeployDir)
+		return nil
+	}
+
+	coveragePath := filepath.Join(deployDir, coverageFileName)
+	files, err := mergeCoverage(storage, bucket, outcome.finalResultsDirs(), coveragePath)
+	if err != nil {
+		log.Warnf("Failed to merge the coverage: %s", err)
+		return nil
+	}
+	if files == 0 {
+		log.Warnf("No coverage *.ec found in the artifacts of gs://%s/%s", bucket, outcome.ResultsDir)
+		return nil
+	}
+
+	log.Donef("Coverage of %d files merged into %s", files, coveragePath)
+	return exportOutputs(config.Runner, []stepOutput{{outputCoveragePath, coveragePath}})
+}
+
+// mergeCoverage downloads the *.ec files of the device artifacts in resultsDirs and writes
+// their merged execution data to outputPath. The re-runs of failed tests below them are left
+// out. Unreadable files are skipped with a warning, fails when none could be merged. Returns
+// the number of merged files.
+func mergeCoverage(storage resultsStorage, bucket string, resultsDirs []string, outputPath string) (int, error) {
+	tmpDir, err := ioutil.TempDir("", "coverage")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	merged := newExecutionData()
+	files, skipped := 0, 0
+	for _, resultsDir := range resultsDirs {
+		prefix := strings.TrimSuffix(resultsDir, "/") + "/"
+		objects, err := storage.List(bucket, prefix)
+		if err != nil {
+			return files, err
+		}
+
+		for i, object := range objects {
+			// <device>/artifacts/..., not rerun_<n>/<device>/artifacts/...
+			parts := strings.SplitN(strings.TrimPrefix(object, prefix), "/", 3)
+			if path.Ext(object) != ".ec" || len(parts) < 3 || parts[1] != "artifacts" {
+				continue
+			}
+
+			localPath := filepath.Join(tmpDir, fmt.Sprintf("%d.ec", i))
+			err = storage.Download(bucket, object, localPath)
+			if err == nil {
+				err = merged.mergeFile(localPath)
+			}
+			if err != nil {
+				log.Warnf("Skipping the coverage of gs://%s/%s: %s", bucket, object, err)
+				skipped++
+				continue
+			}
+			files++
+		}
+	}
+	if skipped > 0 && files == 0 {
+		return 0, fmt.Errorf("none of the %d coverage files could be merged", skipped)
+	}
+	if skipped > 0 {
+		log.Warnf("The merged coverage is partial, %d of %d coverage files were skipped", skipped, files+skipped)
+	}
+	if files == 0 {
+		return 0, nil
+	}
+
+	return files, merged.writeFile(outputPath)
+}
+
+// executionData holds the sessions and the merged probes of JaCoCo execution data files.
+type executionData struct {
+	Sessions []sessionInfo
+	Classes  map[int64]*classExecution
+}
+
+type sessionInfo struct {
+	ID    string
+	Start int64
+	Dump  int64
+}
+
+// classExecution holds the probes of a class, its ID is a hash of the class file.
+type classExecution struct {
+	ID     int64
+	Name   string
+	Probes []bool
+}
+
+func newExecutionData() *executionData {
+	return &executionData{Classes: map[int64]*classExecution{}}
+}
+
+func (data *executionData) readFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	return data.read(bufio.NewReader(file))
+}
+
+// mergeFile merges the execution data file at filePath, or nothing when it can't be read
+// or doesn't match the classes merged so far.
+func (data *executionData) mergeFile(filePath string) error {
+	file := newExecutionData()
+	err := file.readFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	for id, class := range file.Classes {
+		if existing, ok := data.Classes[id]; ok {
+			err = existing.compatible(*class)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, class := range file.Classes {
+		err = data.merge(*class)
+		if err != nil {
+			return err
+		}
+	}
+	data.Sessions = append(data.Sessions, file.Sessions...)
+	return nil
+}
+
+// read merges the blocks of an execution data file, which may hold several dumps.
+func (data *executionData) read(reader *bufio.Reader) error {
+	for {
+		blockType, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch blockType {
+		case jacocoBlockHeader:
+			var magic, version uint16
+			err = readBigEndian(reader, &magic, &version)
+			if err == nil && magic != jacocoMagic {
+				return errors.New("not a JaCoCo execution data file")
+			}
+			if err == nil && version != jacocoFormatVersion {
+				return fmt.Errorf("unsupported JaCoCo execution data version 0x%x", version)
+			}
+		case jacocoBlockSessionInfo:
+			session := sessionInfo{}
+			session.ID, err = readUTF(reader)
+			if err == nil {
+				err = readBigEndian(reader, &session.Start, &session.Dump)
+			}
+			data.Sessions = append(data.Sessions, session)
+		case jacocoBlockExecutionData:
+			class := classExecution{}
+			err = readBigEndian(reader, &class.ID)
+			if err == nil {
+				class.Name, err = readUTF(reader)
+			}
+			if err == nil {
+				class.Probes, err = readBooleanArray(reader)
+			}
+			if err == nil {
+				err = data.merge(class)
+			}
+		default:
+			return fmt.Errorf("unknown block type 0x%x", blockType)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New("truncated JaCoCo execution data")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// merge marks every probe hit by either execution, like JaCoCo's ExecutionDataStore.
+func (data *executionData) merge(class classExecution) error {
+	existing, ok := data.Classes[class.ID]
+	if !ok {
+		data.Classes[class.ID] = &class
+		return nil
+	}
+
+	err := existing.compatible(class)
+	if err != nil {
+		return err
+	}
+	for i, hit := range class.Probes {
+		existing.Probes[i] = existing.Probes[i] || hit
+	}
+	return nil
+}
+
+// compatible fails when other is another class with the same id, or another version of it.
+func (class *classExecution) compatible(other classExecution) error {
+	if class.Name != other.Name {
+		return fmt.Errorf("different class names %s and %s for id %016x", class.Name, other.Name, uint64(other.ID))
+	}
+	if len(class.Probes) != len(other.Probes) {
+		return fmt.Errorf("incompatible execution data for class %s with id %016x", other.Name, uint64(other.ID))
+	}
+	return nil
+}
+
+func (data *executionData) writeFile(filePath string) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	err = data.write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// write writes a single dump, classes without hits are left out like JaCoCo does.
+func (data *executionData) write(writer io.Writer) error {
+	buf := []byte{jacocoBlockHeader}
+	buf = appendBigEndian(buf, uint16(jacocoMagic), uint16(jacocoFormatVersion))
+
+	for _, session := range data.Sessions {
+		buf = append(buf, jacocoBlockSessionInfo)
+		buf = appendUTF(buf, session.ID)
+		buf = appendBigEndian(buf, session.Start, session.Dump)
+	}
+
+	classes := make([]*classExecution, 0, len(data.Classes))
+	for _, class := range data.Classes {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		if classes[i].Name != classes[j].Name {
+			return classes[i].Name < classes[j].Name
+		}
+		return classes[i].ID < classes[j].ID
+	})
+
+	for _, class := range classes {
+		if !class.hasHits() {
+			continue
+		}
+		buf = append(buf, jacocoBlockExecutionData)
+		buf = appendBigEndian(buf, class.ID)
+		buf = appendUTF(buf, class.Name)
+		buf = appendBooleanArray(buf, class.Probes)
+	}
+
+	_, err := writer.Write(buf)
+	return err
+}
+
+func (class classExecution) hasHits() bool {
+	for _, hit := range class.Probes {
+		if hit {
+			return true
+		}
+	}
+	return false
+}
+
+func readBigEndian(reader io.Reader, values ...interface{}) error {
+	for _, value := range values {
+		err := binary.Read(reader, binary.BigEndian, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendBigEndian(buf []byte, values ...interface{}) []byte {
+	for _, value := range values {
+		switch v := value.(type) {
+		case uint16:
+			buf = append(buf, byte(v>>8), byte(v))
+		case int64:
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, uint64(v))
+			buf = append(buf, b...)
+		}
+	}
+	return buf
+}
+
+// readUTF reads a string of Java's DataOutput.writeUTF, kept in its modified UTF-8 encoding.
+func readUTF(reader io.Reader) (string, error) {
+	var length uint16
+	err := binary.Read(reader, binary.BigEndian, &length)
+	if err != nil {
+		return "", err
+	}
+	value := make([]byte, length)
+	_, err = io.ReadFull(reader, value)
+	return string(value), err
+}
+
+func appendUTF(buf []byte, value string) []byte {
+	buf = appendBigEndian(buf, uint16(len(value)))
+	return append(buf, value...)
+}
+
+// readBooleanArray reads the probes of JaCoCo's CompactDataOutput: a var int length followed
+// by 8 probes per byte, lowest bit first.
+func readBooleanArray(reader *bufio.Reader) ([]bool, error) {
+	length, err := readVarInt(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 || length > maxProbes {
+		return nil, fmt.Errorf("invalid probe count %d", length)
+	}
+
+	// read as far as the file goes, a truncated file allocates no more than it holds
+	size := (length + 7) / 8
+	packed, err := ioutil.ReadAll(io.LimitReader(reader, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	if len(packed) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	probes := make([]bool, length)
+	for i := range probes {
+		probes[i] = packed[i/8]&(1<<uint(i%8)) != 0
+	}
+	return probes, nil
+}
+
+func appendBooleanArray(buf []byte, probes []bool) []byte {
+	buf = appendVarInt(buf, len(probes))
+	packed := make([]byte, (len(probes)+7)/8)
+	for i, hit := range probes {
+		if hit {
+			packed[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return append(buf, packed...)
+}
+
+// readVarInt reads 7 bits per byte, lowest first, the high bit tells that more follow.
+func readVarInt(reader *bufio.Reader) (int, error) {
+	value := 0
+	for shift := uint(0); shift < 32; shift += 7 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return value, nil
+		}
+	}
+	return 0, errors.New("malformed var int")
+}
+
+func appendVarInt(buf []byte, value int) []byte {
+	for value >= 0x80 {
+		buf = append(buf, byte(value&0x7F)|0x80)
+		value >>= 7
+	}
+	return append(buf, byte(value))
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ExecutionDataOf holds the execution data of classes, without sessions.
+func ExecutionDataOf(classes ...classExecution) *executionData {
+	data := newExecutionData()
+	for _, class := range classes {
+		PanicOnErr(data.merge(class))
+	}
+	return data
+}
+
+// ExecutionData builds a JaCoCo execution data file of a session and classes, each class is
+// an id, a name and its probes.
+func ExecutionData(session string, classes ...classExecution) []byte {
+	data := ExecutionDataOf(classes...)
+	data.Sessions = []sessionInfo{{ID: session, Start: 1500000000000, Dump: 1500000060000}}
+
+	buf := &bytes.Buffer{}
+	PanicOnErr(data.write(buf))
+	return buf.Bytes()
+}
+
+// readExecutionData reads the execution data of the file at filePath.
+func readExecutionData(assert *assert.Assertions, filePath string) *executionData {
+	data := newExecutionData()
+	assert.NoError(data.readFile(filePath))
+	return data
+}
+
+func TestNewCoverage(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	setupOptionsEnv()
+	Setenv(envKeyCoverage, "true")
+	Setenv(envKeyDirectoriesToPull, "/data/local/tmp/screenshots")
+	Setenv(envKeyEnvironmentVariables, "API_TOKEN=abc")
+
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	assert.True(config.Coverage)
+	assert.Equal([]string{"/data/local/tmp/screenshots", "/sdcard"}, config.TestOptions.DirectoriesToPull)
+
+	gcsCommand, err := buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	assert.Equal("/data/local/tmp/screenshots,/sdcard", gcloudFlagValue(gcsCommand, "--directories-to-pull"))
+	assert.Equal("API_TOKEN=abc,coverage=true,coverageFile=/sdcard/coverage.ec", gcloudFlagValue(gcsCommand, "--environment-variables"))
+
+	//- the orchestrator writes a file per test, variables of the user win
+	setupOptionsEnv()
+	Setenv(envKeyCoverage, "true")
+	Setenv(envKeyDirectoriesToPull, "/sdcard/")
+	Setenv(envKeyEnvironmentVariables, "coverage=false")
+	Setenv(envKeyUseOrchestrator, "true")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal([]string{"/sdcard/"}, config.TestOptions.DirectoriesToPull)
+	assert.Equal([]environmentVariable{
+		{Key: "coverage", Value: "false"},
+		{Key: "coverageFilePath", Value: coverageDevicePath},
+	}, config.TestOptions.EnvironmentVariables)
+
+	//- collecting doesn't run tests
+	setupOptionsEnv()
+	Setenv(envKeyCoverage, "true")
+	Setenv(envKeyMode, "collect")
+	Setenv(envKeyMatrixID, "matrix-1")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	assert.True(config.Coverage)
+	assert.Empty(config.TestOptions.EnvironmentVariables)
+
+	//- disabled by default
+	setupOptionsEnv()
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	assert.False(config.Coverage)
+	assert.Empty(config.TestOptions.DirectoriesToPull)
+}
+
+func TestNewCoverageValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		value    string
+		platform string
+		testType string
+		err      string
+	}{
+		{"yes", platformAndroid, testTypeInstrumentation, envKeyCoverage + " must be 'true' or 'false'"},
+		{"true", platformAndroid, testTypeRobo, envKeyCoverage + " needs instrumentation tests, not robo tests"},
+		{"true", platformAndroid, testTypeGameLoop, envKeyCoverage + " needs instrumentation tests, not game-loop tests"},
+		{"true", platformIOS, testTypeXCTest, envKeyCoverage + " is only supported on Android"},
+		{"false", platformIOS, testTypeXCTest, ""},
+	}
+	for _, c := range cases {
+		Setenv(envKeyCoverage, c.value)
+		_, err := newCoverage(c.platform, c.testType, modeRun)
+		if isEmpty(c.err) {
+			assert.NoError(err, c.value)
+		} else {
+			assert.EqualError(err, c.err, c.value)
+		}
+	}
+	Setenv(envKeyCoverage, "")
+}
+
+func TestExecutionData(t *testing.T) {
+	assert := assert.New(t)
+
+	// a header, a session and the class com/example/App with 10 probes, 1, 3 and 9 hit
+	file := []byte{
+		0x01, 0xC0, 0xC0, 0x10, 0x07,
+		0x10, 0x00, 0x05, 'p', 'i', 'x', 'e', 'l',
+		0x00, 0x00, 0x01, 0x5C, 0xD9, 0x6F, 0x90, 0x00,
+		0x00, 0x00, 0x01, 0x5C, 0xD9, 0x6F, 0x90, 0x60,
+		0x11, 0x12, 0x34, 0x56, 0x78, 0x9A, 0xBC, 0xDE, 0xF0,
+		0x00, 0x0F, 'c', 'o', 'm', '/', 'e', 'x', 'a', 'm', 'p', 'l', 'e', '/', 'A', 'p', 'p',
+		0x0A, 0x0A, 0x01,
+	}
+
+	data := newExecutionData()
+	assert.NoError(data.read(bufio.NewReader(bytes.NewReader(file))))
+	assert.Equal([]sessionInfo{{ID: "pixel", Start: 0x15CD96F9000, Dump: 0x15CD96F9060}}, data.Sessions)
+	assert.Equal(&classExecution{
+		ID:     0x123456789ABCDEF0,
+		Name:   "com/example/App",
+		Probes: []bool{false, true, false, true, false, false, false, false, true, false},
+	}, data.Classes[0x123456789ABCDEF0])
+
+	// written back byte for byte
+	buf := &bytes.Buffer{}
+	assert.NoError(data.write(buf))
+	assert.Equal(file, buf.Bytes())
+
+	//- merging marks the probes hit by either file
+	app := classExecution{ID: 0x123456789ABCDEF0, Name: "com/example/App", Probes: make([]bool, 10)}
+	app.Probes[0] = true
+	assert.NoError(data.read(bufio.NewReader(bytes.NewReader(ExecutionData("nexus", app)))))
+	assert.Equal(2, len(data.Sessions))
+	assert.Equal([]bool{true, true, false, true, false, false, false, false, true, false}, data.Classes[0x123456789ABCDEF0].Probes)
+
+	//- probes of more than 127 need a longer var int
+	probes := make([]bool, 200)
+	probes[199] = true
+	data = newExecutionData()
+	assert.NoError(data.read(bufio.NewReader(bytes.NewReader(ExecutionData("pixel", classExecution{ID: 1, Name: "com/example/Big", Probes: probes})))))
+	assert.Equal(probes, data.Classes[1].Probes)
+
+	//- classes without hits are left out
+	buf.Reset()
+	assert.NoError(ExecutionDataOf(classExecution{ID: 2, Name: "com/example/Unused", Probes: make([]bool, 3)}).write(buf))
+	assert.Equal([]byte{0x01, 0xC0, 0xC0, 0x10, 0x07}, buf.Bytes())
+}
+
+func TestExecutionDataErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	app := ExecutionData("pixel", classExecution{ID: 0x10, Name: "com/example/App", Probes: []bool{true, false}})
+	// the class com/example/Big up to its probes
+	class := []byte{0x11, 0, 0, 0, 0, 0, 0, 0, 0x20, 0x00, 0x0F, 'c', 'o', 'm', '/', 'e', 'x', 'a', 'm', 'p', 'l', 'e', '/', 'B', 'i', 'g'}
+
+	cases := []struct {
+		file []byte
+		err  string
+	}{
+		{[]byte("PK\x03\x04"), "unknown block type 0x50"},
+		{[]byte{0x01, 0xCA, 0xFE, 0x10, 0x07}, "not a JaCoCo execution data file"},
+		{[]byte{0x01, 0xC0, 0xC0, 0x10, 0x06}, "unsupported JaCoCo execution data version 0x1006"},
+		{app[:len(app)-1], "truncated JaCoCo execution data"},
+		{ExecutionData("nexus", classExecution{ID: 0x10, Name: "com/example/Other", Probes: []bool{true, false}}), "different class names com/example/App and com/example/Other for id 0000000000000010"},
+		{ExecutionData("nexus", classExecution{ID: 0x10, Name: "com/example/App", Probes: []bool{true}}), "incompatible execution data for class com/example/App with id 0000000000000010"},
+		// probe counts of corrupt files
+		{appendVarInt(class, maxProbes+1), "invalid probe count 16777217"},
+		{appendVarInt(class, 1<<34), "invalid probe count 17179869184"},
+		{appendVarInt(class, maxProbes), "truncated JaCoCo execution data"},
+	}
+	for _, c := range cases {
+		data := newExecutionData()
+		assert.NoError(data.read(bufio.NewReader(bytes.NewReader(app))))
+		err := data.read(bufio.NewReader(bytes.NewReader(c.file)))
+		assert.EqualError(err, c.err)
+	}
+}
+
+func TestCollectCoverage(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+	deployDir, err := ioutil.TempDir("", "deploy")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(deployDir)
+	}()
+
+	objects := map[string]string{
+		"results_dir/NexusLowRes-25-en-portrait/artifacts/sdcard/coverage.ec": string(ExecutionData("nexus",
+			classExecution{ID: 1, Name: "com/example/App", Probes: []bool{true, false, false}},
+		)),
+		"results_dir/Pixel2-28-en-portrait/artifacts/sdcard/coverage/com.example.AppTest#testA.ec": string(ExecutionData("pixel",
+			classExecution{ID: 1, Name: "com/example/App", Probes: []bool{false, false, true}},
+			classExecution{ID: 2, Name: "com/example/Login", Probes: []bool{true}},
+		)),
+		// not pulled from the device
+		"results_dir/Pixel2-28-en-portrait/coverage.ec": "not execution data",
+		"results_dir/Pixel2-28-en-portrait/logcat":      "",
+		// re-runs of the failed tests
+		"results_dir/rerun_1/Pixel2-28-en-portrait/artifacts/sdcard/coverage.ec": string(ExecutionData("rerun",
+			classExecution{ID: 3, Name: "com/example/Settings", Probes: []bool{true}},
+		)),
+		// a failed attempt of a shard and the final attempts
+		"sharded_dir/shard_0/NexusLowRes-25-en-portrait/artifacts/sdcard/coverage.ec": string(ExecutionData("failed",
+			classExecution{ID: 3, Name: "com/example/Settings", Probes: []bool{true}},
+		)),
+		"sharded_dir/shard_0_attempt_2/NexusLowRes-25-en-portrait/artifacts/sdcard/coverage.ec": string(ExecutionData("nexus",
+			classExecution{ID: 1, Name: "com/example/App", Probes: []bool{true, false, false}},
+		)),
+		"sharded_dir/shard_1/NexusLowRes-25-en-portrait/artifacts/sdcard/coverage.ec": string(ExecutionData("nexus",
+			classExecution{ID: 2, Name: "com/example/Login", Probes: []bool{true}},
+		)),
+	}
+	for object, content := range objects {
+		WriteObject(root, "golang-bucket", object, content)
+	}
+
+	config := newFakeGcloudConfig(assert)
+	Setenv(envKeyDeployDir, deployDir)
+	envman, exports := FakeEnvman()
+	config.Runner = envman
+	storage := localStorage{Root: root}
+
+	err = collectCoverage(config, storage, "golang-bucket", testOutcome{ResultsDir: "results_dir"})
+	assert.NoError(err)
+
+	coveragePath := filepath.Join(deployDir, coverageFileName)
+	assert.Equal(coveragePath, exports[outputCoveragePath])
+	data := readExecutionData(assert, coveragePath)
+	assert.Equal(2, len(data.Sessions))
+	assert.Equal([]bool{true, false, true}, data.Classes[1].Probes)
+	assert.Equal([]bool{true}, data.Classes[2].Probes)
+	assert.Nil(data.Classes[3])
+
+	//- the final attempts of the shards only
+	err = collectCoverage(config, storage, "golang-bucket", testOutcome{
+		ResultsDir:       "sharded_dir",
+		ShardResultsDirs: []string{"sharded_dir/shard_0_attempt_2", "sharded_dir/shard_1"},
+	})
+	assert.NoError(err)
+	data = readExecutionData(assert, coveragePath)
+	assert.Equal(2, len(data.Sessions))
+	assert.Equal([]bool{true, false, false}, data.Classes[1].Probes)
+	assert.Equal([]bool{true}, data.Classes[2].Probes)
+	assert.Nil(data.Classes[3])
+
+	//- no coverage, nothing exported
+	envman, exports = FakeEnvman()
+	config.Runner = envman
+	err = collectCoverage(config, storage, "golang-bucket", testOutcome{ResultsDir: "other_dir"})
+	assert.NoError(err)
+	assert.Empty(exports)
+
+	//- unreadable files warn and are left out, without parts of them
+	WriteObject(root, "golang-bucket", "results_dir/Pixel2-28-en-portrait/artifacts/broken.ec", "broken")
+	WriteObject(root, "golang-bucket", "results_dir/Pixel2-28-en-portrait/artifacts/other.ec", string(ExecutionData("other",
+		classExecution{ID: 3, Name: "com/example/Settings", Probes: []bool{true}},
+		classExecution{ID: 1, Name: "com/example/App", Probes: []bool{true}},
+	)))
+	err = collectCoverage(config, storage, "golang-bucket", testOutcome{ResultsDir: "results_dir"})
+	assert.NoError(err)
+	assert.Equal(coveragePath, exports[outputCoveragePath])
+	data = readExecutionData(assert, coveragePath)
+	assert.Equal(2, len(data.Sessions))
+	assert.Equal([]bool{true, false, true}, data.Classes[1].Probes)
+	assert.Nil(data.Classes[3])
+
+	//- nothing merged fails
+	WriteObject(root, "golang-bucket", "broken_dir/Pixel2-28-en-portrait/artifacts/broken.ec", "broken")
+	_, err = mergeCoverage(storage, "golang-bucket", []string{"broken_dir"}, coveragePath)
+	assert.EqualError(err, "none of the 1 coverage files could be merged")
+	envman, exports = FakeEnvman()
+	config.Runner = envman
+	err = collectCoverage(config, storage, "golang-bucket", testOutcome{ResultsDir: "broken_dir"})
+	assert.NoError(err)
+	assert.Empty(exports)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/bitrise-io/go-utils/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// envKeyCloudSDKConfig points gcloud and gsutil at a configuration directory instead of ~/.config/gcloud.
+	envKeyCloudSDKConfig = "CLOUDSDK_CONFIG"
+	// envKeyCloudSDKProject overrides the project of the gcloud configuration without writing it.
+	envKeyCloudSDKProject = "CLOUDSDK_CORE_PROJECT"
+)
+
+// credentials is the private gcloud state of a run: a CLOUDSDK_CONFIG directory and the key
+// file of AUTH_MODE, in a temp dir only the step user can read. Concurrent runs on one
+// machine don't share the active account or project, and the key doesn't outlive the run.
+type credentials struct {
+	// Dir holds the configuration and the key, empty in gcloud mode.
+	Dir string
+
+	// previous values of the overridden env vars, nil when unset
+	previous map[string]*string
+}
+
+// newCredentials writes the key to a 0600 file and points the child processes of the step at a
+// fresh gcloud configuration. Sets config.KeyPath. In gcloud mode the configuration of the
+// machine is kept and only the project is overridden.
+func newCredentials(config *firebaseConfig) (*credentials, error) {
+	creds := &credentials{previous: map[string]*string{}}
+	if config.Auth.Mode == authModeGcloud {
+		err := creds.setenv(envKeyCloudSDKProject, config.Project)
+		if err != nil {
+			creds.Remove()
+			return nil, err
+		}
+		return creds, nil
+	}
+
+	dir, err := ioutil.TempDir("", "firebase-test-lab")
+	if err != nil {
+		return nil, err
+	}
+	creds.Dir = dir
+
+	configDir := filepath.Join(dir, "gcloud")
+	err = os.Mkdir(configDir, 0700)
+	if err != nil {
+		creds.Remove()
+		return nil, err
+	}
+
+	keyPath := filepath.Join(dir, "key.json")
+	err = ioutil.WriteFile(keyPath, config.Auth.Key, 0600)
+	if err != nil {
+		creds.Remove()
+		return nil, err
+	}
+
+	err = creds.setenv(envKeyCloudSDKConfig, configDir)
+	if err != nil {
+		creds.Remove()
+		return nil, err
+	}
+
+	config.KeyPath = keyPath
+	return creds, nil
+}
+
+// setenv sets key for the step and its child processes, Remove restores it.
+func (creds *credentials) setenv(key string, value string) error {
+	if _, ok := creds.previous[key]; !ok {
+		if previous, set := os.LookupEnv(key); set {
+			creds.previous[key] = &previous
+		} else {
+			creds.previous[key] = nil
+		}
+	}
+	return os.Setenv(key, value)
+}
+
+// Remove deletes the key and the gcloud configuration and restores the env.
+func (creds *credentials) Remove() {
+	for key, previous := range creds.previous {
+		if previous != nil {
+			_ = os.Setenv(key, *previous)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	}
+
+	if isEmpty(creds.Dir) {
+		return
+	}
+	err := os.RemoveAll(creds.Dir)
+	if err != nil {
+		log.Warnf("Failed to remove the credentials in %s: %s", creds.Dir, err)
+	}
+}
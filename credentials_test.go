@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewCredentials(t *testing.T) {
+	assert := assert.New(t)
+	configValue, hadConfig := os.LookupEnv(envKeyCloudSDKConfig)
+	defer func() {
+		if hadConfig {
+			Setenv(envKeyCloudSDKConfig, configValue)
+		} else {
+			PanicOnErr(os.Unsetenv(envKeyCloudSDKConfig))
+		}
+	}()
+
+	Setenv(envKeyCloudSDKConfig, "/home/user/.config/gcloud")
+	config := &firebaseConfig{Auth: authProvider{Key: []byte(`{"type": "service_account"}`)}}
+	creds, err := newCredentials(config)
+	assert.NoError(err)
+
+	assert.Equal(filepath.Join(creds.Dir, "key.json"), config.KeyPath)
+	info, err := os.Stat(config.KeyPath)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	key, err := ioutil.ReadFile(config.KeyPath)
+	assert.NoError(err)
+	assert.Equal(`{"type": "service_account"}`, string(key))
+
+	info, err = os.Stat(creds.Dir)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0700), info.Mode().Perm())
+	assert.Equal(filepath.Join(creds.Dir, "gcloud"), os.Getenv(envKeyCloudSDKConfig))
+
+	//- concurrent runs get their own configuration
+	other, err := newCredentials(&firebaseConfig{})
+	assert.NoError(err)
+	assert.NotEqual(creds.Dir, other.Dir)
+	other.Remove()
+	assert.Equal(filepath.Join(creds.Dir, "gcloud"), os.Getenv(envKeyCloudSDKConfig))
+
+	creds.Remove()
+	_, err = os.Stat(creds.Dir)
+	assert.True(os.IsNotExist(err))
+	assert.Equal("/home/user/.config/gcloud", os.Getenv(envKeyCloudSDKConfig))
+
+	PanicOnErr(os.Unsetenv(envKeyCloudSDKConfig))
+	creds, err = newCredentials(config)
+	assert.NoError(err)
+	creds.Remove()
+	_, set := os.LookupEnv(envKeyCloudSDKConfig)
+	assert.False(set)
+}
+
+func TestNewFirebaseConfigKeepsKeyInMemory(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+	homeValue := os.Getenv(envKeyHome)
+	defer Setenv(envKeyHome, homeValue)
+
+	setupOptionsEnv()
+	Setenv(envKeyHome, "/does/not/exist")
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	key, err := base64.StdEncoding.DecodeString(ServiceAccountKey("fake@example.com"))
+	assert.NoError(err)
+	assert.Equal(key, config.Auth.Key)
+	assert.Equal("", config.KeyPath)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Range bounds of DEVICE_CRITERIA versions read from the manifest of APP_APK.
+const (
+	criteriaMinSdk    = "minSdk"
+	criteriaTargetSdk = "targetSdk"
+)
+
+// deviceCriteria selects devices from the catalog instead of listing their IDs, one key=value per line:
+//
+//	latest=3                      the latest 3 API levels
+//	versions=minSdk..targetSdk    API levels in a range, bounds are numbers, minSdk or targetSdk
+//	form=physical                 physical or virtual devices only
+//	phones=1                      number of phone models, 1 when neither phones nor tablets are set
+//	tablets=1                     number of tablet models
+//	locale=de                     locale of every device
+//	orientation=landscape         orientation of every device
+type deviceCriteria struct {
+	Latest      int
+	MinVersion  string
+	MaxVersion  string
+	Form        string
+	Phones      int
+	Tablets     int
+	Locale      string
+	Orientation string
+}
+
+func parseDeviceCriteria(lines []string) (*deviceCriteria, error) {
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	criteria := &deviceCriteria{}
+	count := func(value string) (int, error) {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 {
+			return 0, errors.New("must be a positive number")
+		}
+		return number, nil
+	}
+
+	for _, line := range lines {
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) != 2 || isEmpty(strings.TrimSpace(keyValue[1])) {
+			return nil, errors.New(envKeyDeviceCriteria + " must be key=value lines: '" + line + "'")
+		}
+		key, value := strings.TrimSpace(keyValue[0]), strings.TrimSpace(keyValue[1])
+
+		var err error
+		switch key {
+		case "latest":
+			criteria.Latest, err = count(value)
+		case "versions":
+			bounds := strings.SplitN(value, "..", 2)
+			if len(bounds) != 2 {
+				err = errors.New("must be a range, e.g. 24..28 or minSdk..targetSdk")
+				break
+			}
+			criteria.MinVersion, criteria.MaxVersion = bounds[0], bounds[1]
+			for _, bound := range bounds {
+				if _, atoiErr := strconv.Atoi(bound); atoiErr != nil && !isEmpty(bound) && bound != criteriaMinSdk && bound != criteriaTargetSdk {
+					err = errors.New("bounds must be API levels, " + criteriaMinSdk + " or " + criteriaTargetSdk)
+				}
+			}
+		case "form":
+			if value != "physical" && value != "virtual" {
+				err = errors.New("must be physical or virtual")
+			}
+			criteria.Form = value
+		case "phones":
+			criteria.Phones, err = count(value)
+		case "tablets":
+			criteria.Tablets, err = count(value)
+		case "locale":
+			criteria.Locale = value
+		case "orientation":
+			if value != "portrait" && value != "landscape" {
+				err = errors.New("must be portrait or landscape")
+			}
+			criteria.Orientation = value
+		default:
+			err = errors.New("unknown criterion")
+		}
+		if err != nil {
+			return nil, errors.New(envKeyDeviceCriteria + " '" + line + "': " + err.Error())
+		}
+	}
+
+	if criteria.Phones == 0 && criteria.Tablets == 0 {
+		criteria.Phones = 1
+	}
+	return criteria, nil
+}
+
+// apiLevels returns the bounds of the versions range, 0 when open. Versions below the minSdk of
+// the app are never selected.
+func (criteria deviceCriteria) apiLevels(manifest *apkManifest) (int, int, error) {
+	level := func(bound string) (int, error) {
+		switch bound {
+		case "":
+			return 0, nil
+		case criteriaMinSdk, criteriaTargetSdk:
+			if manifest == nil {
+				return 0, errors.New(envKeyDeviceCriteria + " " + bound + " needs the manifest of " + envKeyAppApk)
+			}
+			if bound == criteriaMinSdk {
+				return manifest.MinSdk, nil
+			}
+			return manifest.TargetSdk, nil
+		default:
+			return strconv.Atoi(bound)
+		}
+	}
+
+	minLevel, err := level(criteria.MinVersion)
+	if err != nil {
+		return 0, 0, err
+	}
+	maxLevel, err := level(criteria.MaxVersion)
+	if err != nil {
+		return 0, 0, err
+	}
+	if manifest != nil && minLevel < manifest.MinSdk {
+		minLevel = manifest.MinSdk
+	}
+	return minLevel, maxLevel, nil
+}
+
+// resolve picks the models and versions of the catalog matching the criteria. Versions are the
+// ones supported by any matching model, the latest ones when limited. Models supporting most of
+// them are picked first, then the catalog defaults.
+func (criteria deviceCriteria) resolve(catalog deviceCatalog, manifest *apkManifest) ([]device, error) {
+	minLevel, maxLevel, err := criteria.apiLevels(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	levels := map[string]int{}
+	for _, version := range catalog.Versions {
+		if version.APILevel >= minLevel && (maxLevel == 0 || version.APILevel <= maxLevel) {
+			levels[version.ID] = version.APILevel
+		}
+	}
+
+	models := make([]catalogModel, 0)
+	for _, model := range catalog.Models {
+		physical := model.Form == "PHYSICAL"
+		if (criteria.Form == "physical" && !physical) || (criteria.Form == "virtual" && physical) {
+			continue
+		}
+		if (model.FormFactor == "PHONE" && criteria.Phones > 0) || (model.FormFactor == "TABLET" && criteria.Tablets > 0) {
+			models = append(models, model)
+		}
+	}
+
+	versions := make([]string, 0)
+	for _, model := range models {
+		for _, id := range model.SupportedVersionIDs {
+			if _, ok := levels[id]; ok && !containsID(versions, id) {
+				versions = append(versions, id)
+			}
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return levels[versions[i]] > levels[versions[j]]
+	})
+	if criteria.Latest > 0 && len(versions) > criteria.Latest {
+		versions = versions[:criteria.Latest]
+	}
+
+	devices := make([]device, 0)
+	for _, pick := range []struct {
+		formFactor string
+		count      int
+	}{{"PHONE", criteria.Phones}, {"TABLET", criteria.Tablets}} {
+		picked := pickModels(models, pick.formFactor, versions)
+		if len(picked) > pick.count {
+			picked = picked[:pick.count]
+		}
+		if len(picked) < pick.count {
+			log.Warnf("%s matches %d of %d %s models", envKeyDeviceCriteria, len(picked), pick.count, strings.ToLower(pick.formFactor))
+		}
+
+		for _, model := range picked {
+			supported := make([]string, 0)
+			for _, id := range versions {
+				if containsID(model.SupportedVersionIDs, id) {
+					supported = append(supported, id)
+				}
+			}
+			sort.Slice(supported, func(i, j int) bool {
+				return levels[supported[i]] < levels[supported[j]]
+			})
+			for _, id := range supported {
+				devices = append(devices, device{Model: model.ID, Version: id, Locale: criteria.Locale, Orientation: criteria.Orientation})
+			}
+		}
+	}
+
+	if len(devices) == 0 {
+		return nil, errors.New(envKeyDeviceCriteria + " matches no device of the catalog")
+	}
+	return devices, nil
+}
+
+// pickModels returns the models of formFactor supporting any of versions, the ones supporting
+// most of them first, then the ones tagged default.
+func pickModels(models []catalogModel, formFactor string, versions []string) []catalogModel {
+	type candidate struct {
+		model     catalogModel
+		supported int
+		isDefault bool
+	}
+
+	candidates := make([]candidate, 0)
+	for _, model := range models {
+		if model.FormFactor != formFactor {
+			continue
+		}
+		supported := 0
+		for _, id := range versions {
+			if containsID(model.SupportedVersionIDs, id) {
+				supported++
+			}
+		}
+		if supported > 0 {
+			candidates = append(candidates, candidate{model, supported, containsID(model.Tags, "default")})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.supported != b.supported {
+			return a.supported > b.supported
+		}
+		if a.isDefault != b.isDefault {
+			return a.isDefault
+		}
+		return a.model.ID < b.model.ID
+	})
+
+	picked := make([]catalogModel, 0, len(candidates))
+	for _, c := range candidates {
+		picked = append(picked, c.model)
+	}
+	return picked
+}
+
+// resolveDeviceCriteria replaces the devices with the ones DEVICE_CRITERIA selects from the catalog.
+func resolveDeviceCriteria(config *firebaseConfig) error {
+	criteria := config.TestOptions.Criteria
+	if criteria == nil {
+		return nil
+	}
+	if config.Catalog == nil {
+		return errors.New(envKeyDeviceCriteria + " needs the device catalog")
+	}
+
+	catalog, err := config.Catalog.Catalog()
+	if err != nil {
+		return fmt.Errorf("%s needs the device catalog: %s", envKeyDeviceCriteria, err)
+	}
+	devices, err := criteria.resolve(catalog, config.AppManifest)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s resolved to %d devices:", envKeyDeviceCriteria, len(devices))
+	for _, d := range devices {
+		log.Printf("- %s", d)
+	}
+	config.TestOptions.Devices = devices
+	return nil
+}
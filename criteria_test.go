@@ -0,0 +1,146 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseDeviceCriteria(t *testing.T) {
+	assert := assert.New(t)
+
+	criteria, err := parseDeviceCriteria(nil)
+	assert.NoError(err)
+	assert.Nil(criteria)
+
+	criteria, err = parseDeviceCriteria([]string{"latest=3", "versions = minSdk..targetSdk", "form=physical", "tablets=1", "locale=de", "orientation=landscape"})
+	assert.NoError(err)
+	assert.Equal(&deviceCriteria{Latest: 3, MinVersion: "minSdk", MaxVersion: "targetSdk", Form: "physical", Tablets: 1, Locale: "de", Orientation: "landscape"}, criteria)
+
+	criteria, err = parseDeviceCriteria([]string{"versions=24.."})
+	assert.NoError(err)
+	assert.Equal(&deviceCriteria{MinVersion: "24", Phones: 1}, criteria)
+
+	cases := []struct {
+		line string
+		err  string
+	}{
+		{"latest", envKeyDeviceCriteria + " must be key=value lines: 'latest'"},
+		{"latest=0", envKeyDeviceCriteria + " 'latest=0': must be a positive number"},
+		{"phones=two", envKeyDeviceCriteria + " 'phones=two': must be a positive number"},
+		{"versions=28", envKeyDeviceCriteria + " 'versions=28': must be a range, e.g. 24..28 or minSdk..targetSdk"},
+		{"versions=21..maxSdk", envKeyDeviceCriteria + " 'versions=21..maxSdk': bounds must be API levels, minSdk or targetSdk"},
+		{"form=emulator", envKeyDeviceCriteria + " 'form=emulator': must be physical or virtual"},
+		{"orientation=upside-down", envKeyDeviceCriteria + " 'orientation=upside-down': must be portrait or landscape"},
+		{"size=large", envKeyDeviceCriteria + " 'size=large': unknown criterion"},
+	}
+	for _, c := range cases {
+		_, err = parseDeviceCriteria([]string{c.line})
+		assert.EqualError(err, c.err, c.line)
+	}
+}
+
+func TestDeviceCriteriaResolve(t *testing.T) {
+	assert := assert.New(t)
+
+	catalog := FixtureCatalog()
+	app := &apkManifest{Package: "com.example.app", MinSdk: 21, TargetSdk: 28}
+	cases := []struct {
+		criteria deviceCriteria
+		manifest *apkManifest
+		devices  []device
+	}{
+		//- the phone supporting most versions
+		{deviceCriteria{Phones: 1}, nil, []device{
+			{Model: "NexusLowRes", Version: "23"}, {Model: "NexusLowRes", Version: "24"},
+			{Model: "NexusLowRes", Version: "25"}, {Model: "NexusLowRes", Version: "26"},
+			{Model: "NexusLowRes", Version: "27"}, {Model: "NexusLowRes", Version: "28"},
+			{Model: "NexusLowRes", Version: "29"}, {Model: "NexusLowRes", Version: "30"},
+		}},
+		{deviceCriteria{Latest: 3, Form: "physical", Phones: 1, Tablets: 1}, nil, []device{
+			{Model: "Pixel3", Version: "28"}, {Model: "Pixel3", Version: "29"}, {Model: "Pixel3", Version: "30"},
+			{Model: "gts3lltevzw", Version: "28"},
+		}},
+		{deviceCriteria{MinVersion: "minSdk", MaxVersion: "targetSdk", Form: "virtual", Tablets: 1}, app, []device{
+			{Model: "Nexus9", Version: "21"}, {Model: "Nexus9", Version: "22"}, {Model: "Nexus9", Version: "23"},
+			{Model: "Nexus9", Version: "24"}, {Model: "Nexus9", Version: "25"},
+		}},
+		//- ties go to the catalog default
+		{deviceCriteria{Latest: 1, Form: "physical", Phones: 2, Locale: "de", Orientation: "landscape"}, nil, []device{
+			{Model: "Pixel3", Version: "30", Locale: "de", Orientation: "landscape"},
+			{Model: "Pixel2", Version: "30", Locale: "de", Orientation: "landscape"},
+		}},
+		//- never below the minSdk of the app
+		{deviceCriteria{Phones: 1, MaxVersion: "29"}, &apkManifest{MinSdk: 28, TargetSdk: 30}, []device{
+			{Model: "Pixel3", Version: "28"}, {Model: "Pixel3", Version: "29"},
+		}},
+	}
+	for i, c := range cases {
+		devices, err := c.criteria.resolve(catalog, c.manifest)
+		assert.NoError(err, i)
+		assert.Equal(c.devices, devices, i)
+	}
+
+	_, err := deviceCriteria{MinVersion: "minSdk", Phones: 1}.resolve(catalog, nil)
+	assert.EqualError(err, envKeyDeviceCriteria+" minSdk needs the manifest of "+envKeyAppApk)
+
+	_, err = deviceCriteria{MinVersion: "31", Phones: 1}.resolve(catalog, nil)
+	assert.EqualError(err, envKeyDeviceCriteria+" matches no device of the catalog")
+}
+
+func TestNewFirebaseConfigDeviceCriteria(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	setupOptionsEnv()
+	Setenv(envKeyDeviceCriteria, "latest=2\nform=physical")
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal(&deviceCriteria{Latest: 2, Form: "physical", Phones: 1}, config.TestOptions.Criteria)
+
+	Setenv(envKeyDevices, "model=Pixel2,version=28")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyDeviceCriteria+" can't be used together with "+envKeyDevices+" or "+envKeyMatrixFile)
+}
+
+func TestRunResolvesDeviceCriteria(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	config := newFakeGcloudConfig(assert)
+	config.TestOptions.Criteria = &deviceCriteria{Latest: 2, Form: "physical", Phones: 1}
+	runner := &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		if len(cmdSlice) > 4 && cmdSlice[4] == "run" {
+			return commandResult{Stdout: GcloudMatrixOutput(1)}, nil
+		}
+		return commandResult{}, nil
+	}}
+	config.Runner = runner
+	config.Catalog = &cachedCatalog{Source: &fixtureCatalog{}}
+
+	outcome, err := run(config, localStorage{Root: root}, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal("passed", outcome.Name)
+	assert.Equal([]device{{Model: "Pixel3", Version: "29"}, {Model: "Pixel3", Version: "30"}}, config.TestOptions.Devices)
+
+	runCommand := ""
+	for _, command := range runner.Commands() {
+		if strings.HasPrefix(command, "gcloud firebase test android run") {
+			runCommand = command
+		}
+	}
+	assert.Contains(runCommand, "--device model=Pixel3,version=29 --device model=Pixel3,version=30")
+
+	config.Catalog = nil
+	_, err = run(config, localStorage{Root: root}, ioutil.Discard)
+	assert.EqualError(err, envKeyDeviceCriteria+" needs the device catalog")
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Annotation marking JUnit4 test methods
+const junitTestAnnotation = "Lorg/junit/Test;"
+
+const dexAccAbstract = 0x400
+
+var dexFilePattern = regexp.MustCompile(`^classes[0-9]*\.dex$`)
+
+// findTestClasses returns the sorted names of every non abstract class in the apk's
+// dex files with at least one method annotated with @org.junit.Test.
+func findTestClasses(apkPath string) ([]string, error) {
+	reader, err := zip.OpenReader(apkPath)
+	if err != nil {
+		return nil, errors.New("failed to open apk '" + apkPath + "': " + err.Error())
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	classes := make([]string, 0)
+	for _, file := range reader.File {
+		if !dexFilePattern.MatchString(file.Name) {
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		found, err := dexTestClasses(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file.Name, err)
+		}
+		classes = append(classes, found...)
+	}
+
+	sort.Strings(classes)
+	return classes, nil
+}
+
+// dexReader reads the dex format: https://source.android.com/devices/tech/dalvik/dex-format
+type dexReader struct {
+	data []byte
+}
+
+func (r dexReader) uint32(offset uint32) (uint32, error) {
+	if uint64(offset)+4 > uint64(len(r.data)) {
+		return 0, fmt.Errorf("offset 0x%x out of bounds", offset)
+	}
+	return binary.LittleEndian.Uint32(r.data[offset:]), nil
+}
+
+func (r dexReader) uleb128(offset uint32) (uint32, uint32, error) {
+	result := uint32(0)
+	for shift := uint(0); shift < 35; shift += 7 {
+		if uint64(offset) >= uint64(len(r.data)) {
+			return 0, 0, fmt.Errorf("offset 0x%x out of bounds", offset)
+		}
+		b := r.data[offset]
+		offset++
+		result |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return result, offset, nil
+		}
+	}
+	return 0, 0, errors.New("invalid uleb128")
+}
+
+// typeDescriptor resolves a type_ids index to its descriptor, e.g. Lorg/junit/Test;
+func (r dexReader) typeDescriptor(typeIdx uint32) (string, error) {
+	typeIDsSize, err := r.uint32(0x40)
+	if err != nil {
+		return "", err
+	}
+	if typeIdx >= typeIDsSize {
+		return "", fmt.Errorf("type index %d out of bounds", typeIdx)
+	}
+	typeIDsOff, err := r.uint32(0x44)
+	if err != nil {
+		return "", err
+	}
+	stringIdx, err := r.uint32(typeIDsOff + 4*typeIdx)
+	if err != nil {
+		return "", err
+	}
+
+	stringIDsOff, err := r.uint32(0x3C)
+	if err != nil {
+		return "", err
+	}
+	stringDataOff, err := r.uint32(stringIDsOff + 4*stringIdx)
+	if err != nil {
+		return "", err
+	}
+
+	// string_data_item: uleb128 utf16 size followed by a zero terminated MUTF-8 string.
+	_, start, err := r.uleb128(stringDataOff)
+	if err != nil {
+		return "", err
+	}
+	end := start
+	for end < uint32(len(r.data)) && r.data[end] != 0 {
+		end++
+	}
+	return string(r.data[start:end]), nil
+}
+
+// hasMethodAnnotation reports whether a method in the annotations_directory_item at
+// offset is annotated with descriptor.
+func (r dexReader) hasMethodAnnotation(directoryOff uint32, descriptor string) (bool, error) {
+	fieldsSize, err := r.uint32(directoryOff + 4)
+	if err != nil {
+		return false, err
+	}
+	methodsSize, err := r.uint32(directoryOff + 8)
+	if err != nil {
+		return false, err
+	}
+
+	methodsOff := directoryOff + 16 + 8*fieldsSize
+	for i := uint32(0); i < methodsSize; i++ {
+		setOff, err := r.uint32(methodsOff + 8*i + 4)
+		if err != nil {
+			return false, err
+		}
+		setSize, err := r.uint32(setOff)
+		if err != nil {
+			return false, err
+		}
+
+		for j := uint32(0); j < setSize; j++ {
+			annotationOff, err := r.uint32(setOff + 4 + 4*j)
+			if err != nil {
+				return false, err
+			}
+			// annotation_item: ubyte visibility, encoded_annotation starting with uleb128 type_idx
+			typeIdx, _, err := r.uleb128(annotationOff + 1)
+			if err != nil {
+				return false, err
+			}
+			annotation, err := r.typeDescriptor(typeIdx)
+			if err != nil {
+				return false, err
+			}
+			if annotation == descriptor {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func dexTestClasses(data []byte) ([]string, error) {
+	if len(data) < 0x70 || string(data[:4]) != "dex\n" {
+		return nil, errors.New("not a dex file")
+	}
+	r := dexReader{data: data}
+
+	classDefsSize, err := r.uint32(0x60)
+	if err != nil {
+		return nil, err
+	}
+	classDefsOff, err := r.uint32(0x64)
+	if err != nil {
+		return nil, err
+	}
+
+	classes := make([]string, 0)
+	for i := uint32(0); i < classDefsSize; i++ {
+		classDefOff := classDefsOff + 32*i
+
+		accessFlags, err := r.uint32(classDefOff + 4)
+		if err != nil {
+			return nil, err
+		}
+		annotationsOff, err := r.uint32(classDefOff + 20)
+		if err != nil {
+			return nil, err
+		}
+		if annotationsOff == 0 || accessFlags&dexAccAbstract != 0 {
+			continue
+		}
+
+		isTest, err := r.hasMethodAnnotation(annotationsOff, junitTestAnnotation)
+		if err != nil {
+			return nil, err
+		}
+		if !isTest {
+			continue
+		}
+
+		classIdx, err := r.uint32(classDefOff)
+		if err != nil {
+			return nil, err
+		}
+		descriptor, err := r.typeDescriptor(classIdx)
+		if err != nil {
+			return nil, err
+		}
+		classes = append(classes, descriptorToClassName(descriptor))
+	}
+
+	return classes, nil
+}
+
+// descriptorToClassName converts Lcom/example/Outer$Inner; to com.example.Outer$Inner
+func descriptorToClassName(descriptor string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(descriptor, "L"), ";")
+	return strings.Replace(name, "/", ".", -1)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type dexClass struct {
+	Descriptor        string
+	AccessFlags       uint32
+	FieldAnnotations  []string
+	MethodAnnotations []string
+}
+
+// BuildDex writes a minimal dex file with just enough of the string, type, class_def
+// and annotation sections for findTestClasses. Type i is string i.
+func BuildDex(classes []dexClass) []byte {
+	strs := make([]string, 0)
+	index := make(map[string]uint32)
+	add := func(s string) {
+		if _, ok := index[s]; !ok {
+			index[s] = uint32(len(strs))
+			strs = append(strs, s)
+		}
+	}
+	for _, class := range classes {
+		add(class.Descriptor)
+		for _, annotation := range append(class.FieldAnnotations, class.MethodAnnotations...) {
+			add(annotation)
+		}
+	}
+
+	count := uint32(len(strs))
+	stringIDsOff := uint32(0x70)
+	typeIDsOff := stringIDsOff + 4*count
+	classDefsOff := typeIDsOff + 4*count
+
+	buf := make([]byte, classDefsOff+32*uint32(len(classes)))
+	copy(buf, "dex\n035\x00")
+	put := func(offset uint32, value uint32) {
+		binary.LittleEndian.PutUint32(buf[offset:], value)
+	}
+	appendUint32 := func(value uint32) {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, value)
+		buf = append(buf, b...)
+	}
+	align := func() {
+		for len(buf)%4 != 0 {
+			buf = append(buf, 0)
+		}
+	}
+
+	put(0x38, count)
+	put(0x3C, stringIDsOff)
+	put(0x40, count)
+	put(0x44, typeIDsOff)
+	put(0x60, uint32(len(classes)))
+	put(0x64, classDefsOff)
+
+	for i, s := range strs {
+		put(stringIDsOff+4*uint32(i), uint32(len(buf)))
+		buf = append(buf, byte(len(s)))
+		buf = append(buf, s...)
+		buf = append(buf, 0)
+		put(typeIDsOff+4*uint32(i), uint32(i))
+	}
+
+	annotationSet := func(annotations []string) uint32 {
+		items := make([]uint32, 0, len(annotations))
+		for _, annotation := range annotations {
+			items = append(items, uint32(len(buf)))
+			// visibility runtime, type_idx, no elements
+			buf = append(buf, 1, byte(index[annotation]), 0)
+		}
+		align()
+		setOff := uint32(len(buf))
+		appendUint32(uint32(len(items)))
+		for _, item := range items {
+			appendUint32(item)
+		}
+		return setOff
+	}
+
+	for i, class := range classes {
+		classDefOff := classDefsOff + 32*uint32(i)
+		put(classDefOff, index[class.Descriptor])
+		put(classDefOff+4, class.AccessFlags)
+		if len(class.FieldAnnotations) == 0 && len(class.MethodAnnotations) == 0 {
+			continue
+		}
+
+		fieldSet := annotationSet(class.FieldAnnotations)
+		methodSet := annotationSet(class.MethodAnnotations)
+
+		align()
+		directoryOff := uint32(len(buf))
+		appendUint32(0) // class annotations
+		appendUint32(1) // annotated fields
+		appendUint32(1) // annotated methods
+		appendUint32(0) // annotated parameters
+		appendUint32(0)
+		appendUint32(fieldSet)
+		appendUint32(0)
+		appendUint32(methodSet)
+
+		put(classDefOff+20, directoryOff)
+	}
+
+	return buf
+}
+
+// WriteZipFiles creates a zip at zipPath with the given file contents.
+func WriteZipFiles(zipPath string, files map[string][]byte) {
+	file, err := os.Create(zipPath)
+	PanicOnErr(err)
+
+	writer := zip.NewWriter(file)
+	for name, content := range files {
+		w, err := writer.Create(name)
+		PanicOnErr(err)
+		_, err = w.Write(content)
+		PanicOnErr(err)
+	}
+	PanicOnErr(writer.Close())
+	PanicOnErr(file.Close())
+}
+
+// WriteTestApk creates a test apk with CalculatorTest, LoginTest (split into classes2.dex)
+// and non test classes.
+func WriteTestApk(apkPath string) {
+	WriteZipFiles(apkPath, map[string][]byte{
+		"AndroidManifest.xml": nil,
+		"classes.dex": BuildDex([]dexClass{
+			{Descriptor: "Lcom/example/CalculatorTest;", FieldAnnotations: []string{"Lorg/junit/Rule;"}, MethodAnnotations: []string{"Lorg/junit/Test;"}},
+			{Descriptor: "Lcom/example/Helper;"},
+			{Descriptor: "Lcom/example/BaseTest;", AccessFlags: dexAccAbstract, MethodAnnotations: []string{"Lorg/junit/Test;"}},
+			{Descriptor: "Lcom/example/SetupOnly;", MethodAnnotations: []string{"Lorg/junit/Before;"}},
+		}),
+		"classes2.dex": BuildDex([]dexClass{
+			{Descriptor: "Lcom/example/login/LoginTest$Nested;", MethodAnnotations: []string{"Lorg/junit/Before;", "Lorg/junit/Test;"}},
+		}),
+		"assets/classes.dex.txt": []byte("not a dex"),
+	})
+}
+
+func TestFindTestClasses(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "dex")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	apkPath := filepath.Join(tmpDir, "test.apk")
+	WriteTestApk(apkPath)
+
+	classes, err := findTestClasses(apkPath)
+	assert.NoError(err)
+	assert.Equal([]string{"com.example.CalculatorTest", "com.example.login.LoginTest$Nested"}, classes)
+
+	brokenApk := filepath.Join(tmpDir, "broken.apk")
+	WriteZipFiles(brokenApk, map[string][]byte{"classes.dex": []byte("dex\n035")})
+	_, err = findTestClasses(brokenApk)
+	assert.EqualError(err, "classes.dex: not a dex file")
+
+	_, err = findTestClasses(filepath.Join(tmpDir, "missing.apk"))
+	assert.Error(err)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Upper bound for RERUN_FAILED_TESTS, every attempt is a separate test matrix.
+const maxRerunAttempts = 10
+
+// rerunConfig re-submits only the failed tests of a run to tell flaky tests from failing ones.
+type rerunConfig struct {
+	Attempts    int
+	FailOnFlaky bool
+}
+
+func newRerunConfig(platform string, testApk string) (rerunConfig, error) {
+	config := rerunConfig{}
+
+	attemptsValue := getOptionalEnv(envKeyRerunFailedTests)
+	if !isEmpty(attemptsValue) {
+		attempts, err := strconv.Atoi(attemptsValue)
+		if err != nil || attempts < 0 || attempts > maxRerunAttempts {
+			return config, fmt.Errorf("%s must be a number between 0 and %d", envKeyRerunFailedTests, maxRerunAttempts)
+		}
+		config.Attempts = attempts
+	}
+
+	if config.Attempts > 0 && (platform != platformAndroid || isEmpty(testApk)) {
+		return config, errors.New(envKeyRerunFailedTests + " requires an Android instrumentation test, set " + envKeyTestApk)
+	}
+
+	var err error
+	config.FailOnFlaky, err = getOptionalBoolEnv(envKeyFailOnFlaky, false)
+	return config, err
+}
+
+// testCaseKey identifies a test on a device across attempts. Shard and rerun dirs are
+// dropped from the suite name so NexusLowRes-25-en-portrait matches rerun_1/NexusLowRes-25-en-portrait.
+func testCaseKey(suite junitTestSuite, testCase junitTestCase) string {
+	return path.Base(suite.Name) + "\x00" + testCase.ClassName + "\x00" + testCase.Name
+}
+
+// testTarget is the --test-targets entry of a single test method.
+// Parameterized runs like testAdd[0] can only be targeted as a whole.
+func testTarget(testCase junitTestCase) string {
+	name := testCase.Name
+	if i := strings.Index(name, "["); i > 0 {
+		name = name[:i]
+	}
+	return "class " + testCase.ClassName + "#" + name
+}
+
+// failedTestTargets returns the sorted, unique --test-targets of every failed test in report.
+func failedTestTargets(report junitTestSuites) []string {
+	set := make(map[string]bool)
+	for _, suite := range report.Suites {
+		for _, testCase := range suite.TestCases {
+			if testCase.failed() {
+				set[testTarget(testCase)] = true
+			}
+		}
+	}
+
+	targets := make([]string, 0, len(set))
+	for target := range set {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// flakyTests returns "dimension: class#name" for every flaky test in report.
+func flakyTests(report junitTestSuites) []string {
+	tests := make([]string, 0)
+	for _, suite := range report.Suites {
+		for _, testCase := range suite.TestCases {
+			if testCase.flaky() {
+				tests = append(tests, suite.Name+": "+testCase.ClassName+"#"+testCase.Name)
+			}
+		}
+	}
+	return tests
+}
+
+// rerunFailedTests re-submits the failed tests of report with --test-targets, at most
+// config.Rerun.Attempts times. Attempt n writes below <results dir>/rerun_<n>.
+// Tests passing on a re-run are moved from failed to flaky in the returned report. The attempts
+// of every re-run are returned too, each re-run starting with attempt 1.
+func rerunFailedTests(config *firebaseConfig, storage resultsStorage, gcsCommand []string, report junitTestSuites, output io.Writer) (junitTestSuites, []retryAttempt, error) {
+	bucket := gcloudFlagValue(gcsCommand, "--results-bucket")
+	resultsDir := gcloudFlagValue(gcsCommand, "--results-dir")
+
+	// Failures seen on re-runs, reported as flaky failures if the test passes later.
+	rerunFailures := make(map[string][]junitMessage)
+	rerunErrors := make(map[string][]junitMessage)
+	attempts := make([]retryAttempt, 0)
+
+	for attempt := 1; attempt <= config.Rerun.Attempts; attempt++ {
+		targets := failedTestTargets(report)
+		if len(targets) == 0 {
+			break
+		}
+
+		rerunDir := path.Join(resultsDir, fmt.Sprintf("rerun_%d", attempt))
+		rerunCommand := withGcloudFlag(withGcloudFlag(gcsCommand, "--results-dir", rerunDir), "--test-targets", gcloudList(targets))
+
+		_, _ = fmt.Fprintf(output, "Re-running %d failed tests, attempt %d/%d\n", len(targets), attempt, config.Rerun.Attempts)
+		rerunResult, err := runTestMatrix(config, rerunCommand, output)
+		attempts = append(attempts, rerunResult.Attempts...)
+		if err != nil {
+			return report, attempts, err
+		}
+
+		rerunReport, err := fetchJUnitReport(storage, bucket, rerunResult)
+		if err != nil {
+			return report, attempts, err
+		}
+
+		passed := make(map[string]bool)
+		for _, suite := range rerunReport.Suites {
+			for _, testCase := range suite.TestCases {
+				key := testCaseKey(suite, testCase)
+				if testCase.failed() {
+					rerunFailures[key] = append(rerunFailures[key], testCase.Failures...)
+					rerunErrors[key] = append(rerunErrors[key], testCase.Errors...)
+				} else if testCase.Skipped == nil {
+					passed[key] = true
+				}
+			}
+		}
+
+		for i := range report.Suites {
+			suite := &report.Suites[i]
+			for j := range suite.TestCases {
+				testCase := &suite.TestCases[j]
+				key := testCaseKey(*suite, *testCase)
+				if !testCase.failed() || !passed[key] {
+					continue
+				}
+
+				// fresh slices, appending to the failures could write into an array shared with them
+				testCase.FlakyFailures = append(append([]junitMessage{}, testCase.Failures...), rerunFailures[key]...)
+				testCase.FlakyErrors = append(append([]junitMessage{}, testCase.Errors...), rerunErrors[key]...)
+				testCase.Failures = nil
+				testCase.Errors = nil
+			}
+		}
+		report.countTestCases()
+	}
+
+	return report, attempts, nil
+}
+
+// rerunOutcome is the step outcome once every failed test was re-run. The run is flaky only
+// when a failed test passed on a re-run, a failed matrix without failed tests, e.g. of a
+// crashed device, keeps its outcome.
+func rerunOutcome(report junitTestSuites, outcome testOutcome, failOnFlaky bool) testOutcome {
+	if report.Failures > 0 || report.Errors > 0 || len(flakyTests(report)) == 0 {
+		return outcome
+	}
+	flaky := newFlakyOutcome(failOnFlaky)
+	flaky.ResultsDir = outcome.ResultsDir
+	flaky.ShardResultsDirs = outcome.ShardResultsDirs
+	flaky.Attempts = outcome.Attempts
+	return flaky
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// JUnitResult renders a test_result_*.xml of com.example.T where every listed test passes
+// unless its name is in failed.
+func JUnitResult(tests []string, failed ...string) string {
+	failedSet := make(map[string]bool)
+	for _, name := range failed {
+		failedSet[name] = true
+	}
+
+	testCases := ""
+	for _, name := range tests {
+		if failedSet[name] {
+			testCases += fmt.Sprintf(`<testcase name="%s" classname="com.example.T" time="1.0"><failure>%s failed</failure></testcase>`, name, name)
+		} else {
+			testCases += fmt.Sprintf(`<testcase name="%s" classname="com.example.T" time="1.0" />`, name)
+		}
+	}
+	return `<?xml version='1.0' encoding='UTF-8' ?><testsuite name="" tests="0" failures="0">` + testCases + `</testsuite>`
+}
+
+// FakeGcloudResults installs a gcloud which, for each `firebase test` call, writes the
+// JUnit result registered for the last element of --results-dir into root and exits
+// with its exit code. The initial run is registered as "".
+func FakeGcloudResults(root string, results map[string]string, exitCodes map[string]int) string {
+	logPath := FakeGcloud()
+
+	// The initial run matches every dir, so its case goes last.
+	dirs := make([]string, 0, len(results))
+	for dir := range results {
+		dirs = append(dirs, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	cases := ""
+	for _, dir := range dirs {
+		fixture := filepath.Join(fakeBinDir, "result"+dir+".xml")
+		PanicOnErr(ioutil.WriteFile(fixture, []byte(results[dir]), 0644))
+
+		pattern := "*/" + dir
+		if isEmpty(dir) {
+			pattern = "*"
+		}
+		cases += fmt.Sprintf(`  %s) cp %q "$out/test_result_1.xml"; exit %d ;;
+`, pattern, fixture, exitCodes[dir])
+	}
+
+	FakeBinary("gcloud", fmt.Sprintf(`echo "$@" >> %q
+case "$1 $2" in
+  "firebase test") ;;
+  *) exit 0 ;;
+esac
+for arg in "$@"; do
+  case "$arg" in
+    --results-bucket=*) bucket="${arg#--results-bucket=}" ;;
+    --results-dir=*) dir="${arg#--results-dir=}" ;;
+  esac
+done
+out=%q/$bucket/$dir/NexusLowRes-25-en-portrait
+mkdir -p "$out"
+case "$dir" in
+%sesac`, logPath, root, cases))
+
+	return logPath
+}
+
+func TestRerunFailedTests(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	tests := []string{"testAdd", "testFlaky", "testBroken", "testFlaky2"}
+	logPath := FakeGcloudResults(root, map[string]string{
+		"":        JUnitResult(tests, "testFlaky", "testBroken", "testFlaky2"),
+		"rerun_1": JUnitResult([]string{"testFlaky", "testBroken", "testFlaky2"}, "testBroken", "testFlaky2"),
+		"rerun_2": JUnitResult([]string{"testBroken", "testFlaky2"}, "testBroken"),
+	}, map[string]int{"": 10, "rerun_1": 10, "rerun_2": 10})
+
+	config := newFakeGcloudConfig(assert)
+	config.Rerun = rerunConfig{Attempts: 3}
+
+	gcsCommand, err := buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+
+	outcome, err := runTestMatrix(config, gcsCommand, ioutil.Discard)
+	assert.NoError(err)
+
+	outcome, _, _, err = collectResults(config, localStorage{Root: root}, "golang-bucket", gcsCommand, outcome, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal("failed", outcome.Name)
+
+	calls := GcloudCalls(logPath)
+	assert.Equal(4, len(calls))
+	assert.True(strings.HasSuffix(calls[1], "--results-dir=results_dir/rerun_1 --test-targets=class com.example.T#testBroken,class com.example.T#testFlaky,class com.example.T#testFlaky2"))
+	assert.True(strings.HasSuffix(calls[2], "--results-dir=results_dir/rerun_2 --test-targets=class com.example.T#testBroken,class com.example.T#testFlaky2"))
+	assert.True(strings.HasSuffix(calls[3], "--results-dir=results_dir/rerun_3 --test-targets=class com.example.T#testBroken"))
+
+	// every re-run matrix is reported after the matrix it re-ran
+	resultsDirs := make([]string, 0)
+	for _, attempt := range outcome.finalAttempts() {
+		resultsDirs = append(resultsDirs, attempt.ResultsDir)
+	}
+	assert.Equal([]string{"results_dir", "results_dir/rerun_1", "results_dir/rerun_2", "results_dir/rerun_3"}, resultsDirs)
+}
+
+func TestRerunFailedTestsFlakyOutcome(t *testing.T) {
+	assert := assert.New(t)
+
+	deployDir, err := ioutil.TempDir("", "deploy")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(deployDir)
+	}()
+
+	tests := []string{"testAdd", "testFlaky"}
+	for _, failOnFlaky := range []bool{false, true} {
+		root, err := ioutil.TempDir("", "gcs")
+		assert.NoError(err)
+		defer func() {
+			_ = os.RemoveAll(root)
+		}()
+
+		FakeGcloudResults(root, map[string]string{
+			"":        JUnitResult(tests, "testFlaky"),
+			"rerun_1": JUnitResult([]string{"testFlaky"}),
+		}, map[string]int{"": 10})
+
+		config := newFakeGcloudConfig(assert)
+		Setenv(envKeyDeployDir, deployDir)
+		config.Rerun = rerunConfig{Attempts: 2, FailOnFlaky: failOnFlaky}
+
+		gcsCommand, err := buildGcloudCommand(config, "results_dir")
+		assert.NoError(err)
+
+		outcome, err := runTestMatrix(config, gcsCommand, ioutil.Discard)
+		assert.NoError(err)
+		assert.Equal("failed", outcome.Name)
+
+		outcome, _, _, err = collectResults(config, localStorage{Root: root}, "golang-bucket", gcsCommand, outcome, ioutil.Discard)
+		assert.NoError(err)
+		assert.Equal("flaky", outcome.Name)
+		assert.Equal(!failOnFlaky, outcome.Passed)
+
+		data, err := ioutil.ReadFile(filepath.Join(deployDir, junitReportFileName))
+		assert.NoError(err)
+		suites, err := parseJUnit(data)
+		assert.NoError(err)
+
+		report := junitTestSuites{Suites: suites}
+		report.countTestCases()
+		assert.Equal(2, report.Tests)
+		assert.Equal(0, report.Failures)
+		assert.Equal([]string{"NexusLowRes-25-en-portrait: com.example.T#testFlaky"}, flakyTests(report))
+		assert.Contains(string(data), "<flakyFailure>testFlaky failed</flakyFailure>")
+	}
+}
+
+func TestRerunFailedTestsWithoutFailedTests(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	// the matrix failed, e.g. a device crashed, but no test case did
+	FakeGcloudResults(root, map[string]string{
+		"": JUnitResult([]string{"testAdd", "testSubtract"}),
+	}, map[string]int{"": 10})
+
+	config := newFakeGcloudConfig(assert)
+	config.Rerun = rerunConfig{Attempts: 2}
+
+	gcsCommand, err := buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+
+	outcome, err := runTestMatrix(config, gcsCommand, ioutil.Discard)
+	assert.NoError(err)
+
+	outcome, report, _, err := collectResults(config, localStorage{Root: root}, "golang-bucket", gcsCommand, outcome, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal("failed", outcome.Name)
+	assert.Equal(exitCodeTestFailure, outcome.ExitCode)
+	assert.False(outcome.Passed)
+	assert.Empty(flakyTests(report))
+
+	// nothing to re-run
+	_, err = os.Stat(filepath.Join(root, "golang-bucket", "results_dir", "rerun_1"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestNewRerunConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	// main_test reads the key set up in init
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+	setupOptionsEnv()
+
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal(rerunConfig{}, config.Rerun)
+
+	Setenv(envKeyRerunFailedTests, "2")
+	Setenv(envKeyFailOnFlaky, "true")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal(rerunConfig{Attempts: 2, FailOnFlaky: true}, config.Rerun)
+
+	Setenv(envKeyRerunFailedTests, "11")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyRerunFailedTests+" must be a number between 0 and 10")
+
+	Setenv(envKeyRerunFailedTests, "1")
+	Setenv(envKeyTestApk, "")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyRerunFailedTests+" requires an Android instrumentation test, set "+envKeyTestApk)
+}
+
+func TestTestTarget(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("class com.example.T#testAdd", testTarget(junitTestCase{ClassName: "com.example.T", Name: "testAdd"}))
+	assert.Equal("class com.example.T#testAdd", testTarget(junitTestCase{ClassName: "com.example.T", Name: "testAdd[1: 2+2=4]"}))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Values of TEST_TYPE, iOS runs xctest or the game loop of APP_IPA.
+const (
+	testTypeInstrumentation = "instrumentation"
+	testTypeRobo            = "robo"
+	testTypeGameLoop        = "game-loop"
+	testTypeXCTest          = "xctest"
+)
+
+// gameLoopAction is the intent action Test Lab starts Android game loops with.
+const gameLoopAction = "com.google.intent.action.TEST_LOOP"
+
+// gameLoopsMetaData declares the number of loops, labels are declared as
+// com.google.test.loops.<label> with the loops they group.
+const gameLoopsMetaData = "com.google.test.loops"
+
+// Test Lab installs a main and a patch expansion file at most.
+const maxObbFiles = 2
+
+// gameLoopResultsDirName is the dir of the collected results files in the deploy dir.
+const gameLoopResultsDirName = "firebase-test-lab-game-loop"
+
+// Matches the names Test Lab installs OBB files with: main.<versionCode>.<package>.obb
+var obbFilePattern = regexp.MustCompile(`^(main|patch)\.[0-9]+\.[A-Za-z0-9_.]+\.obb$`)
+
+// Matches the results file a scenario writes, e.g. results_scenario_1.json.
+var gameLoopResultsPattern = regexp.MustCompile(`^results_scenario_[0-9]+\.json$`)
+
+// gameLoopInputs configure game loop tests, they're rejected for the other test types.
+var gameLoopInputs = []string{envKeyGameLoopScenarios, envKeyGameLoopLabels, envKeyObbFiles}
+
+// gameLoopConfig selects the scenarios of a game loop run, all of them when empty.
+type gameLoopConfig struct {
+	Scenarios []int
+	Labels    []string
+	ObbFiles  []string
+}
+
+// newTestType reads TEST_TYPE, Android runs are instrumentation tests with TEST_APK and
+// Robo tests without it by default.
+func newTestType(platform string, testApk string, ios iosConfig) (string, error) {
+	testType := getOptionalEnv(envKeyTestType)
+
+	if platform == platformIOS {
+		if !isEmpty(testType) {
+			return testType, errors.New(envKeyTestType + " is only supported on Android, iOS runs " + envKeyXCTestZip + " or the game loop of " + envKeyAppIpa)
+		}
+		if !isEmpty(ios.AppIpa) {
+			return testTypeGameLoop, nil
+		}
+		return testTypeXCTest, nil
+	}
+
+	switch testType {
+	case "":
+		if isEmpty(testApk) {
+			return testTypeRobo, nil
+		}
+		return testTypeInstrumentation, nil
+	case testTypeInstrumentation:
+		if isEmpty(testApk) {
+			return testType, errors.New(envKeyTestType + " " + testType + " needs " + envKeyTestApk)
+		}
+		return testType, nil
+	case testTypeRobo, testTypeGameLoop:
+		if !isEmpty(testApk) {
+			return testType, errors.New(envKeyTestApk + " can't be used with " + envKeyTestType + " " + testType)
+		}
+		return testType, nil
+	default:
+		return testType, errors.New(envKeyTestType + " must be '" + testTypeInstrumentation + "', '" + testTypeRobo + "' or '" + testTypeGameLoop + "'")
+	}
+}
+
+// newCollectTestType reads the TEST_TYPE of the matrix MODE collect waits for, without the
+// apps it was submitted with.
+func newCollectTestType() (string, error) {
+	switch testType := getOptionalEnv(envKeyTestType); testType {
+	case "", testTypeInstrumentation, testTypeRobo, testTypeGameLoop:
+		return testType, nil
+	default:
+		return testType, errors.New(envKeyTestType + " must be '" + testTypeInstrumentation + "', '" + testTypeRobo + "' or '" + testTypeGameLoop + "'")
+	}
+}
+
+func newGameLoopConfig(platform string, testType string) (gameLoopConfig, error) {
+	gameLoop := gameLoopConfig{}
+
+	for _, key := range gameLoopInputs {
+		if isEmpty(getOptionalEnv(key)) {
+			continue
+		}
+		if testType != testTypeGameLoop {
+			return gameLoop, errors.New(key + " configures game loop tests, not " + testType + " tests")
+		}
+		if platform != platformAndroid && key != envKeyGameLoopScenarios {
+			return gameLoop, errors.New(key + " is only supported on Android")
+		}
+	}
+
+	for _, value := range splitList(getOptionalEnv(envKeyGameLoopScenarios)) {
+		scenario, err := strconv.Atoi(value)
+		if err != nil || scenario < 1 {
+			return gameLoop, errors.New(envKeyGameLoopScenarios + " must be scenario numbers from 1: '" + value + "'")
+		}
+		gameLoop.Scenarios = append(gameLoop.Scenarios, scenario)
+	}
+
+	gameLoop.Labels = splitList(getOptionalEnv(envKeyGameLoopLabels))
+
+	gameLoop.ObbFiles = splitLines(getOptionalEnv(envKeyObbFiles))
+	if len(gameLoop.ObbFiles) > maxObbFiles {
+		return gameLoop, fmt.Errorf("%s takes %d files at most, a main and a patch expansion file", envKeyObbFiles, maxObbFiles)
+	}
+	for _, obbFile := range gameLoop.ObbFiles {
+		err := fileExists(obbFile)
+		if err != nil {
+			return gameLoop, err
+		}
+		if !obbFilePattern.MatchString(filepath.Base(obbFile)) {
+			return gameLoop, errors.New(envKeyObbFiles + " must be named like main.<versionCode>.<package>.obb: '" + obbFile + "'")
+		}
+	}
+
+	return gameLoop, nil
+}
+
+// splitList returns the trimmed, non empty values of value, separated by commas or newlines.
+func splitList(value string) []string {
+	return splitLines(strings.Replace(value, ",", "\n", -1))
+}
+
+// checkGameLoop checks the selected scenarios against the manifest of the app, skipped when
+// it couldn't be read.
+func checkGameLoop(manifest *apkManifest, gameLoop gameLoopConfig) error {
+	if manifest == nil {
+		return nil
+	}
+
+	if !manifest.GameLoop {
+		return errors.New(envKeyAppApk + " " + manifest.Package + " has no game loop intent filter, an activity must handle " + gameLoopAction)
+	}
+	for _, scenario := range gameLoop.Scenarios {
+		if manifest.GameLoops > 0 && scenario > manifest.GameLoops {
+			return fmt.Errorf("%s: scenario %d is above the %d loops of %s", envKeyGameLoopScenarios, scenario, manifest.GameLoops, manifest.Package)
+		}
+	}
+	for _, label := range gameLoop.Labels {
+		if !containsID(manifest.GameLoopLabels, label) {
+			return errors.New(envKeyGameLoopLabels + ": " + manifest.Package + " declares no scenario label '" + label + "'")
+		}
+	}
+
+	return nil
+}
+
+// gcloudFlags renders the game loop inputs, skipping every flag already set in userOptionsSet.
+func (gameLoop gameLoopConfig) gcloudFlags(userOptionsSet map[string]bool) []string {
+	args := make([]string, 0)
+
+	if len(gameLoop.Scenarios) > 0 && !hasGcloudFlag(userOptionsSet, "--scenario-numbers") {
+		scenarios := make([]string, 0, len(gameLoop.Scenarios))
+		for _, scenario := range gameLoop.Scenarios {
+			scenarios = append(scenarios, strconv.Itoa(scenario))
+		}
+		args = append(args, "--scenario-numbers", gcloudList(scenarios))
+	}
+
+	if len(gameLoop.Labels) > 0 && !hasGcloudFlag(userOptionsSet, "--scenario-labels") {
+		args = append(args, "--scenario-labels", gcloudList(gameLoop.Labels))
+	}
+
+	if len(gameLoop.ObbFiles) > 0 && !hasGcloudFlag(userOptionsSet, "--obb-files") {
+		args = append(args, "--obb-files", gcloudList(gameLoop.ObbFiles))
+	}
+
+	return args
+}
+
+// collectGameLoopResults downloads the results files of every scenario into the deploy dir
+// and exports their dir. Failing to fetch them doesn't fail the step.
+func collectGameLoopResults(config *firebaseConfig, storage resultsStorage, bucket string, resultsDir string) error {
+	deployDir := getOptionalEnv(envKeyDeployDir)
+	if isEmpty(deployDir) {
+		log.Warnf("%s is not defined, skipping the game loop results", envKeyDeployDir)
+		return nil
+	}
+
+	outputDir := filepath.Join(deployDir, gameLoopResultsDirName)
+	files, err := fetchGameLoopResults(storage, bucket, resultsDir, outputDir)
+	if err != nil {
+		log.Warnf("Failed to collect the game loop results: %s", err)
+		return nil
+	}
+	if files == 0 {
+		log.Warnf("No results_scenario_*.json found in gs://%s/%s", bucket, resultsDir)
+		return nil
+	}
+
+	log.Donef("Game loop results: %d files in %s", files, outputDir)
+	return exportOutputs(config.Runner, []stepOutput{{outputGameLoopResultsDir, outputDir}})
+}
+
+// fetchGameLoopResults downloads every results_scenario_*.json below resultsDir into
+// outputDir, keeping the dirs of the devices. Returns the number of files.
+func fetchGameLoopResults(storage resultsStorage, bucket string, resultsDir string, outputDir string) (int, error) {
+	prefix := strings.TrimSuffix(resultsDir, "/") + "/"
+	objects, err := storage.List(bucket, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	files := 0
+	for _, object := range objects {
+		if !gameLoopResultsPattern.MatchString(path.Base(object)) {
+			continue
+		}
+
+		localPath := filepath.Join(outputDir, filepath.FromSlash(strings.TrimPrefix(object, prefix)))
+		err = os.MkdirAll(filepath.Dir(localPath), 0755)
+		if err != nil {
+			return files, err
+		}
+		err = storage.Download(bucket, object, localPath)
+		if err != nil {
+			return files, err
+		}
+		files++
+	}
+
+	return files, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// GameLoopManifest is the manifest of com.example.game with 5 loops, labelled smoke and
+// performance.
+func GameLoopManifest() []byte {
+	return BuildManifest([]manifestElement{
+		{Name: "manifest", Attributes: map[string]interface{}{"package": "com.example.game"}},
+		{Name: "uses-sdk", Attributes: map[string]interface{}{"minSdkVersion": 21, "targetSdkVersion": 28}},
+		{Name: "activity", Attributes: map[string]interface{}{"name": "com.example.game.MainActivity"}},
+		{Name: "intent-filter", Attributes: map[string]interface{}{}},
+		{Name: "action", Attributes: map[string]interface{}{"name": gameLoopAction}},
+		{Name: "data", Attributes: map[string]interface{}{"mimeType": "application/javascript"}},
+		{Name: "meta-data", Attributes: map[string]interface{}{"name": "com.google.test.loops", "value": 5}},
+		{Name: "meta-data", Attributes: map[string]interface{}{"name": "com.google.test.loops.smoke", "value": "1,2"}},
+		{Name: "meta-data", Attributes: map[string]interface{}{"name": "com.google.test.loops.performance", "value": "3-5"}},
+	}, true)
+}
+
+// setupGameLoopEnv sets up a game loop run of a game apk in tmpDir.
+func setupGameLoopEnv(tmpDir string) {
+	setupOptionsEnv()
+
+	appApk := filepath.Join(tmpDir, "game.apk")
+	WriteZipFiles(appApk, map[string][]byte{"AndroidManifest.xml": GameLoopManifest()})
+	Setenv(envKeyAppApk, appApk)
+	Setenv(envKeyTestApk, "")
+	Setenv(envKeyTestType, testTypeGameLoop)
+}
+
+func TestNewTestType(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		platform string
+		value    string
+		testApk  string
+		ios      iosConfig
+		testType string
+		err      string
+	}{
+		{platformAndroid, "", "/tmp/test.apk", iosConfig{}, testTypeInstrumentation, ""},
+		{platformAndroid, "", "", iosConfig{}, testTypeRobo, ""},
+		{platformAndroid, "game-loop", "", iosConfig{}, testTypeGameLoop, ""},
+		{platformAndroid, "instrumentation", "", iosConfig{}, "", envKeyTestType + " instrumentation needs " + envKeyTestApk},
+		{platformAndroid, "game-loop", "/tmp/test.apk", iosConfig{}, "", envKeyTestApk + " can't be used with " + envKeyTestType + " game-loop"},
+		{platformAndroid, "espresso", "", iosConfig{}, "", envKeyTestType + " must be 'instrumentation', 'robo' or 'game-loop'"},
+		{platformIOS, "", "", iosConfig{XCTestZip: "/tmp/tests.zip"}, testTypeXCTest, ""},
+		{platformIOS, "", "", iosConfig{AppIpa: "/tmp/game.ipa"}, testTypeGameLoop, ""},
+		{platformIOS, "game-loop", "", iosConfig{AppIpa: "/tmp/game.ipa"}, "", envKeyTestType + " is only supported on Android, iOS runs " + envKeyXCTestZip + " or the game loop of " + envKeyAppIpa},
+	}
+	for _, c := range cases {
+		Setenv(envKeyTestType, c.value)
+		testType, err := newTestType(c.platform, c.testApk, c.ios)
+		if isEmpty(c.err) {
+			assert.NoError(err)
+			assert.Equal(c.testType, testType)
+		} else {
+			assert.EqualError(err, c.err)
+		}
+	}
+	Setenv(envKeyTestType, "")
+}
+
+func TestNewGameLoopConfig(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	tmpDir, err := ioutil.TempDir("", "gameloop")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	mainObb := filepath.Join(tmpDir, "main.3.com.example.game.obb")
+	WriteFile(mainObb)
+	patchObb := filepath.Join(tmpDir, "patch.4.com.example.game.obb")
+	WriteFile(patchObb)
+
+	setupGameLoopEnv(tmpDir)
+	Setenv(envKeyGameLoopScenarios, "1, 3\n5")
+	Setenv(envKeyGameLoopLabels, "smoke")
+	Setenv(envKeyObbFiles, mainObb+"\n"+patchObb)
+
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal(testTypeGameLoop, config.TestType)
+	assert.Equal(gameLoopConfig{
+		Scenarios: []int{1, 3, 5},
+		Labels:    []string{"smoke"},
+		ObbFiles:  []string{mainObb, patchObb},
+	}, config.GameLoop)
+	assert.Equal(5, config.AppManifest.GameLoops)
+
+	gcsCommand, err := buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	assert.Equal([]string{
+		"gcloud", "firebase", "test", "android", "run",
+		"--type", "game-loop",
+		"--scenario-numbers", "1,3,5",
+		"--scenario-labels", "smoke",
+		"--obb-files", mainObb + "," + patchObb,
+		"--app", config.AppApk,
+		"--results-bucket=golang-bucket",
+		"--results-dir=results_dir",
+	}, gcsCommand)
+
+	//- all scenarios, flags of GCLOUD_OPTIONS win
+	setupGameLoopEnv(tmpDir)
+	Setenv(envKeyGameLoopScenarios, "2")
+	Setenv(envKeyGcloudOptions, "--scenario-numbers=4")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	gcsCommand, err = buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	assert.Equal("4", gcloudFlagValue(gcsCommand, "--scenario-numbers"))
+	assert.Equal([]string{"--scenario-numbers=4"}, gcsCommand[len(gcsCommand)-1:])
+}
+
+func TestNewGameLoopConfigValidation(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	tmpDir, err := ioutil.TempDir("", "gameloop")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	obbFile := filepath.Join(tmpDir, "main.3.com.example.game.obb")
+	WriteFile(obbFile)
+	renamedObb := filepath.Join(tmpDir, "assets.obb")
+	WriteFile(renamedObb)
+
+	cases := []struct {
+		key   string
+		value string
+		err   string
+	}{
+		{envKeyGameLoopScenarios, "1,two", envKeyGameLoopScenarios + " must be scenario numbers from 1: 'two'"},
+		{envKeyGameLoopScenarios, "0", envKeyGameLoopScenarios + " must be scenario numbers from 1: '0'"},
+		{envKeyGameLoopScenarios, "6", envKeyGameLoopScenarios + ": scenario 6 is above the 5 loops of com.example.game"},
+		{envKeyGameLoopLabels, "smoke,nightly", envKeyGameLoopLabels + ": com.example.game declares no scenario label 'nightly'"},
+		{envKeyObbFiles, renamedObb, envKeyObbFiles + " must be named like main.<versionCode>.<package>.obb: '" + renamedObb + "'"},
+		{envKeyObbFiles, filepath.Join(tmpDir, "main.1.missing.obb"), "file doesn't exist: '" + filepath.Join(tmpDir, "main.1.missing.obb") + "'"},
+		{envKeyObbFiles, obbFile + "\n" + obbFile + "\n" + obbFile, envKeyObbFiles + " takes 2 files at most, a main and a patch expansion file"},
+	}
+	for _, c := range cases {
+		setupGameLoopEnv(tmpDir)
+		Setenv(c.key, c.value)
+		_, err := newFirebaseConfig()
+		assert.EqualError(err, c.err, c.key+"="+c.value)
+	}
+
+	//- game loop inputs of other test types
+	setupOptionsEnv()
+	Setenv(envKeyGameLoopScenarios, "1")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyGameLoopScenarios+" configures game loop tests, not instrumentation tests")
+
+	_, err = newGameLoopConfig(platformIOS, testTypeGameLoop)
+	assert.NoError(err)
+	Setenv(envKeyObbFiles, obbFile)
+	_, err = newGameLoopConfig(platformIOS, testTypeGameLoop)
+	assert.EqualError(err, envKeyObbFiles+" is only supported on Android")
+
+	//- an app without the game loop intent filter
+	setupGameLoopEnv(tmpDir)
+	appApk := filepath.Join(tmpDir, "app.apk")
+	WriteZipFiles(appApk, map[string][]byte{"AndroidManifest.xml": AppManifest()})
+	Setenv(envKeyAppApk, appApk)
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyAppApk+" com.example.app has no game loop intent filter, an activity must handle "+gameLoopAction)
+}
+
+func TestCollectGameLoopResults(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+	deployDir, err := ioutil.TempDir("", "deploy")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(deployDir)
+	}()
+
+	results := map[string]string{
+		"NexusLowRes-25-en-portrait/game_loop_results/results_scenario_1.json": `{"fps": 60}`,
+		"NexusLowRes-25-en-portrait/game_loop_results/results_scenario_2.json": `{"fps": 58}`,
+		"Pixel2-28-en-portrait/game_loop_results/results_scenario_1.json":      `{"fps": 30}`,
+		"Pixel2-28-en-portrait/logcat":                                         "",
+	}
+	for object, content := range results {
+		localPath := filepath.Join(root, "golang-bucket", "results_dir", filepath.FromSlash(object))
+		PanicOnErr(os.MkdirAll(filepath.Dir(localPath), 0755))
+		PanicOnErr(ioutil.WriteFile(localPath, []byte(content), 0644))
+	}
+
+	config := newFakeGcloudConfig(assert)
+	Setenv(envKeyDeployDir, deployDir)
+	envman, exports := FakeEnvman()
+	config.Runner = envman
+
+	err = collectGameLoopResults(config, localStorage{Root: root}, "golang-bucket", "results_dir")
+	assert.NoError(err)
+
+	outputDir := filepath.Join(deployDir, gameLoopResultsDirName)
+	assert.Equal(outputDir, exports[outputGameLoopResultsDir])
+	data, err := ioutil.ReadFile(filepath.Join(outputDir, "Pixel2-28-en-portrait", "game_loop_results", "results_scenario_1.json"))
+	assert.NoError(err)
+	assert.Equal(`{"fps": 30}`, string(data))
+	files, err := filepath.Glob(filepath.Join(outputDir, "*", "game_loop_results", "*.json"))
+	assert.NoError(err)
+	assert.Equal(3, len(files))
+	assert.NoError(fileExists(filepath.Join(outputDir, "NexusLowRes-25-en-portrait", "game_loop_results", "results_scenario_2.json")))
+
+	//- no results, nothing exported
+	envman, exports = FakeEnvman()
+	config.Runner = envman
+	err = collectGameLoopResults(config, localStorage{Root: root}, "golang-bucket", "other_dir")
+	assert.NoError(err)
+	assert.Empty(exports)
+}
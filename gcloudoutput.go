@@ -0,0 +1,83 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Lines of `gcloud firebase test run` identifying the test matrix, e.g.
+//
+//	Test [matrix-1a2b3c4d5e6f7] has been created in the Google Cloud.
+//	Test results will be streamed to [https://console.firebase.google.com/project/p/testlab/histories/bh.1/matrices/2].
+var (
+	matrixIDPattern   = regexp.MustCompile(`Test \[(matrix-[0-9A-Za-z_-]+)\] has been created`)
+	consoleURLPattern = regexp.MustCompile(`Test results will be streamed to \[(\S+)\]`)
+)
+
+// Row of the outcome table gcloud prints once the matrix finished, drawn with box
+// characters by recent gcloud versions and with | by older ones:
+//
+//	│ OUTCOME │      TEST_AXIS_VALUE       │     TEST_DETAILS     │
+//	│ Passed  │ NexusLowRes-25-en-portrait │ 12 test cases passed │
+var outcomeTableRowPattern = regexp.MustCompile(`^\s*[│|]([^│|]*)[│|]([^│|]*)[│|]([^│|]*)[│|]\s*$`)
+
+// runResult is what gcloud reported about a test matrix. Fields are empty when gcloud
+// failed before getting that far.
+type runResult struct {
+	MatrixID   string        `json:"matrix_id"`
+	ConsoleURL string        `json:"console_url"`
+	Outcomes   []axisOutcome `json:"outcomes"`
+}
+
+// axisOutcome is a row of the outcome table, the result on a single device.
+type axisOutcome struct {
+	Outcome       string `json:"outcome"`
+	TestAxisValue string `json:"test_axis_value"`
+	TestDetails   string `json:"test_details"`
+}
+
+// parseRunResult extracts the run result from the combined output of gcloud.
+func parseRunResult(gcloudOutput string) runResult {
+	result := runResult{}
+	if match := matrixIDPattern.FindStringSubmatch(gcloudOutput); match != nil {
+		result.MatrixID = match[1]
+	}
+	if match := consoleURLPattern.FindStringSubmatch(gcloudOutput); match != nil {
+		result.ConsoleURL = match[1]
+	}
+	result.Outcomes = parseOutcomeTable(gcloudOutput)
+	return result
+}
+
+// parseOutcomeTable returns the rows below the OUTCOME header. gcloud wraps long
+// details into rows with empty outcome and axis columns, they're joined to the row above.
+func parseOutcomeTable(gcloudOutput string) []axisOutcome {
+	var outcomes []axisOutcome
+	inTable := false
+
+	for _, line := range strings.Split(gcloudOutput, "\n") {
+		match := outcomeTableRowPattern.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if match == nil {
+			continue
+		}
+
+		row := axisOutcome{
+			Outcome:       strings.TrimSpace(match[1]),
+			TestAxisValue: strings.TrimSpace(match[2]),
+			TestDetails:   strings.TrimSpace(match[3]),
+		}
+
+		switch {
+		case row.Outcome == "OUTCOME":
+			inTable = true
+		case !inTable:
+		case isEmpty(row.Outcome) && isEmpty(row.TestAxisValue) && len(outcomes) > 0:
+			last := &outcomes[len(outcomes)-1]
+			last.TestDetails = strings.TrimSpace(last.TestDetails + " " + row.TestDetails)
+		default:
+			outcomes = append(outcomes, row)
+		}
+	}
+
+	return outcomes
+}
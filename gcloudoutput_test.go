@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// ReadFixture returns the content of testdata/name.
+func ReadFixture(name string) string {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	PanicOnErr(err)
+	return string(data)
+}
+
+func TestParseRunResult(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(runResult{
+		MatrixID:   "matrix-1vqa8x2ghc2uw",
+		ConsoleURL: "https://console.firebase.google.com/project/fake-project/testlab/histories/bh.9f4dbc8e0b9b5f3d/matrices/7516553046426836329",
+		Outcomes: []axisOutcome{
+			{Outcome: "Passed", TestAxisValue: "NexusLowRes-25-en-portrait", TestDetails: "12 test cases passed"},
+		},
+	}, parseRunResult(ReadFixture("gcloud_android_passed.txt")))
+
+	assert.Equal(runResult{
+		MatrixID:   "matrix-2c9rbkq0yxf3e",
+		ConsoleURL: "https://console.firebase.google.com/project/fake-project/testlab/histories/bh.9f4dbc8e0b9b5f3d/matrices/6841360372410523614",
+		Outcomes: []axisOutcome{
+			{Outcome: "Failed", TestAxisValue: "Nexus9-24-en-landscape", TestDetails: "1 test cases failed, 11 passed"},
+			{Outcome: "Passed", TestAxisValue: "NexusLowRes-25-en-portrait", TestDetails: "12 test cases passed"},
+			{Outcome: "Inconclusive", TestAxisValue: "Pixel2-28-en-portrait", TestDetails: "Infrastructure failure: Test timed out"},
+		},
+	}, parseRunResult(ReadFixture("gcloud_android_failed_ascii.txt")))
+
+	assert.Equal(runResult{}, parseRunResult(ReadFixture("gcloud_error.txt")))
+}
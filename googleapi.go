@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoints of the Google APIs called by the api backend.
+const (
+	defaultTokenURI   = "https://oauth2.googleapis.com/token"
+	toolResultsAPIURL = "https://toolresults.googleapis.com"
+	storageAPIURL     = "https://storage.googleapis.com"
+	// cloudPlatformScope covers Test Lab, Tool Results and Cloud Storage.
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+	// apiRequestTimeout bounds every request to the Google APIs, uploading an app included.
+	apiRequestTimeout = 10 * time.Minute
+	// apiCancelTimeout bounds cancelling a matrix, which isn't stopped with the step.
+	apiCancelTimeout = time.Minute
+)
+
+// tokenSource provides OAuth access tokens for the Google APIs.
+type tokenSource interface {
+	Token() (string, error)
+}
+
+// gcloudTokens asks gcloud for the token of the activated service account.
+type gcloudTokens struct {
+	Runner commandRunner
+}
+
+func (tokens gcloudTokens) Token() (string, error) {
+	cmdSlice := []string{"gcloud", "auth", "print-access-token"}
+	result, err := tokens.Runner.Run(cmdSlice, nil)
+	if err != nil {
+		return "", err
+	}
+	if result.ExitCode != 0 {
+		return "", fmt.Errorf("%s failed with exit code %d", strings.Join(cmdSlice, " "), result.ExitCode)
+	}
+	return strings.TrimSpace(result.Stdout), nil
+}
+
+// serviceAccountTokens exchanges a JWT signed with the private key of GCLOUD_KEY for
+// an access token, without gcloud. Tokens are reused until shortly before they expire.
+type serviceAccountTokens struct {
+	Email    string
+	TokenURI string
+	Key      *rsa.PrivateKey
+	Client   *http.Client
+
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+	// Replaced in tests, time.Now when nil.
+	now func() time.Time
+}
+
+func newServiceAccountTokens(keyJSON []byte, client *http.Client) (*serviceAccountTokens, error) {
+	keyFile := GcloudKeyFile{}
+	err := json.Unmarshal(keyJSON, &keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if keyFile.Type != "service_account" {
+		return nil, errors.New(envKeyGcloud + " must be a service account key, type: '" + keyFile.Type + "'")
+	}
+	if isEmpty(keyFile.ClientEmail) {
+		return nil, errors.New(envKeyGcloud + " has no client_email")
+	}
+
+	block, _ := pem.Decode([]byte(keyFile.PrivateKey))
+	if block == nil {
+		return nil, errors.New(envKeyGcloud + " has no PEM encoded private_key")
+	}
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New(envKeyGcloud + " has an invalid private_key: " + err.Error())
+	}
+
+	tokenURI := keyFile.TokenURI
+	if isEmpty(tokenURI) {
+		tokenURI = defaultTokenURI
+	}
+
+	return &serviceAccountTokens{Email: keyFile.ClientEmail, TokenURI: tokenURI, Key: key, Client: client}, nil
+}
+
+// parsePrivateKey parses the PKCS#8 keys of service account keys, or PKCS#1 keys.
+func parsePrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
+
+func (tokens *serviceAccountTokens) Token() (string, error) {
+	tokens.lock.Lock()
+	defer tokens.lock.Unlock()
+
+	now := time.Now
+	if tokens.now != nil {
+		now = tokens.now
+	}
+	if !isEmpty(tokens.token) && now().Add(time.Minute).Before(tokens.expires) {
+		return tokens.token, nil
+	}
+
+	assertion, err := tokens.assertion(now())
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	response, err := tokens.Client.PostForm(tokens.TokenURI, form)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed to get an access token for %s, status: %s | response: %s", tokens.Email, response.Status, strings.TrimSpace(string(body)))
+	}
+
+	parsed := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	err = json.Unmarshal(body, &parsed)
+	if err != nil {
+		return "", err
+	}
+	if isEmpty(parsed.AccessToken) {
+		return "", errors.New("Failed to get an access token for " + tokens.Email + ", response has no access_token")
+	}
+
+	tokens.token = parsed.AccessToken
+	tokens.expires = now().Add(time.Duration(parsed.ExpiresIn) * time.Second)
+	return tokens.token, nil
+}
+
+// assertion is the RS256 signed JWT of the OAuth 2.0 JWT bearer flow.
+// https://developers.google.com/identity/protocols/oauth2/service-account#authorizingrequests
+func (tokens *serviceAccountTokens) assertion(now time.Time) (string, error) {
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   tokens.Email,
+		"scope": cloudPlatformScope,
+		"aud":   tokens.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	signingInput := encoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + encoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, tokens.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+// googleAPI sends authorized requests to the Google APIs.
+type googleAPI struct {
+	Tokens tokenSource
+	Client *http.Client
+	// Context stops the requests, never done when nil.
+	Context context.Context
+}
+
+// send sends the request and returns the response when it succeeded. action and target
+// describe the request in errors, e.g. "get" and the matrix ID.
+func (api googleAPI) send(method string, requestURL string, body io.Reader, contentType string, action string, target string) (*http.Response, error) {
+	response, err := api.do(method, requestURL, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(response.Body)
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("Failed to %s %s, status: %s | response: %s", action, target, response.Status, strings.TrimSpace(string(data)))
+	}
+
+	return response, nil
+}
+
+// do sends the authorized request, stopped with Context, and returns the response whatever its status.
+func (api googleAPI) do(method string, requestURL string, body io.Reader, contentType string) (*http.Response, error) {
+	token, err := api.Tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if api.Context != nil {
+		request = request.WithContext(api.Context)
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	if !isEmpty(contentType) {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	return api.Client.Do(request)
+}
+
+// call is send returning the response body.
+func (api googleAPI) call(method string, requestURL string, body io.Reader, contentType string, action string, target string) ([]byte, error) {
+	response, err := api.send(method, requestURL, body, contentType, action, target)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	return ioutil.ReadAll(response.Body)
+}
+
+// callJSON sends request as JSON, when not nil, and decodes the response into result.
+func (api googleAPI) callJSON(method string, requestURL string, request interface{}, result interface{}, action string, target string) error {
+	var body io.Reader
+	contentType := ""
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = strings.NewReader(string(data))
+		contentType = "application/json"
+	}
+
+	data, err := api.call(method, requestURL, body, contentType, action, target)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, result)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"path"
+	"strings"
+)
+
+const platformAndroid = "android"
+const platformIOS = "ios"
+
+// iosConfig holds the iOS inputs, either an XCTest bundle or a game loop app.
+type iosConfig struct {
+	XCTestZip     string
+	XCTestRunFile string
+	AppIpa        string
+}
+
+func newIOSConfig() (iosConfig, error) {
+	config := iosConfig{
+		XCTestZip:     getOptionalEnv(envKeyXCTestZip),
+		XCTestRunFile: getOptionalEnv(envKeyXCTestRunFile),
+		AppIpa:        getOptionalEnv(envKeyAppIpa),
+	}
+
+	emptyXCTestZip := isEmpty(config.XCTestZip)
+	emptyAppIpa := isEmpty(config.AppIpa)
+
+	if emptyXCTestZip && emptyAppIpa {
+		return config, errors.New(envKeyXCTestZip + " or " + envKeyAppIpa + " must be defined for iOS")
+	}
+	if !emptyXCTestZip && !emptyAppIpa {
+		return config, errors.New(envKeyXCTestZip + " and " + envKeyAppIpa + " can't be used together")
+	}
+
+	if !emptyAppIpa {
+		err := fileExists(config.AppIpa)
+		if err != nil {
+			return config, err
+		}
+		return config, validateIpa(config.AppIpa)
+	}
+
+	err := fileExists(config.XCTestZip)
+	if err != nil {
+		return config, err
+	}
+
+	if !isEmpty(config.XCTestRunFile) {
+		err = fileExists(config.XCTestRunFile)
+		if err != nil {
+			return config, err
+		}
+		if path.Ext(config.XCTestRunFile) != ".xctestrun" {
+			return config, errors.New(envKeyXCTestRunFile + " must be an .xctestrun file: '" + config.XCTestRunFile + "'")
+		}
+	}
+
+	xcTestRunFiles, err := zipEntries(config.XCTestZip, func(name string) bool {
+		return path.Ext(name) == ".xctestrun"
+	})
+	if err != nil {
+		return config, err
+	}
+
+	// Test Lab needs exactly one .xctestrun, unless --xctestrun-file overrides it.
+	if isEmpty(config.XCTestRunFile) {
+		if len(xcTestRunFiles) == 0 {
+			return config, errors.New("no .xctestrun file in '" + config.XCTestZip + "', set " + envKeyXCTestRunFile)
+		}
+		if len(xcTestRunFiles) > 1 {
+			return config, errors.New("multiple .xctestrun files in '" + config.XCTestZip + "': " +
+				strings.Join(xcTestRunFiles, ", ") + ", set " + envKeyXCTestRunFile)
+		}
+	}
+
+	return config, nil
+}
+
+// validateIpa checks the .ipa is an app archive: Payload/<name>.app/...
+func validateIpa(ipaPath string) error {
+	apps, err := zipEntries(ipaPath, func(name string) bool {
+		parts := strings.Split(name, "/")
+		return len(parts) > 2 && parts[0] == "Payload" && path.Ext(parts[1]) == ".app"
+	})
+	if err != nil {
+		return err
+	}
+	if len(apps) == 0 {
+		return errors.New("no Payload/*.app in '" + ipaPath + "'")
+	}
+
+	return nil
+}
+
+// zipEntries returns the names of the entries in the zip at zipPath accepted by match.
+func zipEntries(zipPath string, match func(name string) bool) ([]string, error) {
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, errors.New("failed to open zip '" + zipPath + "': " + err.Error())
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	entries := make([]string, 0)
+	for _, file := range reader.File {
+		if match(file.Name) {
+			entries = append(entries, file.Name)
+		}
+	}
+
+	return entries, nil
+}
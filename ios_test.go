@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/zip"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// WriteZip creates a zip at zipPath with an empty file for every entry name.
+func WriteZip(zipPath string, names ...string) {
+	file, err := os.Create(zipPath)
+	PanicOnErr(err)
+
+	writer := zip.NewWriter(file)
+	for _, name := range names {
+		_, err = writer.Create(name)
+		PanicOnErr(err)
+	}
+	PanicOnErr(writer.Close())
+	PanicOnErr(file.Close())
+}
+
+func setupIOSEnv(assert *assert.Assertions) {
+	gcloudKeyValue, err := getRequiredEnv(envKeyGcloud)
+	assert.NoError(err)
+
+	resetEnv()
+	Setenv(envKeyGcloud, gcloudKeyValue)
+	Setenv(envKeyGcloudUser, "fake@example.com")
+	Setenv(envKeyGcloudProject, "fake-project")
+	Setenv(envKeyGcloudBucket, "golang-bucket")
+	Setenv(envKeyPlatform, platformIOS)
+}
+
+func TestNewIOSConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "ios")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	setupIOSEnv(assert)
+
+	//- nothing to test
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyXCTestZip+" or "+envKeyAppIpa+" must be defined for iOS")
+
+	//- XCTest and game loop together
+	Setenv(envKeyXCTestZip, "tests.zip")
+	Setenv(envKeyAppIpa, "app.ipa")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyXCTestZip+" and "+envKeyAppIpa+" can't be used together")
+	Setenv(envKeyAppIpa, "")
+
+	//- zip not a zip
+	notZip := filepath.Join(tmpDir, "not.zip")
+	WriteFile(notZip)
+	Setenv(envKeyXCTestZip, notZip)
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, "failed to open zip '"+notZip+"': zip: not a valid zip file")
+
+	//- zip without .xctestrun
+	noTestRun := filepath.Join(tmpDir, "notestrun.zip")
+	WriteZip(noTestRun, "Debug-iphoneos/App.app/Info.plist")
+	Setenv(envKeyXCTestZip, noTestRun)
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, "no .xctestrun file in '"+noTestRun+"', set "+envKeyXCTestRunFile)
+
+	//- zip with multiple .xctestrun
+	multiTestRun := filepath.Join(tmpDir, "multi.zip")
+	WriteZip(multiTestRun, "App_iphoneos11.2-arm64.xctestrun", "App_iphoneos12.0-arm64.xctestrun")
+	Setenv(envKeyXCTestZip, multiTestRun)
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, "multiple .xctestrun files in '"+multiTestRun+"': "+
+		"App_iphoneos11.2-arm64.xctestrun, App_iphoneos12.0-arm64.xctestrun, set "+envKeyXCTestRunFile)
+
+	//- --xctestrun-file override must be an .xctestrun
+	Setenv(envKeyXCTestRunFile, noTestRun)
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyXCTestRunFile+" must be an .xctestrun file: '"+noTestRun+"'")
+
+	xcTestRun := filepath.Join(tmpDir, "App.xctestrun")
+	WriteFile(xcTestRun)
+	Setenv(envKeyXCTestRunFile, xcTestRun)
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal(multiTestRun, config.IOS.XCTestZip)
+	assert.Equal(xcTestRun, config.IOS.XCTestRunFile)
+
+	//- game loop .ipa without an app
+	Setenv(envKeyXCTestZip, "")
+	Setenv(envKeyXCTestRunFile, "")
+	Setenv(envKeyAppIpa, noTestRun)
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, "no Payload/*.app in '"+noTestRun+"'")
+
+	//- unknown platform
+	Setenv(envKeyPlatform, "windows")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyPlatform+" must be 'android' or 'ios'")
+}
+
+func TestExecuteGcloudIOS(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "ios")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	xcTestZip := filepath.Join(tmpDir, "tests.zip")
+	WriteZip(xcTestZip, "Debug-iphoneos/App.app/Info.plist", "App_iphoneos11.2-arm64.xctestrun")
+	appIpa := filepath.Join(tmpDir, "game.ipa")
+	WriteZip(appIpa, "Payload/Game.app/Info.plist")
+
+	setupIOSEnv(assert)
+	Setenv(envKeyGcloudOptions, "--device model=iphone8,version=11.2")
+	Setenv(envKeyXCTestZip, xcTestZip)
+
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+
+	result, err := buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	assert.Equal([]string{
+		"gcloud", "firebase", "test", "ios", "run",
+		"--type", "xctest",
+		"--test", xcTestZip,
+		"--results-bucket=golang-bucket",
+		"--results-dir=results_dir",
+		"--device", "model=iphone8,version=11.2",
+	}, result)
+
+	Setenv(envKeyXCTestZip, "")
+	Setenv(envKeyAppIpa, appIpa)
+
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+
+	result, err = buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	assert.Equal([]string{
+		"gcloud", "firebase", "test", "ios", "run",
+		"--type", "game-loop",
+		"--app", appIpa,
+		"--results-bucket=golang-bucket",
+		"--results-dir=results_dir",
+		"--device", "model=iphone8,version=11.2",
+	}, result)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// junitReportFileName is the name of the merged report written into the deploy dir.
+const junitReportFileName = "firebase-test-lab-junit.xml"
+
+// Matches test_result_0.xml, test_result_1.xml, ...
+var testResultFilePattern = regexp.MustCompile(`^test_result_[^/]*\.xml$`)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     float64          `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	Hostname  string          `xml:"hostname,attr,omitempty"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string         `xml:"name,attr"`
+	ClassName string         `xml:"classname,attr"`
+	Time      float64        `xml:"time,attr"`
+	Failures  []junitMessage `xml:"failure,omitempty"`
+	Errors    []junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage  `xml:"skipped,omitempty"`
+	// Failures of earlier attempts of a test that passed on re-run, like Maven Surefire reports them.
+	FlakyFailures []junitMessage `xml:"flakyFailure,omitempty"`
+	FlakyErrors   []junitMessage `xml:"flakyError,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr,omitempty"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// parseJUnit accepts both a <testsuites> and a bare <testsuite> root element.
+func parseJUnit(data []byte) ([]junitTestSuite, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "testsuites":
+			suites := junitTestSuites{}
+			err = xml.Unmarshal(data, &suites)
+			return suites.Suites, err
+		case "testsuite":
+			suite := junitTestSuite{}
+			err = xml.Unmarshal(data, &suite)
+			return []junitTestSuite{suite}, err
+		default:
+			return nil, fmt.Errorf("unexpected JUnit root element: <%s>", start.Name.Local)
+		}
+	}
+}
+
+// mergeJUnitResults folds every suite of a matrix dimension (e.g. NexusLowRes-25-en-portrait)
+// into a single suite named after that dimension.
+func mergeJUnitResults(dimensions map[string][]junitTestSuite) junitTestSuites {
+	names := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := junitTestSuites{}
+	for _, name := range names {
+		merged := junitTestSuite{Name: name}
+		for _, suite := range dimensions[name] {
+			if isEmpty(merged.Timestamp) {
+				merged.Timestamp = suite.Timestamp
+				merged.Hostname = suite.Hostname
+			}
+			merged.Time += suite.Time
+			merged.TestCases = append(merged.TestCases, suite.TestCases...)
+		}
+		report.Suites = append(report.Suites, merged)
+	}
+	report.countTestCases()
+
+	return report
+}
+
+// countTestCases recomputes the counts of every suite and the totals.
+func (report *junitTestSuites) countTestCases() {
+	report.Tests, report.Failures, report.Errors, report.Skipped, report.Time = 0, 0, 0, 0, 0
+
+	for i := range report.Suites {
+		suite := &report.Suites[i]
+		suite.countTestCases()
+
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Errors += suite.Errors
+		report.Skipped += suite.Skipped
+		report.Time += suite.Time
+	}
+}
+
+func (suite *junitTestSuite) countTestCases() {
+	suite.Tests = len(suite.TestCases)
+	suite.Failures, suite.Errors, suite.Skipped = 0, 0, 0
+
+	for _, testCase := range suite.TestCases {
+		switch {
+		case len(testCase.Failures) > 0:
+			suite.Failures++
+		case len(testCase.Errors) > 0:
+			suite.Errors++
+		case testCase.Skipped != nil:
+			suite.Skipped++
+		}
+	}
+}
+
+// testCounts puts every test case into exactly one of the buckets.
+type testCounts struct {
+	Passed  int `json:"passed"`
+	Failed  int `json:"failed"`
+	Flaky   int `json:"flaky"`
+	Skipped int `json:"skipped"`
+}
+
+func (report junitTestSuites) counts() testCounts {
+	counts := testCounts{}
+	for _, suite := range report.Suites {
+		for _, testCase := range suite.TestCases {
+			switch {
+			case testCase.failed():
+				counts.Failed++
+			case testCase.flaky():
+				counts.Flaky++
+			case testCase.Skipped != nil:
+				counts.Skipped++
+			default:
+				counts.Passed++
+			}
+		}
+	}
+	return counts
+}
+
+func (testCase junitTestCase) failed() bool {
+	return len(testCase.Failures) > 0 || len(testCase.Errors) > 0
+}
+
+func (testCase junitTestCase) flaky() bool {
+	return !testCase.failed() && (len(testCase.FlakyFailures) > 0 || len(testCase.FlakyErrors) > 0)
+}
+
+// writeJUnitReport writes the report with the secrets of redactor masked, failure messages may
+// print them.
+func writeJUnitReport(report junitTestSuites, filePath string, redactor *redactor) error {
+	data, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filePath, []byte(xml.Header+redactor.Redact(string(data))), 0644)
+}
+
+// fetchJUnitReport downloads and merges every test_result_*.xml below the final results dirs
+// of outcome. Suites are named after the dimension dir relative to outcome.ResultsDir.
+func fetchJUnitReport(storage resultsStorage, bucket string, outcome testOutcome) (junitTestSuites, error) {
+	prefix := strings.TrimSuffix(outcome.ResultsDir, "/") + "/"
+
+	tmpDir, err := ioutil.TempDir("", "junit")
+	if err != nil {
+		return junitTestSuites{}, err
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	dimensions := make(map[string][]junitTestSuite)
+	files := 0
+	for _, resultsDir := range outcome.finalResultsDirs() {
+		objects, err := storage.List(bucket, strings.TrimSuffix(resultsDir, "/")+"/")
+		if err != nil {
+			return junitTestSuites{}, err
+		}
+
+		for _, object := range objects {
+			if !testResultFilePattern.MatchString(path.Base(object)) {
+				continue
+			}
+
+			localPath := filepath.Join(tmpDir, fmt.Sprintf("%d.xml", files))
+			files++
+			err = storage.Download(bucket, object, localPath)
+			if err != nil {
+				return junitTestSuites{}, err
+			}
+
+			data, err := ioutil.ReadFile(localPath)
+			if err != nil {
+				return junitTestSuites{}, err
+			}
+
+			suites, err := parseJUnit(data)
+			if err != nil {
+				return junitTestSuites{}, fmt.Errorf("failed to parse gs://%s/%s: %s", bucket, object, err)
+			}
+
+			dimension := path.Dir(strings.TrimPrefix(object, prefix))
+			dimensions[dimension] = append(dimensions[dimension], suites...)
+		}
+	}
+
+	return mergeJUnitResults(dimensions), nil
+}
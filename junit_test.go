@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testResultPhone = `<?xml version='1.0' encoding='UTF-8' ?>
+<testsuite name="" tests="3" failures="1" errors="0" skipped="1" time="4.2" timestamp="2017-07-12T11:36:12" hostname="localhost">
+  <properties />
+  <testcase name="testAdd" classname="com.example.CalculatorTest" time="1.0" />
+  <testcase name="testDivide" classname="com.example.CalculatorTest" time="2.2">
+    <failure>java.lang.ArithmeticException: divide by zero</failure>
+  </testcase>
+  <testcase name="testIgnored" classname="com.example.CalculatorTest" time="0.0">
+    <skipped />
+  </testcase>
+</testsuite>`
+
+const testResultTablet = `<?xml version='1.0' encoding='UTF-8' ?>
+<testsuites>
+  <testsuite name="" tests="1" failures="0" errors="0" skipped="0" time="1.5">
+    <testcase name="testAdd" classname="com.example.CalculatorTest" time="1.5" />
+  </testsuite>
+</testsuites>`
+
+// WriteObject stores content as gs://bucket/object in a localStorage rooted at root.
+func WriteObject(root string, bucket string, object string, content string) {
+	filePath := filepath.Join(root, bucket, filepath.FromSlash(object))
+	PanicOnErr(os.MkdirAll(filepath.Dir(filePath), 0755))
+	PanicOnErr(ioutil.WriteFile(filePath, []byte(content), 0644))
+}
+
+func TestParseJUnit(t *testing.T) {
+	assert := assert.New(t)
+
+	suites, err := parseJUnit([]byte(testResultPhone))
+	assert.NoError(err)
+	assert.Equal(1, len(suites))
+	assert.Equal(3, len(suites[0].TestCases))
+	assert.Equal("java.lang.ArithmeticException: divide by zero", suites[0].TestCases[1].Failures[0].Text)
+	assert.NotNil(suites[0].TestCases[2].Skipped)
+
+	suites, err = parseJUnit([]byte(testResultTablet))
+	assert.NoError(err)
+	assert.Equal(1, len(suites))
+	assert.Equal(1.5, suites[0].Time)
+
+	_, err = parseJUnit([]byte(`<html></html>`))
+	assert.EqualError(err, "unexpected JUnit root element: <html>")
+}
+
+func TestFetchJUnitReport(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	outputDir, err := ioutil.TempDir("", "deploy")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(outputDir)
+	}()
+
+	const Bucket = "golang-bucket"
+	const ResultsDir = "2017-07-12_11:36:12.467586_XVlB"
+
+	WriteObject(root, Bucket, ResultsDir+"/NexusLowRes-25-en-portrait/test_result_1.xml", testResultPhone)
+	WriteObject(root, Bucket, ResultsDir+"/NexusLowRes-25-en-portrait/test_result_2.xml", testResultTablet)
+	WriteObject(root, Bucket, ResultsDir+"/Nexus9-24-en-landscape/test_result_1.xml", testResultTablet)
+	WriteObject(root, Bucket, ResultsDir+"/Nexus9-24-en-landscape/logcat", "not a test result")
+	WriteObject(root, Bucket, "other_dir/Nexus9-24-en-landscape/test_result_1.xml", testResultPhone)
+
+	report, err := fetchJUnitReport(localStorage{Root: root}, Bucket, testOutcome{ResultsDir: ResultsDir})
+	assert.NoError(err)
+	assert.Equal(5, report.Tests)
+	assert.Equal(1, report.Failures)
+
+	// written like collectResults does, failure messages may print secrets
+	Setenv("DIVISOR_SECRET", "divide by zero")
+	defer Setenv("DIVISOR_SECRET", "")
+	reportPath := filepath.Join(outputDir, junitReportFileName)
+	err = writeJUnitReport(report, reportPath, newRedactor([]string{"DIVISOR_SECRET"}, nil, nil))
+	assert.NoError(err)
+
+	data, err := ioutil.ReadFile(reportPath)
+	assert.NoError(err)
+	assert.Contains(string(data), "java.lang.ArithmeticException: "+redactedValue)
+	assert.NotContains(string(data), "divide by zero")
+
+	report = junitTestSuites{}
+	suites, err := parseJUnit(data)
+	assert.NoError(err)
+	report.Suites = suites
+
+	assert.Equal(2, len(report.Suites))
+
+	assert.Equal("Nexus9-24-en-landscape", report.Suites[0].Name)
+	assert.Equal(1, report.Suites[0].Tests)
+	assert.Equal(0, report.Suites[0].Failures)
+
+	assert.Equal("NexusLowRes-25-en-portrait", report.Suites[1].Name)
+	assert.Equal(4, report.Suites[1].Tests)
+	assert.Equal(1, report.Suites[1].Failures)
+	assert.Equal(1, report.Suites[1].Skipped)
+	assert.Equal(5.7, report.Suites[1].Time)
+	assert.Equal("2017-07-12T11:36:12", report.Suites[1].Timestamp)
+}
+
+func TestFetchJUnitReportNoResults(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	report, err := fetchJUnitReport(localStorage{Root: root}, "golang-bucket", testOutcome{ResultsDir: "missing"})
+	assert.NoError(err)
+	assert.Empty(report.Suites)
+}
@@ -1,27 +1,35 @@
 package main
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/bitrise-io/go-utils/command"
 	"github.com/bitrise-io/go-utils/log"
 	"github.com/kballard/go-shellquote"
-	"io/ioutil"
+	"io"
+	"net/http"
 	"os"
-	"os/exec"
-	"path"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 // GcloudKeyFile defines the project id & user
 // must be exported for json.Unmarshal
 type GcloudKeyFile struct {
+	Type        string `json:"type"`
 	ProjectID   string `json:"project_id"`
 	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	// external_account fields of workload identity federation configs
+	Audience         string          `json:"audience"`
+	CredentialSource json.RawMessage `json:"credential_source"`
+	ImpersonationURL string          `json:"service_account_impersonation_url"`
 }
 
 type firebaseConfig struct {
+	Platform      string
 	ResultsBucket string
 	Options       string
 	User          string
@@ -29,7 +37,38 @@ type firebaseConfig struct {
 	KeyPath       string
 	AppApk        string
 	TestApk       string
-	Debug         bool
+	TestType      string
+	IOS           iosConfig
+	GameLoop      gameLoopConfig
+	TestOptions   testOptions
+	Robo          roboConfig
+	Shards        shardConfig
+	Rerun         rerunConfig
+	Retry         retryPolicy
+	Async         asyncConfig
+	// AppManifest is read from APP_APK, nil when unknown.
+	AppManifest *apkManifest
+	// Auth holds the credentials of AUTH_MODE, newCredentials writes them to KeyPath for gcloud.
+	Auth authProvider
+	// Redactor masks the secrets of the logs and reports.
+	Redactor *redactor
+	// Backend runs the test matrices, gcloud or the Cloud Testing API.
+	Backend string
+	// Runner runs gcloud, gsutil and envman, replaced in tests.
+	Runner commandRunner
+	// Matrices looks up and cancels test matrices, replaced in tests.
+	Matrices matrixService
+	// Catalog lists the Android devices of Test Lab, set up with the backend. The devices
+	// aren't checked when nil.
+	Catalog catalogSource
+	// StepTimeout stops the step and cancels its test matrices, 0 means no timeout.
+	StepTimeout time.Duration
+	// FailOnInconclusive fails the step when Test Lab reports an inconclusive outcome.
+	FailOnInconclusive bool
+	// CacheResults reuses the passing outcome of the same apps, devices and options.
+	CacheResults bool
+	// Coverage pulls the JaCoCo coverage of instrumentation tests and merges it into the deploy dir.
+	Coverage bool
 }
 
 func newFirebaseConfig() (*firebaseConfig, error) {
@@ -38,116 +77,275 @@ func newFirebaseConfig() (*firebaseConfig, error) {
 	gcloudUserValue := getOptionalEnv(envKeyGcloudUser)
 	gcloudProjectValue := getOptionalEnv(envKeyGcloudProject)
 
-	appApkValue, err := getRequiredEnv(envKeyAppApk)
-	if err != nil {
-		return empty, err
+	platformValue := getOptionalEnv(envKeyPlatform)
+	if isEmpty(platformValue) {
+		platformValue = platformAndroid
 	}
 
-	err = fileExists(appApkValue)
+	asyncValue, err := newAsyncConfig()
 	if err != nil {
 		return empty, err
 	}
 
-	testApkValue := getOptionalEnv(envKeyTestApk)
-	if !isEmpty(testApkValue) {
-		err = fileExists(testApkValue)
+	var appApkValue, testApkValue string
+	var iosValue iosConfig
+
+	switch {
+	case asyncValue.Mode == modeCollect:
+		// the matrix was submitted by an earlier step, its app and tests aren't needed
+	case platformValue == platformAndroid:
+		appApkValue, err = getRequiredEnv(envKeyAppApk)
+		if err != nil {
+			return empty, err
+		}
+
+		err = fileExists(appApkValue)
+		if err != nil {
+			return empty, err
+		}
+
+		testApkValue = getOptionalEnv(envKeyTestApk)
+		if !isEmpty(testApkValue) {
+			err = fileExists(testApkValue)
+			if err != nil {
+				return empty, err
+			}
+		}
+	case platformValue == platformIOS:
+		iosValue, err = newIOSConfig()
 		if err != nil {
 			return empty, err
 		}
+	default:
+		return empty, errors.New(envKeyPlatform + " must be '" + platformAndroid + "' or '" + platformIOS + "'")
 	}
 
-	gcloudKeyBase64, err := getRequiredEnv(envKeyGcloud)
+	var testTypeValue string
+	var gameLoopValue gameLoopConfig
+	// the login of ROBO_LOGIN is masked like SECRET_ENVS
+	var roboValue roboConfig
+	if asyncValue.Mode != modeCollect {
+		testTypeValue, err = newTestType(platformValue, testApkValue, iosValue)
+		if err != nil {
+			return empty, err
+		}
+
+		gameLoopValue, err = newGameLoopConfig(platformValue, testTypeValue)
+		if err != nil {
+			return empty, err
+		}
+
+		roboValue, err = newRoboConfig(platformValue, testTypeValue)
+		if err != nil {
+			return empty, err
+		}
+	} else {
+		// game loop results are collected like after a run
+		testTypeValue, err = newCollectTestType()
+		if err != nil {
+			return empty, err
+		}
+	}
+
+	authValue, err := newAuthProvider(&http.Client{Timeout: keyDownloadTimeout})
 	if err != nil {
 		return empty, err
 	}
 
-	gcloudKey, err := base64.StdEncoding.DecodeString(gcloudKeyBase64)
+	if isEmpty(gcloudUserValue) {
+		gcloudUserValue = authValue.Email
+	}
+
+	if isEmpty(gcloudProjectValue) {
+		gcloudProjectValue = authValue.Project
+		if isEmpty(gcloudProjectValue) {
+			return empty, errors.New(envKeyGcloudProject + " not defined in env or gcloud key")
+		}
+	}
+
+	sensitiveFlagsValue := splitLines(getOptionalEnv(envKeySensitiveFlags))
+	if len(sensitiveFlagsValue) == 0 {
+		sensitiveFlagsValue = []string{"--environment-variables", "--robo-directives"}
+	}
+	for _, flag := range sensitiveFlagsValue {
+		if !strings.HasPrefix(flag, "--") {
+			return empty, errors.New(envKeySensitiveFlags + " must be gcloud flags like --environment-variables: '" + flag + "'")
+		}
+	}
+	secretEnvsValue := append(splitLines(getOptionalEnv(envKeySecretEnvs)), roboValue.LoginEnvs...)
+	for _, env := range secretEnvsValue {
+		if value := strings.TrimSpace(os.Getenv(env)); value != "" && len(value) < minNamedSecretLength {
+			log.Warnf("%s is shorter than %d characters and isn't masked", env, minNamedSecretLength)
+		}
+	}
+	redactorValue := newRedactor(secretEnvsValue, sensitiveFlagsValue, authValue.Key)
+
+	gcloudBucketValue, err := getRequiredEnv(envKeyGcloudBucket)
+	if err != nil {
+		return empty, err
+	}
+
+	gcloudOptionsValue := getOptionalEnv(envKeyGcloudOptions)
+
+	testOptionsValue, err := newTestOptions(platformValue)
 	if err != nil {
 		return empty, err
 	}
 
-	emptyGcloudUser := isEmpty(gcloudUserValue)
-	emptyGcloudProject := isEmpty(gcloudProjectValue)
+	coverageValue, err := newCoverage(platformValue, testTypeValue, asyncValue.Mode)
+	if err != nil {
+		return empty, err
+	}
+	if coverageValue && asyncValue.Mode != modeCollect {
+		testOptionsValue = testOptionsValue.withCoverage()
+	}
 
-	if emptyGcloudUser || emptyGcloudProject {
-		parsedKeyFile := GcloudKeyFile{}
-		err = json.Unmarshal([]byte(gcloudKey), &parsedKeyFile)
+	// Checked before anything is uploaded, a wrong apk would only fail in Test Lab.
+	var appManifestValue *apkManifest
+	if platformValue == platformAndroid && asyncValue.Mode != modeCollect {
+		appManifestValue, err = checkApks(appApkValue, testApkValue)
 		if err != nil {
 			return empty, err
 		}
 
-		if emptyGcloudUser {
-			gcloudUserValue = parsedKeyFile.ClientEmail
-			if isEmpty(gcloudUserValue) {
-				return empty, errors.New(envKeyGcloudUser + " not defined in env or gcloud key")
-
+		if testTypeValue == testTypeGameLoop {
+			err = checkGameLoop(appManifestValue, gameLoopValue)
+			if err != nil {
+				return empty, err
 			}
 		}
+	}
 
-		if emptyGcloudProject {
-			gcloudProjectValue = parsedKeyFile.ProjectID
-			if isEmpty(gcloudProjectValue) {
-				return empty, errors.New(envKeyGcloudProject + " not defined in env or gcloud key")
-			}
+	shardsValue := shardConfig{Count: 1}
+	rerunValue := rerunConfig{}
+	if asyncValue.Mode != modeCollect {
+		shardsValue, err = newShardConfig(platformValue, testApkValue, testOptionsValue, getOptionalEnv(envKeyGcloudOptions))
+		if err != nil {
+			return empty, err
+		}
+
+		rerunValue, err = newRerunConfig(platformValue, testApkValue)
+		if err != nil {
+			return empty, err
 		}
 	}
 
-	homeDir, err := getRequiredEnv(envKeyHome)
+	// A submitted matrix is collected by its ID, there is a single one and no gcloud command to re-run.
+	if asyncValue.Mode == modeSubmit && (shardsValue.Count > 1 || rerunValue.Attempts > 0) {
+		return empty, errors.New(envKeyMode + " submit can't be combined with " + envKeyNumShards + " or " + envKeyRerunFailedTests)
+	}
+
+	retryValue, err := newRetryPolicy()
 	if err != nil {
 		return empty, err
 	}
 
-	keyFilePath := path.Join(homeDir, "gcloudkey.json")
-	err = ioutil.WriteFile(keyFilePath, gcloudKey, 0644)
+	failOnInconclusiveValue, err := getOptionalBoolEnv(envKeyFailOnInconclusive, true)
 	if err != nil {
 		return empty, err
 	}
 
-	gcloudBucketValue, err := getRequiredEnv(envKeyGcloudBucket)
+	// Only a run waits for the outcome worth caching.
+	cacheResultsValue, err := getOptionalBoolEnv(envKeyCacheResults, false)
 	if err != nil {
 		return empty, err
 	}
+	cacheResultsValue = cacheResultsValue && asyncValue.Mode == modeRun
 
-	gcloudOptionsValue := getOptionalEnv(envKeyGcloudOptions)
-
-	return &firebaseConfig{
-		ResultsBucket: gcloudBucketValue,
-		User:          gcloudUserValue,
-		Project:       gcloudProjectValue,
-		KeyPath:       keyFilePath,
-		AppApk:        appApkValue,
-		TestApk:       testApkValue,
-		Options:       gcloudOptionsValue,
-		Debug:         false,
-	}, nil
-}
-
-func exportGcsDir(bucket string, object string) error {
-	gcsResultsDir := "gs://" + bucket + "/" + object
-	fmt.Println("Exporting ", gcsResultsDir, " ", gcsResultsDir)
-	cmdLog, err := exec.Command("bitrise", "envman", "add", "--key", gcsResultsDir, "--value", gcsResultsDir).CombinedOutput()
+	backendValue, err := newBackend(platformValue)
 	if err != nil {
-		return fmt.Errorf("Failed to export "+gcsResultsDir+", error: %#v | output: %s", err.Error(), cmdLog)
+		return empty, err
 	}
 
-	return nil
-}
-
-func buildGcloudCommand(config *firebaseConfig, gcsObject string) ([]string, error) {
-	empty := make([]string, 0)
-	if !config.Debug {
-		err := runCommand("gcloud config set project " + config.Project)
+	var stepTimeoutValue time.Duration
+	if timeoutValue := getOptionalEnv(envKeyStepTimeout); !isEmpty(timeoutValue) {
+		stepTimeoutValue, err = parseTimeout(envKeyStepTimeout, timeoutValue)
 		if err != nil {
 			return empty, err
 		}
+	}
+
+	config := &firebaseConfig{
+		Platform:           platformValue,
+		ResultsBucket:      gcloudBucketValue,
+		User:               gcloudUserValue,
+		Project:            gcloudProjectValue,
+		Auth:               authValue,
+		Redactor:           redactorValue,
+		AppApk:             appApkValue,
+		TestApk:            testApkValue,
+		TestType:           testTypeValue,
+		GameLoop:           gameLoopValue,
+		AppManifest:        appManifestValue,
+		IOS:                iosValue,
+		TestOptions:        testOptionsValue,
+		Robo:               roboValue,
+		Coverage:           coverageValue,
+		Shards:             shardsValue,
+		Rerun:              rerunValue,
+		Retry:              retryValue,
+		Async:              asyncValue,
+		Backend:            backendValue,
+		Runner:             execRunner{},
+		Matrices:           testingAPI{API: googleAPI{Tokens: gcloudTokens{Runner: execRunner{}}, Client: &http.Client{Timeout: apiCancelTimeout}}, Project: gcloudProjectValue, BaseURL: testingAPIURL},
+		StepTimeout:        stepTimeoutValue,
+		Options:            gcloudOptionsValue,
+		FailOnInconclusive: failOnInconclusiveValue,
+		CacheResults:       cacheResultsValue,
+	}
 
-		err = runCommand("gcloud auth activate-service-account --key-file " + config.KeyPath + " " + config.User)
+	// The api backend fails unsupported flags and test types before running anything.
+	if backendValue == backendAPI && asyncValue.Mode != modeCollect {
+		gcsCommand, err := buildGcloudCommand(config, "")
 		if err != nil {
 			return empty, err
 		}
+		err = checkAPITestRun(gcsCommand)
+		if err != nil {
+			return empty, err
+		}
+	}
+
+	return config, nil
+}
+
+// authenticate points gcloud at the project and logs in with the credentials of AUTH_MODE.
+// The api backend signs its own tokens with service account keys and needs no gcloud.
+func authenticate(config *firebaseConfig, output io.Writer) error {
+	log.Printf("Authenticating with %s", config.Auth)
+	if config.Backend == backendAPI && config.Auth.Type == credentialsServiceAccount {
+		return nil
 	}
 
+	login := config.Auth.loginCommand(config.KeyPath, config.User)
+	if login == nil {
+		// gcloud keeps its own configuration, newCredentials passes the project
+		return nil
+	}
+
+	commands := [][]string{
+		{"gcloud", "config", "set", "project", config.Project},
+		login,
+	}
+
+	for _, cmdSlice := range commands {
+		result, err := config.Runner.Run(cmdSlice, output)
+		if err != nil {
+			return err
+		}
+		if result.ExitCode != 0 {
+			return fmt.Errorf("%s failed with exit code %d", strings.Join(cmdSlice, " "), result.ExitCode)
+		}
+	}
+
+	return nil
+}
+
+func buildGcloudCommand(config *firebaseConfig, gcsObject string) ([]string, error) {
+	empty := make([]string, 0)
+
 	// https://cloud.google.com/sdk/gcloud/reference/firebase/test/android/run
+	// https://cloud.google.com/sdk/gcloud/reference/firebase/test/ios/run
 	userOptionsSlice, err := shellquote.Split(config.Options)
 	if err != nil {
 		return empty, err
@@ -158,25 +356,49 @@ func buildGcloudCommand(config *firebaseConfig, gcsObject string) ([]string, err
 	// Set --app, --test, --results-bucket, --results-dir and test type
 	// Use user values for flags if supplied.
 	args := make([]string, 0)
-	args = append(args, "gcloud", "firebase", "test", "android", "run")
+	args = append(args, "gcloud", "firebase", "test", config.Platform, "run")
 
 	const TypeFlag = "--type"
 	const TestFlag = "--test"
 	const AppFlag = "--app"
+	const XCTestRunFileFlag = "--xctestrun-file"
 	const ResultsBucketFlag = "--results-bucket="
 	const ResultsDirFlag = "--results-dir="
 
-	if isEmpty(config.TestApk) {
-		args = append(args, TypeFlag, "robo")
+	if config.Platform == platformIOS {
+		if isEmpty(config.IOS.AppIpa) {
+			args = append(args, TypeFlag, testTypeXCTest)
+			if !hasGcloudFlag(userOptionsSet, TestFlag) {
+				args = append(args, TestFlag, config.IOS.XCTestZip)
+			}
+			if !isEmpty(config.IOS.XCTestRunFile) && !hasGcloudFlag(userOptionsSet, XCTestRunFileFlag) {
+				args = append(args, XCTestRunFileFlag, config.IOS.XCTestRunFile)
+			}
+		} else {
+			args = append(args, TypeFlag, testTypeGameLoop)
+			if !hasGcloudFlag(userOptionsSet, AppFlag) {
+				args = append(args, AppFlag, config.IOS.AppIpa)
+			}
+			args = append(args, config.GameLoop.gcloudFlags(userOptionsSet)...)
+		}
 	} else {
-		args = append(args, TypeFlag, "instrumentation")
-		if !userOptionsSet[TestFlag] {
-			args = append(args, "--test", config.TestApk)
+		switch {
+		case config.TestType == testTypeGameLoop:
+			args = append(args, TypeFlag, testTypeGameLoop)
+			args = append(args, config.GameLoop.gcloudFlags(userOptionsSet)...)
+		case isEmpty(config.TestApk):
+			args = append(args, TypeFlag, testTypeRobo)
+			args = append(args, config.Robo.gcloudFlags(userOptionsSet)...)
+		default:
+			args = append(args, TypeFlag, testTypeInstrumentation)
+			if !hasGcloudFlag(userOptionsSet, TestFlag) {
+				args = append(args, "--test", config.TestApk)
+			}
 		}
-	}
 
-	if !userOptionsSet[AppFlag] {
-		args = append(args, AppFlag, config.AppApk)
+		if !hasGcloudFlag(userOptionsSet, AppFlag) {
+			args = append(args, AppFlag, config.AppApk)
+		}
 	}
 	if !userOptionsSet[ResultsBucketFlag] {
 		args = append(args, ResultsBucketFlag+config.ResultsBucket)
@@ -185,45 +407,264 @@ func buildGcloudCommand(config *firebaseConfig, gcsObject string) ([]string, err
 		args = append(args, ResultsDirFlag+gcsObject)
 	}
 
-	// Don't export results bucket when it's user defined.
-	if !userOptionsSet[ResultsBucketFlag] || !userOptionsSet[ResultsDirFlag] {
-		err = exportGcsDir(config.ResultsBucket, gcsObject)
+	const AsyncFlag = "--async"
+	if config.Async.Mode == modeSubmit && !userOptionsSet[AsyncFlag] {
+		args = append(args, AsyncFlag)
+	}
+
+	args = append(args, config.TestOptions.gcloudFlags(userOptionsSet)...)
+
+	return append(args, userOptionsSlice...), nil
+}
+
+// runTestMatrix runs gcloud, retrying infrastructure failures, and maps the final
+// exit code to the step outcome.
+func runTestMatrix(config *firebaseConfig, gcsCommand []string, output io.Writer) (testOutcome, error) {
+	// Note that gcloud CLI has a transparent retry of 3 on top of config.Retry.
+	attempts, err := config.Retry.run(config.Runner, gcsCommand, output)
+	if err != nil {
+		return testOutcome{}, err
+	}
+
+	last := attempts[len(attempts)-1]
+	outcome := newTestOutcome(last.ExitCode, config.FailOnInconclusive)
+	outcome.ResultsDir = last.ResultsDir
+	outcome.Attempts = attempts
+	return outcome, nil
+}
+
+// runTestMatrices runs gcsCommand, or one command per shard when sharding is enabled.
+func runTestMatrices(config *firebaseConfig, gcsCommand []string, output io.Writer) (testOutcome, error) {
+	if config.Shards.Count <= 1 {
+		return runTestMatrix(config, gcsCommand, output)
+	}
+
+	shards := splitShards(config.Shards.Classes, config.Shards.Count)
+	log.Infof("Running %d test classes in %d shards, %d at a time", len(config.Shards.Classes), len(shards), config.Shards.MaxConcurrent)
+
+	outcomes, err := runShards(config, shardCommands(gcsCommand, shards), config.Shards.MaxConcurrent, output)
+	if err != nil {
+		return testOutcome{}, err
+	}
+
+	// Every shard and its retries write below the parent results dir.
+	outcome := worstOutcome(outcomes)
+	outcome.ResultsDir = gcloudFlagValue(gcsCommand, "--results-dir")
+	outcome.Attempts = nil
+	for _, shardOutcome := range outcomes {
+		outcome.ShardResultsDirs = append(outcome.ShardResultsDirs, shardOutcome.ResultsDir)
+		outcome.Attempts = append(outcome.Attempts, shardOutcome.Attempts...)
+	}
+	return outcome, nil
+}
+
+// run authenticates, runs the test matrices, collects the results and exports the step outputs.
+func run(config *firebaseConfig, storage resultsStorage, output io.Writer) (testOutcome, error) {
+	err := authenticate(config, output)
+	if err != nil {
+		return testOutcome{}, err
+	}
+
+	err = resolveDeviceCriteria(config)
+	if err != nil {
+		return testOutcome{}, err
+	}
+
+	err = validateDevices(config)
+	if err != nil {
+		return testOutcome{}, err
+	}
+
+	err = uploadApps(config, storage)
+	if err != nil {
+		return testOutcome{}, err
+	}
+
+	gcsCommand, err := buildGcloudCommand(config, newGcsObjectName())
+	if err != nil {
+		return testOutcome{}, err
+	}
+
+	log.Printf("%s", config.Redactor.Command(gcsCommand))
+	_, _ = fmt.Fprintln(output)
+
+	bucket := gcloudFlagValue(gcsCommand, "--results-bucket")
+	cache, err := newResultCache(config, storage, bucket, gcsCommand)
+	if err != nil {
+		return testOutcome{}, err
+	}
+
+	outcome, cached := testOutcome{}, false
+	if cache != nil {
+		outcome, cached, err = cache.Lookup()
 		if err != nil {
-			return empty, err
+			return testOutcome{}, err
+		}
+		err = exportOutputs(config.Runner, []stepOutput{cacheOutput(cached)})
+		if err != nil {
+			return testOutcome{}, err
 		}
 	}
 
-	if config.Debug {
-		fmt.Println("auto args: ", args)
-		fmt.Println("user args: ", userOptionsSlice)
+	resultsDir := gcloudFlagValue(gcsCommand, "--results-dir")
+	if cached {
+		resultsDir = outcome.ResultsDir
+	}
+	err = exportOutputs(config.Runner, locationOutputs(bucket, resultsDir))
+	if err != nil {
+		return testOutcome{}, err
 	}
 
-	return append(args, userOptionsSlice...), nil
+	// The matrices of the run and of the re-runs of failed tests are cancelled when the step
+	// fails while they may still run, e.g. when it was aborted, they would keep running without gcloud.
+	tracker := &matrixTracker{out: output}
+	cancelOnError := func(outcome testOutcome, err error) (testOutcome, error) {
+		if err != nil {
+			cancelMatrices(config.Matrices, tracker.MatrixIDs())
+		}
+		return outcome, err
+	}
+
+	if !cached {
+		outcome, err = runTestMatrices(config, gcsCommand, tracker)
+		if err != nil {
+			return cancelOnError(outcome, err)
+		}
+	}
+
+	if config.Async.Mode == modeSubmit {
+		if outcome.ExitCode == exitCodeSuccess {
+			submitted := newSubmittedOutcome()
+			submitted.ResultsDir, submitted.Attempts = outcome.ResultsDir, outcome.Attempts
+			outcome = submitted
+		}
+		return outcome, reportResults(config, bucket, outcome, junitTestSuites{}, "")
+	}
+
+	outcome, report, reportPath, err := collectResults(config, storage, bucket, gcsCommand, outcome, tracker)
+	if err != nil {
+		return cancelOnError(outcome, err)
+	}
+	if config.TestType == testTypeGameLoop {
+		err = collectGameLoopResults(config, storage, bucket, outcome.ResultsDir)
+		if err != nil {
+			return cancelOnError(outcome, err)
+		}
+	}
+	if config.Coverage {
+		err = collectCoverage(config, storage, bucket, outcome)
+		if err != nil {
+			return cancelOnError(outcome, err)
+		}
+	}
+	if cache != nil && !cached {
+		cache.Store(outcome)
+	}
+
+	return cancelOnError(outcome, reportResults(config, bucket, outcome, report, reportPath))
+}
+
+// reportResults logs the run summary, writes it into the deploy dir and exports the result outputs.
+func reportResults(config *firebaseConfig, bucket string, outcome testOutcome, report junitTestSuites, reportPath string) error {
+	summary := newRunSummary(bucket, outcome, report, reportPath)
+	summary.Robo = config.Robo.summary()
+	logRunSummary(summary)
+
+	summaryPath := ""
+	if deployDir := getOptionalEnv(envKeyDeployDir); !isEmpty(deployDir) {
+		summaryPath = filepath.Join(deployDir, summaryFileName)
+		err := writeRunSummary(summary, summaryPath, config.Redactor)
+		if err != nil {
+			return err
+		}
+	}
+
+	return exportOutputs(config.Runner, resultOutputs(summary, summaryPath))
 }
 
 func main() {
+	console := newConsoleRedactor().Writer(os.Stdout)
+	log.SetOutWriter(console)
+	consoleOutput = console
+	onExit(console.Flush)
+
 	config, err := newFirebaseConfig()
 	fatalError(err)
+	console.SetRedactor(config.Redactor)
 
-	gcsCommand, err := buildGcloudCommand(config, newGcsObjectName())
+	creds, err := newCredentials(config)
 	fatalError(err)
+	onExit(creds.Remove)
 
-	log.Printf(command.PrintableCommandArgs(false, gcsCommand))
-	fmt.Println()
+	ctx, stop := newStepContext(config.StepTimeout)
+	defer stop()
 
-	const InfrastructureFailure = 20
-	const TryCount = 3
+	storage, err := setupBackend(config, ctx)
+	fatalError(err)
 
-	// Note that gcloud CLI has a transparent retry of 3.
-	// Retrying 3x here means we try up to 9 times in total.
-	for i := 1; i <= TryCount; i++ {
-		exitCode, err := runCommandSlice(gcsCommand)
-		fatalError(err)
+	var outcome testOutcome
+	if config.Async.Mode == modeCollect {
+		outcome, err = collect(config, storage, console)
+	} else {
+		outcome, err = run(config, storage, console)
+	}
+	fatalError(abortError(ctx, config.StepTimeout, err))
 
-		if exitCode != InfrastructureFailure {
-			break
+	if outcome.Passed {
+		log.Donef("Test outcome: %s", outcome)
+	} else {
+		log.Errorf("Test outcome: %s", outcome)
+	}
+
+	exit(outcome.StepExitCode())
+}
+
+// collectResults merges the JUnit results of the run into the deploy dir, re-running
+// failed tests of gcsCommand first when enabled. Failing to fetch results doesn't fail the step.
+// Returns the merged report and its path, empty when it wasn't written.
+func collectResults(config *firebaseConfig, storage resultsStorage, bucket string, gcsCommand []string, outcome testOutcome, output io.Writer) (testOutcome, junitTestSuites, string, error) {
+	resultsDir := outcome.ResultsDir
+
+	report, err := fetchJUnitReport(storage, bucket, outcome)
+	if err != nil {
+		log.Warnf("Failed to collect JUnit results: %s", err)
+		return outcome, junitTestSuites{}, "", nil
+	}
+	if len(report.Suites) == 0 {
+		log.Warnf("No test_result_*.xml found in gs://%s/%s", bucket, resultsDir)
+		return outcome, report, "", nil
+	}
+
+	if config.Rerun.Attempts > 0 && outcome.ExitCode == exitCodeTestFailure {
+		var rerunAttempts []retryAttempt
+		report, rerunAttempts, err = rerunFailedTests(config, storage, gcsCommand, report, output)
+		// the re-run matrices are listed in the outputs and the summary after the ones they re-run
+		outcome.Attempts = append(outcome.Attempts, rerunAttempts...)
+		if err != nil {
+			return outcome, report, "", err
+		}
+		outcome = rerunOutcome(report, outcome, config.Rerun.FailOnFlaky)
+	}
+
+	if flaky := flakyTests(report); len(flaky) > 0 {
+		log.Warnf("Flaky tests, passed on re-run:")
+		for _, test := range flaky {
+			log.Warnf("- %s", test)
 		}
 	}
 
-	os.Exit(0)
+	deployDir := getOptionalEnv(envKeyDeployDir)
+	if isEmpty(deployDir) {
+		log.Warnf("%s is not defined, skipping JUnit report", envKeyDeployDir)
+		return outcome, report, "", nil
+	}
+
+	reportPath := filepath.Join(deployDir, junitReportFileName)
+	err = writeJUnitReport(report, reportPath, config.Redactor)
+	if err != nil {
+		return outcome, report, "", err
+	}
+	log.Donef("JUnit report: %s", reportPath)
+
+	return outcome, report, reportPath, nil
 }
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Chunk types of the binary XML format aapt compiles AndroidManifest.xml into:
+// https://android.googlesource.com/platform/frameworks/base/+/master/libs/androidfw/include/androidfw/ResourceTypes.h
+const (
+	axmlStringPoolType   = 0x0001
+	axmlXMLType          = 0x0003
+	axmlStartElementType = 0x0102
+
+	axmlUTF8Flag   = 1 << 8
+	axmlNoIndex    = 0xFFFFFFFF
+	axmlTypeString = 0x03
+	axmlTypeIntDec = 0x10
+	axmlTypeIntHex = 0x11
+)
+
+// apkManifest holds what the pre-flight checks need from an AndroidManifest.xml.
+type apkManifest struct {
+	Package   string
+	MinSdk    int
+	TargetSdk int
+	// TargetPackages of the declared instrumentations, the apps a test apk tests.
+	TargetPackages []string
+	// GameLoop is true when an activity handles the game loop intent.
+	GameLoop bool
+	// GameLoops is the number of loops of the com.google.test.loops meta-data, 0 when not declared.
+	GameLoops int
+	// GameLoopLabels are the scenario labels declared as com.google.test.loops.<label>.
+	GameLoopLabels []string
+}
+
+// readApkManifest parses the binary AndroidManifest.xml of the apk at apkPath.
+func readApkManifest(apkPath string) (apkManifest, error) {
+	reader, err := zip.OpenReader(apkPath)
+	if err != nil {
+		return apkManifest{}, errors.New("failed to open apk '" + apkPath + "': " + err.Error())
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	for _, file := range reader.File {
+		if file.Name != "AndroidManifest.xml" {
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return apkManifest{}, err
+		}
+		data, err := ioutil.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return apkManifest{}, err
+		}
+
+		manifest, err := parseManifest(data)
+		if err != nil {
+			return apkManifest{}, fmt.Errorf("%s: %s", file.Name, err)
+		}
+		return manifest, nil
+	}
+
+	return apkManifest{}, errors.New("no AndroidManifest.xml in '" + apkPath + "'")
+}
+
+// parseManifest reads the package, uses-sdk, instrumentation, intent action and meta-data
+// elements of a binary manifest.
+func parseManifest(data []byte) (apkManifest, error) {
+	manifest := apkManifest{TargetPackages: []string{}}
+
+	if len(data) < 8 || binary.LittleEndian.Uint16(data) != axmlXMLType {
+		return manifest, errors.New("not a binary XML file")
+	}
+
+	var pool []string
+	minSdk, targetSdk := "", ""
+	offset := uint32(binary.LittleEndian.Uint16(data[2:]))
+	for uint64(offset)+8 <= uint64(len(data)) {
+		chunkType := binary.LittleEndian.Uint16(data[offset:])
+		chunkSize := binary.LittleEndian.Uint32(data[offset+4:])
+		if chunkSize < 8 || uint64(offset)+uint64(chunkSize) > uint64(len(data)) {
+			return manifest, errors.New("truncated chunk")
+		}
+		chunk := data[offset : offset+chunkSize]
+		offset += chunkSize
+
+		switch chunkType {
+		case axmlStringPoolType:
+			var err error
+			pool, err = parseStringPool(chunk)
+			if err != nil {
+				return manifest, err
+			}
+		case axmlStartElementType:
+			name, attributes, err := parseStartElement(chunk, pool)
+			if err != nil {
+				return manifest, err
+			}
+
+			switch name {
+			case "manifest":
+				manifest.Package = attributes["package"]
+			case "uses-sdk":
+				minSdk, targetSdk = attributes["minSdkVersion"], attributes["targetSdkVersion"]
+			case "instrumentation":
+				manifest.TargetPackages = append(manifest.TargetPackages, attributes["targetPackage"])
+			case "action":
+				manifest.GameLoop = manifest.GameLoop || attributes["name"] == gameLoopAction
+			case "meta-data":
+				if name := attributes["name"]; name == gameLoopsMetaData {
+					manifest.GameLoops, _ = strconv.Atoi(attributes["value"])
+				} else if strings.HasPrefix(name, gameLoopsMetaData+".") {
+					manifest.GameLoopLabels = append(manifest.GameLoopLabels, strings.TrimPrefix(name, gameLoopsMetaData+"."))
+				}
+			}
+		}
+	}
+
+	if isEmpty(manifest.Package) {
+		return manifest, errors.New("no package name")
+	}
+
+	// minSdk defaults to 1 and targetSdk to minSdk, preview codenames are ignored the same way.
+	manifest.MinSdk = 1
+	if value, err := strconv.Atoi(minSdk); err == nil {
+		manifest.MinSdk = value
+	}
+	manifest.TargetSdk = manifest.MinSdk
+	if value, err := strconv.Atoi(targetSdk); err == nil {
+		manifest.TargetSdk = value
+	}
+
+	return manifest, nil
+}
+
+// parseStringPool decodes the UTF-8 or UTF-16 strings of a ResStringPool chunk.
+func parseStringPool(chunk []byte) ([]string, error) {
+	if len(chunk) < 28 {
+		return nil, errors.New("truncated string pool")
+	}
+	headerSize := uint32(binary.LittleEndian.Uint16(chunk[2:]))
+	count := binary.LittleEndian.Uint32(chunk[8:])
+	flags := binary.LittleEndian.Uint32(chunk[16:])
+	stringsStart := binary.LittleEndian.Uint32(chunk[20:])
+	if uint64(headerSize)+uint64(count)*4 > uint64(len(chunk)) {
+		return nil, errors.New("truncated string pool")
+	}
+
+	pool := make([]string, 0, count)
+	for i := uint32(0); i < count; i++ {
+		start := uint64(stringsStart) + uint64(binary.LittleEndian.Uint32(chunk[headerSize+i*4:]))
+		if start >= uint64(len(chunk)) {
+			return nil, errors.New("string out of the string pool")
+		}
+
+		var value string
+		var err error
+		if flags&axmlUTF8Flag != 0 {
+			value, err = utf8PoolString(chunk[start:])
+		} else {
+			value, err = utf16PoolString(chunk[start:])
+		}
+		if err != nil {
+			return nil, err
+		}
+		pool = append(pool, value)
+	}
+
+	return pool, nil
+}
+
+// utf8PoolString reads a string prefixed with its length in characters, then in bytes.
+func utf8PoolString(data []byte) (string, error) {
+	length := func(data []byte) (int, int) {
+		if len(data) > 1 && data[0]&0x80 != 0 {
+			return int(data[0]&0x7F)<<8 | int(data[1]), 2
+		}
+		return int(data[0]), 1
+	}
+
+	_, skip := length(data)
+	if skip >= len(data) {
+		return "", errors.New("truncated string")
+	}
+	size, sizeLen := length(data[skip:])
+	start := skip + sizeLen
+	if start+size > len(data) {
+		return "", errors.New("truncated string")
+	}
+	return string(data[start : start+size]), nil
+}
+
+// utf16PoolString reads a string prefixed with its length in UTF-16 code units.
+func utf16PoolString(data []byte) (string, error) {
+	if len(data) < 2 {
+		return "", errors.New("truncated string")
+	}
+	size, start := int(binary.LittleEndian.Uint16(data)), 2
+	if size&0x8000 != 0 {
+		if len(data) < 4 {
+			return "", errors.New("truncated string")
+		}
+		size, start = (size&0x7FFF)<<16|int(binary.LittleEndian.Uint16(data[2:])), 4
+	}
+	if start+size*2 > len(data) {
+		return "", errors.New("truncated string")
+	}
+
+	units := make([]uint16, size)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(data[start+i*2:])
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// parseStartElement returns the name and the string and integer attributes of a
+// ResXMLTree_attrExt chunk, integers formatted in decimal.
+func parseStartElement(chunk []byte, pool []string) (string, map[string]string, error) {
+	lookup := func(index uint32) string {
+		if index == axmlNoIndex || index >= uint32(len(pool)) {
+			return ""
+		}
+		return pool[index]
+	}
+
+	headerSize := uint32(binary.LittleEndian.Uint16(chunk[2:]))
+	if uint32(len(chunk)) < headerSize+20 {
+		return "", nil, errors.New("truncated element")
+	}
+	ext := chunk[headerSize:]
+	name := lookup(binary.LittleEndian.Uint32(ext[4:]))
+	attributeStart := uint32(binary.LittleEndian.Uint16(ext[8:]))
+	attributeSize := uint32(binary.LittleEndian.Uint16(ext[10:]))
+	attributeCount := uint32(binary.LittleEndian.Uint16(ext[12:]))
+	if attributeSize < 20 || uint64(attributeStart)+uint64(attributeCount)*uint64(attributeSize) > uint64(len(ext)) {
+		return "", nil, errors.New("truncated attributes of <" + name + ">")
+	}
+
+	attributes := map[string]string{}
+	for i := uint32(0); i < attributeCount; i++ {
+		attribute := ext[attributeStart+i*attributeSize:]
+		rawValue := binary.LittleEndian.Uint32(attribute[8:])
+		dataType := attribute[15]
+		data := binary.LittleEndian.Uint32(attribute[16:])
+
+		value := lookup(rawValue)
+		switch dataType {
+		case axmlTypeString:
+			value = lookup(data)
+		case axmlTypeIntDec, axmlTypeIntHex:
+			value = strconv.Itoa(int(int32(data)))
+		}
+		attributes[lookup(binary.LittleEndian.Uint32(attribute[4:]))] = value
+	}
+
+	return name, attributes, nil
+}
+
+// checkApks reads the manifests of APP_APK and TEST_APK before anything is uploaded. The test
+// apk must instrument the app. Returns nil when a manifest can't be read, gcloud reports
+// broken apks itself.
+func checkApks(appApk string, testApk string) (*apkManifest, error) {
+	app, err := readApkManifest(appApk)
+	if err != nil {
+		log.Warnf("Failed to read the manifest of %s, skipping the apk checks: %s", envKeyAppApk, err)
+		return nil, nil
+	}
+	log.Printf("%s: %s, minSdk %d, targetSdk %d", envKeyAppApk, app.Package, app.MinSdk, app.TargetSdk)
+
+	if !isEmpty(testApk) {
+		test, err := readApkManifest(testApk)
+		if err != nil {
+			log.Warnf("Failed to read the manifest of %s, skipping the apk checks: %s", envKeyTestApk, err)
+			return &app, nil
+		}
+		if len(test.TargetPackages) == 0 {
+			return nil, errors.New(envKeyTestApk + " " + test.Package + " declares no instrumentation")
+		}
+		instrumentsApp := false
+		for _, targetPackage := range test.TargetPackages {
+			instrumentsApp = instrumentsApp || targetPackage == app.Package
+		}
+		if !instrumentsApp {
+			return nil, errors.New(envKeyTestApk + " " + test.Package + " instruments " + strings.Join(test.TargetPackages, ", ") + ", not " + app.Package + " of " + envKeyAppApk)
+		}
+	}
+
+	return &app, nil
+}
+
+// checkMinSdk fails when a device runs an API level below the minSdk of app, which is
+// nil when its manifest couldn't be read.
+func checkMinSdk(app *apkManifest, devices []device) error {
+	if app == nil {
+		return nil
+	}
+	for _, d := range devices {
+		version, err := strconv.Atoi(d.Version)
+		if err != nil {
+			continue
+		}
+		if version < app.MinSdk {
+			return fmt.Errorf("device %s runs API level %d, below the minSdk %d of %s", d, version, app.MinSdk, app.Package)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"unicode/utf16"
+)
+
+// manifestElement is a start element of BuildManifest, attribute values are strings or ints.
+type manifestElement struct {
+	Name       string
+	Attributes map[string]interface{}
+}
+
+// BuildManifest writes a binary manifest with a string pool, a namespace and the start
+// elements, UTF-8 encoded like aapt2 does or UTF-16 like aapt.
+func BuildManifest(elements []manifestElement, utf8 bool) []byte {
+	strs := make([]string, 0)
+	index := make(map[string]uint32)
+	add := func(s string) uint32 {
+		if _, ok := index[s]; !ok {
+			index[s] = uint32(len(strs))
+			strs = append(strs, s)
+		}
+		return index[s]
+	}
+	add("android")
+	add("http://schemas.android.com/apk/res/android")
+
+	buf := make([]byte, 0)
+	appendUint16 := func(value uint16) {
+		b := make([]byte, 2)
+		binary.LittleEndian.PutUint16(b, value)
+		buf = append(buf, b...)
+	}
+	appendUint32 := func(value uint32) {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, value)
+		buf = append(buf, b...)
+	}
+
+	nodes := make([]byte, 0)
+	for _, element := range elements {
+		names := make([]string, 0, len(element.Attributes))
+		for name := range element.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		buf = buf[:0]
+		appendUint16(axmlStartElementType)
+		appendUint16(16)
+		appendUint32(uint32(16 + 20 + 20*len(names)))
+		appendUint32(1)          // line number
+		appendUint32(0xFFFFFFFF) // comment
+		appendUint32(0xFFFFFFFF) // namespace
+		appendUint32(add(element.Name))
+		appendUint16(20) // attribute start
+		appendUint16(20) // attribute size
+		appendUint16(uint16(len(names)))
+		appendUint16(0)
+		appendUint16(0)
+		appendUint16(0)
+		for _, name := range names {
+			appendUint32(index["http://schemas.android.com/apk/res/android"])
+			appendUint32(add(name))
+			switch value := element.Attributes[name].(type) {
+			case int:
+				appendUint32(0xFFFFFFFF)
+				appendUint16(8)
+				buf = append(buf, 0, axmlTypeIntDec)
+				appendUint32(uint32(value))
+			case string:
+				appendUint32(add(value))
+				appendUint16(8)
+				buf = append(buf, 0, axmlTypeString)
+				appendUint32(add(value))
+			}
+		}
+		nodes = append(nodes, buf...)
+	}
+
+	// the namespace of the android: attributes
+	buf = buf[:0]
+	appendUint16(0x0100)
+	appendUint16(16)
+	appendUint32(24)
+	appendUint32(1)
+	appendUint32(0xFFFFFFFF)
+	appendUint32(0)
+	appendUint32(1)
+	nodes = append(append([]byte{}, buf...), nodes...)
+
+	data := make([]byte, 0)
+	offsets := make([]uint32, 0, len(strs))
+	for _, s := range strs {
+		offsets = append(offsets, uint32(len(data)))
+		buf = buf[:0]
+		if utf8 {
+			buf = append(buf, byte(len([]rune(s))), byte(len(s)))
+			buf = append(buf, s...)
+			buf = append(buf, 0)
+		} else {
+			units := utf16.Encode([]rune(s))
+			appendUint16(uint16(len(units)))
+			for _, unit := range units {
+				appendUint16(unit)
+			}
+			appendUint16(0)
+		}
+		data = append(data, buf...)
+	}
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+
+	flags := uint32(0)
+	if utf8 {
+		flags = axmlUTF8Flag
+	}
+	buf = buf[:0]
+	stringsStart := uint32(28 + 4*len(strs))
+	appendUint16(axmlStringPoolType)
+	appendUint16(28)
+	appendUint32(stringsStart + uint32(len(data)))
+	appendUint32(uint32(len(strs)))
+	appendUint32(0) // styles
+	appendUint32(flags)
+	appendUint32(stringsStart)
+	appendUint32(0)
+	for _, offset := range offsets {
+		appendUint32(offset)
+	}
+	pool := append(append([]byte{}, buf...), data...)
+
+	buf = buf[:0]
+	appendUint16(axmlXMLType)
+	appendUint16(8)
+	appendUint32(uint32(8 + len(pool) + len(nodes)))
+	return append(append(buf, pool...), nodes...)
+}
+
+// AppManifest is the manifest of com.example.app, minSdk 21 and targetSdk 28.
+func AppManifest() []byte {
+	return BuildManifest([]manifestElement{
+		{Name: "manifest", Attributes: map[string]interface{}{"package": "com.example.app", "versionCode": 3}},
+		{Name: "uses-sdk", Attributes: map[string]interface{}{"minSdkVersion": 21, "targetSdkVersion": 28}},
+		{Name: "application", Attributes: map[string]interface{}{"label": "Example"}},
+	}, false)
+}
+
+// InstrumentationManifest is the manifest of com.example.app.test instrumenting targetPackage.
+func InstrumentationManifest(targetPackage string) []byte {
+	return BuildManifest([]manifestElement{
+		{Name: "manifest", Attributes: map[string]interface{}{"package": "com.example.app.test"}},
+		{Name: "uses-sdk", Attributes: map[string]interface{}{"minSdkVersion": 21}},
+		{Name: "instrumentation", Attributes: map[string]interface{}{"name": "androidx.test.runner.AndroidJUnitRunner", "targetPackage": targetPackage}},
+	}, true)
+}
+
+func TestParseManifest(t *testing.T) {
+	assert := assert.New(t)
+
+	manifest, err := parseManifest(AppManifest())
+	assert.NoError(err)
+	assert.Equal(apkManifest{Package: "com.example.app", MinSdk: 21, TargetSdk: 28, TargetPackages: []string{}}, manifest)
+
+	manifest, err = parseManifest(InstrumentationManifest("com.example.app"))
+	assert.NoError(err)
+	assert.Equal(apkManifest{Package: "com.example.app.test", MinSdk: 21, TargetSdk: 21, TargetPackages: []string{"com.example.app"}}, manifest)
+
+	manifest, err = parseManifest(GameLoopManifest())
+	assert.NoError(err)
+	assert.True(manifest.GameLoop)
+	assert.Equal(5, manifest.GameLoops)
+	assert.Equal([]string{"smoke", "performance"}, manifest.GameLoopLabels)
+
+	//- without uses-sdk, a preview codename
+	manifest, err = parseManifest(BuildManifest([]manifestElement{
+		{Name: "manifest", Attributes: map[string]interface{}{"package": "com.example.app"}},
+	}, true))
+	assert.NoError(err)
+	assert.Equal(1, manifest.MinSdk)
+	assert.Equal(1, manifest.TargetSdk)
+
+	manifest, err = parseManifest(BuildManifest([]manifestElement{
+		{Name: "manifest", Attributes: map[string]interface{}{"package": "com.example.app"}},
+		{Name: "uses-sdk", Attributes: map[string]interface{}{"minSdkVersion": "Q", "targetSdkVersion": "29"}},
+	}, false))
+	assert.NoError(err)
+	assert.Equal(1, manifest.MinSdk)
+	assert.Equal(29, manifest.TargetSdk)
+
+	_, err = parseManifest([]byte(`<manifest package="com.example.app"/>`))
+	assert.EqualError(err, "not a binary XML file")
+
+	data := AppManifest()
+	_, err = parseManifest(data[:len(data)-10])
+	assert.EqualError(err, "truncated chunk")
+
+	_, err = parseManifest(BuildManifest([]manifestElement{{Name: "manifest"}}, true))
+	assert.EqualError(err, "no package name")
+}
+
+func TestParseManifestChunkSizes(t *testing.T) {
+	assert := assert.New(t)
+
+	//- the first chunk would wrap the offset around in 32 bits
+	data := AppManifest()
+	binary.LittleEndian.PutUint32(data[12:], 0xFFFFFFF8)
+	_, err := parseManifest(data)
+	assert.EqualError(err, "truncated chunk")
+
+	//- oversized sizes and counts anywhere fail without panicking
+	for _, size := range []uint32{0xFFFFFFFF, 0xFFFFFFF8, 0x80000000, 0x7FFFFFFF} {
+		for i := 0; i+4 <= len(AppManifest()); i += 4 {
+			data := AppManifest()
+			binary.LittleEndian.PutUint32(data[i:], size)
+			assert.NotPanics(func() {
+				_, _ = parseManifest(data)
+			}, "%#x at %d", size, i)
+		}
+	}
+}
+
+func TestCheckApks(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "manifest")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	appApk := filepath.Join(tmpDir, "app.apk")
+	WriteZipFiles(appApk, map[string][]byte{"AndroidManifest.xml": AppManifest(), "classes.dex": nil})
+	testApk := filepath.Join(tmpDir, "test.apk")
+	WriteZipFiles(testApk, map[string][]byte{"AndroidManifest.xml": InstrumentationManifest("com.example.app")})
+	otherApk := filepath.Join(tmpDir, "other.apk")
+	WriteZipFiles(otherApk, map[string][]byte{"AndroidManifest.xml": InstrumentationManifest("com.example.other")})
+	brokenApk := filepath.Join(tmpDir, "broken.apk")
+	WriteZipFiles(brokenApk, map[string][]byte{"AndroidManifest.xml": nil})
+
+	manifest, err := checkApks(appApk, testApk)
+	assert.NoError(err)
+	assert.Equal("com.example.app", manifest.Package)
+
+	_, err = checkApks(appApk, otherApk)
+	assert.EqualError(err, envKeyTestApk+" com.example.app.test instruments com.example.other, not com.example.app of "+envKeyAppApk)
+
+	_, err = checkApks(appApk, appApk)
+	assert.EqualError(err, envKeyTestApk+" com.example.app declares no instrumentation")
+
+	assert.NoError(checkMinSdk(manifest, []device{{Model: "NexusLowRes", Version: "21"}, {Model: "Pixel2", Version: "28"}}))
+	err = checkMinSdk(manifest, []device{{Model: "Nexus5", Version: "19", Locale: "de"}})
+	assert.EqualError(err, "device model=Nexus5,version=19,locale=de runs API level 19, below the minSdk 21 of com.example.app")
+	assert.NoError(checkMinSdk(nil, []device{{Model: "Nexus5", Version: "19"}}))
+
+	//- unreadable manifests skip the checks
+	manifest, err = checkApks(brokenApk, otherApk)
+	assert.NoError(err)
+	assert.Nil(manifest)
+
+	manifest, err = checkApks(appApk, brokenApk)
+	assert.NoError(err)
+	assert.Equal(21, manifest.MinSdk)
+
+	_, err = readApkManifest(filepath.Join(tmpDir, "missing.apk"))
+	assert.Error(err)
+	noManifestApk := filepath.Join(tmpDir, "no_manifest.apk")
+	WriteZipFiles(noManifestApk, map[string][]byte{"classes.dex": nil})
+	_, err = readApkManifest(noManifestApk)
+	assert.EqualError(err, "no AndroidManifest.xml in '"+noManifestApk+"'")
+}
+
+func TestNewFirebaseConfigChecksApks(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	tmpDir, err := ioutil.TempDir("", "manifest")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	appApk := filepath.Join(tmpDir, "app.apk")
+	WriteZipFiles(appApk, map[string][]byte{"AndroidManifest.xml": AppManifest()})
+	testApk := filepath.Join(tmpDir, "test.apk")
+	WriteZipFiles(testApk, map[string][]byte{"AndroidManifest.xml": InstrumentationManifest("com.example.app")})
+
+	setupOptionsEnv()
+	Setenv(envKeyAppApk, appApk)
+	Setenv(envKeyTestApk, testApk)
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal(28, config.AppManifest.TargetSdk)
+
+	//- devices below the minSdk fail once they're resolved, however they were chosen
+	Setenv(envKeyDevices, "model=NexusLowRes,version=19")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	err = validateDevices(config)
+	assert.EqualError(err, "device model=NexusLowRes,version=19 runs API level 19, below the minSdk 21 of com.example.app")
+
+	Setenv(envKeyDevices, "")
+	Setenv(envKeyGcloudOptions, "--device=model=Nexus5,version=19")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	err = validateDevices(config)
+	assert.EqualError(err, "device model=Nexus5,version=19 runs API level 19, below the minSdk 21 of com.example.app")
+}
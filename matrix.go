@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// deviceMatrix is the MATRIX_FILE format, YAML or JSON:
+//
+//	default: smoke
+//	groups:
+//	  smoke:
+//	    timeout: 15m
+//	    devices:
+//	    - model: NexusLowRes
+//	      versions: [25]
+//	  full:
+//	    devices:
+//	    - model: Nexus9
+//	      versions: [24, 25]
+//	      locales: [en, de]
+//	      orientations: [portrait, landscape]
+type deviceMatrix struct {
+	Default string                 `yaml:"default" json:"default"`
+	Groups  map[string]deviceGroup `yaml:"groups" json:"groups"`
+}
+
+type deviceGroup struct {
+	Timeout string         `yaml:"timeout" json:"timeout"`
+	Devices []deviceSelect `yaml:"devices" json:"devices"`
+}
+
+// deviceSelect expands to every combination of its versions, locales and orientations.
+type deviceSelect struct {
+	Model        string     `yaml:"model" json:"model"`
+	Versions     stringList `yaml:"versions" json:"versions"`
+	Locales      stringList `yaml:"locales" json:"locales"`
+	Orientations stringList `yaml:"orientations" json:"orientations"`
+}
+
+// stringList accepts numbers as well, so versions can be written as [24, 25].
+type stringList []string
+
+func (list *stringList) UnmarshalJSON(data []byte) error {
+	values := []interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		switch v := value.(type) {
+		case string:
+			*list = append(*list, v)
+		case json.Number:
+			*list = append(*list, v.String())
+		default:
+			return fmt.Errorf("expected a string or number, got %v", value)
+		}
+	}
+	return nil
+}
+
+func loadDeviceMatrix(matrixPath string) (deviceMatrix, error) {
+	matrix := deviceMatrix{}
+
+	data, err := ioutil.ReadFile(matrixPath)
+	if err != nil {
+		return matrix, errors.New("failed to read " + envKeyMatrixFile + ": " + err.Error())
+	}
+
+	if strings.ToLower(filepath.Ext(matrixPath)) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&matrix)
+	} else {
+		err = yaml.UnmarshalStrict(data, &matrix)
+	}
+	if err != nil {
+		return matrix, errors.New("failed to parse " + matrixPath + ": " + err.Error())
+	}
+
+	return matrix, matrix.validate()
+}
+
+func (matrix deviceMatrix) validate() error {
+	if len(matrix.Groups) == 0 {
+		return errors.New(envKeyMatrixFile + " defines no device groups")
+	}
+	if !isEmpty(matrix.Default) {
+		if _, ok := matrix.Groups[matrix.Default]; !ok {
+			return errors.New("default device group '" + matrix.Default + "' is not defined")
+		}
+	}
+
+	for _, name := range matrix.groupNames() {
+		group := matrix.Groups[name]
+		if len(group.Devices) == 0 {
+			return errors.New("device group '" + name + "' has no devices")
+		}
+		if !isEmpty(group.Timeout) {
+			err := validateTimeout("timeout of device group '"+name+"'", group.Timeout)
+			if err != nil {
+				return err
+			}
+		}
+
+		for i, d := range group.Devices {
+			if isEmpty(d.Model) {
+				return fmt.Errorf("device %d of group '%s' has no model", i+1, name)
+			}
+			for _, orientation := range d.Orientations {
+				if orientation != "portrait" && orientation != "landscape" {
+					return fmt.Errorf("orientation must be portrait or landscape, got '%s' in group '%s'", orientation, name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// selectGroup picks the named group, the default group, or the only group.
+func (matrix deviceMatrix) selectGroup(name string) (string, deviceGroup, error) {
+	if isEmpty(name) {
+		name = matrix.Default
+	}
+	if isEmpty(name) && len(matrix.Groups) == 1 {
+		name = matrix.groupNames()[0]
+	}
+	if isEmpty(name) {
+		return "", deviceGroup{}, errors.New(envKeyMatrixGroup + " must be one of: " + strings.Join(matrix.groupNames(), ", "))
+	}
+
+	group, ok := matrix.Groups[name]
+	if !ok {
+		return "", deviceGroup{}, errors.New("device group '" + name + "' is not defined, available: " + strings.Join(matrix.groupNames(), ", "))
+	}
+
+	return name, group, nil
+}
+
+func (matrix deviceMatrix) groupNames() []string {
+	names := make([]string, 0, len(matrix.Groups))
+	for name := range matrix.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expand returns a --device for every model, version, locale and orientation combination.
+func (group deviceGroup) expand() []device {
+	devices := make([]device, 0)
+
+	for _, d := range group.Devices {
+		for _, version := range orDefault(d.Versions) {
+			for _, locale := range orDefault(d.Locales) {
+				for _, orientation := range orDefault(d.Orientations) {
+					devices = append(devices, device{
+						Model:       d.Model,
+						Version:     version,
+						Locale:      locale,
+						Orientation: orientation,
+					})
+				}
+			}
+		}
+	}
+
+	return devices
+}
+
+// orDefault keeps an omitted dimension as a single empty value, which leaves it to Test Lab.
+func orDefault(values []string) []string {
+	if len(values) == 0 {
+		return []string{""}
+	}
+	return values
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const deviceMatrixYAML = `
+default: smoke
+groups:
+  smoke:
+    timeout: 15m
+    devices:
+    - model: NexusLowRes
+      versions: [25]
+  full:
+    timeout: 45m
+    devices:
+    - model: NexusLowRes
+      versions: [23, 25]
+      locales: [en, de]
+    - model: Nexus9
+      versions: ["24"]
+      orientations: [landscape]
+`
+
+const deviceMatrixJSON = `{
+	"groups": {
+		"nightly": {
+			"devices": [
+				{"model": "Nexus9", "versions": [24, "25"], "orientations": ["portrait", "landscape"]}
+			]
+		}
+	}
+}`
+
+func TestLoadDeviceMatrix(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "matrix")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	yamlPath := filepath.Join(tmpDir, "devices.yml")
+	assert.NoError(ioutil.WriteFile(yamlPath, []byte(deviceMatrixYAML), 0644))
+
+	matrix, err := loadDeviceMatrix(yamlPath)
+	assert.NoError(err)
+
+	name, group, err := matrix.selectGroup("")
+	assert.NoError(err)
+	assert.Equal("smoke", name)
+	assert.Equal("15m", group.Timeout)
+	assert.Equal([]device{{Model: "NexusLowRes", Version: "25"}}, group.expand())
+
+	name, group, err = matrix.selectGroup("full")
+	assert.NoError(err)
+	assert.Equal("full", name)
+	assert.Equal([]device{
+		{Model: "NexusLowRes", Version: "23", Locale: "en"},
+		{Model: "NexusLowRes", Version: "23", Locale: "de"},
+		{Model: "NexusLowRes", Version: "25", Locale: "en"},
+		{Model: "NexusLowRes", Version: "25", Locale: "de"},
+		{Model: "Nexus9", Version: "24", Orientation: "landscape"},
+	}, group.expand())
+
+	_, _, err = matrix.selectGroup("weekly")
+	assert.EqualError(err, "device group 'weekly' is not defined, available: full, smoke")
+
+	jsonPath := filepath.Join(tmpDir, "devices.json")
+	assert.NoError(ioutil.WriteFile(jsonPath, []byte(deviceMatrixJSON), 0644))
+
+	matrix, err = loadDeviceMatrix(jsonPath)
+	assert.NoError(err)
+
+	name, group, err = matrix.selectGroup("")
+	assert.NoError(err)
+	assert.Equal("nightly", name)
+	assert.Equal(4, len(group.expand()))
+	assert.Equal(device{Model: "Nexus9", Version: "25", Orientation: "landscape"}, group.expand()[3])
+}
+
+func TestLoadDeviceMatrixValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "matrix")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	cases := []struct {
+		content string
+		err     string
+	}{
+		{`groups: {}`, envKeyMatrixFile + " defines no device groups"},
+		{"default: full\ngroups:\n  smoke:\n    devices: [{model: NexusLowRes}]", "default device group 'full' is not defined"},
+		{"groups:\n  smoke:\n    timeout: 15m", "device group 'smoke' has no devices"},
+		{"groups:\n  smoke:\n    timeout: soon\n    devices: [{model: NexusLowRes}]", "timeout of device group 'smoke' must be a duration like 90s, 25m or 1h: 'soon'"},
+		{"groups:\n  smoke:\n    devices: [{versions: [25]}]", "device 1 of group 'smoke' has no model"},
+		{"groups:\n  smoke:\n    devices: [{model: NexusLowRes, orientations: [sideways]}]", "orientation must be portrait or landscape, got 'sideways' in group 'smoke'"},
+	}
+
+	matrixPath := filepath.Join(tmpDir, "devices.yml")
+	for _, c := range cases {
+		assert.NoError(ioutil.WriteFile(matrixPath, []byte(c.content), 0644))
+		_, err = loadDeviceMatrix(matrixPath)
+		assert.EqualError(err, c.err)
+	}
+
+	//- unknown fields are rejected
+	assert.NoError(ioutil.WriteFile(matrixPath, []byte("groups:\n  smoke:\n    device: []"), 0644))
+	_, err = loadDeviceMatrix(matrixPath)
+	assert.Contains(err.Error(), "field device not found")
+
+	//- no default and multiple groups
+	assert.NoError(ioutil.WriteFile(matrixPath, []byte(deviceMatrixYAML[len("\ndefault: smoke"):]), 0644))
+	matrix, err := loadDeviceMatrix(matrixPath)
+	assert.NoError(err)
+	_, _, err = matrix.selectGroup("")
+	assert.EqualError(err, envKeyMatrixGroup+" must be one of: full, smoke")
+}
+
+func TestExecuteGcloudMatrixFile(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "matrix")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	matrixPath := filepath.Join(tmpDir, "devices.yml")
+	assert.NoError(ioutil.WriteFile(matrixPath, []byte(deviceMatrixYAML), 0644))
+
+	setupOptionsEnv()
+	Setenv(envKeyMatrixFile, matrixPath)
+	Setenv(envKeyMatrixGroup, "full")
+	Setenv(envKeyTimeout, "30m")
+
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+
+	result, err := buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	assert.Equal([]string{
+		"gcloud", "firebase", "test", "android", "run",
+		"--type", "instrumentation",
+		"--test", "/tmp/test.apk",
+		"--app", "/tmp/app.apk",
+		"--results-bucket=golang-bucket",
+		"--results-dir=results_dir",
+		"--device", "model=NexusLowRes,version=23,locale=en",
+		"--device", "model=NexusLowRes,version=23,locale=de",
+		"--device", "model=NexusLowRes,version=25,locale=en",
+		"--device", "model=NexusLowRes,version=25,locale=de",
+		"--device", "model=Nexus9,version=24,orientation=landscape",
+		"--timeout", "30m",
+	}, result)
+
+	//- group timeout is used when TIMEOUT is not set
+	Setenv(envKeyMatrixGroup, "")
+	Setenv(envKeyTimeout, "")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal("15m", config.TestOptions.Timeout)
+	assert.Equal([]device{{Model: "NexusLowRes", Version: "25"}}, config.TestOptions.Devices)
+
+	Setenv(envKeyDevices, "model=NexusLowRes")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyDevices+" and "+envKeyMatrixFile+" can't be used together")
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// testOptions are the typed step inputs rendered into gcloud flags.
+// Flags in GCLOUD_OPTIONS win over these.
+type testOptions struct {
+	Devices              []device
+	Timeout              string
+	DirectoriesToPull    []string
+	EnvironmentVariables []environmentVariable
+	TestTargets          []string
+	UseOrchestrator      bool
+	NumFlakyTestAttempts int
+	// Criteria replace Devices with devices of the catalog, resolved at the start of the run.
+	Criteria *deviceCriteria
+}
+
+// device is a single --device dimension, empty values use the Test Lab defaults.
+type device struct {
+	Model       string
+	Version     string
+	Locale      string
+	Orientation string
+}
+
+type environmentVariable struct {
+	Key   string
+	Value string
+}
+
+// Test Lab limit for --num-flaky-test-attempts
+const maxFlakyTestAttempts = 10
+
+// Matches gcloud durations: 90, 90s, 25m, 1h
+var timeoutPattern = regexp.MustCompile(`^[0-9]+[smh]?$`)
+
+var environmentKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func newTestOptions(platform string) (testOptions, error) {
+	options := testOptions{}
+
+	devices, err := parseDevices(splitLines(getOptionalEnv(envKeyDevices)))
+	if err != nil {
+		return options, err
+	}
+	options.Devices = devices
+
+	options.Timeout = strings.TrimSpace(getOptionalEnv(envKeyTimeout))
+	if !isEmpty(options.Timeout) {
+		err = validateTimeout(envKeyTimeout, options.Timeout)
+		if err != nil {
+			return options, err
+		}
+	}
+
+	matrixFileValue := getOptionalEnv(envKeyMatrixFile)
+	if !isEmpty(matrixFileValue) {
+		if len(options.Devices) > 0 {
+			return options, errors.New(envKeyDevices + " and " + envKeyMatrixFile + " can't be used together")
+		}
+
+		matrix, err := loadDeviceMatrix(matrixFileValue)
+		if err != nil {
+			return options, err
+		}
+
+		name, group, err := matrix.selectGroup(getOptionalEnv(envKeyMatrixGroup))
+		if err != nil {
+			return options, err
+		}
+
+		options.Devices = group.expand()
+		// TIMEOUT wins over the group timeout.
+		if isEmpty(options.Timeout) {
+			options.Timeout = group.Timeout
+		}
+		log.Printf("Using device group '%s' from %s: %d devices", name, matrixFileValue, len(options.Devices))
+	}
+
+	options.Criteria, err = parseDeviceCriteria(splitLines(getOptionalEnv(envKeyDeviceCriteria)))
+	if err != nil {
+		return options, err
+	}
+	if options.Criteria != nil && len(options.Devices) > 0 {
+		return options, errors.New(envKeyDeviceCriteria + " can't be used together with " + envKeyDevices + " or " + envKeyMatrixFile)
+	}
+
+	options.DirectoriesToPull = splitLines(getOptionalEnv(envKeyDirectoriesToPull))
+	for _, dir := range options.DirectoriesToPull {
+		if !strings.HasPrefix(dir, "/sdcard") && !strings.HasPrefix(dir, "/data/local/tmp") {
+			return options, errors.New(envKeyDirectoriesToPull + " must be below /sdcard or /data/local/tmp: '" + dir + "'")
+		}
+	}
+
+	for _, line := range splitLines(getOptionalEnv(envKeyEnvironmentVariables)) {
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) != 2 || !environmentKeyPattern.MatchString(keyValue[0]) {
+			return options, errors.New(envKeyEnvironmentVariables + " must be KEY=VALUE lines: '" + line + "'")
+		}
+		options.EnvironmentVariables = append(options.EnvironmentVariables, environmentVariable{Key: keyValue[0], Value: keyValue[1]})
+	}
+
+	options.TestTargets = splitLines(getOptionalEnv(envKeyTestTargets))
+
+	options.UseOrchestrator, err = getOptionalBoolEnv(envKeyUseOrchestrator, false)
+	if err != nil {
+		return options, err
+	}
+
+	flakyAttemptsValue := getOptionalEnv(envKeyNumFlakyTestAttempts)
+	if !isEmpty(flakyAttemptsValue) {
+		options.NumFlakyTestAttempts, err = strconv.Atoi(flakyAttemptsValue)
+		if err != nil || options.NumFlakyTestAttempts < 0 || options.NumFlakyTestAttempts > maxFlakyTestAttempts {
+			return options, fmt.Errorf("%s must be a number between 0 and %d", envKeyNumFlakyTestAttempts, maxFlakyTestAttempts)
+		}
+	}
+
+	if platform == platformIOS {
+		androidOnly := map[string]bool{
+			envKeyDirectoriesToPull:    len(options.DirectoriesToPull) > 0,
+			envKeyEnvironmentVariables: len(options.EnvironmentVariables) > 0,
+			envKeyTestTargets:          len(options.TestTargets) > 0,
+			envKeyUseOrchestrator:      options.UseOrchestrator,
+			envKeyDeviceCriteria:       options.Criteria != nil,
+		}
+		for _, key := range []string{envKeyDirectoriesToPull, envKeyEnvironmentVariables, envKeyTestTargets, envKeyUseOrchestrator, envKeyDeviceCriteria} {
+			if androidOnly[key] {
+				return options, errors.New(key + " is only supported on Android")
+			}
+		}
+	}
+
+	return options, nil
+}
+
+// parseDevices parses lines in the --device format: model=NexusLowRes,version=25,locale=en,orientation=portrait
+func parseDevices(lines []string) ([]device, error) {
+	devices := make([]device, 0, len(lines))
+
+	for _, line := range lines {
+		parsed := device{}
+		for _, dimension := range strings.Split(line, ",") {
+			keyValue := strings.SplitN(strings.TrimSpace(dimension), "=", 2)
+			if len(keyValue) != 2 || isEmpty(keyValue[1]) {
+				return nil, errors.New("invalid device dimension '" + dimension + "' in '" + line + "'")
+			}
+
+			switch keyValue[0] {
+			case "model":
+				parsed.Model = keyValue[1]
+			case "version":
+				parsed.Version = keyValue[1]
+			case "locale":
+				parsed.Locale = keyValue[1]
+			case "orientation":
+				if keyValue[1] != "portrait" && keyValue[1] != "landscape" {
+					return nil, errors.New("orientation must be portrait or landscape in '" + line + "'")
+				}
+				parsed.Orientation = keyValue[1]
+			default:
+				return nil, errors.New("unknown device dimension '" + keyValue[0] + "' in '" + line + "'")
+			}
+		}
+		devices = append(devices, parsed)
+	}
+
+	return devices, nil
+}
+
+func validateTimeout(name string, timeout string) error {
+	_, err := parseTimeout(name, timeout)
+	return err
+}
+
+// parseTimeout parses a positive duration in gcloud's format, plain numbers are seconds.
+func parseTimeout(name string, timeout string) (time.Duration, error) {
+	if timeoutPattern.MatchString(timeout) {
+		value := timeout
+		if _, err := strconv.Atoi(value); err == nil {
+			value += "s"
+		}
+		duration, err := time.ParseDuration(value)
+		if err == nil && duration > 0 {
+			return duration, nil
+		}
+	}
+
+	return 0, errors.New(name + " must be a duration like 90s, 25m or 1h: '" + timeout + "'")
+}
+
+// String renders the device in gcloud's --device format.
+func (d device) String() string {
+	dimensions := make([]string, 0, 4)
+	if !isEmpty(d.Model) {
+		dimensions = append(dimensions, "model="+d.Model)
+	}
+	if !isEmpty(d.Version) {
+		dimensions = append(dimensions, "version="+d.Version)
+	}
+	if !isEmpty(d.Locale) {
+		dimensions = append(dimensions, "locale="+d.Locale)
+	}
+	if !isEmpty(d.Orientation) {
+		dimensions = append(dimensions, "orientation="+d.Orientation)
+	}
+	return strings.Join(dimensions, ",")
+}
+
+// gcloudFlags renders the options, skipping every flag already set in userOptionsSet.
+func (options testOptions) gcloudFlags(userOptionsSet map[string]bool) []string {
+	args := make([]string, 0)
+
+	userDevices := hasGcloudFlag(userOptionsSet, "--device") ||
+		hasGcloudFlag(userOptionsSet, "--device-ids") ||
+		hasGcloudFlag(userOptionsSet, "--os-version-ids") ||
+		hasGcloudFlag(userOptionsSet, "--locales") ||
+		hasGcloudFlag(userOptionsSet, "--orientations")
+	if !userDevices {
+		for _, d := range options.Devices {
+			args = append(args, "--device", d.String())
+		}
+	}
+
+	if !isEmpty(options.Timeout) && !hasGcloudFlag(userOptionsSet, "--timeout") {
+		args = append(args, "--timeout", options.Timeout)
+	}
+
+	if len(options.DirectoriesToPull) > 0 && !hasGcloudFlag(userOptionsSet, "--directories-to-pull") {
+		args = append(args, "--directories-to-pull", gcloudList(options.DirectoriesToPull))
+	}
+
+	if len(options.EnvironmentVariables) > 0 && !hasGcloudFlag(userOptionsSet, "--environment-variables") {
+		pairs := make([]string, 0, len(options.EnvironmentVariables))
+		for _, env := range options.EnvironmentVariables {
+			pairs = append(pairs, env.Key+"="+env.Value)
+		}
+		args = append(args, "--environment-variables", gcloudList(pairs))
+	}
+
+	if len(options.TestTargets) > 0 && !hasGcloudFlag(userOptionsSet, "--test-targets") {
+		args = append(args, "--test-targets", gcloudList(options.TestTargets))
+	}
+
+	if options.UseOrchestrator && !hasGcloudFlag(userOptionsSet, "--use-orchestrator") && !hasGcloudFlag(userOptionsSet, "--no-use-orchestrator") {
+		args = append(args, "--use-orchestrator")
+	}
+
+	if options.NumFlakyTestAttempts > 0 && !hasGcloudFlag(userOptionsSet, "--num-flaky-test-attempts") {
+		args = append(args, "--num-flaky-test-attempts", strconv.Itoa(options.NumFlakyTestAttempts))
+	}
+
+	return args
+}
+
+// hasGcloudFlag matches both "--flag value" and "--flag=value" in a gcloudOptionsToSet set.
+func hasGcloudFlag(userOptionsSet map[string]bool, flag string) bool {
+	return userOptionsSet[flag] || userOptionsSet[flag+"="]
+}
+
+// gcloudList joins values with commas. When a value contains a comma gcloud's
+// alternate delimiter syntax is used instead: ^:^a:b
+// https://cloud.google.com/sdk/gcloud/reference/topic/escaping
+func gcloudList(values []string) string {
+	joined := strings.Join(values, "")
+	if !strings.Contains(joined, ",") {
+		return strings.Join(values, ",")
+	}
+
+	for _, delimiter := range []string{":", ";", "|", "#", "@"} {
+		if !strings.Contains(joined, delimiter) {
+			return "^" + delimiter + "^" + strings.Join(values, delimiter)
+		}
+	}
+
+	return "^~^" + strings.Join(values, "~")
+}
+
+// splitLines returns the trimmed, non empty lines of value.
+func splitLines(value string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if !isEmpty(line) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
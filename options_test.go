@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func setupOptionsEnv() {
+	resetEnv()
+	Setenv(envKeyGcloud, ServiceAccountKey("fake@example.com"))
+	Setenv(envKeyGcloudUser, "fake@example.com")
+	Setenv(envKeyGcloudProject, "fake-project")
+	Setenv(envKeyGcloudBucket, "golang-bucket")
+
+	WriteFile("/tmp/app.apk")
+	WriteFile("/tmp/test.apk")
+	Setenv(envKeyAppApk, "/tmp/app.apk")
+	Setenv(envKeyTestApk, "/tmp/test.apk")
+}
+
+func TestNewTestOptions(t *testing.T) {
+	assert := assert.New(t)
+	setupOptionsEnv()
+
+	Setenv(envKeyDevices, `
+	model=NexusLowRes,version=25,locale=en,orientation=portrait
+	model=Nexus9, version=24
+	`)
+	Setenv(envKeyTimeout, "25m")
+	Setenv(envKeyDirectoriesToPull, "/sdcard\n/data/local/tmp/screenshots")
+	Setenv(envKeyEnvironmentVariables, "coverage=true\ncoverageFile=/sdcard/coverage.ec\nAPI_TOKEN=a=b")
+	Setenv(envKeyTestTargets, "class com.example.CalculatorTest\npackage com.example.smoke")
+	Setenv(envKeyUseOrchestrator, "true")
+	Setenv(envKeyNumFlakyTestAttempts, "2")
+
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+
+	assert.Equal(testOptions{
+		Devices: []device{
+			{Model: "NexusLowRes", Version: "25", Locale: "en", Orientation: "portrait"},
+			{Model: "Nexus9", Version: "24"},
+		},
+		Timeout:           "25m",
+		DirectoriesToPull: []string{"/sdcard", "/data/local/tmp/screenshots"},
+		EnvironmentVariables: []environmentVariable{
+			{Key: "coverage", Value: "true"},
+			{Key: "coverageFile", Value: "/sdcard/coverage.ec"},
+			{Key: "API_TOKEN", Value: "a=b"},
+		},
+		TestTargets:          []string{"class com.example.CalculatorTest", "package com.example.smoke"},
+		UseOrchestrator:      true,
+		NumFlakyTestAttempts: 2,
+	}, config.TestOptions)
+}
+
+func TestNewTestOptionsValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		key   string
+		value string
+		err   string
+	}{
+		{envKeyDevices, "model=NexusLowRes,size=large", "unknown device dimension 'size' in 'model=NexusLowRes,size=large'"},
+		{envKeyDevices, "model=NexusLowRes,version=", "invalid device dimension 'version=' in 'model=NexusLowRes,version='"},
+		{envKeyDevices, "orientation=upside-down", "orientation must be portrait or landscape in 'orientation=upside-down'"},
+		{envKeyTimeout, "25 minutes", envKeyTimeout + " must be a duration like 90s, 25m or 1h: '25 minutes'"},
+		{envKeyTimeout, "0m", envKeyTimeout + " must be a duration like 90s, 25m or 1h: '0m'"},
+		{envKeyDirectoriesToPull, "/tmp", envKeyDirectoriesToPull + " must be below /sdcard or /data/local/tmp: '/tmp'"},
+		{envKeyEnvironmentVariables, "coverage", envKeyEnvironmentVariables + " must be KEY=VALUE lines: 'coverage'"},
+		{envKeyEnvironmentVariables, "1KEY=value", envKeyEnvironmentVariables + " must be KEY=VALUE lines: '1KEY=value'"},
+		{envKeyUseOrchestrator, "yes", envKeyUseOrchestrator + " must be 'true' or 'false'"},
+		{envKeyNumFlakyTestAttempts, "11", envKeyNumFlakyTestAttempts + " must be a number between 0 and 10"},
+		{envKeyNumFlakyTestAttempts, "two", envKeyNumFlakyTestAttempts + " must be a number between 0 and 10"},
+	}
+
+	for _, c := range cases {
+		setupOptionsEnv()
+		Setenv(c.key, c.value)
+
+		_, err := newFirebaseConfig()
+		assert.EqualError(err, c.err)
+	}
+
+	//- Android only options on iOS
+	setupOptionsEnv()
+	_, err := newTestOptions(platformIOS)
+	assert.NoError(err)
+
+	Setenv(envKeyTestTargets, "class com.example.CalculatorTest")
+	_, err = newTestOptions(platformIOS)
+	assert.EqualError(err, envKeyTestTargets+" is only supported on Android")
+}
+
+func TestExecuteGcloudTestOptions(t *testing.T) {
+	assert := assert.New(t)
+	setupOptionsEnv()
+
+	Setenv(envKeyDevices, "model=NexusLowRes,version=25\nmodel=Nexus9,version=24,orientation=landscape")
+	Setenv(envKeyTimeout, "25m")
+	Setenv(envKeyDirectoriesToPull, "/sdcard")
+	Setenv(envKeyEnvironmentVariables, "coverage=true\ncoverageFile=/sdcard/coverage.ec")
+	Setenv(envKeyTestTargets, "class com.example.A,com.example.B")
+	Setenv(envKeyUseOrchestrator, "true")
+	Setenv(envKeyNumFlakyTestAttempts, "1")
+
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+
+	result, err := buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	assert.Equal([]string{
+		"gcloud", "firebase", "test", "android", "run",
+		"--type", "instrumentation",
+		"--test", "/tmp/test.apk",
+		"--app", "/tmp/app.apk",
+		"--results-bucket=golang-bucket",
+		"--results-dir=results_dir",
+		"--device", "model=NexusLowRes,version=25",
+		"--device", "model=Nexus9,version=24,orientation=landscape",
+		"--timeout", "25m",
+		"--directories-to-pull", "/sdcard",
+		"--environment-variables", "coverage=true,coverageFile=/sdcard/coverage.ec",
+		"--test-targets", "^:^class com.example.A,com.example.B",
+		"--use-orchestrator",
+		"--num-flaky-test-attempts", "1",
+	}, result)
+
+	// GCLOUD_OPTIONS wins on conflicts
+	Setenv(envKeyGcloudOptions, "--device-ids NexusLowRes --timeout=10m --no-use-orchestrator --test-targets 'class com.example.C'")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+
+	result, err = buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	assert.Equal([]string{
+		"gcloud", "firebase", "test", "android", "run",
+		"--type", "instrumentation",
+		"--test", "/tmp/test.apk",
+		"--app", "/tmp/app.apk",
+		"--results-bucket=golang-bucket",
+		"--results-dir=results_dir",
+		"--directories-to-pull", "/sdcard",
+		"--environment-variables", "coverage=true,coverageFile=/sdcard/coverage.ec",
+		"--num-flaky-test-attempts", "1",
+		"--device-ids", "NexusLowRes",
+		"--timeout=10m",
+		"--no-use-orchestrator",
+		"--test-targets", "class com.example.C",
+	}, result)
+}
+
+func TestGcloudList(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("a,b", gcloudList([]string{"a", "b"}))
+	assert.Equal("^:^a,b:c", gcloudList([]string{"a,b", "c"}))
+	assert.Equal("^;^a,b;c:d", gcloudList([]string{"a,b", "c:d"}))
+}
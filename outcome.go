@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Exit codes of `gcloud firebase test android run`
+// https://firebase.google.com/docs/test-lab/android/command-line#script_exit_codes
+const (
+	exitCodeSuccess        = 0  // all test executions passed
+	exitCodeGeneralFailure = 1  // gcloud failed, e.g. invalid arguments or an upload error
+	exitCodeTestFailure    = 10 // at least one test case failed
+	exitCodeInconclusive   = 15 // Test Lab couldn't decide whether the tests passed
+	exitCodeIncompatible   = 18 // the app or test is incompatible with a requested device
+	exitCodeCancelled      = 19 // the test matrix was cancelled
+	exitCodeInfrastructure = 20 // Test Lab infrastructure error, worth retrying
+)
+
+// testOutcome is the step level meaning of a gcloud exit code.
+//
+//	code  outcome                 step
+//	0     passed                  success
+//	1     gcloud error            failure
+//	10    failed                  failure
+//	15    inconclusive            failure, success when FAIL_ON_INCONCLUSIVE is false
+//	18    incompatible            failure
+//	19    cancelled               failure
+//	20    infrastructure failure  failure once retries are exhausted
+//	*     unknown                 failure
+type testOutcome struct {
+	ExitCode int
+	Name     string
+	Passed   bool
+	// ResultsDir holds the artefacts of the outcome, the results dir of the last attempt.
+	// Sharded runs write below it.
+	ResultsDir string
+	// ShardResultsDirs are the results dirs of the last attempt of every shard, results are
+	// collected from these only. Empty without shards.
+	ShardResultsDirs []string
+	Attempts         []retryAttempt
+}
+
+func newTestOutcome(exitCode int, failOnInconclusive bool) testOutcome {
+	outcome := testOutcome{ExitCode: exitCode}
+
+	switch exitCode {
+	case exitCodeSuccess:
+		outcome.Name = "passed"
+		outcome.Passed = true
+	case exitCodeGeneralFailure:
+		outcome.Name = "gcloud error"
+	case exitCodeTestFailure:
+		outcome.Name = "failed"
+	case exitCodeInconclusive:
+		outcome.Name = "inconclusive"
+		outcome.Passed = !failOnInconclusive
+	case exitCodeIncompatible:
+		outcome.Name = "incompatible"
+	case exitCodeCancelled:
+		outcome.Name = "cancelled"
+	case exitCodeInfrastructure:
+		outcome.Name = "infrastructure failure"
+	default:
+		outcome.Name = fmt.Sprintf("unknown exit code %d", exitCode)
+	}
+
+	return outcome
+}
+
+// newFlakyOutcome is the outcome of a run whose failed tests all passed on re-run.
+func newFlakyOutcome(failOnFlaky bool) testOutcome {
+	return testOutcome{
+		ExitCode: exitCodeTestFailure,
+		Name:     "flaky",
+		Passed:   !failOnFlaky,
+	}
+}
+
+// newSubmittedOutcome is the outcome of MODE submit once Test Lab accepted the matrix.
+func newSubmittedOutcome() testOutcome {
+	return testOutcome{
+		ExitCode: exitCodeSuccess,
+		Name:     "submitted",
+		Passed:   true,
+	}
+}
+
+// finalAttempts returns the last attempt of every test matrix. Shards and re-runs list the
+// attempts of one matrix after the other, each starting with attempt 1.
+func (outcome testOutcome) finalAttempts() []retryAttempt {
+	final := make([]retryAttempt, 0)
+	for i, attempt := range outcome.Attempts {
+		if i == len(outcome.Attempts)-1 || outcome.Attempts[i+1].Number == 1 {
+			final = append(final, attempt)
+		}
+	}
+	return final
+}
+
+// StepExitCode is what the step exits with for this outcome.
+func (outcome testOutcome) StepExitCode() int {
+	if outcome.Passed {
+		return 0
+	}
+	return 1
+}
+
+func (outcome testOutcome) String() string {
+	return fmt.Sprintf("%s (gcloud exit code %d)", outcome.Name, outcome.ExitCode)
+}
+
+// finalResultsDirs are the dirs the results of the outcome are collected from, leaving out
+// the failed attempts of shards next to them.
+func (outcome testOutcome) finalResultsDirs() []string {
+	if len(outcome.ShardResultsDirs) > 0 {
+		return outcome.ShardResultsDirs
+	}
+	return []string{outcome.ResultsDir}
+}
+
+// worstOutcome picks the outcome that best explains why a set of matrices failed:
+// gcloud errors over configuration problems over test failures over inconclusive results.
+// Of passing outcomes, an inconclusive one allowed by FAIL_ON_INCONCLUSIVE wins over passed.
+func worstOutcome(outcomes []testOutcome) testOutcome {
+	worst := newTestOutcome(exitCodeSuccess, true)
+	for _, outcome := range outcomes {
+		severity := outcome.severity()
+		if severity > worst.severity() || severity == worst.severity() && worst.ExitCode == exitCodeSuccess {
+			worst = outcome
+		}
+	}
+	return worst
+}
+
+func (outcome testOutcome) severity() int {
+	if outcome.Passed {
+		return 0
+	}
+
+	switch outcome.ExitCode {
+	case exitCodeInconclusive:
+		return 1
+	case exitCodeTestFailure:
+		return 2
+	case exitCodeInfrastructure:
+		return 3
+	case exitCodeCancelled:
+		return 4
+	case exitCodeIncompatible:
+		return 5
+	case exitCodeGeneralFailure:
+		return 6
+	default:
+		return 7
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewTestOutcome(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		exitCode           int
+		failOnInconclusive bool
+		name               string
+		passed             bool
+	}{
+		{0, true, "passed", true},
+		{1, true, "gcloud error", false},
+		{10, true, "failed", false},
+		{15, true, "inconclusive", false},
+		{15, false, "inconclusive", true},
+		{18, false, "incompatible", false},
+		{19, false, "cancelled", false},
+		{20, false, "infrastructure failure", false},
+		{42, false, "unknown exit code 42", false},
+	}
+
+	for _, c := range cases {
+		outcome := newTestOutcome(c.exitCode, c.failOnInconclusive)
+		assert.Equal(c.name, outcome.Name)
+		assert.Equal(c.passed, outcome.Passed)
+		if c.passed {
+			assert.Equal(0, outcome.StepExitCode())
+		} else {
+			assert.Equal(1, outcome.StepExitCode())
+		}
+	}
+}
+
+func TestWorstOutcome(t *testing.T) {
+	assert := assert.New(t)
+
+	passed := newTestOutcome(exitCodeSuccess, false)
+	allowedInconclusive := newTestOutcome(exitCodeInconclusive, false)
+	failed := newTestOutcome(exitCodeTestFailure, false)
+
+	cases := []struct {
+		outcomes []testOutcome
+		name     string
+		passed   bool
+	}{
+		{[]testOutcome{passed, passed}, "passed", true},
+		{[]testOutcome{passed, allowedInconclusive}, "inconclusive", true},
+		{[]testOutcome{allowedInconclusive, passed}, "inconclusive", true},
+		{[]testOutcome{allowedInconclusive, failed, passed}, "failed", false},
+	}
+
+	for _, c := range cases {
+		outcome := worstOutcome(c.outcomes)
+		assert.Equal(c.name, outcome.Name)
+		assert.Equal(c.passed, outcome.Passed)
+	}
+}
+
+// newFakeGcloudConfig configures the step for an instrumentation run which authenticates
+// through the fake gcloud on PATH.
+func newFakeGcloudConfig(assert *assert.Assertions) *firebaseConfig {
+	resetEnv()
+	Setenv(envKeyGcloud, ServiceAccountKey("fake@example.com"))
+	Setenv(envKeyGcloudBucket, "golang-bucket")
+
+	WriteFile("/tmp/app.apk")
+	WriteFile("/tmp/test.apk")
+	Setenv(envKeyAppApk, "/tmp/app.apk")
+	Setenv(envKeyTestApk, "/tmp/test.apk")
+
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	config.Retry.sleep = func(time.Duration) {}
+	return config
+}
+
+func TestRunTestMatrixExitPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		exitCodes []int
+		calls     int
+		exitCode  int
+		stepExit  int
+	}{
+		{[]int{0}, 1, 0, 0},
+		{[]int{10}, 1, 10, 1},
+		{[]int{15}, 1, 15, 1},
+		{[]int{18}, 1, 18, 1},
+		{[]int{19}, 1, 19, 1},
+		{[]int{20, 0}, 2, 0, 0},
+		{[]int{20, 20, 10}, 3, 10, 1},
+		{[]int{20, 20, 20, 0}, 3, 20, 1},
+	}
+
+	for _, c := range cases {
+		config := newFakeGcloudConfig(assert)
+		logPath := FakeGcloud(c.exitCodes...)
+		assert.NoError(authenticate(config, os.Stdout))
+
+		gcsCommand, err := buildGcloudCommand(config, "results_dir")
+		assert.NoError(err)
+
+		outcome, err := runTestMatrix(config, gcsCommand, os.Stdout)
+		assert.NoError(err)
+		assert.Equal(c.exitCode, outcome.ExitCode)
+		assert.Equal(c.stepExit, outcome.StepExitCode())
+
+		calls := GcloudCalls(logPath)
+		assert.Equal("config set project fake-project", calls[0])
+		assert.Equal("auth activate-service-account --key-file "+config.KeyPath+" fake@example.com", calls[1])
+		assert.Equal(2+c.calls, len(calls))
+		assert.Contains(calls[2], "firebase test android run --type instrumentation")
+	}
+}
+
+func TestRunTestMatrixInconclusiveAllowed(t *testing.T) {
+	assert := assert.New(t)
+
+	config := newFakeGcloudConfig(assert)
+	Setenv(envKeyFailOnInconclusive, "false")
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	FakeGcloud(15)
+
+	gcsCommand, err := buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+
+	outcome, err := runTestMatrix(config, gcsCommand, os.Stdout)
+	assert.NoError(err)
+	assert.Equal("inconclusive", outcome.Name)
+	assert.Equal(0, outcome.StepExitCode())
+
+	Setenv(envKeyFailOnInconclusive, "maybe")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyFailOnInconclusive+" must be 'true' or 'false'")
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bitrise-io/go-utils/log"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Step outputs, declared in step.yml.
+const (
+	outputGcsResultsDir      = "GCS_RESULTS_DIR"
+	outputResultsBucket      = "FIREBASE_TEST_LAB_RESULTS_BUCKET"
+	outputResultsDir         = "FIREBASE_TEST_LAB_RESULTS_DIR"
+	outputConsoleURL         = "FIREBASE_TEST_LAB_CONSOLE_URL"
+	outputMatrixID           = "FIREBASE_TEST_LAB_MATRIX_ID"
+	outputOutcome            = "FIREBASE_TEST_LAB_OUTCOME"
+	outputTestsPassed        = "FIREBASE_TEST_LAB_TESTS_PASSED"
+	outputTestsFailed        = "FIREBASE_TEST_LAB_TESTS_FAILED"
+	outputTestsFlaky         = "FIREBASE_TEST_LAB_TESTS_FLAKY"
+	outputTestsSkipped       = "FIREBASE_TEST_LAB_TESTS_SKIPPED"
+	outputJUnitReportPath    = "FIREBASE_TEST_LAB_JUNIT_REPORT_PATH"
+	outputSummaryPath        = "FIREBASE_TEST_LAB_SUMMARY_PATH"
+	outputCache              = "FIREBASE_TEST_LAB_CACHE"
+	outputGameLoopResultsDir = "FIREBASE_TEST_LAB_GAME_LOOP_RESULTS_DIR"
+	outputCoveragePath       = "FIREBASE_TEST_LAB_COVERAGE_PATH"
+)
+
+// summaryFileName is the name of the run summary written into the deploy dir.
+const summaryFileName = "firebase-test-lab-summary.json"
+
+// stepOutput is a single environment variable exported for the following steps.
+type stepOutput struct {
+	Key   string
+	Value string
+}
+
+// locationOutputs point at the results in the bucket, exported before the run so
+// they're available even when the step fails.
+func locationOutputs(bucket string, resultsDir string) []stepOutput {
+	return []stepOutput{
+		{outputGcsResultsDir, "gs://" + bucket + "/" + resultsDir},
+		{outputResultsBucket, bucket},
+		{outputResultsDir, resultsDir},
+	}
+}
+
+// cacheOutput tells whether the outcome was reused from the result cache.
+func cacheOutput(hit bool) stepOutput {
+	if hit {
+		return stepOutput{outputCache, cacheHit}
+	}
+	return stepOutput{outputCache, cacheMiss}
+}
+
+// runSummary is the typed result of the run, written as JSON into the deploy dir.
+type runSummary struct {
+	Outcome       string `json:"outcome"`
+	Passed        bool   `json:"passed"`
+	ResultsBucket string `json:"results_bucket"`
+	ResultsDir    string `json:"results_dir"`
+	// The last attempt of every test matrix, one per shard and re-run.
+	Matrices []matrixSummary `json:"matrices"`
+	// Nil without JUnit results.
+	Tests           *testCounts `json:"tests,omitempty"`
+	JUnitReportPath string      `json:"junit_report_path,omitempty"`
+	// Nil without Robo inputs.
+	Robo *roboSummary `json:"robo,omitempty"`
+}
+
+type matrixSummary struct {
+	runResult
+	ResultsDir string `json:"results_dir"`
+	ExitCode   int    `json:"exit_code"`
+	Attempts   int    `json:"attempts"`
+}
+
+func newRunSummary(bucket string, outcome testOutcome, report junitTestSuites, reportPath string) runSummary {
+	summary := runSummary{
+		Outcome:         outcome.Name,
+		Passed:          outcome.Passed,
+		ResultsBucket:   bucket,
+		ResultsDir:      outcome.ResultsDir,
+		Matrices:        make([]matrixSummary, 0),
+		JUnitReportPath: reportPath,
+	}
+
+	for _, attempt := range outcome.finalAttempts() {
+		summary.Matrices = append(summary.Matrices, matrixSummary{
+			runResult:  attempt.Run,
+			ResultsDir: attempt.ResultsDir,
+			ExitCode:   attempt.ExitCode,
+			Attempts:   attempt.Number,
+		})
+	}
+
+	if len(report.Suites) > 0 {
+		counts := report.counts()
+		summary.Tests = &counts
+	}
+
+	return summary
+}
+
+// logRunSummary prints every matrix with its outcome table.
+func logRunSummary(summary runSummary) {
+	for _, matrix := range summary.Matrices {
+		if isEmpty(matrix.MatrixID) {
+			log.Warnf("No test matrix was created, results dir: %s, gcloud exit code: %d", matrix.ResultsDir, matrix.ExitCode)
+			continue
+		}
+
+		log.Infof("Test matrix %s, gcloud exit code: %d", matrix.MatrixID, matrix.ExitCode)
+		log.Printf("Firebase console: %s", matrix.ConsoleURL)
+		for _, outcome := range matrix.Outcomes {
+			log.Printf("- %s: %s, %s", outcome.TestAxisValue, outcome.Outcome, outcome.TestDetails)
+		}
+	}
+	if summary.Tests != nil {
+		log.Printf("Tests: %d passed, %d failed, %d flaky, %d skipped", summary.Tests.Passed, summary.Tests.Failed, summary.Tests.Flaky, summary.Tests.Skipped)
+	}
+}
+
+func writeRunSummary(summary runSummary, filePath string, redactor *redactor) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath, []byte(redactor.Redact(string(data))), 0644)
+}
+
+// resultOutputs describe the finished run. Matrix IDs and console URLs are one per
+// line when the run was sharded. The counts are left out without JUnit results.
+func resultOutputs(summary runSummary, summaryPath string) []stepOutput {
+	matrixIDs := make([]string, 0)
+	consoleURLs := make([]string, 0)
+	for _, matrix := range summary.Matrices {
+		if !isEmpty(matrix.MatrixID) {
+			matrixIDs = append(matrixIDs, matrix.MatrixID)
+		}
+		if !isEmpty(matrix.ConsoleURL) {
+			consoleURLs = append(consoleURLs, matrix.ConsoleURL)
+		}
+	}
+
+	outputs := locationOutputs(summary.ResultsBucket, summary.ResultsDir)
+	outputs = append(outputs,
+		stepOutput{outputConsoleURL, strings.Join(consoleURLs, "\n")},
+		stepOutput{outputMatrixID, strings.Join(matrixIDs, "\n")},
+		stepOutput{outputOutcome, summary.Outcome},
+		stepOutput{outputJUnitReportPath, summary.JUnitReportPath},
+		stepOutput{outputSummaryPath, summaryPath},
+	)
+
+	if summary.Tests != nil {
+		outputs = append(outputs,
+			stepOutput{outputTestsPassed, strconv.Itoa(summary.Tests.Passed)},
+			stepOutput{outputTestsFailed, strconv.Itoa(summary.Tests.Failed)},
+			stepOutput{outputTestsFlaky, strconv.Itoa(summary.Tests.Flaky)},
+			stepOutput{outputTestsSkipped, strconv.Itoa(summary.Tests.Skipped)},
+		)
+	}
+
+	return outputs
+}
+
+// exportOutputs exports every output with a value through envman.
+func exportOutputs(runner commandRunner, outputs []stepOutput) error {
+	for _, output := range outputs {
+		if isEmpty(output.Value) {
+			continue
+		}
+
+		log.Printf("Exporting %s: %s", output.Key, output.Value)
+		result, err := runner.Run([]string{"bitrise", "envman", "add", "--key", output.Key, "--value", output.Value}, nil)
+		if err != nil {
+			return fmt.Errorf("Failed to export "+output.Key+", error: %#v", err.Error())
+		}
+		if result.ExitCode != 0 {
+			return fmt.Errorf("Failed to export "+output.Key+", exit code: %d | output: %s", result.ExitCode, result.combinedOutput())
+		}
+	}
+
+	return nil
+}
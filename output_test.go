@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// FakeEnvman records the values of `bitrise envman add` calls by key.
+func FakeEnvman() (*recordingRunner, map[string]string) {
+	exports := make(map[string]string)
+	runner := &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		if len(cmdSlice) != 7 || cmdSlice[1] != "envman" || cmdSlice[3] != "--key" || cmdSlice[5] != "--value" {
+			return commandResult{ExitCode: 1, Stderr: fmt.Sprintf("unexpected envman call: %q", cmdSlice)}, nil
+		}
+		exports[cmdSlice[4]] = cmdSlice[6]
+		return commandResult{}, nil
+	}}
+	return runner, exports
+}
+
+// GcloudMatrixOutput is what gcloud prints when it created matrix-<n>.
+func GcloudMatrixOutput(n int) string {
+	return fmt.Sprintf(`Uploading [/tmp/app.apk] to Firebase Test Lab...
+Test [matrix-%d] has been created in the Google Cloud.
+Firebase Test Lab will execute your instrumentation test on 1 device(s).
+Test results will be streamed to [https://console.firebase.google.com/project/fake-project/testlab/histories/bh.1/matrices/%d].
+`, n, n)
+}
+
+func TestExportOutputs(t *testing.T) {
+	assert := assert.New(t)
+
+	envman, exports := FakeEnvman()
+	err := exportOutputs(envman, []stepOutput{{"A", "gs://bucket/dir"}, {"EMPTY", ""}, {"B", "1\n2"}})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"A": "gs://bucket/dir", "B": "1\n2"}, exports)
+	assert.Equal([]string{"bitrise envman add --key A --value gs://bucket/dir", "bitrise envman add --key B --value 1\n2"}, envman.Commands())
+
+	failing := &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		return commandResult{ExitCode: 1, Stderr: "envstore not found"}, nil
+	}}
+	err = exportOutputs(failing, []stepOutput{{"A", "value"}})
+	assert.EqualError(err, "Failed to export A, exit code: 1 | output: envstore not found")
+}
+
+func TestResultOutputs(t *testing.T) {
+	assert := assert.New(t)
+
+	//- two shards, the first one retried
+	outcome := newTestOutcome(exitCodeTestFailure, true)
+	outcome.ResultsDir = "parent"
+	outcome.Attempts = []retryAttempt{
+		{Number: 1, ResultsDir: "parent/shard_0", ExitCode: 20, Run: runResult{MatrixID: "matrix-1", ConsoleURL: "https://console/1"}},
+		{Number: 2, ResultsDir: "parent/shard_0_attempt_2", ExitCode: 0, Run: runResult{MatrixID: "matrix-2", ConsoleURL: "https://console/2"}},
+		{Number: 1, ResultsDir: "parent/shard_1", ExitCode: 10, Run: parseRunResult(ReadFixture("gcloud_android_failed_ascii.txt"))},
+	}
+
+	report := junitTestSuites{Suites: []junitTestSuite{{Name: "NexusLowRes-25-en-portrait", TestCases: []junitTestCase{
+		{Name: "passed"},
+		{Name: "passed2"},
+		{Name: "failed", Failures: []junitMessage{{Text: "boom"}}},
+		{Name: "error", Errors: []junitMessage{{Text: "crash"}}},
+		{Name: "flaky", FlakyFailures: []junitMessage{{Text: "boom"}}},
+		{Name: "skipped", Skipped: &junitMessage{}},
+	}}}}
+
+	summary := newRunSummary("bucket", outcome, report, "/deploy/report.xml")
+	assert.Equal(runSummary{
+		Outcome:       "failed",
+		ResultsBucket: "bucket",
+		ResultsDir:    "parent",
+		Matrices: []matrixSummary{
+			{runResult: runResult{MatrixID: "matrix-2", ConsoleURL: "https://console/2"}, ResultsDir: "parent/shard_0_attempt_2", ExitCode: 0, Attempts: 2},
+			{runResult: outcome.Attempts[2].Run, ResultsDir: "parent/shard_1", ExitCode: 10, Attempts: 1},
+		},
+		Tests:           &testCounts{Passed: 2, Failed: 2, Flaky: 1, Skipped: 1},
+		JUnitReportPath: "/deploy/report.xml",
+	}, summary)
+
+	assert.Equal([]stepOutput{
+		{outputGcsResultsDir, "gs://bucket/parent"},
+		{outputResultsBucket, "bucket"},
+		{outputResultsDir, "parent"},
+		{outputConsoleURL, "https://console/2\nhttps://console.firebase.google.com/project/fake-project/testlab/histories/bh.9f4dbc8e0b9b5f3d/matrices/6841360372410523614"},
+		{outputMatrixID, "matrix-2\nmatrix-2c9rbkq0yxf3e"},
+		{outputOutcome, "failed"},
+		{outputJUnitReportPath, "/deploy/report.xml"},
+		{outputSummaryPath, "/deploy/summary.json"},
+		{outputTestsPassed, "2"},
+		{outputTestsFailed, "2"},
+		{outputTestsFlaky, "1"},
+		{outputTestsSkipped, "1"},
+	}, resultOutputs(summary, "/deploy/summary.json"))
+
+	//- no JUnit results, no counts
+	summary = newRunSummary("bucket", outcome, junitTestSuites{}, "")
+	assert.Nil(summary.Tests)
+	assert.Equal(8, len(resultOutputs(summary, "")))
+}
+
+func TestWriteRunSummary(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "summary")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	outcome := newTestOutcome(exitCodeSuccess, true)
+	outcome.ResultsDir = "results_dir"
+	outcome.Attempts = []retryAttempt{{Number: 1, ResultsDir: "results_dir", Run: parseRunResult(ReadFixture("gcloud_android_passed.txt"))}}
+
+	summaryPath := filepath.Join(tmpDir, summaryFileName)
+	assert.NoError(writeRunSummary(newRunSummary("bucket", outcome, junitTestSuites{}, ""), summaryPath, nil))
+
+	data, err := ioutil.ReadFile(summaryPath)
+	assert.NoError(err)
+	assert.JSONEq(`{
+		"outcome": "passed",
+		"passed": true,
+		"results_bucket": "bucket",
+		"results_dir": "results_dir",
+		"matrices": [{
+			"matrix_id": "matrix-1vqa8x2ghc2uw",
+			"console_url": "https://console.firebase.google.com/project/fake-project/testlab/histories/bh.9f4dbc8e0b9b5f3d/matrices/7516553046426836329",
+			"outcomes": [{"outcome": "Passed", "test_axis_value": "NexusLowRes-25-en-portrait", "test_details": "12 test cases passed"}],
+			"results_dir": "results_dir",
+			"exit_code": 0,
+			"attempts": 1
+		}]
+	}`, string(data))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/bitrise-io/go-utils/command"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const redactedValue = "[REDACTED]"
+
+// Shorter values derived from the key, e.g. the last line of a PEM body, would mask unrelated
+// text.
+const minSecretLength = 6
+
+// Values of named envs are masked from this length on, shorter ones like `yes` or `1` would
+// mask the log and the reports all over.
+const minNamedSecretLength = 4
+
+// Lines longer than this are written before their newline, the bytes that may start a
+// secret are held back.
+const maxPendingOutput = 4096
+
+// redactor masks secrets in everything the step prints and in the reports it writes: the values
+// of SECRET_ENVS, the key material of the credentials, and the values of SENSITIVE_FLAGS in
+// logged commands. A nil redactor masks nothing.
+type redactor struct {
+	// secrets are masked anywhere, longest first so that contained secrets don't leave parts.
+	secrets []string
+	// flags have their values masked in logged commands.
+	flags map[string]bool
+}
+
+func newRedactor(secretEnvs []string, sensitiveFlags []string, key []byte) *redactor {
+	r := &redactor{flags: map[string]bool{}}
+	for _, flag := range sensitiveFlags {
+		r.flags[flag] = true
+	}
+
+	r.add(os.Getenv(envKeyGcloud), 1)
+	for _, env := range secretEnvs {
+		r.add(os.Getenv(env), minNamedSecretLength)
+	}
+	r.add(string(key), 1)
+
+	keyFile := map[string]interface{}{}
+	if json.Unmarshal(key, &keyFile) == nil {
+		for _, field := range []string{"private_key", "private_key_id", "client_secret", "refresh_token"} {
+			value, ok := keyFile[field].(string)
+			if !ok {
+				continue
+			}
+			r.add(value, minSecretLength)
+			// every line of a PEM body, in case the key is printed in parts
+			for _, line := range strings.Split(value, "\n") {
+				if !strings.HasPrefix(line, "-----") {
+					r.add(line, minSecretLength)
+				}
+			}
+		}
+	}
+
+	sort.Slice(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+	return r
+}
+
+// newConsoleRedactor masks the secrets known before the config is read, so that its errors
+// are masked too: GCLOUD_KEY, SECRET_ENVS and the envs read by ROBO_LOGIN.
+func newConsoleRedactor() *redactor {
+	secretEnvs := splitLines(getOptionalEnv(envKeySecretEnvs))
+	for _, line := range splitLines(getOptionalEnv(envKeyRoboLogin)) {
+		if keyValue := strings.SplitN(line, "=", 2); len(keyValue) == 2 {
+			secretEnvs = append(secretEnvs, strings.TrimSpace(keyValue[1]))
+		}
+	}
+	return newRedactor(secretEnvs, nil, nil)
+}
+
+// add masks secret as is and as it appears escaped in JSON and XML reports, unless it is
+// shorter than minLength.
+func (r *redactor) add(secret string, minLength int) {
+	secret = strings.TrimSpace(secret)
+	if len(secret) < minLength {
+		return
+	}
+
+	variants := []string{secret}
+	if escaped, err := json.Marshal(secret); err == nil {
+		variants = append(variants, strings.Trim(string(escaped), `"`))
+	}
+	escaped := &bytes.Buffer{}
+	if xml.EscapeText(escaped, []byte(secret)) == nil {
+		variants = append(variants, escaped.String())
+	}
+
+	for _, variant := range variants {
+		if !containsID(r.secrets, variant) {
+			r.secrets = append(r.secrets, variant)
+		}
+	}
+}
+
+// Redact masks every secret in s.
+func (r *redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, secret := range r.secrets {
+		s = strings.Replace(s, secret, redactedValue, -1)
+	}
+	return s
+}
+
+// Command prints cmdSlice for the log with the values of sensitive flags masked. Values of
+// KEY=VALUE lists, e.g. --environment-variables, keep their keys.
+func (r *redactor) Command(cmdSlice []string) string {
+	if r == nil {
+		return command.PrintableCommandArgs(false, cmdSlice)
+	}
+
+	masked := make([]string, 0, len(cmdSlice))
+	for i := 0; i < len(cmdSlice); i++ {
+		parts := strings.SplitN(cmdSlice[i], "=", 2)
+		if !r.flags[parts[0]] {
+			masked = append(masked, cmdSlice[i])
+			continue
+		}
+
+		if len(parts) == 2 {
+			masked = append(masked, parts[0]+"="+maskFlagValue(parts[1]))
+		} else if i+1 < len(cmdSlice) {
+			masked = append(masked, cmdSlice[i], maskFlagValue(cmdSlice[i+1]))
+			i++
+		} else {
+			masked = append(masked, cmdSlice[i])
+		}
+	}
+	return r.Redact(command.PrintableCommandArgs(false, masked))
+}
+
+func maskFlagValue(value string) string {
+	items := splitGcloudList(value)
+	for i, item := range items {
+		if keyValue := strings.SplitN(item, "=", 2); len(keyValue) == 2 {
+			items[i] = keyValue[0] + "=" + redactedValue
+		} else {
+			items[i] = redactedValue
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// Writer masks the secrets of the lines written to out. Safe for concurrent use, Flush writes
+// an unfinished last line.
+func (r *redactor) Writer(out io.Writer) *redactingWriter {
+	return &redactingWriter{redactor: r, out: out}
+}
+
+type redactingWriter struct {
+	redactor *redactor
+	out      io.Writer
+
+	lock    sync.Mutex
+	pending string
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.pending = w.redactor.Redact(w.pending + string(p))
+	ready := strings.LastIndex(w.pending, "\n") + 1
+	if ready == 0 && len(w.pending) > maxPendingOutput {
+		ready = len(w.pending) - w.redactor.longestSecret()
+	}
+	if ready > 0 {
+		_, err := io.WriteString(w.out, w.pending[:ready])
+		w.pending = w.pending[ready:]
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// SetRedactor masks the secrets of r from now on, e.g. once the config was read.
+func (w *redactingWriter) SetRedactor(r *redactor) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.redactor = r
+}
+
+// Flush writes the unfinished last line.
+func (w *redactingWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.pending) > 0 {
+		_, _ = io.WriteString(w.out, w.pending)
+		w.pending = ""
+	}
+}
+
+func (r *redactor) longestSecret() int {
+	if r == nil || len(r.secrets) == 0 {
+		return 0
+	}
+	return len(r.secrets[0])
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewRedactor(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	resetEnv()
+	Setenv(envKeyGcloud, ServiceAccountKey("fake@example.com"))
+	Setenv("API_TOKEN", "tok_s3cr3t&more")
+	Setenv("SHORT", "yes")
+	key, err := base64.StdEncoding.DecodeString(os.Getenv(envKeyGcloud))
+	assert.NoError(err)
+	r := newRedactor([]string{"API_TOKEN", "SHORT", "UNSET"}, nil, key)
+
+	keyFile := GcloudKeyFile{}
+	PanicOnErr(json.Unmarshal(key, &keyFile))
+	pemLine := strings.Split(keyFile.PrivateKey, "\n")[1]
+	escapedKey, err := json.Marshal(keyFile.PrivateKey)
+	assert.NoError(err)
+
+	cases := []struct {
+		text     string
+		redacted string
+	}{
+		{"--environment-variables API_TOKEN=tok_s3cr3t&more", "--environment-variables API_TOKEN=" + redactedValue},
+		{`<failure message="401 for tok_s3cr3t&amp;more"></failure>`, `<failure message="401 for ` + redactedValue + `"></failure>`},
+		{"GCLOUD_KEY=" + os.Getenv(envKeyGcloud), "GCLOUD_KEY=" + redactedValue},
+		{"key: " + keyFile.PrivateKey, "key: " + redactedValue + "\n"},
+		{"line: " + pemLine, "line: " + redactedValue},
+		{`{"private_key": ` + string(escapedKey) + `}`, `{"private_key": "` + redactedValue + `\n"}`},
+		{"key id " + "0123456789abcdef", "key id " + redactedValue},
+		// short values of named envs would mask unrelated text
+		{"VERBOSE=yes fake@example.com", "VERBOSE=yes fake@example.com"},
+	}
+	for _, c := range cases {
+		assert.Equal(c.redacted, r.Redact(c.text), c.text)
+	}
+
+	var none *redactor
+	assert.Equal("tok_s3cr3t&more", none.Redact("tok_s3cr3t&more"))
+}
+
+func TestNewConsoleRedactor(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	setupOptionsEnv()
+	Setenv("API_TOKEN", "tok_")
+	Setenv("ROBO_PASSWORD", "hunter2")
+	Setenv(envKeySecretEnvs, "API_TOKEN")
+	Setenv(envKeyRoboLogin, "password_field=ROBO_PASSWORD")
+	Setenv(envKeyTestApk, "")
+	Setenv(envKeyTestType, testTypeRobo)
+	Setenv(envKeyGcloud, "http://example.com/key.json")
+
+	// errors of the config are printed before it has a redactor
+	out := &bytes.Buffer{}
+	console := newConsoleRedactor().Writer(out)
+	_, err := newFirebaseConfig()
+	assert.EqualError(err, envKeyGcloud+" must be downloaded over https: 'http://example.com/key.json'")
+	_, _ = io.WriteString(console, err.Error()+" tok_ hunter2\n")
+	assert.Equal(envKeyGcloud+" must be downloaded over https: '[REDACTED]' [REDACTED] [REDACTED]\n", out.String())
+
+	//- the redactor of the config takes over
+	out.Reset()
+	Setenv(envKeyGcloud, ServiceAccountKey("fake@example.com"))
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	console.SetRedactor(config.Redactor)
+	_, _ = io.WriteString(console, "hunter2 tok_\n")
+	assert.Equal("[REDACTED] [REDACTED]\n", out.String())
+}
+
+func TestRedactorCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newRedactor(nil, []string{"--environment-variables", "--robo-directives"}, nil)
+	assert.Equal(`gcloud "firebase" "test" "android" "run" "--environment-variables=coverage=[REDACTED],API_TOKEN=[REDACTED]" "--robo-directives" "[REDACTED]" "--timeout" "5m"`, r.Command([]string{
+		"gcloud", "firebase", "test", "android", "run",
+		"--environment-variables=coverage=true,API_TOKEN=tok_s3cr3t",
+		"--robo-directives", "s3cr3t_password",
+		"--timeout", "5m",
+	}))
+	assert.Equal(`gcloud "run" "--environment-variables" "API_TOKEN=[REDACTED]"`, r.Command([]string{"gcloud", "run", "--environment-variables", "API_TOKEN=tok_s3cr3t"}))
+	assert.Equal(`gcloud "run" "--environment-variables"`, r.Command([]string{"gcloud", "run", "--environment-variables"}))
+
+	var none *redactor
+	assert.Equal(`gcloud "--environment-variables" "API_TOKEN=tok_s3cr3t"`, none.Command([]string{"gcloud", "--environment-variables", "API_TOKEN=tok_s3cr3t"}))
+}
+
+func TestRedactingWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &redactor{secrets: []string{"tok_s3cr3t"}}
+	out := &bytes.Buffer{}
+	w := r.Writer(out)
+
+	//- secrets split across writes
+	for _, part := range []string{"Authorization: tok_", "s3", "cr3t\nnext", " line"} {
+		n, err := w.Write([]byte(part))
+		assert.NoError(err)
+		assert.Equal(len(part), n)
+	}
+	assert.Equal("Authorization: [REDACTED]\n", out.String())
+	w.Flush()
+	assert.Equal("Authorization: [REDACTED]\nnext line", out.String())
+
+	//- long lines are written before their newline, holding back a possible secret
+	out.Reset()
+	_, _ = io.WriteString(w, strings.Repeat(".", maxPendingOutput)+"tok_s3c")
+	assert.Equal(strings.Repeat(".", maxPendingOutput-3), out.String())
+	_, _ = io.WriteString(w, "r3t\n")
+	assert.Equal(strings.Repeat(".", maxPendingOutput)+"[REDACTED]\n", out.String())
+}
+
+func TestWriteReportsRedacted(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "redact")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	r := &redactor{}
+	r.add("tok_s3cr3t&more", 1)
+
+	reportPath := filepath.Join(tmpDir, junitReportFileName)
+	report := junitTestSuites{Suites: []junitTestSuite{{Name: "Pixel2-28", TestCases: []junitTestCase{{
+		Name:     "testLogin",
+		Failures: []junitMessage{{Message: "401 for tok_s3cr3t&more", Text: "java.lang.AssertionError: tok_s3cr3t&more"}},
+	}}}}}
+	assert.NoError(writeJUnitReport(report, reportPath, r))
+	data, err := ioutil.ReadFile(reportPath)
+	assert.NoError(err)
+	assert.NotContains(string(data), "s3cr3t")
+	assert.Contains(string(data), `<failure message="401 for [REDACTED]">java.lang.AssertionError: [REDACTED]</failure>`)
+
+	summaryPath := filepath.Join(tmpDir, summaryFileName)
+	summary := newRunSummary("bucket", testOutcome{Name: "failed", ResultsDir: "tok_s3cr3t&more"}, junitTestSuites{}, "")
+	assert.NoError(writeRunSummary(summary, summaryPath, r))
+	data, err = ioutil.ReadFile(summaryPath)
+	assert.NoError(err)
+	assert.NotContains(string(data), "s3cr3t")
+}
+
+func TestNewFirebaseConfigRedactor(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	setupOptionsEnv()
+	Setenv("API_TOKEN", "tok_s3cr3t")
+	Setenv(envKeySecretEnvs, "API_TOKEN")
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal("token [REDACTED]", config.Redactor.Redact("token tok_s3cr3t"))
+	assert.Equal(map[string]bool{"--environment-variables": true, "--robo-directives": true}, config.Redactor.flags)
+
+	Setenv(envKeySensitiveFlags, "--robo-directives\n--other-files")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal(map[string]bool{"--robo-directives": true, "--other-files": true}, config.Redactor.flags)
+
+	Setenv(envKeySensitiveFlags, "robo-directives")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeySensitiveFlags+" must be gcloud flags like --environment-variables: 'robo-directives'")
+}
+
+func TestRunRedactsOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	config := newFakeGcloudConfig(assert)
+	Setenv("API_TOKEN", "tok_s3cr3t")
+	Setenv(envKeySecretEnvs, "API_TOKEN")
+	Setenv(envKeyEnvironmentVariables, "API_TOKEN=tok_s3cr3t\ncoverage=true")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	config.Runner = &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		if len(cmdSlice) > 4 && cmdSlice[4] == "run" {
+			_, _ = io.WriteString(output, "Sending API_TOKEN=tok_s3cr3t\n")
+			return commandResult{Stdout: GcloudMatrixOutput(1)}, nil
+		}
+		return commandResult{}, nil
+	}}
+
+	out := &bytes.Buffer{}
+	console := config.Redactor.Writer(out)
+	log.SetOutWriter(console)
+	defer log.SetOutWriter(os.Stdout)
+
+	outcome, err := run(config, localStorage{Root: root}, console)
+	assert.NoError(err)
+	assert.Equal("passed", outcome.Name)
+	console.Flush()
+	assert.NotContains(out.String(), "tok_s3cr3t")
+	assert.Contains(out.String(), `"--environment-variables" "API_TOKEN=[REDACTED],coverage=[REDACTED]"`)
+	assert.Contains(out.String(), "Sending API_TOKEN=[REDACTED]")
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults of the RETRY_* inputs.
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = 30 * time.Second
+	defaultRetryMaxBackoff     = 5 * time.Minute
+	maxRetryAttempts           = 10
+	// Each backoff is randomized by up to ±20% so parallel shards don't retry in lockstep.
+	retryJitter = 0.2
+	// Attempt n > 1 writes to <results dir>_attempt_<n> instead of overwriting the earlier attempts.
+	retryResultsDirSuffix = "_attempt_%d"
+)
+
+// retryPolicy decides whether and when a test matrix is submitted again.
+type retryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter randomizes each backoff by up to ±Jitter of its length.
+	Jitter         float64
+	RetryExitCodes []int
+	// Deadline bounds the time of all attempts including backoff, 0 means no deadline.
+	// A running attempt isn't interrupted, the policy just won't start another one.
+	Deadline         time.Duration
+	ResultsDirSuffix string
+
+	// Replaced in tests, time.Now, time.Sleep and rand.Float64 when nil.
+	now    func() time.Time
+	sleep  func(time.Duration)
+	random func() float64
+}
+
+// retryAttempt records a single gcloud run of a test matrix.
+type retryAttempt struct {
+	Number     int
+	ResultsDir string
+	ExitCode   int
+	Duration   time.Duration
+	Run        runResult
+}
+
+func newRetryPolicy() (retryPolicy, error) {
+	policy := retryPolicy{
+		MaxAttempts:      defaultRetryMaxAttempts,
+		InitialBackoff:   defaultRetryInitialBackoff,
+		MaxBackoff:       defaultRetryMaxBackoff,
+		Jitter:           retryJitter,
+		RetryExitCodes:   []int{exitCodeInfrastructure},
+		ResultsDirSuffix: retryResultsDirSuffix,
+	}
+
+	attemptsValue := getOptionalEnv(envKeyRetryMaxAttempts)
+	if !isEmpty(attemptsValue) {
+		attempts, err := strconv.Atoi(attemptsValue)
+		if err != nil || attempts < 1 || attempts > maxRetryAttempts {
+			return policy, fmt.Errorf("%s must be a number between 1 and %d", envKeyRetryMaxAttempts, maxRetryAttempts)
+		}
+		policy.MaxAttempts = attempts
+	}
+
+	var err error
+	if backoffValue := getOptionalEnv(envKeyRetryBackoff); !isEmpty(backoffValue) {
+		policy.InitialBackoff, err = parseTimeout(envKeyRetryBackoff, backoffValue)
+		if err != nil {
+			return policy, err
+		}
+	}
+
+	if maxBackoffValue := getOptionalEnv(envKeyRetryMaxBackoff); !isEmpty(maxBackoffValue) {
+		policy.MaxBackoff, err = parseTimeout(envKeyRetryMaxBackoff, maxBackoffValue)
+		if err != nil {
+			return policy, err
+		}
+	}
+	if policy.MaxBackoff < policy.InitialBackoff {
+		return policy, errors.New(envKeyRetryMaxBackoff + " must not be shorter than " + envKeyRetryBackoff)
+	}
+
+	if deadlineValue := getOptionalEnv(envKeyRetryDeadline); !isEmpty(deadlineValue) {
+		policy.Deadline, err = parseTimeout(envKeyRetryDeadline, deadlineValue)
+		if err != nil {
+			return policy, err
+		}
+	}
+
+	if exitCodesValue := getOptionalEnv(envKeyRetryExitCodes); !isEmpty(exitCodesValue) {
+		policy.RetryExitCodes, err = parseExitCodes(exitCodesValue)
+		if err != nil {
+			return policy, err
+		}
+	}
+
+	return policy, nil
+}
+
+// parseExitCodes parses a comma or whitespace separated list of nonzero exit codes.
+func parseExitCodes(value string) ([]int, error) {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	})
+
+	codes := make([]int, 0, len(fields))
+	for _, field := range fields {
+		code, err := strconv.Atoi(field)
+		if err != nil || code <= 0 {
+			return nil, errors.New(envKeyRetryExitCodes + " must list nonzero exit codes like 20 or 15,20: '" + value + "'")
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func (policy retryPolicy) retryable(exitCode int) bool {
+	for _, code := range policy.RetryExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff is the jittered wait after the given attempt: InitialBackoff doubled per
+// attempt, capped at MaxBackoff.
+func (policy retryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(policy.InitialBackoff) * math.Pow(2, float64(attempt-1))
+	if delay > float64(policy.MaxBackoff) {
+		delay = float64(policy.MaxBackoff)
+	}
+
+	random := policy.random
+	if random == nil {
+		random = rand.Float64
+	}
+	delay *= 1 + policy.Jitter*(2*random()-1)
+
+	if delay > float64(policy.MaxBackoff) {
+		delay = float64(policy.MaxBackoff)
+	}
+	return time.Duration(delay) / time.Millisecond * time.Millisecond
+}
+
+// clock returns the now and sleep of policy, time.Now and time.Sleep unless replaced.
+func (policy retryPolicy) clock() (func() time.Time, func(time.Duration)) {
+	now, sleep := policy.now, policy.sleep
+	if now == nil {
+		now = time.Now
+	}
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	return now, sleep
+}
+
+// withContext makes the sleeps of policy end early once ctx is done, unless sleep was replaced.
+func (policy retryPolicy) withContext(ctx context.Context) retryPolicy {
+	if policy.sleep == nil {
+		policy.sleep = func(d time.Duration) {
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+			}
+		}
+	}
+	return policy
+}
+
+// run runs gcsCommand until it exits with a code that isn't retryable, MaxAttempts
+// is reached or the next attempt would start past the deadline.
+func (policy retryPolicy) run(runner commandRunner, gcsCommand []string, output io.Writer) ([]retryAttempt, error) {
+	now, sleep := policy.clock()
+
+	resultsDir := gcloudFlagValue(gcsCommand, "--results-dir")
+	start := now()
+	attempts := make([]retryAttempt, 0, 1)
+
+	for number := 1; ; number++ {
+		attempt := retryAttempt{Number: number, ResultsDir: resultsDir}
+		attemptCommand := gcsCommand
+		if number > 1 {
+			attempt.ResultsDir = resultsDir + fmt.Sprintf(policy.ResultsDirSuffix, number)
+			attemptCommand = withGcloudFlag(gcsCommand, "--results-dir", attempt.ResultsDir)
+		}
+
+		attemptStart := now()
+		result, err := runner.Run(attemptCommand, output)
+		if err != nil {
+			return attempts, err
+		}
+		attempt.ExitCode = result.ExitCode
+		attempt.Run = parseRunResult(result.combinedOutput())
+		attempt.Duration = now().Sub(attemptStart) / time.Millisecond * time.Millisecond
+		attempts = append(attempts, attempt)
+		_, _ = fmt.Fprintf(output, "Attempt %d/%d exited with %d after %s, results: %s\n", number, policy.MaxAttempts, attempt.ExitCode, attempt.Duration, attempt.ResultsDir)
+
+		if !policy.retryable(attempt.ExitCode) || number >= policy.MaxAttempts {
+			return attempts, nil
+		}
+
+		delay := policy.backoff(number)
+		if policy.Deadline > 0 && now().Add(delay).Sub(start) >= policy.Deadline {
+			_, _ = fmt.Fprintf(output, "Not retrying, the next attempt would start after the retry deadline of %s\n", policy.Deadline)
+			return attempts, nil
+		}
+
+		_, _ = fmt.Fprintf(output, "Exit code %d is retryable, retrying in %s\n", attempt.ExitCode, delay)
+		sleep(delay)
+	}
+}
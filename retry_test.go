@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// fakeRunner records every command it runs and exits with the next of ExitCodes,
+// each run taking Duration on the fake clock.
+type fakeRunner struct {
+	ExitCodes []int
+	Duration  time.Duration
+	Commands  [][]string
+	Sleeps    []time.Duration
+	clock     time.Time
+}
+
+func (runner *fakeRunner) Run(cmdSlice []string, output io.Writer) (commandResult, error) {
+	runner.Commands = append(runner.Commands, cmdSlice)
+	runner.clock = runner.clock.Add(runner.Duration)
+
+	result := commandResult{Duration: runner.Duration}
+	if len(runner.ExitCodes) > 0 {
+		result.ExitCode, runner.ExitCodes = runner.ExitCodes[0], runner.ExitCodes[1:]
+	}
+	return result, nil
+}
+
+// Policy returns policy running on the fake clock without jitter.
+func (runner *fakeRunner) Policy(policy retryPolicy) retryPolicy {
+	policy.now = func() time.Time {
+		return runner.clock
+	}
+	policy.sleep = func(d time.Duration) {
+		runner.Sleeps = append(runner.Sleeps, d)
+		runner.clock = runner.clock.Add(d)
+	}
+	policy.random = func() float64 {
+		return 0.5
+	}
+	return policy
+}
+
+func testRetryPolicy() retryPolicy {
+	return retryPolicy{
+		MaxAttempts:      4,
+		InitialBackoff:   30 * time.Second,
+		MaxBackoff:       time.Minute,
+		RetryExitCodes:   []int{exitCodeInfrastructure, exitCodeInconclusive},
+		ResultsDirSuffix: retryResultsDirSuffix,
+	}
+}
+
+func TestRetryPolicyRun(t *testing.T) {
+	assert := assert.New(t)
+
+	gcsCommand := []string{"gcloud", "firebase", "test", "android", "run", "--results-dir=results_dir", "--timeout", "25m"}
+
+	runner := &fakeRunner{ExitCodes: []int{20, 15, 20, 10}, Duration: 10 * time.Minute}
+	output := &bytes.Buffer{}
+	attempts, err := runner.Policy(testRetryPolicy()).run(runner, gcsCommand, output)
+	assert.NoError(err)
+
+	assert.Equal([]retryAttempt{
+		{Number: 1, ResultsDir: "results_dir", ExitCode: 20, Duration: 10 * time.Minute},
+		{Number: 2, ResultsDir: "results_dir_attempt_2", ExitCode: 15, Duration: 10 * time.Minute},
+		{Number: 3, ResultsDir: "results_dir_attempt_3", ExitCode: 20, Duration: 10 * time.Minute},
+		{Number: 4, ResultsDir: "results_dir_attempt_4", ExitCode: 10, Duration: 10 * time.Minute},
+	}, attempts)
+	assert.Equal([]time.Duration{30 * time.Second, time.Minute, time.Minute}, runner.Sleeps)
+
+	assert.Equal(gcsCommand, runner.Commands[0])
+	assert.Equal([]string{"gcloud", "firebase", "test", "android", "run", "--timeout", "25m", "--results-dir=results_dir_attempt_2"}, runner.Commands[1])
+	assert.Contains(output.String(), "Attempt 1/4 exited with 20 after 10m0s, results: results_dir\n")
+	assert.Contains(output.String(), "Exit code 20 is retryable, retrying in 30s\n")
+	assert.Contains(output.String(), "Attempt 4/4 exited with 10 after 10m0s, results: results_dir_attempt_4\n")
+}
+
+func TestRetryPolicyRunLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	gcsCommand := []string{"gcloud", "firebase", "test", "android", "run", "--results-dir=results_dir"}
+
+	//- exit code not retryable
+	runner := &fakeRunner{ExitCodes: []int{18, 20}}
+	attempts, err := runner.Policy(testRetryPolicy()).run(runner, gcsCommand, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal(1, len(attempts))
+	assert.Equal(0, len(runner.Sleeps))
+
+	//- attempts exhausted
+	policy := testRetryPolicy()
+	policy.MaxAttempts = 2
+	runner = &fakeRunner{ExitCodes: []int{20, 20, 0}}
+	attempts, err = runner.Policy(policy).run(runner, gcsCommand, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal(2, len(attempts))
+	assert.Equal(20, attempts[1].ExitCode)
+
+	//- the third attempt would start at 10m + 30s + 10m + 60s
+	policy = testRetryPolicy()
+	policy.Deadline = 21 * time.Minute
+	runner = &fakeRunner{ExitCodes: []int{20, 20, 0}, Duration: 10 * time.Minute}
+	output := &bytes.Buffer{}
+	attempts, err = runner.Policy(policy).run(runner, gcsCommand, output)
+	assert.NoError(err)
+	assert.Equal(2, len(attempts))
+	assert.Contains(output.String(), "Not retrying, the next attempt would start after the retry deadline of 21m0s")
+
+	//- runner errors aren't retried
+	failing := &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		return commandResult{}, errors.New("gcloud not found")
+	}}
+	_, err = testRetryPolicy().run(failing, gcsCommand, ioutil.Discard)
+	assert.EqualError(err, "gcloud not found")
+	assert.Equal(1, len(failing.Calls))
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	policy := retryPolicy{InitialBackoff: 10 * time.Second, MaxBackoff: time.Minute, Jitter: 0.2}
+
+	policy.random = func() float64 { return 0.5 }
+	assert.Equal(10*time.Second, policy.backoff(1))
+	assert.Equal(20*time.Second, policy.backoff(2))
+	assert.Equal(40*time.Second, policy.backoff(3))
+	assert.Equal(time.Minute, policy.backoff(4))
+
+	policy.random = func() float64 { return 0 }
+	assert.Equal(8*time.Second, policy.backoff(1))
+	assert.Equal(48*time.Second, policy.backoff(10))
+
+	policy.random = func() float64 { return 1 }
+	assert.Equal(12*time.Second, policy.backoff(1))
+	assert.Equal(time.Minute, policy.backoff(10))
+}
+
+func TestNewRetryPolicy(t *testing.T) {
+	assert := assert.New(t)
+	resetEnv()
+
+	policy, err := newRetryPolicy()
+	assert.NoError(err)
+	assert.Equal(retryPolicy{
+		MaxAttempts:      3,
+		InitialBackoff:   30 * time.Second,
+		MaxBackoff:       5 * time.Minute,
+		Jitter:           0.2,
+		RetryExitCodes:   []int{20},
+		ResultsDirSuffix: "_attempt_%d",
+	}, policy)
+
+	Setenv(envKeyRetryMaxAttempts, "5")
+	Setenv(envKeyRetryBackoff, "90")
+	Setenv(envKeyRetryMaxBackoff, "10m")
+	Setenv(envKeyRetryExitCodes, "15, 20")
+	Setenv(envKeyRetryDeadline, "2h")
+	policy, err = newRetryPolicy()
+	assert.NoError(err)
+	assert.Equal(5, policy.MaxAttempts)
+	assert.Equal(90*time.Second, policy.InitialBackoff)
+	assert.Equal(10*time.Minute, policy.MaxBackoff)
+	assert.Equal([]int{15, 20}, policy.RetryExitCodes)
+	assert.Equal(2*time.Hour, policy.Deadline)
+
+	cases := []struct {
+		key   string
+		value string
+		err   string
+	}{
+		{envKeyRetryMaxAttempts, "0", envKeyRetryMaxAttempts + " must be a number between 1 and 10"},
+		{envKeyRetryBackoff, "soon", envKeyRetryBackoff + " must be a duration like 90s, 25m or 1h: 'soon'"},
+		{envKeyRetryMaxBackoff, "30s", envKeyRetryMaxBackoff + " must not be shorter than " + envKeyRetryBackoff},
+		{envKeyRetryExitCodes, "0,20", envKeyRetryExitCodes + " must list nonzero exit codes like 20 or 15,20: '0,20'"},
+		{envKeyRetryDeadline, "-1h", envKeyRetryDeadline + " must be a duration like 90s, 25m or 1h: '-1h'"},
+	}
+
+	for _, c := range cases {
+		resetEnv()
+		Setenv(envKeyRetryBackoff, "1m")
+		Setenv(c.key, c.value)
+
+		_, err = newRetryPolicy()
+		assert.EqualError(err, c.err)
+	}
+}
+
+func TestRunTestMatrixRecordsAttempts(t *testing.T) {
+	assert := assert.New(t)
+
+	config := newFakeGcloudConfig(assert)
+	runner := &fakeRunner{ExitCodes: []int{20, 10}}
+	config.Runner = runner
+	config.Retry = runner.Policy(config.Retry)
+
+	gcsCommand, err := buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+
+	outcome, err := runTestMatrix(config, gcsCommand, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal("failed", outcome.Name)
+	assert.Equal("results_dir_attempt_2", outcome.ResultsDir)
+	assert.Equal([]retryAttempt{
+		{Number: 1, ResultsDir: "results_dir", ExitCode: 20},
+		{Number: 2, ResultsDir: "results_dir_attempt_2", ExitCode: 10},
+	}, outcome.Attempts)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Types of ROBO_DIRECTIVES, text is the default like in gcloud.
+const (
+	roboDirectiveText   = "text"
+	roboDirectiveClick  = "click"
+	roboDirectiveIgnore = "ignore"
+)
+
+// Limits of gcloud for --max-depth and --max-steps.
+const (
+	minRoboMaxDepth = 2
+	minRoboMaxSteps = 1
+)
+
+// roboInputs configure Robo tests, they're rejected for the other test types and iOS.
+var roboInputs = []string{envKeyRoboScript, envKeyRoboDirectives, envKeyRoboLogin, envKeyRoboInitialActivity, envKeyRoboMaxDepth, envKeyRoboMaxSteps}
+
+// roboConfig holds the typed Robo inputs of TEST_TYPE robo.
+type roboConfig struct {
+	// Script is the path of the Robo script, uploaded with the apps.
+	Script string
+	// Directives include the text entries of ROBO_LOGIN.
+	Directives      []roboDirective
+	InitialActivity string
+	MaxDepth        int
+	MaxSteps        int
+	// LoginEnvs hold the values of the ROBO_LOGIN text entries, masked like SECRET_ENVS.
+	LoginEnvs []string
+}
+
+// roboDirective tells Robo what to do with the element of a resource name, e.g. text:username=alice.
+type roboDirective struct {
+	Type     string `json:"type"`
+	Resource string `json:"resource_name"`
+	Value    string `json:"value,omitempty"`
+	// Login values come from secret envs.
+	Login bool `json:"-"`
+}
+
+// roboAction is the part of a Robo script action the step checks. Scripts with a context
+// descriptor wrap their actions.
+// https://firebase.google.com/docs/test-lab/android/robo-scripts-reference
+type roboAction struct {
+	EventType       string       `json:"eventType"`
+	ReplacementText *string      `json:"replacementText"`
+	Actions         []roboAction `json:"actions"`
+}
+
+func newRoboConfig(platform string, testType string) (roboConfig, error) {
+	robo := roboConfig{}
+
+	for _, key := range roboInputs {
+		if isEmpty(getOptionalEnv(key)) {
+			continue
+		}
+		if platform != platformAndroid {
+			return robo, errors.New(key + " is only supported on Android")
+		}
+		if testType != testTypeRobo {
+			return robo, errors.New(key + " configures Robo tests, not " + testType + " tests")
+		}
+	}
+
+	robo.Script = strings.TrimSpace(getOptionalEnv(envKeyRoboScript))
+	if !isEmpty(robo.Script) {
+		err := validateRoboScript(robo.Script)
+		if err != nil {
+			return robo, err
+		}
+	}
+
+	directives, err := parseRoboDirectives(envKeyRoboDirectives, splitLines(getOptionalEnv(envKeyRoboDirectives)))
+	if err != nil {
+		return robo, err
+	}
+	robo.Directives = directives
+
+	for _, line := range splitLines(getOptionalEnv(envKeyRoboLogin)) {
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) != 2 || isEmpty(strings.TrimSpace(keyValue[0])) || !environmentKeyPattern.MatchString(strings.TrimSpace(keyValue[1])) {
+			return robo, errors.New(envKeyRoboLogin + " must be resource_name=ENV_NAME lines: '" + line + "'")
+		}
+
+		env := strings.TrimSpace(keyValue[1])
+		value, err := getRequiredEnv(env)
+		if err != nil {
+			return robo, errors.New(envKeyRoboLogin + " reads " + env + ", which is not defined")
+		}
+		robo.Directives = append(robo.Directives, roboDirective{Type: roboDirectiveText, Resource: strings.TrimSpace(keyValue[0]), Value: value, Login: true})
+		robo.LoginEnvs = append(robo.LoginEnvs, env)
+	}
+
+	resources := map[string]bool{}
+	for _, directive := range robo.Directives {
+		if resources[directive.Resource] {
+			return robo, errors.New(envKeyRoboDirectives + " and " + envKeyRoboLogin + " can't name a resource twice: '" + directive.Resource + "'")
+		}
+		resources[directive.Resource] = true
+	}
+
+	robo.InitialActivity = strings.TrimSpace(getOptionalEnv(envKeyRoboInitialActivity))
+
+	robo.MaxDepth, err = parseRoboLimit(envKeyRoboMaxDepth, minRoboMaxDepth)
+	if err != nil {
+		return robo, err
+	}
+	robo.MaxSteps, err = parseRoboLimit(envKeyRoboMaxSteps, minRoboMaxSteps)
+	return robo, err
+}
+
+// parseRoboDirectives parses type:resource_name=value lines, name is the input or flag
+// they were read from. Click and ignore directives take no value.
+func parseRoboDirectives(name string, lines []string) ([]roboDirective, error) {
+	directives := make([]roboDirective, 0, len(lines))
+
+	for _, line := range lines {
+		directive := roboDirective{Type: roboDirectiveText}
+		rest := line
+		// resource names may contain a colon too, e.g. com.example:id/username
+		if colon := strings.Index(line, ":"); colon >= 0 {
+			switch line[:colon] {
+			case roboDirectiveText, roboDirectiveClick, roboDirectiveIgnore:
+				directive.Type, rest = line[:colon], line[colon+1:]
+			}
+		}
+
+		keyValue := strings.SplitN(rest, "=", 2)
+		directive.Resource = strings.TrimSpace(keyValue[0])
+		if len(keyValue) == 2 {
+			directive.Value = keyValue[1]
+		}
+
+		switch {
+		case isEmpty(directive.Resource):
+			return nil, errors.New(name + " needs a resource name: '" + line + "'")
+		case directive.Type == roboDirectiveText && len(keyValue) != 2:
+			return nil, errors.New(name + " text entries must be resource_name=text: '" + line + "'")
+		case directive.Type != roboDirectiveText && !isEmpty(directive.Value):
+			return nil, errors.New(name + " " + directive.Type + " directives take no value: '" + line + "'")
+		}
+		directives = append(directives, directive)
+	}
+
+	return directives, nil
+}
+
+// parseRoboLimit reads a limit of the crawl, 0 when not set.
+func parseRoboLimit(env string, min int) (int, error) {
+	value := getOptionalEnv(env)
+	if isEmpty(value) {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < min {
+		return 0, fmt.Errorf("%s must be a number of at least %d", env, min)
+	}
+	return limit, nil
+}
+
+// validateRoboScript checks that the file is a JSON array of Robo actions, Test Lab only
+// reports a broken script once the matrix ran.
+func validateRoboScript(scriptPath string) error {
+	err := fileExists(scriptPath)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(scriptPath)
+	if err != nil {
+		return err
+	}
+
+	actions := []roboAction{}
+	err = json.Unmarshal(data, &actions)
+	if err != nil {
+		return errors.New(envKeyRoboScript + " '" + scriptPath + "' isn't a JSON Robo script: " + err.Error())
+	}
+	if len(actions) == 0 {
+		return errors.New(envKeyRoboScript + " '" + scriptPath + "' has no actions")
+	}
+
+	return validateRoboActions(scriptPath, "", actions)
+}
+
+// validateRoboActions names actions by their position, e.g. action 2.3 is the third action
+// of the second script.
+func validateRoboActions(scriptPath string, prefix string, actions []roboAction) error {
+	for i, action := range actions {
+		position := prefix + strconv.Itoa(i+1)
+		switch {
+		case len(action.Actions) > 0:
+			err := validateRoboActions(scriptPath, position+".", action.Actions)
+			if err != nil {
+				return err
+			}
+		case isEmpty(action.EventType):
+			return errors.New(envKeyRoboScript + " '" + scriptPath + "': action " + position + " has no eventType")
+		case action.EventType == "VIEW_TEXT_CHANGED" && action.ReplacementText == nil:
+			return errors.New(envKeyRoboScript + " '" + scriptPath + "': action " + position + " of type VIEW_TEXT_CHANGED has no replacementText")
+		}
+	}
+	return nil
+}
+
+func (robo roboConfig) enabled() bool {
+	return !isEmpty(robo.Script) || len(robo.Directives) > 0 || !isEmpty(robo.InitialActivity) || robo.MaxDepth > 0 || robo.MaxSteps > 0
+}
+
+// String renders the directive in gcloud's --robo-directives format.
+func (directive roboDirective) String() string {
+	return directive.Type + ":" + directive.Resource + "=" + directive.Value
+}
+
+// gcloudFlags renders the Robo inputs, skipping every flag already set in userOptionsSet.
+func (robo roboConfig) gcloudFlags(userOptionsSet map[string]bool) []string {
+	args := make([]string, 0)
+
+	if !isEmpty(robo.Script) && !hasGcloudFlag(userOptionsSet, "--robo-script") {
+		args = append(args, "--robo-script", robo.Script)
+	}
+
+	if len(robo.Directives) > 0 && !hasGcloudFlag(userOptionsSet, "--robo-directives") {
+		pairs := make([]string, 0, len(robo.Directives))
+		for _, directive := range robo.Directives {
+			pairs = append(pairs, directive.String())
+		}
+		args = append(args, "--robo-directives", gcloudList(pairs))
+	}
+
+	if !isEmpty(robo.InitialActivity) && !hasGcloudFlag(userOptionsSet, "--app-initial-activity") {
+		args = append(args, "--app-initial-activity", robo.InitialActivity)
+	}
+
+	if robo.MaxDepth > 0 && !hasGcloudFlag(userOptionsSet, "--max-depth") {
+		args = append(args, "--max-depth", strconv.Itoa(robo.MaxDepth))
+	}
+
+	if robo.MaxSteps > 0 && !hasGcloudFlag(userOptionsSet, "--max-steps") {
+		args = append(args, "--max-steps", strconv.Itoa(robo.MaxSteps))
+	}
+
+	return args
+}
+
+// roboSummary is the Robo configuration of the run summary, login values are masked.
+type roboSummary struct {
+	Script          string          `json:"script,omitempty"`
+	Directives      []roboDirective `json:"directives,omitempty"`
+	InitialActivity string          `json:"initial_activity,omitempty"`
+	MaxDepth        int             `json:"max_depth,omitempty"`
+	MaxSteps        int             `json:"max_steps,omitempty"`
+}
+
+// summary is nil without Robo inputs.
+func (robo roboConfig) summary() *roboSummary {
+	if !robo.enabled() {
+		return nil
+	}
+
+	summary := &roboSummary{
+		Script:          robo.Script,
+		InitialActivity: robo.InitialActivity,
+		MaxDepth:        robo.MaxDepth,
+		MaxSteps:        robo.MaxSteps,
+	}
+	for _, directive := range robo.Directives {
+		if directive.Login {
+			directive.Value = redactedValue
+		}
+		summary.Directives = append(summary.Directives, directive)
+	}
+	return summary
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const roboScript = `[
+  {"eventType": "VIEW_TEXT_CHANGED", "replacementText": "alice", "elementDescriptors": [{"resourceId": "com.example:id/username"}]},
+  {"eventType": "VIEW_CLICKED", "elementDescriptors": [{"resourceId": "com.example:id/sign_in"}]}
+]`
+
+// setupRoboEnv sets up a Robo run with a script in tmpDir.
+func setupRoboEnv(tmpDir string) string {
+	setupOptionsEnv()
+	Setenv(envKeyTestApk, "")
+
+	scriptPath := filepath.Join(tmpDir, "robo.json")
+	PanicOnErr(ioutil.WriteFile(scriptPath, []byte(roboScript), 0644))
+	return scriptPath
+}
+
+func TestNewRoboConfig(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	tmpDir, err := ioutil.TempDir("", "robo")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	scriptPath := setupRoboEnv(tmpDir)
+	Setenv(envKeyRoboScript, scriptPath)
+	Setenv(envKeyRoboDirectives, "text:com.example:id/search=espresso\nclick:com.example:id/accept_terms\nignore:sign_out_button\nnickname=a,b")
+	Setenv("ROBO_PASSWORD", "s3cr3t_password")
+	Setenv(envKeyRoboLogin, "password_field=ROBO_PASSWORD")
+	Setenv(envKeyRoboInitialActivity, "com.example.LoginActivity")
+	Setenv(envKeyRoboMaxDepth, "20")
+	Setenv(envKeyRoboMaxSteps, "300")
+
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal(roboConfig{
+		Script: scriptPath,
+		Directives: []roboDirective{
+			{Type: "text", Resource: "com.example:id/search", Value: "espresso"},
+			{Type: "click", Resource: "com.example:id/accept_terms"},
+			{Type: "ignore", Resource: "sign_out_button"},
+			{Type: "text", Resource: "nickname", Value: "a,b"},
+			{Type: "text", Resource: "password_field", Value: "s3cr3t_password", Login: true},
+		},
+		InitialActivity: "com.example.LoginActivity",
+		MaxDepth:        20,
+		MaxSteps:        300,
+		LoginEnvs:       []string{"ROBO_PASSWORD"},
+	}, config.Robo)
+
+	gcsCommand, err := buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	assert.Equal([]string{
+		"gcloud", "firebase", "test", "android", "run",
+		"--type", "robo",
+		"--robo-script", scriptPath,
+		"--robo-directives", "^;^text:com.example:id/search=espresso;click:com.example:id/accept_terms=;ignore:sign_out_button=;text:nickname=a,b;text:password_field=s3cr3t_password",
+		"--app-initial-activity", "com.example.LoginActivity",
+		"--max-depth", "20",
+		"--max-steps", "300",
+		"--app", "/tmp/app.apk",
+		"--results-bucket=golang-bucket",
+		"--results-dir=results_dir",
+	}, gcsCommand)
+
+	// the login is a secret, the other directives keep their resource names in the log
+	assert.Equal("password "+redactedValue, config.Redactor.Redact("password s3cr3t_password"))
+	assert.NotContains(config.Redactor.Command(gcsCommand), "s3cr3t_password")
+	assert.NotContains(config.Redactor.Command(gcsCommand), "espresso")
+
+	//- flags of GCLOUD_OPTIONS win
+	config.Options = "--max-steps=50 --robo-directives text:search=kotlin"
+	gcsCommand, err = buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	assert.Equal("50", gcloudFlagValue(gcsCommand, "--max-steps"))
+	assert.Equal("text:search=kotlin", gcloudFlagValue(gcsCommand, "--robo-directives"))
+	assert.Equal("20", gcloudFlagValue(gcsCommand, "--max-depth"))
+}
+
+func TestNewRoboConfigValidation(t *testing.T) {
+	assert := assert.New(t)
+	gcloudKeyValue := os.Getenv(envKeyGcloud)
+	defer Setenv(envKeyGcloud, gcloudKeyValue)
+
+	tmpDir, err := ioutil.TempDir("", "robo")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	cases := []struct {
+		key   string
+		value string
+		err   string
+	}{
+		{envKeyRoboScript, "/tmp/missing-robo.json", "file doesn't exist: '/tmp/missing-robo.json'"},
+		{envKeyRoboDirectives, "click:=", envKeyRoboDirectives + " needs a resource name: 'click:='"},
+		{envKeyRoboDirectives, "username", envKeyRoboDirectives + " text entries must be resource_name=text: 'username'"},
+		{envKeyRoboDirectives, "click:sign_in=now", envKeyRoboDirectives + " click directives take no value: 'click:sign_in=now'"},
+		{envKeyRoboDirectives, "user=a\nclick:user", envKeyRoboDirectives + " and " + envKeyRoboLogin + " can't name a resource twice: 'user'"},
+		{envKeyRoboLogin, "password_field", envKeyRoboLogin + " must be resource_name=ENV_NAME lines: 'password_field'"},
+		{envKeyRoboLogin, "password_field=$ROBO_PASSWORD", envKeyRoboLogin + " must be resource_name=ENV_NAME lines: 'password_field=$ROBO_PASSWORD'"},
+		{envKeyRoboLogin, "password_field=ROBO_PASSWORD", envKeyRoboLogin + " reads ROBO_PASSWORD, which is not defined"},
+		{envKeyRoboMaxDepth, "1", envKeyRoboMaxDepth + " must be a number of at least 2"},
+		{envKeyRoboMaxSteps, "many", envKeyRoboMaxSteps + " must be a number of at least 1"},
+	}
+	for _, c := range cases {
+		setupRoboEnv(tmpDir)
+		Setenv(c.key, c.value)
+		_, err := newFirebaseConfig()
+		assert.EqualError(err, c.err, c.key+"="+c.value)
+	}
+
+	//- Robo inputs of instrumentation tests
+	setupOptionsEnv()
+	Setenv(envKeyRoboMaxSteps, "100")
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, envKeyRoboMaxSteps+" configures Robo tests, not instrumentation tests")
+
+	_, err = newRoboConfig(platformIOS, testTypeXCTest)
+	assert.EqualError(err, envKeyRoboMaxSteps+" is only supported on Android")
+}
+
+func TestValidateRoboScript(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "robo")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	scriptPath := filepath.Join(tmpDir, "robo.json")
+
+	cases := []struct {
+		script string
+		err    string
+	}{
+		{roboScript, ""},
+		// a script with a context descriptor
+		{`[{"id": 1000, "contextDescriptor": {"condition": "app_under_test_shown"}, "actions": [{"eventType": "PRESSED_BACK"}]}]`, ""},
+		{`{"eventType": "PRESSED_BACK"}`, "ROBO_SCRIPT '" + scriptPath + "' isn't a JSON Robo script: json: cannot unmarshal object into Go value of type []main.roboAction"},
+		{`[]`, "ROBO_SCRIPT '" + scriptPath + "' has no actions"},
+		{`[{"eventType": "PRESSED_BACK"}, {"delayTime": 500}]`, "ROBO_SCRIPT '" + scriptPath + "': action 2 has no eventType"},
+		{`[{"actions": [{"eventType": "PRESSED_BACK"}, {"eventType": "VIEW_TEXT_CHANGED"}]}]`, "ROBO_SCRIPT '" + scriptPath + "': action 1.2 of type VIEW_TEXT_CHANGED has no replacementText"},
+	}
+	for _, c := range cases {
+		PanicOnErr(ioutil.WriteFile(scriptPath, []byte(c.script), 0644))
+		err := validateRoboScript(scriptPath)
+		if isEmpty(c.err) {
+			assert.NoError(err, c.script)
+		} else {
+			assert.EqualError(err, c.err, c.script)
+		}
+	}
+}
+
+func TestRoboSummary(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(roboConfig{}.summary())
+
+	robo := roboConfig{
+		Script: "gs://golang-bucket/uploads/sha256/abc.json",
+		Directives: []roboDirective{
+			{Type: "click", Resource: "accept_terms"},
+			{Type: "text", Resource: "password_field", Value: "s3cr3t_password", Login: true},
+		},
+		MaxSteps: 300,
+	}
+	data, err := json.Marshal(robo.summary())
+	assert.NoError(err)
+	assert.JSONEq(`{
+		"script": "gs://golang-bucket/uploads/sha256/abc.json",
+		"directives": [
+			{"type": "click", "resource_name": "accept_terms"},
+			{"type": "text", "resource_name": "password_field", "value": "[REDACTED]"}
+		],
+		"max_steps": 300
+	}`, string(data))
+	assert.Equal("s3cr3t_password", robo.Directives[1].Value)
+}
+
+func TestParseTestRunCommandRobo(t *testing.T) {
+	assert := assert.New(t)
+
+	run, err := parseTestRunCommand([]string{
+		"gcloud", "firebase", "test", "android", "run",
+		"--type", "robo",
+		"--robo-script", "gs://golang-bucket/uploads/sha256/abc.json",
+		"--robo-directives", "^;^text:com.example:id/search=a,b;click:accept_terms=",
+		"--app-initial-activity", "com.example.LoginActivity",
+		"--max-depth", "20",
+		"--max-steps=300",
+		"--app", "gs://golang-bucket/app.apk",
+		"--results-bucket=golang-bucket",
+		"--results-dir=results_dir",
+		"--device", "model=NexusLowRes,version=25",
+	})
+	assert.NoError(err)
+
+	data, err := json.Marshal(run.request("fake-project", "gs://golang-bucket/app.apk", "").TestSpecification)
+	assert.NoError(err)
+	assert.JSONEq(`{
+		"androidRoboTest": {
+			"appApk": {"gcsPath": "gs://golang-bucket/app.apk"},
+			"appInitialActivity": "com.example.LoginActivity",
+			"maxDepth": 20,
+			"maxSteps": 300,
+			"roboDirectives": [
+				{"resourceName": "com.example:id/search", "inputText": "a,b", "actionType": "ENTER_TEXT"},
+				{"resourceName": "accept_terms", "actionType": "SINGLE_CLICK"}
+			],
+			"roboScript": {"gcsPath": "gs://golang-bucket/uploads/sha256/abc.json"}
+		}
+	}`, string(data))
+
+	_, err = parseTestRunCommand([]string{
+		"gcloud", "firebase", "test", "android", "run",
+		"--type", "instrumentation", "--app", "app.apk", "--test", "test.apk", "--max-steps", "10",
+	})
+	assert.EqualError(err, "--robo-script, --robo-directives, --app-initial-activity, --max-depth and --max-steps need --type robo")
+}
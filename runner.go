@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/errorutil"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// commandResult is what a finished command left behind.
+type commandResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Duration time.Duration
+}
+
+// commandRunner runs the external commands of the step: gcloud, gsutil and envman.
+// execRunner runs them for real, tests use a recording fake.
+type commandRunner interface {
+	// Run runs cmdSlice with its stdout and stderr streamed to output, which may be nil.
+	// An error means the command couldn't be run, a nonzero exit code is reported in the result.
+	Run(cmdSlice []string, output io.Writer) (commandResult, error)
+}
+
+// execRunner runs commands as child processes and captures their output. Children are
+// killed once Context is done, which fails Run with the error of Context.
+type execRunner struct {
+	// Context of the step, never done when nil.
+	Context context.Context
+}
+
+func (runner execRunner) Run(cmdSlice []string, output io.Writer) (commandResult, error) {
+	if output == nil {
+		output = ioutil.Discard
+	}
+	ctx := runner.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// stdout and stderr are copied by separate goroutines, output must see one write at a time.
+	shared := &lockedWriter{out: output}
+	var stdout, stderr bytes.Buffer
+	cmdObj := command.NewWithCmd(exec.CommandContext(ctx, cmdSlice[0], cmdSlice[1:]...)).
+		SetStdout(io.MultiWriter(shared, &stdout)).
+		SetStderr(io.MultiWriter(shared, &stderr))
+
+	start := time.Now()
+	exitCode, err := cmdObj.RunAndReturnExitCode()
+	result := commandResult{
+		ExitCode: exitCode,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Duration: time.Since(start),
+	}
+
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	if err != nil && errorutil.IsExitStatusError(err) {
+		return result, nil
+	}
+	return result, err
+}
+
+// combinedOutput is the captured stdout followed by the captured stderr.
+func (result commandResult) combinedOutput() string {
+	return result.Stdout + result.Stderr
+}
+
+// lockedWriter serializes writes to out.
+type lockedWriter struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.out.Write(p)
+}
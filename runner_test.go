@@ -0,0 +1,195 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingRunner records every command it's asked to run. Commands are answered by
+// Handle, or exit with 0 without output when it's nil. Safe for concurrent shards.
+type recordingRunner struct {
+	Handle func(cmdSlice []string, output io.Writer) (commandResult, error)
+	Calls  [][]string
+	lock   sync.Mutex
+}
+
+func (runner *recordingRunner) Run(cmdSlice []string, output io.Writer) (commandResult, error) {
+	runner.lock.Lock()
+	runner.Calls = append(runner.Calls, cmdSlice)
+	runner.lock.Unlock()
+
+	if runner.Handle == nil {
+		return commandResult{}, nil
+	}
+	return runner.Handle(cmdSlice, output)
+}
+
+// Commands returns every recorded command joined by spaces.
+func (runner *recordingRunner) Commands() []string {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+
+	commands := make([]string, 0, len(runner.Calls))
+	for _, cmdSlice := range runner.Calls {
+		commands = append(commands, strings.Join(cmdSlice, " "))
+	}
+	return commands
+}
+
+func TestRun(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	deployDir, err := ioutil.TempDir("", "deploy")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(deployDir)
+	}()
+
+	config := newFakeGcloudConfig(assert)
+	Setenv(envKeyDeployDir, deployDir)
+	config.Rerun = rerunConfig{Attempts: 1}
+
+	// infrastructure failure, testFlaky fails on the retry and passes on re-run
+	tests := []string{"testAdd", "testFlaky"}
+	envman, exports := FakeEnvman()
+	matrices := 0
+	runner := &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		if cmdSlice[0] == "bitrise" {
+			return envman.Run(cmdSlice, output)
+		}
+		if cmdSlice[1] != "firebase" {
+			return commandResult{}, nil
+		}
+		matrices++
+
+		resultsDir := gcloudFlagValue(cmdSlice, "--results-dir")
+		result, exitCode := JUnitResult(tests, "testFlaky"), exitCodeTestFailure
+		switch {
+		case strings.HasSuffix(resultsDir, "/rerun_1"):
+			result, exitCode = JUnitResult([]string{"testFlaky"}), exitCodeSuccess
+		case !strings.HasSuffix(resultsDir, "_attempt_2"):
+			return commandResult{ExitCode: exitCodeInfrastructure}, nil
+		}
+
+		resultPath := filepath.Join(root, gcloudFlagValue(cmdSlice, "--results-bucket"), resultsDir, "NexusLowRes-25-en-portrait", "test_result_1.xml")
+		PanicOnErr(os.MkdirAll(filepath.Dir(resultPath), 0755))
+		PanicOnErr(ioutil.WriteFile(resultPath, []byte(result), 0644))
+		return commandResult{ExitCode: exitCode, Stderr: GcloudMatrixOutput(matrices)}, nil
+	}}
+	config.Runner = runner
+
+	outcome, err := run(config, localStorage{Root: root}, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal("flaky", outcome.Name)
+	assert.True(outcome.Passed)
+
+	commands := make([]string, 0)
+	for _, command := range runner.Commands() {
+		if strings.HasPrefix(command, "gcloud ") {
+			commands = append(commands, command)
+		}
+	}
+	assert.Equal(5, len(commands))
+	assert.Equal("gcloud config set project fake-project", commands[0])
+	assert.Equal("gcloud auth activate-service-account --key-file "+config.KeyPath+" fake@example.com", commands[1])
+	resultsDir := strings.TrimSuffix(outcome.ResultsDir, "_attempt_2")
+	assert.True(strings.HasSuffix(commands[2], "--results-dir="+resultsDir))
+	assert.True(strings.HasSuffix(commands[3], "--results-dir="+resultsDir+"_attempt_2"))
+	assert.True(strings.HasSuffix(commands[4], "--results-dir="+resultsDir+"/rerun_1 --test-targets=class com.example.T#testFlaky"))
+
+	reportPath := filepath.Join(deployDir, junitReportFileName)
+	data, err := ioutil.ReadFile(reportPath)
+	assert.NoError(err)
+	assert.Contains(string(data), "<flakyFailure>testFlaky failed</flakyFailure>")
+
+	// the results dir of the retry, the matrices of the retry and the rerun
+	assert.Equal(map[string]string{
+		outputGcsResultsDir:   "gs://golang-bucket/" + resultsDir + "_attempt_2",
+		outputResultsBucket:   "golang-bucket",
+		outputResultsDir:      resultsDir + "_attempt_2",
+		outputConsoleURL:      "https://console.firebase.google.com/project/fake-project/testlab/histories/bh.1/matrices/2\nhttps://console.firebase.google.com/project/fake-project/testlab/histories/bh.1/matrices/3",
+		outputMatrixID:        "matrix-2\nmatrix-3",
+		outputOutcome:         "flaky",
+		outputTestsPassed:     "1",
+		outputTestsFailed:     "0",
+		outputTestsFlaky:      "1",
+		outputTestsSkipped:    "0",
+		outputJUnitReportPath: reportPath,
+		outputSummaryPath:     filepath.Join(deployDir, summaryFileName),
+	}, exports)
+}
+
+func TestRunAuthFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	config := newFakeGcloudConfig(assert)
+	runner := &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		if cmdSlice[1] == "auth" {
+			return commandResult{ExitCode: 1}, nil
+		}
+		return commandResult{}, nil
+	}}
+	config.Runner = runner
+
+	_, err := run(config, localStorage{}, ioutil.Discard)
+	assert.EqualError(err, "gcloud auth activate-service-account --key-file "+config.KeyPath+" fake@example.com failed with exit code 1")
+	assert.Equal(2, len(runner.Calls))
+}
+
+func TestGsutilStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	runner := &recordingRunner{Handle: func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		return commandResult{Stdout: "gs://bucket/dir/NexusLowRes/\ngs://bucket/dir/NexusLowRes/test_result_1.xml\n"}, nil
+	}}
+	objects, err := gsutilStorage{Runner: runner}.List("bucket", "dir/")
+	assert.NoError(err)
+	assert.Equal([]string{"dir/NexusLowRes/test_result_1.xml"}, objects)
+	assert.Equal([]string{"gsutil ls gs://bucket/dir/**"}, runner.Commands())
+
+	runner.Handle = func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		return commandResult{ExitCode: 1, Stderr: "CommandException: One or more URLs matched no objects."}, nil
+	}
+	objects, err = gsutilStorage{Runner: runner}.List("bucket", "dir/")
+	assert.NoError(err)
+	assert.Equal([]string{}, objects)
+
+	runner.Handle = func(cmdSlice []string, output io.Writer) (commandResult, error) {
+		return commandResult{ExitCode: 1, Stderr: "AccessDeniedException: 403"}, nil
+	}
+	_, err = gsutilStorage{Runner: runner}.List("bucket", "dir/")
+	assert.EqualError(err, "Failed to list gs://bucket/dir/, exit code: 1 | output: AccessDeniedException: 403")
+
+	err = gsutilStorage{Runner: runner}.Download("bucket", "dir/a.xml", "/tmp/a.xml")
+	assert.EqualError(err, "Failed to download gs://bucket/dir/a.xml, exit code: 1 | output: AccessDeniedException: 403")
+	assert.Equal("gsutil cp gs://bucket/dir/a.xml /tmp/a.xml", runner.Commands()[3])
+
+	err = gsutilStorage{Runner: runner}.Upload("bucket", "dir/app.apk", "/tmp/app.apk")
+	assert.EqualError(err, "Failed to upload /tmp/app.apk to gs://bucket/dir/app.apk, exit code: 1 | output: AccessDeniedException: 403")
+	assert.Equal("gsutil cp /tmp/app.apk gs://bucket/dir/app.apk", runner.Commands()[4])
+
+	_, err = gsutilStorage{Runner: runner}.Exists("bucket", "dir/app.apk")
+	assert.EqualError(err, "Failed to stat gs://bucket/dir/app.apk, exit code: 1 | output: AccessDeniedException: 403")
+	assert.Equal("gsutil -q stat gs://bucket/dir/app.apk", runner.Commands()[5])
+
+	for exitCode, exists := range map[int]bool{0: true, 1: false} {
+		runner.Handle = func(cmdSlice []string, output io.Writer) (commandResult, error) {
+			return commandResult{ExitCode: exitCode}, nil
+		}
+		found, err := gsutilStorage{Runner: runner}.Exists("bucket", "dir/app.apk")
+		assert.NoError(err)
+		assert.Equal(exists, found)
+	}
+}
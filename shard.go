@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kballard/go-shellquote"
+	"io"
+	"path"
+	"strconv"
+	"sync"
+)
+
+// Upper bound for NUM_SHARDS, every shard is a separate test matrix.
+const maxShards = 50
+
+// shardConfig splits an instrumentation run into Count matrices run by at most
+// MaxConcurrent gcloud processes at a time.
+type shardConfig struct {
+	Count         int
+	MaxConcurrent int
+	Classes       []string
+}
+
+func newShardConfig(platform string, testApk string, options testOptions, userOptions string) (shardConfig, error) {
+	config := shardConfig{Count: 1}
+
+	countValue := getOptionalEnv(envKeyNumShards)
+	if !isEmpty(countValue) {
+		count, err := strconv.Atoi(countValue)
+		if err != nil || count < 1 || count > maxShards {
+			return config, fmt.Errorf("%s must be a number between 1 and %d", envKeyNumShards, maxShards)
+		}
+		config.Count = count
+	}
+
+	config.MaxConcurrent = config.Count
+	concurrentValue := getOptionalEnv(envKeyMaxConcurrentShards)
+	if !isEmpty(concurrentValue) {
+		concurrent, err := strconv.Atoi(concurrentValue)
+		if err != nil || concurrent < 1 {
+			return config, errors.New(envKeyMaxConcurrentShards + " must be a positive number")
+		}
+		if concurrent < config.MaxConcurrent {
+			config.MaxConcurrent = concurrent
+		}
+	}
+
+	if config.Count == 1 {
+		return config, nil
+	}
+
+	if platform != platformAndroid || isEmpty(testApk) {
+		return config, errors.New(envKeyNumShards + " requires an Android instrumentation test, set " + envKeyTestApk)
+	}
+	if len(options.TestTargets) > 0 {
+		return config, errors.New(envKeyNumShards + " and " + envKeyTestTargets + " can't be used together")
+	}
+	userOptionsSlice, err := shellquote.Split(userOptions)
+	if err != nil {
+		return config, err
+	}
+	if hasGcloudFlag(gcloudOptionsToSet(userOptionsSlice), "--test-targets") {
+		return config, errors.New(envKeyNumShards + " can't be used together with --test-targets in " + envKeyGcloudOptions)
+	}
+
+	config.Classes = splitLines(getOptionalEnv(envKeyShardClasses))
+	if len(config.Classes) == 0 {
+		config.Classes, err = findTestClasses(testApk)
+		if err != nil {
+			return config, err
+		}
+		if len(config.Classes) == 0 {
+			return config, errors.New("no @Test classes found in '" + testApk + "', set " + envKeyShardClasses)
+		}
+	}
+
+	return config, nil
+}
+
+// splitShards deals classes round robin into at most count shards.
+func splitShards(classes []string, count int) [][]string {
+	if count > len(classes) {
+		count = len(classes)
+	}
+
+	shards := make([][]string, count)
+	for i, class := range classes {
+		shards[i%count] = append(shards[i%count], class)
+	}
+	return shards
+}
+
+// shardCommands derives a command per shard from gcsCommand with the shard's
+// --test-targets and its own results dir below the original one.
+func shardCommands(gcsCommand []string, shards [][]string) [][]string {
+	resultsDir := gcloudFlagValue(gcsCommand, "--results-dir")
+
+	commands := make([][]string, 0, len(shards))
+	for i, classes := range shards {
+		targets := make([]string, 0, len(classes))
+		for _, class := range classes {
+			targets = append(targets, "class "+class)
+		}
+
+		args := withGcloudFlag(gcsCommand, "--results-dir", path.Join(resultsDir, fmt.Sprintf("shard_%d", i)))
+		commands = append(commands, append(args, "--test-targets", gcloudList(targets)))
+	}
+
+	return commands
+}
+
+// runShards runs the commands on a pool of maxConcurrent workers. Each shard's
+// output goes to output line by line, prefixed with the shard number.
+func runShards(config *firebaseConfig, commands [][]string, maxConcurrent int, output io.Writer) ([]testOutcome, error) {
+	outcomes := make([]testOutcome, len(commands))
+	errs := make([]error, len(commands))
+
+	outputLock := &sync.Mutex{}
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < maxConcurrent && w < len(commands); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				shardOutput := newPrefixWriter(outputLock, output, fmt.Sprintf("[shard %d/%d] ", i+1, len(commands)))
+				_, _ = fmt.Fprintln(shardOutput, config.Redactor.Command(commands[i]))
+				outcomes[i], errs[i] = runTestMatrix(config, commands[i], shardOutput)
+				_, _ = fmt.Fprintf(shardOutput, "outcome: %s\n", outcomes[i])
+				shardOutput.Flush()
+			}
+		}()
+	}
+
+	for i := range commands {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return outcomes, fmt.Errorf("shard %d: %s", i+1, err)
+		}
+	}
+	return outcomes, nil
+}
+
+// prefixWriter writes complete lines to out, each starting with prefix.
+// Writers sharing lock never interleave within a line.
+type prefixWriter struct {
+	lock   *sync.Mutex
+	out    io.Writer
+	prefix string
+	buffer []byte
+}
+
+func newPrefixWriter(lock *sync.Mutex, out io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{lock: lock, out: out, prefix: prefix}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+
+	for {
+		end := -1
+		for i, b := range w.buffer {
+			if b == '\n' {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return len(p), nil
+		}
+
+		err := w.writeLine(w.buffer[:end+1])
+		w.buffer = w.buffer[end+1:]
+		if err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Flush writes a trailing incomplete line.
+func (w *prefixWriter) Flush() {
+	if len(w.buffer) > 0 {
+		_ = w.writeLine(append(w.buffer, '\n'))
+		w.buffer = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	_, err := w.out.Write(append([]byte(w.prefix), line...))
+	return err
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSplitShards(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([][]string{{"a", "d"}, {"b", "e"}, {"c"}}, splitShards([]string{"a", "b", "c", "d", "e"}, 3))
+	assert.Equal([][]string{{"a"}, {"b"}}, splitShards([]string{"a", "b"}, 4))
+}
+
+func TestShardCommands(t *testing.T) {
+	assert := assert.New(t)
+
+	gcsCommand := []string{"gcloud", "firebase", "test", "android", "run", "--results-dir=parent", "--timeout", "25m"}
+	commands := shardCommands(gcsCommand, [][]string{{"a.A", "a.C"}, {"a.B"}})
+
+	assert.Equal([][]string{
+		{"gcloud", "firebase", "test", "android", "run", "--timeout", "25m", "--results-dir=parent/shard_0", "--test-targets", "class a.A,class a.C"},
+		{"gcloud", "firebase", "test", "android", "run", "--timeout", "25m", "--results-dir=parent/shard_1", "--test-targets", "class a.B"},
+	}, commands)
+}
+
+func TestNewShardConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "shard")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	apkPath := filepath.Join(tmpDir, "test.apk")
+	WriteTestApk(apkPath)
+
+	setupOptionsEnv()
+	Setenv(envKeyTestApk, apkPath)
+
+	config, err := newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal(shardConfig{Count: 1, MaxConcurrent: 1}, config.Shards)
+
+	//- classes from the test apk
+	Setenv(envKeyNumShards, "4")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal(shardConfig{
+		Count:         4,
+		MaxConcurrent: 4,
+		Classes:       []string{"com.example.CalculatorTest", "com.example.login.LoginTest$Nested"},
+	}, config.Shards)
+
+	//- classes from the input
+	Setenv(envKeyShardClasses, "com.example.A\ncom.example.B\ncom.example.C")
+	Setenv(envKeyMaxConcurrentShards, "2")
+	config, err = newFirebaseConfig()
+	assert.NoError(err)
+	assert.Equal(shardConfig{
+		Count:         4,
+		MaxConcurrent: 2,
+		Classes:       []string{"com.example.A", "com.example.B", "com.example.C"},
+	}, config.Shards)
+
+	cases := []struct {
+		key   string
+		value string
+		err   string
+	}{
+		{envKeyNumShards, "0", envKeyNumShards + " must be a number between 1 and 50"},
+		{envKeyNumShards, "many", envKeyNumShards + " must be a number between 1 and 50"},
+		{envKeyMaxConcurrentShards, "0", envKeyMaxConcurrentShards + " must be a positive number"},
+		{envKeyTestTargets, "class com.example.A", envKeyNumShards + " and " + envKeyTestTargets + " can't be used together"},
+		{envKeyGcloudOptions, "--test-targets=class com.example.A", envKeyNumShards + " can't be used together with --test-targets in " + envKeyGcloudOptions},
+		{envKeyTestApk, "", envKeyNumShards + " requires an Android instrumentation test, set " + envKeyTestApk},
+	}
+
+	for _, c := range cases {
+		setupOptionsEnv()
+		Setenv(envKeyNumShards, "2")
+		Setenv(envKeyShardClasses, "com.example.A")
+		Setenv(c.key, c.value)
+
+		_, err = newFirebaseConfig()
+		assert.EqualError(err, c.err)
+	}
+
+	//- no test classes in the apk
+	emptyApk := filepath.Join(tmpDir, "empty.apk")
+	WriteZipFiles(emptyApk, map[string][]byte{"classes.dex": BuildDex([]dexClass{{Descriptor: "Lcom/example/Helper;"}})})
+
+	setupOptionsEnv()
+	Setenv(envKeyNumShards, "2")
+	Setenv(envKeyTestApk, emptyApk)
+	_, err = newFirebaseConfig()
+	assert.EqualError(err, "no @Test classes found in '"+emptyApk+"', set "+envKeyShardClasses)
+}
+
+func TestRunShards(t *testing.T) {
+	assert := assert.New(t)
+
+	config := newFakeGcloudConfig(assert)
+	config.Shards = shardConfig{Count: 3, MaxConcurrent: 2, Classes: []string{"a.A", "a.B", "a.C", "a.D"}}
+	logPath := FakeGcloud()
+
+	gcsCommand, err := buildGcloudCommand(config, "parent")
+	assert.NoError(err)
+
+	output := &bytes.Buffer{}
+	outcome, err := runTestMatrices(config, gcsCommand, output)
+	assert.NoError(err)
+	assert.True(outcome.Passed)
+
+	calls := GcloudCalls(logPath)
+	sort.Strings(calls)
+	assert.Equal(3, len(calls))
+	assert.True(strings.HasSuffix(calls[0], "--results-dir=parent/shard_0 --test-targets class a.A,class a.D"))
+	assert.True(strings.HasSuffix(calls[1], "--results-dir=parent/shard_1 --test-targets class a.B"))
+	assert.True(strings.HasSuffix(calls[2], "--results-dir=parent/shard_2 --test-targets class a.C"))
+
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		assert.Regexp(`^\[shard [1-3]/3\] `, line)
+	}
+	assert.Contains(output.String(), "[shard 2/3] outcome: passed (gcloud exit code 0)")
+}
+
+func TestRunShardsWorstOutcome(t *testing.T) {
+	assert := assert.New(t)
+
+	config := newFakeGcloudConfig(assert)
+	config.Shards = shardConfig{Count: 3, MaxConcurrent: 1, Classes: []string{"a.A", "a.B", "a.C"}}
+	// shard 1 passes, shard 2 has failing tests, shard 3 is inconclusive
+	FakeGcloud(0, 10, 15)
+
+	gcsCommand, err := buildGcloudCommand(config, "parent")
+	assert.NoError(err)
+
+	outcome, err := runTestMatrices(config, gcsCommand, ioutil.Discard)
+	assert.NoError(err)
+	assert.Equal("failed", outcome.Name)
+	assert.Equal(1, outcome.StepExitCode())
+}
+
+func TestRunShardsCollectsFinalAttempts(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	// the first attempt of shard 1 fails with an infrastructure error, its retry passes
+	FakeGcloudResults(root, map[string]string{
+		"shard_0":           JUnitResult([]string{"testAdd"}, "testAdd"),
+		"shard_0_attempt_2": JUnitResult([]string{"testAdd"}),
+		"shard_1":           JUnitResult([]string{"testSubtract"}),
+	}, map[string]int{"shard_0": 20})
+
+	config := newFakeGcloudConfig(assert)
+	config.Shards = shardConfig{Count: 2, MaxConcurrent: 1, Classes: []string{"a.A", "a.B"}}
+
+	gcsCommand, err := buildGcloudCommand(config, "parent")
+	assert.NoError(err)
+
+	outcome, err := runTestMatrices(config, gcsCommand, ioutil.Discard)
+	assert.NoError(err)
+	assert.True(outcome.Passed)
+	assert.Equal("parent", outcome.ResultsDir)
+	assert.Equal([]string{"parent/shard_0_attempt_2", "parent/shard_1"}, outcome.ShardResultsDirs)
+	assert.Equal(3, len(outcome.Attempts))
+
+	outcome, report, _, err := collectResults(config, localStorage{Root: root}, "golang-bucket", gcsCommand, outcome, ioutil.Discard)
+	assert.NoError(err)
+	assert.True(outcome.Passed)
+	assert.Equal(2, report.Tests)
+	assert.Equal(0, report.Failures)
+	assert.Equal("shard_0_attempt_2/NexusLowRes-25-en-portrait", report.Suites[0].Name)
+	assert.Equal("shard_1/NexusLowRes-25-en-portrait", report.Suites[1].Name)
+}
+
+func TestPrefixWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	output := &bytes.Buffer{}
+	lock := &sync.Mutex{}
+	first := newPrefixWriter(lock, output, "[1] ")
+	second := newPrefixWriter(lock, output, "[2] ")
+
+	_, err := first.Write([]byte("partial "))
+	assert.NoError(err)
+	_, err = second.Write([]byte("two\nlines\n"))
+	assert.NoError(err)
+	_, err = first.Write([]byte("line\nno newline"))
+	assert.NoError(err)
+	first.Flush()
+
+	assert.Equal("[2] two\n[2] lines\n[1] partial line\n[1] no newline\n", output.String())
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resultsStorage gives access to the objects Firebase Test Lab writes into the results bucket.
+// gsutilStorage and storageAPI talk to Google Cloud Storage, localStorage is a directory based
+// stand-in for tests.
+type resultsStorage interface {
+	// List returns the names of every object in bucket starting with prefix.
+	List(bucket string, prefix string) ([]string, error)
+	// Download copies bucket/object to the local file dest.
+	Download(bucket string, object string, dest string) error
+	// Exists reports whether bucket/object exists.
+	Exists(bucket string, object string) (bool, error)
+	// Upload copies the local file src to bucket/object.
+	Upload(bucket string, object string, src string) error
+}
+
+// gsutilStorage shells out to gsutil which ships with the gcloud SDK.
+type gsutilStorage struct {
+	Runner commandRunner
+}
+
+func (s gsutilStorage) List(bucket string, prefix string) ([]string, error) {
+	bucketURL := "gs://" + bucket + "/"
+	result, err := s.Runner.Run([]string{"gsutil", "ls", bucketURL + strings.TrimSuffix(prefix, "/") + "/**"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list "+bucketURL+prefix+", error: %#v", err.Error())
+	}
+	if result.ExitCode != 0 {
+		// gsutil fails when the wildcard doesn't match anything.
+		if strings.Contains(result.combinedOutput(), "matched no objects") {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("Failed to list "+bucketURL+prefix+", exit code: %d | output: %s", result.ExitCode, result.combinedOutput())
+	}
+
+	objects := make([]string, 0)
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, bucketURL) && !strings.HasSuffix(line, "/") {
+			objects = append(objects, strings.TrimPrefix(line, bucketURL))
+		}
+	}
+
+	return objects, nil
+}
+
+func (s gsutilStorage) Download(bucket string, object string, dest string) error {
+	objectURL := "gs://" + bucket + "/" + object
+	result, err := s.Runner.Run([]string{"gsutil", "cp", objectURL, dest}, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to download "+objectURL+", error: %#v", err.Error())
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("Failed to download "+objectURL+", exit code: %d | output: %s", result.ExitCode, result.combinedOutput())
+	}
+
+	return nil
+}
+
+func (s gsutilStorage) Exists(bucket string, object string) (bool, error) {
+	objectURL := "gs://" + bucket + "/" + object
+	result, err := s.Runner.Run([]string{"gsutil", "-q", "stat", objectURL}, nil)
+	if err != nil {
+		return false, fmt.Errorf("Failed to stat "+objectURL+", error: %#v", err.Error())
+	}
+	switch {
+	case result.ExitCode == 0:
+		return true, nil
+	// gsutil -q stat exits with 1 without output when the object doesn't exist.
+	case result.ExitCode == 1 && isEmpty(strings.TrimSpace(result.combinedOutput())):
+		return false, nil
+	default:
+		return false, fmt.Errorf("Failed to stat "+objectURL+", exit code: %d | output: %s", result.ExitCode, result.combinedOutput())
+	}
+}
+
+func (s gsutilStorage) Upload(bucket string, object string, src string) error {
+	objectURL := "gs://" + bucket + "/" + object
+	result, err := s.Runner.Run([]string{"gsutil", "cp", src, objectURL}, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to upload "+src+" to "+objectURL+", error: %#v", err.Error())
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("Failed to upload "+src+" to "+objectURL+", exit code: %d | output: %s", result.ExitCode, result.combinedOutput())
+	}
+
+	return nil
+}
+
+// storageAPI calls the Cloud Storage JSON API, the api backend needs no gsutil.
+type storageAPI struct {
+	API     googleAPI
+	BaseURL string
+}
+
+func (s storageAPI) List(bucket string, prefix string) ([]string, error) {
+	objects := make([]string, 0)
+	pageToken := ""
+
+	for {
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		query.Set("fields", "items/name,nextPageToken")
+		if !isEmpty(pageToken) {
+			query.Set("pageToken", pageToken)
+		}
+
+		page := struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}{}
+		listURL := s.BaseURL + "/storage/v1/b/" + url.PathEscape(bucket) + "/o?" + query.Encode()
+		err := s.API.callJSON("GET", listURL, nil, &page, "list", "gs://"+bucket+"/"+prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range page.Items {
+			if !strings.HasSuffix(item.Name, "/") {
+				objects = append(objects, item.Name)
+			}
+		}
+		if isEmpty(page.NextPageToken) {
+			return objects, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (s storageAPI) Download(bucket string, object string, dest string) error {
+	objectURL := s.BaseURL + "/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(object) + "?alt=media"
+	response, err := s.API.send("GET", objectURL, nil, "", "download", "gs://"+bucket+"/"+object)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, response.Body)
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (s storageAPI) Exists(bucket string, object string) (bool, error) {
+	objectURL := s.BaseURL + "/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(object) + "?fields=name"
+	response, err := s.API.do("GET", objectURL, nil, "")
+	if err != nil {
+		return false, err
+	}
+	_ = response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Failed to stat gs://%s/%s, status: %s", bucket, object, response.Status)
+	}
+}
+
+func (s storageAPI) Upload(bucket string, object string, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	uploadURL := s.BaseURL + "/upload/storage/v1/b/" + url.PathEscape(bucket) + "/o?uploadType=media&name=" + url.QueryEscape(object)
+	_, err = s.API.call("POST", uploadURL, in, "application/octet-stream", "upload", src+" to gs://"+bucket+"/"+object)
+	return err
+}
+
+// localStorage maps gs://bucket/object to Root/bucket/object on the local filesystem.
+type localStorage struct {
+	Root string
+}
+
+func (s localStorage) List(bucket string, prefix string) ([]string, error) {
+	bucketDir := filepath.Join(s.Root, bucket)
+	objects := make([]string, 0)
+
+	err := filepath.Walk(bucketDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		object, err := filepath.Rel(bucketDir, filePath)
+		if err != nil {
+			return err
+		}
+		object = filepath.ToSlash(object)
+		if strings.HasPrefix(object, prefix) {
+			objects = append(objects, object)
+		}
+		return nil
+	})
+
+	return objects, err
+}
+
+func (s localStorage) Download(bucket string, object string, dest string) error {
+	return copyFile(filepath.Join(s.Root, bucket, filepath.FromSlash(object)), dest)
+}
+
+func (s localStorage) Exists(bucket string, object string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.Root, bucket, filepath.FromSlash(object)))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s localStorage) Upload(bucket string, object string, src string) error {
+	dest := filepath.Join(s.Root, bucket, filepath.FromSlash(object))
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	return copyFile(src, dest)
+}
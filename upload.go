@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/kballard/go-shellquote"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// uploadsPrefix is where the apps are stored in the results bucket by their SHA-256.
+const uploadsPrefix = "uploads/sha256/"
+
+// uploadApps uploads APP_APK, TEST_APK and ROBO_SCRIPT to the results bucket once and points config
+// at their gs:// paths, so retries, shards and later builds of the same apps reuse them
+// instead of gcloud uploading them for every test matrix.
+func uploadApps(config *firebaseConfig, storage resultsStorage) error {
+	if config.Platform != platformAndroid {
+		return nil
+	}
+
+	userOptionsSlice, err := shellquote.Split(config.Options)
+	if err != nil {
+		return err
+	}
+	userOptionsSet := gcloudOptionsToSet(userOptionsSlice)
+
+	apps := []struct {
+		flag string
+		path *string
+	}{
+		{"--app", &config.AppApk},
+		{"--test", &config.TestApk},
+		{"--robo-script", &config.Robo.Script},
+	}
+	for _, app := range apps {
+		if isEmpty(*app.path) || strings.HasPrefix(*app.path, "gs://") || hasGcloudFlag(userOptionsSet, app.flag) {
+			continue
+		}
+
+		gcsPath, err := uploadApp(storage, config.ResultsBucket, *app.path)
+		if err != nil {
+			return err
+		}
+		*app.path = gcsPath
+	}
+
+	return nil
+}
+
+// uploadApp uploads the app at path to its content-addressed object unless it's already
+// there and returns its gs:// path.
+func uploadApp(storage resultsStorage, bucket string, path string) (string, error) {
+	hash, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	object := uploadsPrefix + hash + filepath.Ext(path)
+	gcsPath := "gs://" + bucket + "/" + object
+
+	exists, err := storage.Exists(bucket, object)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		log.Printf("Reusing %s for %s", gcsPath, path)
+		return gcsPath, nil
+	}
+
+	log.Printf("Uploading %s to %s", path, gcsPath)
+	return gcsPath, storage.Upload(bucket, object, path)
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
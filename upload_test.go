@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSHA256(t *testing.T) {
+	assert := assert.New(t)
+
+	hash, err := fileSHA256(os.DevNull)
+	assert.NoError(err)
+	assert.Equal("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", hash)
+
+	_, err = fileSHA256("/tmp/missing.apk")
+	assert.Error(err)
+}
+
+func TestUploadApps(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "gcs")
+	assert.NoError(err)
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+
+	appPath, testPath := filepath.Join(root, "app.apk"), filepath.Join(root, "test.apk")
+	PanicOnErr(ioutil.WriteFile(appPath, []byte("app"), 0644))
+	PanicOnErr(ioutil.WriteFile(testPath, []byte("test"), 0644))
+	appHash, err := fileSHA256(appPath)
+	assert.NoError(err)
+	testHash, err := fileSHA256(testPath)
+	assert.NoError(err)
+
+	config := newFakeGcloudConfig(assert)
+	config.AppApk, config.TestApk = appPath, testPath
+
+	storage := localStorage{Root: root}
+	assert.NoError(uploadApps(config, storage))
+	assert.Equal("gs://golang-bucket/"+uploadsPrefix+appHash+".apk", config.AppApk)
+	assert.Equal("gs://golang-bucket/"+uploadsPrefix+testHash+".apk", config.TestApk)
+
+	data, err := ioutil.ReadFile(filepath.Join(root, "golang-bucket", uploadsPrefix+appHash+".apk"))
+	assert.NoError(err)
+	assert.Equal("app", string(data))
+
+	//- gs:// paths are kept
+	assert.NoError(uploadApps(config, storage))
+	assert.Equal("gs://golang-bucket/"+uploadsPrefix+appHash+".apk", config.AppApk)
+
+	//- the same content isn't uploaded again
+	uploaded := filepath.Join(root, "golang-bucket", uploadsPrefix+testHash+".apk")
+	PanicOnErr(ioutil.WriteFile(uploaded, []byte("uploaded"), 0644))
+	config.AppApk = testPath
+	assert.NoError(uploadApps(config, storage))
+	assert.Equal("gs://golang-bucket/"+uploadsPrefix+testHash+".apk", config.AppApk)
+	data, err = ioutil.ReadFile(uploaded)
+	assert.NoError(err)
+	assert.Equal("uploaded", string(data))
+
+	//- user supplied --app and --test
+	config.AppApk, config.TestApk = appPath, testPath
+	config.Options = "--app gs://other/app.apk --test gs://other/test.apk"
+	assert.NoError(uploadApps(config, storage))
+	assert.Equal(appPath, config.AppApk)
+	assert.Equal(testPath, config.TestApk)
+
+	//- also in the --flag=value form, without a second flag in the command
+	config.Options = "--app=gs://other/app.apk --test=gs://other/test.apk --robo-script=gs://other/script.json"
+	config.Robo.Script = testPath
+	assert.NoError(uploadApps(config, storage))
+	assert.Equal(appPath, config.AppApk)
+	assert.Equal(testPath, config.TestApk)
+	assert.Equal(testPath, config.Robo.Script)
+	config.Robo.Script = ""
+	config.Options = "--app=gs://other/app.apk --test=gs://other/test.apk"
+	gcsCommand, err := buildGcloudCommand(config, "results_dir")
+	assert.NoError(err)
+	assert.Equal("--app=gs://other/app.apk", gcsCommand[len(gcsCommand)-2])
+	assert.Equal("--test=gs://other/test.apk", gcsCommand[len(gcsCommand)-1])
+	for _, arg := range gcsCommand {
+		assert.NotEqual("--app", arg)
+		assert.NotEqual("--test", arg)
+	}
+
+	config.Options = ""
+	config.AppApk = filepath.Join(root, "missing.apk")
+	assert.Error(uploadApps(config, storage))
+
+	config.Platform = platformIOS
+	assert.NoError(uploadApps(config, storage))
+	assert.Equal(filepath.Join(root, "missing.apk"), config.AppApk)
+}
@@ -4,7 +4,7 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
-	"github.com/bitrise-io/go-utils/command"
+	"io"
 	"math/big"
 	"os"
 	"strings"
@@ -25,6 +25,39 @@ func gcloudOptionsToSet(slice []string) map[string]bool {
 	return set
 }
 
+// gcloudFlagValue returns the value of flag from args, accepting both
+// "--flag value" and "--flag=value". The last occurrence wins like in gcloud.
+func gcloudFlagValue(args []string, flag string) string {
+	value := ""
+	for i := 0; i < len(args); i++ {
+		if args[i] == flag && i+1 < len(args) {
+			value = args[i+1]
+			i++
+		} else if strings.HasPrefix(args[i], flag+"=") {
+			value = strings.TrimPrefix(args[i], flag+"=")
+		}
+	}
+
+	return value
+}
+
+// withGcloudFlag returns a copy of args without any occurrence of flag, followed by flag=value.
+func withGcloudFlag(args []string, flag string, value string) []string {
+	result := make([]string, 0, len(args)+1)
+	for i := 0; i < len(args); i++ {
+		if args[i] == flag && i+1 < len(args) {
+			i++
+			continue
+		}
+		if strings.HasPrefix(args[i], flag+"=") {
+			continue
+		}
+		result = append(result, args[i])
+	}
+
+	return append(result, flag+"="+value)
+}
+
 // Matches api_lib/firebase/test/arg_validate.py _GenerateUniqueGcsObjectName from gcloud SDK
 // Example output: 2017-07-12_11:36:12.467586_XVlB
 func newGcsObjectName() string {
@@ -61,6 +94,20 @@ func getRequiredEnv(env string) (string, error) {
 	return result, nil
 }
 
+// getOptionalBoolEnv parses "true" or "false", returning defaultValue when env is not set.
+func getOptionalBoolEnv(env string, defaultValue bool) (bool, error) {
+	switch os.Getenv(env) {
+	case "":
+		return defaultValue, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, errors.New(env + " must be 'true' or 'false'")
+	}
+}
+
 func isEmpty(str string) bool {
 	return len(str) == 0
 }
@@ -73,16 +120,27 @@ func fileExists(filePath string) error {
 	return nil
 }
 
-func runCommand(cmd string) error {
-	cmdSlice := strings.Fields(cmd)
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
 
-	cmdObj := command.NewWithStandardOuts(cmdSlice[0], cmdSlice[1:]...)
-	return cmdObj.Run()
-}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
 
-func runCommandSlice(cmdSlice []string) (int, error) {
-	cmdObj := command.NewWithStandardOuts(cmdSlice[0], cmdSlice[1:]...)
-	return cmdObj.RunAndReturnExitCode()
+	_, err = io.Copy(out, in)
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	return out.Close()
 }
 
 // Env string names
@@ -90,15 +148,93 @@ func runCommandSlice(cmdSlice []string) (int, error) {
 const envKeyGcloudUser = "GCLOUD_USER"       // optional. read from keyfile
 const envKeyGcloudProject = "GCLOUD_PROJECT" // optional. read from keyfile
 const envKeyGcloudBucket = "GCLOUD_BUCKET"   // required
-const envKeyGcloudOptions = "GCLOUD_OPTIONS" // required
+const envKeyGcloudOptions = "GCLOUD_OPTIONS" // optional
 const envKeyAppApk = "APP_APK"               // required
 const envKeyTestApk = "TEST_APK"             // optional
-const envKeyGcloud = "GCLOUD_KEY"            // required
+const envKeyGcloud = "GCLOUD_KEY"            // required in key mode
+const envKeyAuthMode = "AUTH_MODE"           // optional. key (default), adc or gcloud
 const envKeyHome = "HOME"
+const envKeyDeployDir = "BITRISE_DEPLOY_DIR" // optional. JUnit report is written here
+
+const envKeyFailOnInconclusive = "FAIL_ON_INCONCLUSIVE" // optional. defaults to true
+
+const envKeyPlatform = "PLATFORM"            // optional. android (default) or ios
+const envKeyXCTestZip = "XCTEST_ZIP"         // required for iOS XCTest
+const envKeyXCTestRunFile = "XCTESTRUN_FILE" // optional. overrides the .xctestrun in XCTEST_ZIP
+const envKeyAppIpa = "APP_IPA"               // required for iOS game loop
+
+const envKeyTestType = "TEST_TYPE"                    // optional. read from TEST_APK when empty
+const envKeyGameLoopScenarios = "GAME_LOOP_SCENARIOS" // optional. all scenarios when empty
+const envKeyGameLoopLabels = "GAME_LOOP_LABELS"       // optional. scenario labels of the manifest
+const envKeyObbFiles = "OBB_FILES"                    // optional. one .obb per line
+const envKeyCoverage = "COVERAGE"                     // optional. defaults to false
+
+const envKeyDevices = "DEVICES"                              // optional. one --device per line
+const envKeyTimeout = "TIMEOUT"                              // optional
+const envKeyDirectoriesToPull = "DIRECTORIES_TO_PULL"        // optional. one dir per line
+const envKeyEnvironmentVariables = "ENVIRONMENT_VARIABLES"   // optional. KEY=VALUE per line
+const envKeyTestTargets = "TEST_TARGETS"                     // optional. one target per line
+const envKeyUseOrchestrator = "USE_ORCHESTRATOR"             // optional. defaults to false
+const envKeyNumFlakyTestAttempts = "NUM_FLAKY_TEST_ATTEMPTS" // optional. 0-10
+
+const envKeyMatrixFile = "MATRIX_FILE"         // optional. YAML or JSON device matrix
+const envKeyMatrixGroup = "MATRIX_GROUP"       // optional. device group of MATRIX_FILE
+const envKeyDeviceCriteria = "DEVICE_CRITERIA" // optional. one criterion per line
+
+const envKeyRoboScript = "ROBO_SCRIPT"                    // optional. Robo script JSON
+const envKeyRoboDirectives = "ROBO_DIRECTIVES"            // optional. type:resource_name=value per line
+const envKeyRoboLogin = "ROBO_LOGIN"                      // optional. resource_name=ENV_NAME per line
+const envKeyRoboInitialActivity = "ROBO_INITIAL_ACTIVITY" // optional
+const envKeyRoboMaxDepth = "ROBO_MAX_DEPTH"               // optional. at least 2
+const envKeyRoboMaxSteps = "ROBO_MAX_STEPS"               // optional
+
+const envKeyNumShards = "NUM_SHARDS"                      // optional. defaults to 1
+const envKeyShardClasses = "SHARD_CLASSES"                // optional. read from TEST_APK
+const envKeyMaxConcurrentShards = "MAX_CONCURRENT_SHARDS" // optional. defaults to NUM_SHARDS
+
+const envKeyRerunFailedTests = "RERUN_FAILED_TESTS" // optional. defaults to 0
+const envKeyFailOnFlaky = "FAIL_ON_FLAKY"           // optional. defaults to false
+
+const envKeyRetryMaxAttempts = "RETRY_MAX_ATTEMPTS" // optional. defaults to 3
+const envKeyRetryBackoff = "RETRY_BACKOFF"          // optional. defaults to 30s, doubled per attempt
+const envKeyRetryMaxBackoff = "RETRY_MAX_BACKOFF"   // optional. defaults to 5m
+const envKeyRetryExitCodes = "RETRY_EXIT_CODES"     // optional. defaults to 20
+const envKeyRetryDeadline = "RETRY_DEADLINE"        // optional. no deadline by default
+
+const envKeyMode = "MODE"                // optional. run (default), submit or collect
+const envKeyMatrixID = "MATRIX_ID"       // required for collect
+const envKeyWaitTimeout = "WAIT_TIMEOUT" // optional. defaults to 2h
+
+const envKeyStepTimeout = "STEP_TIMEOUT" // optional. no timeout by default
+
+const envKeyBackend = "BACKEND" // optional. gcloud (default) or api
+
+const envKeyCacheResults = "CACHE_RESULTS" // optional. defaults to false
+
+const envKeySecretEnvs = "SECRET_ENVS"         // optional. one env var name per line
+const envKeySensitiveFlags = "SENSITIVE_FLAGS" // optional. defaults to --environment-variables and --robo-directives
+
+// exitHooks run before the step exits, last registered first.
+var exitHooks []func()
+
+// onExit registers hook to run on exit, also when the step fails with a fatal error.
+func onExit(hook func()) {
+	exitHooks = append(exitHooks, hook)
+}
+
+func exit(code int) {
+	for i := len(exitHooks) - 1; i >= 0; i-- {
+		exitHooks[i]()
+	}
+	os.Exit(code)
+}
+
+// consoleOutput is where the step prints, main masks its secrets.
+var consoleOutput io.Writer = os.Stdout
 
 func fatalError(err error) {
 	if err != nil {
-		fmt.Println("Error: ", err.Error())
-		os.Exit(1)
+		_, _ = fmt.Fprintln(consoleOutput, "Error: ", err.Error())
+		exit(1)
 	}
 }